@@ -0,0 +1,152 @@
+package main
+
+import (
+	"coderelay/services"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+// runCLI 处理命令行子命令，返回 handled=false 时继续启动 GUI
+// 用法：
+//
+//	code-relay profile list
+//	code-relay profile use <name>
+//	code-relay profile save <name> [description]
+//	code-relay logs export [-format csv|json|ndjson] [-from 2025-01-01] [-to 2025-02-01] [-o file] ...
+func runCLI(args []string) (handled bool, exitCode int) {
+	if len(args) == 0 {
+		return false, 0
+	}
+	switch args[0] {
+	case "profile":
+		return true, runProfileCLI(args[1:])
+	case "logs":
+		return true, runLogsCLI(args[1:])
+	}
+	return false, 0
+}
+
+func runProfileCLI(args []string) int {
+	providerService := services.NewProviderService()
+	profileService := services.NewProfileService(providerService, services.NewCommonConfigService())
+
+	if len(args) == 0 {
+		args = []string{"list"}
+	}
+	switch args[0] {
+	case "list", "ls":
+		profiles, err := profileService.ListProfiles()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		active := profileService.GetActiveProfile()
+		for _, p := range profiles {
+			marker := " "
+			if p.Name == active {
+				marker = "*"
+			}
+			fmt.Printf("%s %s\t%s\n", marker, p.Name, p.Description)
+		}
+		return 0
+	case "use", "switch":
+		if len(args) < 2 {
+			fmt.Fprintln(os.Stderr, "usage: code-relay profile use <name>")
+			return 2
+		}
+		// 运行中的实例会检测到 profiles.json 的变化并立即生效
+		if err := profileService.SwitchProfile(args[1]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Printf("switched to profile %s\n", args[1])
+		return 0
+	case "save":
+		if len(args) < 2 {
+			fmt.Fprintln(os.Stderr, "usage: code-relay profile save <name> [description]")
+			return 2
+		}
+		description := ""
+		if len(args) > 2 {
+			description = args[2]
+		}
+		if _, err := profileService.SaveProfile(args[1], description); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Printf("saved profile %s\n", args[1])
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "unknown profile command: %s\n", args[0])
+		fmt.Fprintln(os.Stderr, "usage: code-relay profile [list|use <name>|save <name> [description]]")
+		return 2
+	}
+}
+
+func runLogsCLI(args []string) int {
+	if len(args) == 0 || args[0] != "export" {
+		fmt.Fprintln(os.Stderr, "usage: code-relay logs export [flags]")
+		return 2
+	}
+
+	fs := flag.NewFlagSet("logs export", flag.ContinueOnError)
+	output := fs.String("o", "-", "output file, - for stdout")
+	format := fs.String("format", "", "csv, json or ndjson (default: from file extension, csv for stdout)")
+	from := fs.String("from", "", "start time, inclusive (2006-01-02, 2006-01-02 15:04:05 or RFC 3339)")
+	to := fs.String("to", "", "end time, exclusive")
+	query := services.LogExportQuery{}
+	fs.StringVar(&query.Platform, "platform", "", "claude, codex or gemini")
+	fs.StringVar(&query.Provider, "provider", "", "provider name")
+	fs.StringVar(&query.Model, "model", "", "model name, wildcard or re:pattern")
+	fs.StringVar(&query.Client, "client", "", "client fingerprint")
+	fs.StringVar(&query.StatusClass, "status", "", "2xx, 4xx, 5xx, error or failed")
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	var err error
+	if query.Start, err = parseCLITime(*from); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -from: %v\n", err)
+		return 2
+	}
+	if query.End, err = parseCLITime(*to); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -to: %v\n", err)
+		return 2
+	}
+	query.Path = *output
+	query.Format = *format
+
+	logService := services.NewLogService()
+	defer logService.Stop()
+	if err := logService.OpenDatabase(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	result, err := logService.ExportRequestLogs(query)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if result.Path != "-" {
+		fmt.Printf("exported %d rows to %s (%s)\n", result.Rows, result.Path, result.Format)
+	}
+	return 0
+}
+
+// parseCLITime 解析命令行中的时间，未带时区的按本地时间处理
+func parseCLITime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognized time %q", value)
+}
@@ -4,12 +4,19 @@ export type AppSettings = {
   show_heatmap: boolean
   show_home_title: boolean
   auto_start: boolean
+  // 原始请求日志保留天数，0 表示永久保留
+  log_retention_days: number
+  success_window_minutes: number
+  success_window_requests: number
 }
 
 const DEFAULT_SETTINGS: AppSettings = {
   show_heatmap: true,
   show_home_title: true,
   auto_start: false,
+  log_retention_days: 90,
+  success_window_minutes: 60,
+  success_window_requests: 0,
 }
 
 export const fetchAppSettings = async (): Promise<AppSettings> => {
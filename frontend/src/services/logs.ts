@@ -1,4 +1,4 @@
-import { Call } from '@wailsio/runtime'
+import { Call, Events } from '@wailsio/runtime'
 
 export type RequestLog = {
   id: number
@@ -108,3 +108,77 @@ export const fetchHeatmapStats = async (days: number): Promise<HeatmapStat[]> =>
   const range = Number.isFinite(days) && days > 0 ? Math.floor(days) : 30
   return Call.ByName('coderelay/services.LogService.HeatmapStats', range)
 }
+
+// 日志数据库的大小与保留状态，对应后端 DatabaseInfo
+export type DatabaseInfo = {
+  path: string
+  size_bytes: number
+  wal_bytes: number
+  raw_rows: number
+  oldest_raw: string
+  aggregate_days: number
+  retention_days: number
+  last_run_at: string
+  last_pruned_rows: number
+  last_vacuum_at: string
+}
+
+export const fetchDatabaseInfo = async (): Promise<DatabaseInfo> => {
+  return Call.ByName('coderelay/services.LogService.DatabaseInfo')
+}
+
+// 立即按保留天数清理过期日志并压缩数据库
+export const runLogMaintenance = async (): Promise<DatabaseInfo> => {
+  return Call.ByName('coderelay/services.LogService.RunLogMaintenance')
+}
+
+// 进行中的请求，对应后端 ActiveRequest
+export type ActiveRequest = {
+  id: string
+  platform: string
+  model: string
+  provider: string
+  key_index: number
+  client: string
+  is_stream: boolean
+  started_at: string
+  elapsed_sec: number
+  bytes: number
+  input_tokens: number
+  output_tokens: number
+  cancelling: boolean
+}
+
+// 请求生命周期事件，对应后端 RelayEvent（relay:request）
+export type RelayEvent = {
+  request_id: string
+  type: 'received' | 'provider_selected' | 'first_byte' | 'progress' | 'failover' | 'completed'
+  time: string
+  platform: string
+  model: string
+  client?: string
+  provider?: string
+  key_index?: number
+  is_stream: boolean
+  http_code?: number
+  elapsed_sec: number
+  queue_wait_sec?: number
+  bytes?: number
+  input_tokens?: number
+  output_tokens?: number
+  fallback_from?: string
+  error?: string
+}
+
+export const fetchActiveRequests = async (): Promise<ActiveRequest[]> => {
+  return Call.ByName('coderelay/services.RelayService.ListActiveRequests')
+}
+
+export const cancelRequest = async (id: string): Promise<void> => {
+  await Call.ByName('coderelay/services.RelayService.CancelRequest', id)
+}
+
+// 订阅请求生命周期事件，返回取消订阅函数
+export const onRelayEvent = (handler: (event: RelayEvent) => void): (() => void) => {
+  return Events.On('relay:request', (event: { data: RelayEvent }) => handler(event.data))
+}
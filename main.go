@@ -6,6 +6,7 @@ import (
 	_ "embed"
 	"fmt"
 	"log"
+	"os"
 	"runtime"
 	"time"
 
@@ -61,6 +62,10 @@ func (a *AppService) OpenSecondWindow() {
 // and starts a goroutine that emits a time-based event every second. It subsequently runs the application and
 // logs any error that might occur.
 func main() {
+	if handled, code := runCLI(os.Args[1:]); handled {
+		os.Exit(code)
+	}
+
 	appservice := &AppService{}
 
 	suiService, errt := services.NewSuiStore()
@@ -80,10 +85,18 @@ func main() {
 	skillService := services.NewSkillService()
 	promptService := services.NewPromptService()
 	importService := services.NewImportService(providerService, mcpService)
+	profileService := services.NewProfileService(providerService, commonConfigService)
 	dockService := dock.New()
 	versionService := NewVersionService()
 	updateService := services.NewUpdateService(AppVersion)
 
+	if err := providerService.Start(); err != nil {
+		log.Printf("provider service start error: %v", err)
+	}
+	if err := profileService.Start(); err != nil {
+		log.Printf("profile service start error: %v", err)
+	}
+
 	go func() {
 		if err := providerRelay.Start(); err != nil {
 			log.Printf("provider relay start error: %v", err)
@@ -103,6 +116,7 @@ func main() {
 			application.NewService(appservice),
 			application.NewService(suiService),
 			application.NewService(providerService),
+			application.NewService(services.NewRelayService(providerRelay)),
 			application.NewService(commonConfigService),
 			application.NewService(claudeSettings),
 			application.NewService(codexSettings),
@@ -113,6 +127,7 @@ func main() {
 			application.NewService(skillService),
 			application.NewService(promptService),
 			application.NewService(importService),
+			application.NewService(profileService),
 			application.NewService(dockService),
 			application.NewService(versionService),
 			application.NewService(updateService),
@@ -127,6 +142,9 @@ func main() {
 
 	app.OnShutdown(func() {
 		_ = providerRelay.Stop()
+		_ = logService.Stop()
+		_ = profileService.Stop()
+		_ = providerService.Stop()
 	})
 
 	// Create a new window with the necessary options.
@@ -205,14 +223,51 @@ func main() {
 		systray.SetDarkModeIcon(darkIcon)
 	}
 
-	trayMenu := application.NewMenu()
-	trayMenu.Add("显示主窗口").OnClick(func(ctx *application.Context) {
-		showMainWindow(true)
+	buildTrayMenu := func() *application.Menu {
+		trayMenu := application.NewMenu()
+		trayMenu.Add("显示主窗口").OnClick(func(ctx *application.Context) {
+			showMainWindow(true)
+		})
+		addProfileMenu(trayMenu, profileService)
+		trayMenu.Add("退出").OnClick(func(ctx *application.Context) {
+			app.Quit()
+		})
+		return trayMenu
+	}
+	systray.SetMenu(buildTrayMenu())
+	// 方案列表或激活方案变化（GUI / CLI）时重建托盘菜单
+	profileService.SetOnChange(func() {
+		application.InvokeAsync(func() {
+			systray.SetMenu(buildTrayMenu())
+		})
 	})
-	trayMenu.Add("退出").OnClick(func(ctx *application.Context) {
-		app.Quit()
+
+	// 按应用设置中的保留天数定期清理请求日志
+	logService.SetRetentionSource(func() int {
+		settings, err := appSettings.GetAppSettings()
+		if err != nil {
+			return 0
+		}
+		return settings.LogRetentionDays
+	})
+	// 路由成功率窗口同样来自应用设置
+	logService.SetSuccessWindowSource(func() services.SuccessWindow {
+		settings, err := appSettings.GetAppSettings()
+		if err != nil {
+			return services.SuccessWindow{}
+		}
+		return services.SuccessWindow{Minutes: settings.SuccessWindowMinutes, Requests: settings.SuccessWindowRequests}
+	})
+
+	// 预算达到软 / 硬限制时通知前端
+	providerRelay.SetOnBudgetAlert(func(alert services.BudgetAlert) {
+		app.Event.Emit("budget:alert", alert)
+	})
+
+	// 请求生命周期实时推送给日志页面
+	providerRelay.SetOnRelayEvent(func(event services.RelayEvent) {
+		app.Event.Emit("relay:request", event)
 	})
-	systray.SetMenu(trayMenu)
 
 	systray.OnClick(func() {
 		if !mainWindow.IsVisible() {
@@ -245,6 +300,24 @@ func main() {
 	}
 }
 
+// addProfileMenu 在托盘菜单中添加配置方案切换子菜单（无方案时不添加）
+func addProfileMenu(menu *application.Menu, profileService *services.ProfileService) {
+	profiles, err := profileService.ListProfiles()
+	if err != nil || len(profiles) == 0 {
+		return
+	}
+	active := profileService.GetActiveProfile()
+	submenu := menu.AddSubmenu("配置方案")
+	for _, p := range profiles {
+		name := p.Name
+		submenu.AddRadio(name, name == active).OnClick(func(ctx *application.Context) {
+			if err := profileService.SwitchProfile(name); err != nil {
+				log.Printf("switch profile %s failed: %v", name, err)
+			}
+		})
+	}
+}
+
 func loadTrayIcon(path string) []byte {
 	data, err := trayIcons.ReadFile(path)
 	if err != nil {
@@ -0,0 +1,181 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 取消请求相关常量
+const (
+	statusRequestCancelled = 499 // 请求被主动取消时的状态码（写入 request_log 并返回给非流式客户端）
+	stopDrainTimeout       = 5 * time.Second
+	stopCancelGrace        = 2 * time.Second // 取消剩余请求后等待其写完终止消息的时间
+
+	requestCancelledMessage = "请求已在 Code Relay 中被取消"
+)
+
+// ActiveRequest 进行中的 relay 请求
+type ActiveRequest struct {
+	ID           string  `json:"id"`
+	Platform     string  `json:"platform"`
+	Model        string  `json:"model"`
+	Provider     string  `json:"provider"`
+	KeyIndex     int     `json:"key_index"` // 尚未选定 provider 时为 -1
+	Client       string  `json:"client"`
+	IsStream     bool    `json:"is_stream"`
+	StartedAt    string  `json:"started_at"`
+	ElapsedSec   float64 `json:"elapsed_sec"`
+	Bytes        int64   `json:"bytes"` // 已向客户端转发的响应字节数
+	InputTokens  int     `json:"input_tokens"`
+	OutputTokens int     `json:"output_tokens"`
+	Cancelling   bool    `json:"cancelling"`
+}
+
+// activeRequests 进行中请求的登记表
+type activeRequests struct {
+	mu       sync.Mutex
+	requests map[string]*liveRequest
+}
+
+func newActiveRequests() *activeRequests {
+	return &activeRequests{requests: make(map[string]*liveRequest)}
+}
+
+func (ar *activeRequests) add(live *liveRequest) {
+	ar.mu.Lock()
+	defer ar.mu.Unlock()
+	ar.requests[live.id] = live
+}
+
+func (ar *activeRequests) remove(id string) {
+	ar.mu.Lock()
+	defer ar.mu.Unlock()
+	delete(ar.requests, id)
+}
+
+func (ar *activeRequests) get(id string) *liveRequest {
+	ar.mu.Lock()
+	defer ar.mu.Unlock()
+	return ar.requests[id]
+}
+
+func (ar *activeRequests) count() int {
+	ar.mu.Lock()
+	defer ar.mu.Unlock()
+	return len(ar.requests)
+}
+
+// cancelAll 取消所有进行中的请求，返回取消的数量
+func (ar *activeRequests) cancelAll() int {
+	ar.mu.Lock()
+	defer ar.mu.Unlock()
+	for _, live := range ar.requests {
+		live.cancelled.Store(true)
+		live.cancel()
+	}
+	return len(ar.requests)
+}
+
+// wait 等待所有进行中的请求结束，超时返回 false
+func (ar *activeRequests) wait(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for ar.count() > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return true
+}
+
+// ListActiveRequests 返回进行中的请求（按开始时间排序）
+func (prs *ProviderRelayService) ListActiveRequests() []ActiveRequest {
+	prs.active.mu.Lock()
+	lives := make([]*liveRequest, 0, len(prs.active.requests))
+	for _, live := range prs.active.requests {
+		lives = append(lives, live)
+	}
+	prs.active.mu.Unlock()
+
+	sort.Slice(lives, func(i, j int) bool { return lives[i].start.Before(lives[j].start) })
+	result := make([]ActiveRequest, 0, len(lives))
+	for _, live := range lives {
+		live.mu.Lock()
+		result = append(result, ActiveRequest{
+			ID:           live.id,
+			Platform:     live.platform,
+			Model:        live.model,
+			Provider:     live.provider,
+			KeyIndex:     live.keyIndex,
+			Client:       live.client,
+			IsStream:     live.isStream,
+			StartedAt:    live.start.Format(time.RFC3339),
+			ElapsedSec:   time.Since(live.start).Seconds(),
+			Bytes:        live.bytes,
+			InputTokens:  live.inputTokens,
+			OutputTokens: live.outputTokens,
+			Cancelling:   live.cancelled.Load(),
+		})
+		live.mu.Unlock()
+	}
+	return result
+}
+
+// CancelRequest 取消进行中的请求：中止上游请求，并按协议向客户端返回终止消息
+func (prs *ProviderRelayService) CancelRequest(id string) error {
+	live := prs.active.get(id)
+	if live == nil {
+		return fmt.Errorf("请求 %s 不存在或已结束", id)
+	}
+	log.Printf("[Relay] 取消请求 %s (%s, model=%s)", id, live.platform, live.model)
+	live.cancelled.Store(true)
+	live.cancel()
+	return nil
+}
+
+// requestCancelled 请求是否被 CancelRequest / Stop 主动取消（区别于客户端自行断开）
+func requestCancelled(c *gin.Context) bool {
+	live := liveRequestFrom(c)
+	return live != nil && live.cancelled.Load()
+}
+
+// writeStreamCancelled 在已开始的流式响应末尾写入协议规范的终止事件，客户端据此结束而非等待或重连
+func writeStreamCancelled(c *gin.Context, endpoint string) {
+	var frame string
+	switch endpoint {
+	case "/v1/messages":
+		data, _ := json.Marshal(gin.H{
+			"type":  "error",
+			"error": gin.H{"type": "api_error", "message": requestCancelledMessage},
+		})
+		frame = "event: error\ndata: " + string(data) + "\n\n"
+	case "/responses":
+		data, _ := json.Marshal(gin.H{
+			"type": "response.failed",
+			"response": gin.H{
+				"status": "failed",
+				"error":  gin.H{"code": "cancelled", "message": requestCancelledMessage},
+			},
+		})
+		frame = "event: response.failed\ndata: " + string(data) + "\n\n"
+	default:
+		data, _ := json.Marshal(gin.H{
+			"error": gin.H{"message": requestCancelledMessage, "type": "cancelled", "code": "cancelled"},
+		})
+		frame = "data: " + string(data) + "\n\ndata: [DONE]\n\n"
+	}
+	// 上一个 chunk 可能被截断在行中间，先补一个空行结束它
+	if _, err := c.Writer.WriteString("\n\n" + frame); err != nil {
+		return
+	}
+	if flusher, ok := c.Writer.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,70 @@
+package services
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitActive 等待指定 provider 上出现已开始转发的进行中请求
+func waitActive(t *testing.T, provider string) ActiveRequest {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, req := range testRelay.ListActiveRequests() {
+			if req.Provider == provider && (!req.IsStream || req.Bytes > 0) {
+				return req
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("no active request on %s", provider)
+	return ActiveRequest{}
+}
+
+func TestRelayCancelRequest(t *testing.T) {
+	setProviders(t, "claude", mockProvider("cancel-stream", "interval=300ms,in=6"))
+
+	done := make(chan *httptest.ResponseRecorder, 1)
+	start := time.Now()
+	go func() {
+		done <- doRelay(t, nil, "/v1/messages", `{"model":"claude-sonnet-4","stream":true}`, nil)
+	}()
+	active := waitActive(t, "cancel-stream")
+	if active.Platform != "claude" || active.InputTokens != 6 {
+		t.Fatalf("unexpected active request: %+v", active)
+	}
+	if err := testRelay.CancelRequest(active.ID); err != nil {
+		t.Fatalf("CancelRequest: %v", err)
+	}
+
+	w := <-done
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("cancelled stream took %s", elapsed)
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, "event: error") || strings.Contains(body, "message_stop") {
+		t.Fatalf("expected cancelled stream, got: %s", body)
+	}
+	if logs := waitLogs(t, "claude", "cancel-stream", 1); logs[0].HttpCode != statusRequestCancelled {
+		t.Fatalf("unexpected log: %+v", logs[0])
+	}
+	if err := testRelay.CancelRequest(active.ID); err == nil {
+		t.Fatalf("expected error cancelling finished request")
+	}
+
+	// 非流式请求：返回协议格式的错误
+	setProviders(t, "codex", mockProvider("cancel-slow", "latency=5s"))
+	go func() {
+		done <- doRelay(t, nil, "/responses", `{"model":"gpt-5"}`, nil)
+	}()
+	active = waitActive(t, "cancel-slow")
+	if err := testRelay.CancelRequest(active.ID); err != nil {
+		t.Fatalf("CancelRequest: %v", err)
+	}
+	w = <-done
+	if w.Code != statusRequestCancelled || !strings.Contains(w.Body.String(), requestCancelledMessage) {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+}
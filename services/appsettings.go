@@ -2,6 +2,8 @@ package services
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
 	"sync"
@@ -10,12 +12,19 @@ import (
 const (
 	appSettingsDir  = ".codex-switch"
 	appSettingsFile = "app.json"
+
+	defaultLogRetentionDays = 90
 )
 
 type AppSettings struct {
 	ShowHeatmap   bool `json:"show_heatmap"`
 	ShowHomeTitle bool `json:"show_home_title"`
 	AutoStart     bool `json:"auto_start"`
+	// 原始请求日志保留天数，过期日志汇总为每日统计后删除；0 表示永久保留
+	LogRetentionDays int `json:"log_retention_days"`
+	// 路由成功率的滑动窗口：SuccessWindowRequests > 0 时按最近 N 次请求计算，否则按最近 N 分钟
+	SuccessWindowMinutes  int `json:"success_window_minutes"`
+	SuccessWindowRequests int `json:"success_window_requests"`
 }
 
 type AppSettingsService struct {
@@ -49,6 +58,9 @@ func (as *AppSettingsService) defaultSettings() AppSettings {
 		ShowHeatmap:   true,
 		ShowHomeTitle: true,
 		AutoStart:     autoStartEnabled,
+
+		LogRetentionDays:     defaultLogRetentionDays,
+		SuccessWindowMinutes: defaultSuccessWindowMinutes,
 	}
 }
 
@@ -64,6 +76,16 @@ func (as *AppSettingsService) SaveAppSettings(settings AppSettings) (AppSettings
 	as.mu.Lock()
 	defer as.mu.Unlock()
 
+	if settings.LogRetentionDays < 0 {
+		return settings, errors.New("日志保留天数不能为负数")
+	}
+	if settings.SuccessWindowMinutes < 0 || settings.SuccessWindowMinutes > maxSuccessWindowMinutes {
+		return settings, fmt.Errorf("成功率窗口应在 0-%d 分钟之间", maxSuccessWindowMinutes)
+	}
+	if settings.SuccessWindowRequests < 0 || settings.SuccessWindowRequests > maxSuccessSamples {
+		return settings, fmt.Errorf("成功率窗口应在 0-%d 次请求之间", maxSuccessSamples)
+	}
+
 	// 同步开机自启动状态
 	if as.autoStartService != nil {
 		if settings.AutoStart {
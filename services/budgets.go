@@ -0,0 +1,555 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/daodao97/xgo/xdb"
+	"github.com/gin-gonic/gin"
+)
+
+// 预算相关常量
+const (
+	budgetFile          = "budgets.json"
+	budgetRefreshPeriod = 5 * time.Minute // 从客户端日汇总重新读取费用的间隔，期间按每次请求增量累加
+	clientCtxKey        = "relay.client"  // gin.Context 中记录客户端标识（token 指纹）的键
+
+	BudgetScopeGlobal   = "global"
+	BudgetScopeProvider = "provider"
+	BudgetScopeClient   = "client"
+
+	BudgetPeriodDay   = "day"
+	BudgetPeriodMonth = "month"
+
+	BudgetLevelSoft = "soft"
+	BudgetLevelHard = "hard"
+)
+
+// Budget 费用预算（USD），按自然日或自然月统计请求日志中的费用
+// 达到软限制时发出告警；达到硬限制时 provider 预算停止路由到该 provider，
+// 客户端 / 全局预算直接以 429 拒绝请求
+type Budget struct {
+	Name      string  `json:"name"`
+	Enabled   bool    `json:"enabled"`
+	Scope     string  `json:"scope"`               // global、provider 或 client
+	Platform  string  `json:"platform,omitempty"`  // 生效的平台，为空表示全部
+	Target    string  `json:"target,omitempty"`    // provider 名称或客户端 relay token
+	Period    string  `json:"period"`              // day 或 month
+	SoftLimit float64 `json:"softLimit,omitempty"` // 0 表示不告警
+	HardLimit float64 `json:"hardLimit,omitempty"` // 0 表示不限制
+}
+
+// BudgetStatus 预算的当前用量
+type BudgetStatus struct {
+	Budget
+	Spent   float64 `json:"spent"`
+	Percent float64 `json:"percent"` // 相对硬限制（无硬限制时相对软限制）的比例
+	Level   string  `json:"level"`   // 空、soft 或 hard
+}
+
+// BudgetAlert 预算达到软 / 硬限制时发出的告警（每个周期每个级别只发一次）
+type BudgetAlert struct {
+	Budget string  `json:"budget"`
+	Level  string  `json:"level"`
+	Scope  string  `json:"scope"`
+	Target string  `json:"target,omitempty"`
+	Period string  `json:"period"`
+	Spent  float64 `json:"spent"`
+	Limit  float64 `json:"limit"`
+}
+
+// spendKey 费用汇总的维度
+type spendKey struct {
+	platform string
+	provider string
+	client   string
+}
+
+// alertKey 告警去重的键：每个预算每个周期每个级别只告警一次
+type alertKey struct {
+	budget string
+	period string
+	start  time.Time
+	level  string
+}
+
+// budgetTracker 预算配置与当期费用汇总
+type budgetTracker struct {
+	mu      sync.Mutex
+	path    string
+	loaded  bool
+	budgets []Budget
+
+	dayStart    time.Time
+	monthStart  time.Time
+	daySpend    map[spendKey]float64
+	monthSpend  map[spendKey]float64
+	refreshedAt time.Time
+	refreshing  bool
+	pending     map[spendKey]float64 // 重新读取期间累加的费用，替换时补记
+
+	alerted map[alertKey]bool
+	onAlert func(BudgetAlert)
+}
+
+func newBudgetTracker() *budgetTracker {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		home = "."
+	}
+	return &budgetTracker{
+		path:    filepath.Join(home, ".code-relay", budgetFile),
+		alerted: make(map[alertKey]bool),
+	}
+}
+
+func (bt *budgetTracker) loadLocked() ([]Budget, error) {
+	if !bt.loaded {
+		budgets := []Budget{}
+		data, err := os.ReadFile(bt.path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		if len(data) > 0 {
+			if err := json.Unmarshal(data, &budgets); err != nil {
+				return nil, err
+			}
+		}
+		bt.budgets = budgets
+		bt.loaded = true
+	}
+	return bt.budgets, nil
+}
+
+func (bt *budgetTracker) save(budgets []Budget) error {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(bt.path), 0o755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(budgets, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := bt.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, bt.path); err != nil {
+		return err
+	}
+	bt.budgets = append([]Budget(nil), budgets...)
+	bt.loaded = true
+	return nil
+}
+
+// refreshSpend 周期切换或超过刷新间隔时从客户端日汇总重新读取本月 / 今日费用，返回是否由本次调用完成刷新。
+// 读取在锁外进行，不阻塞请求路径上的预算检查；读取期间累加的费用在替换时补记（可能与读取结果重复，宁可多算）
+func (bt *budgetTracker) refreshSpend() bool {
+	now := time.Now()
+	dayStart := startOfDay(now)
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+
+	bt.mu.Lock()
+	if bt.refreshing || (bt.monthSpend != nil && bt.dayStart.Equal(dayStart) && time.Since(bt.refreshedAt) < budgetRefreshPeriod) {
+		bt.mu.Unlock()
+		return false
+	}
+	bt.refreshing = true
+	bt.pending = make(map[spendKey]float64)
+	bt.mu.Unlock()
+
+	daySpend, monthSpend, err := loadPeriodSpend(dayStart, monthStart)
+
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+	bt.refreshing = false
+	pending := bt.pending
+	bt.pending = nil
+	if err != nil {
+		log.Printf("[Budget] 汇总费用失败: %v", err)
+		if bt.monthSpend != nil {
+			return false
+		}
+		daySpend, monthSpend = make(map[spendKey]float64), make(map[spendKey]float64)
+	}
+	for key, cost := range pending {
+		daySpend[key] += cost
+		monthSpend[key] += cost
+	}
+	if !bt.dayStart.Equal(dayStart) {
+		bt.pruneAlertsLocked(dayStart, monthStart)
+	}
+	bt.dayStart, bt.monthStart = dayStart, monthStart
+	bt.daySpend, bt.monthSpend = daySpend, monthSpend
+	bt.refreshedAt = now
+	return true
+}
+
+// pruneAlertsLocked 周期切换时清理已结束周期的告警记录
+func (bt *budgetTracker) pruneAlertsLocked(dayStart time.Time, monthStart time.Time) {
+	for key := range bt.alerted {
+		current := dayStart
+		if key.period == BudgetPeriodMonth {
+			current = monthStart
+		}
+		if key.start.Before(current) {
+			delete(bt.alerted, key)
+		}
+	}
+}
+
+// addSpendLocked 将一次请求的费用累加到当期汇总
+func (bt *budgetTracker) addSpendLocked(key spendKey, cost float64) {
+	if bt.pending != nil {
+		bt.pending[key] += cost
+	}
+	if bt.monthSpend != nil {
+		bt.daySpend[key] += cost
+		bt.monthSpend[key] += cost
+	}
+}
+
+// loadPeriodSpend 从客户端日汇总读取本月及今日各维度的费用
+func loadPeriodSpend(dayStart time.Time, monthStart time.Time) (map[spendKey]float64, map[spendKey]float64, error) {
+	daySpend := make(map[spendKey]float64)
+	monthSpend := make(map[spendKey]float64)
+	db, err := xdb.DB("default")
+	if err != nil {
+		return nil, nil, err
+	}
+	rows, err := db.Query("SELECT day, platform, provider, client, total_cost FROM "+clientRollupTable+" WHERE day >= ? AND total_cost > 0",
+		monthStart.Format(dayLayout))
+	if err != nil {
+		if isNoSuchTableErr(err) {
+			return daySpend, monthSpend, nil
+		}
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	today := dayStart.Format(dayLayout)
+	for rows.Next() {
+		var day string
+		var key spendKey
+		var cost float64
+		if err := rows.Scan(&day, &key.platform, &key.provider, &key.client, &cost); err != nil {
+			return nil, nil, err
+		}
+		monthSpend[key] += cost
+		if day == today {
+			daySpend[key] += cost
+		}
+	}
+	return daySpend, monthSpend, rows.Err()
+}
+
+// spentLocked 计算预算在当前周期内的费用
+func (bt *budgetTracker) spentLocked(b Budget) float64 {
+	spend := bt.daySpend
+	if b.Period == BudgetPeriodMonth {
+		spend = bt.monthSpend
+	}
+	var total float64
+	for key, cost := range spend {
+		if b.Platform != "" && !strings.EqualFold(b.Platform, key.platform) {
+			continue
+		}
+		switch b.Scope {
+		case BudgetScopeProvider:
+			if !strings.EqualFold(b.Target, key.provider) {
+				continue
+			}
+		case BudgetScopeClient:
+			if clientFingerprint(b.Target) != key.client {
+				continue
+			}
+		}
+		total += cost
+	}
+	return total
+}
+
+func (bt *budgetTracker) periodStartLocked(b Budget) time.Time {
+	if b.Period == BudgetPeriodMonth {
+		return bt.monthStart
+	}
+	return bt.dayStart
+}
+
+// record 将一次已完成请求的费用计入当期汇总，并检查是否触发告警
+func (bt *budgetTracker) record(ls *LogService, rl *RequestLog) {
+	entry := *rl
+	ls.decorateCost(&entry)
+	if entry.TotalCost == 0 {
+		return
+	}
+
+	bt.mu.Lock()
+	budgets, err := bt.loadLocked()
+	bt.mu.Unlock()
+	if err != nil || len(budgets) == 0 {
+		return
+	}
+	// 调用时该请求已写入汇总表，重新读取时已包含本次费用
+	refreshed := bt.refreshSpend()
+
+	bt.mu.Lock()
+	if !refreshed {
+		bt.addSpendLocked(spendKey{entry.Platform, entry.Provider, entry.Client}, entry.TotalCost)
+	}
+
+	var alerts []BudgetAlert
+	for _, b := range budgets {
+		if !b.Enabled || !b.appliesTo(entry.Platform, entry.Provider, entry.Client) {
+			continue
+		}
+		spent := bt.spentLocked(b)
+		level, limit := b.levelFor(spent)
+		if level == "" {
+			continue
+		}
+		key := alertKey{budget: b.Name, period: b.Period, start: bt.periodStartLocked(b), level: level}
+		if bt.alerted[key] {
+			continue
+		}
+		bt.alerted[key] = true
+		alerts = append(alerts, BudgetAlert{
+			Budget: b.Name,
+			Level:  level,
+			Scope:  b.Scope,
+			Target: b.displayTarget(),
+			Period: b.Period,
+			Spent:  spent,
+			Limit:  limit,
+		})
+	}
+	onAlert := bt.onAlert
+	bt.mu.Unlock()
+
+	for _, alert := range alerts {
+		log.Printf("[Budget] 预算 %s 达到%s限制: $%.2f / $%.2f", alert.Budget, alert.Level, alert.Spent, alert.Limit)
+		if onAlert != nil {
+			onAlert(alert)
+		}
+	}
+}
+
+// exceeded 返回已达到硬限制、且适用于该请求的第一个预算
+// provider 为空时只检查全局和客户端预算
+func (bt *budgetTracker) exceeded(platform string, provider string, client string) (Budget, float64, bool) {
+	bt.mu.Lock()
+	budgets, err := bt.loadLocked()
+	bt.mu.Unlock()
+	if err != nil {
+		log.Printf("[Budget] 加载预算失败: %v", err)
+		return Budget{}, 0, false
+	}
+	if len(budgets) == 0 {
+		return Budget{}, 0, false
+	}
+	bt.refreshSpend()
+
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+	for _, b := range budgets {
+		if !b.Enabled || b.HardLimit <= 0 {
+			continue
+		}
+		// provider 预算只在筛选 provider 时检查，全局 / 客户端预算只在请求入口检查
+		if isProviderBudget := b.Scope == BudgetScopeProvider; isProviderBudget != (provider != "") {
+			continue
+		}
+		if !b.appliesTo(platform, provider, client) {
+			continue
+		}
+		if spent := bt.spentLocked(b); spent >= b.HardLimit {
+			return b, spent, true
+		}
+	}
+	return Budget{}, 0, false
+}
+
+// appliesTo 判断预算是否覆盖该平台 / provider / 客户端的请求
+func (b Budget) appliesTo(platform string, provider string, client string) bool {
+	if b.Platform != "" && !strings.EqualFold(b.Platform, platform) {
+		return false
+	}
+	switch b.Scope {
+	case BudgetScopeProvider:
+		return strings.EqualFold(b.Target, provider)
+	case BudgetScopeClient:
+		return clientFingerprint(b.Target) == client
+	}
+	return true
+}
+
+// levelFor 返回费用所处的限制级别及对应限额
+func (b Budget) levelFor(spent float64) (string, float64) {
+	if b.HardLimit > 0 && spent >= b.HardLimit {
+		return BudgetLevelHard, b.HardLimit
+	}
+	if b.SoftLimit > 0 && spent >= b.SoftLimit {
+		return BudgetLevelSoft, b.SoftLimit
+	}
+	return "", 0
+}
+
+// displayTarget 展示用的目标（客户端 token 只显示指纹）
+func (b Budget) displayTarget() string {
+	if b.Scope == BudgetScopeClient {
+		return clientFingerprint(b.Target)
+	}
+	return b.Target
+}
+
+func (b *Budget) validate() error {
+	if b.Name == "" {
+		return fmt.Errorf("名称不能为空")
+	}
+	b.Scope = strings.ToLower(strings.TrimSpace(b.Scope))
+	switch b.Scope {
+	case "":
+		b.Scope = BudgetScopeGlobal
+	case BudgetScopeGlobal, BudgetScopeProvider, BudgetScopeClient:
+	default:
+		return fmt.Errorf("未知范围 %q（应为 global、provider 或 client）", b.Scope)
+	}
+	if b.Scope != BudgetScopeGlobal && strings.TrimSpace(b.Target) == "" {
+		return fmt.Errorf("%s 预算必须指定目标", b.Scope)
+	}
+	b.Period = strings.ToLower(strings.TrimSpace(b.Period))
+	switch b.Period {
+	case "":
+		b.Period = BudgetPeriodDay
+	case BudgetPeriodDay, BudgetPeriodMonth:
+	default:
+		return fmt.Errorf("未知周期 %q（应为 day 或 month）", b.Period)
+	}
+	if b.SoftLimit < 0 || b.HardLimit < 0 {
+		return fmt.Errorf("限额不能为负数")
+	}
+	if b.SoftLimit == 0 && b.HardLimit == 0 {
+		return fmt.Errorf("至少需要设置软限制或硬限制")
+	}
+	return nil
+}
+
+// ListBudgets 返回所有预算配置，客户端 token 脱敏
+func (prs *ProviderRelayService) ListBudgets() ([]Budget, error) {
+	prs.budgets.mu.Lock()
+	defer prs.budgets.mu.Unlock()
+	budgets, err := prs.budgets.loadLocked()
+	if err != nil {
+		return nil, err
+	}
+	result := append([]Budget(nil), budgets...)
+	for i := range result {
+		if result[i].Scope == BudgetScopeClient {
+			result[i].Target = maskSecret(result[i].Target)
+		}
+	}
+	return result, nil
+}
+
+// SaveBudgets 校验并保存预算配置，立即对后续请求生效
+func (prs *ProviderRelayService) SaveBudgets(budgets []Budget) error {
+	prs.budgets.mu.Lock()
+	existing, err := prs.budgets.loadLocked()
+	prs.budgets.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	// 前端拿到的是脱敏的客户端 token，按预算名称还原为已保存的 token
+	storedTargets := make(map[string]string, len(existing))
+	for _, b := range existing {
+		if b.Scope == BudgetScopeClient {
+			storedTargets[b.Name] = b.Target
+		}
+	}
+
+	for i := range budgets {
+		budgets[i].Name = strings.TrimSpace(budgets[i].Name)
+		if budgets[i].Target, err = resolveMaskedSecret(budgets[i].Target, storedTargets[budgets[i].Name]); err != nil {
+			return fmt.Errorf("预算 %q: %w", budgets[i].Name, err)
+		}
+		if err := budgets[i].validate(); err != nil {
+			return fmt.Errorf("预算 %q: %w", budgets[i].Name, err)
+		}
+	}
+	return prs.budgets.save(budgets)
+}
+
+// BudgetStatus 返回各预算在当前周期内的用量
+func (prs *ProviderRelayService) BudgetStatus() ([]BudgetStatus, error) {
+	bt := prs.budgets
+	bt.mu.Lock()
+	budgets, err := bt.loadLocked()
+	bt.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	bt.refreshSpend()
+
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+	result := make([]BudgetStatus, 0, len(budgets))
+	for _, b := range budgets {
+		spent := bt.spentLocked(b)
+		status := BudgetStatus{Budget: b, Spent: spent}
+		status.Level, _ = b.levelFor(spent)
+		if limit := b.HardLimit; limit > 0 {
+			status.Percent = spent / limit
+		} else if b.SoftLimit > 0 {
+			status.Percent = spent / b.SoftLimit
+		}
+		if b.Scope == BudgetScopeClient {
+			status.Target = b.displayTarget()
+		}
+		result = append(result, status)
+	}
+	return result, nil
+}
+
+// SetOnBudgetAlert 设置预算告警回调（由 main 转发为前端事件）
+func (prs *ProviderRelayService) SetOnBudgetAlert(fn func(BudgetAlert)) {
+	prs.budgets.mu.Lock()
+	defer prs.budgets.mu.Unlock()
+	prs.budgets.onAlert = fn
+}
+
+// clientFingerprint 客户端 token 的指纹，写入 request_log 以免保存明文 token
+func clientFingerprint(token string) string {
+	if token == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:6])
+}
+
+// clientFrom 返回当前请求的客户端标识（写入 request_log）
+func clientFrom(c *gin.Context) string {
+	if c == nil {
+		return ""
+	}
+	return c.GetString(clientCtxKey)
+}
+
+// budgetExceededMessage 返回给客户端的预算超限说明
+func budgetExceededMessage(b Budget, spent float64) string {
+	period := "今日"
+	if b.Period == BudgetPeriodMonth {
+		period = "本月"
+	}
+	return fmt.Sprintf("预算 '%s' %s已用 $%.2f，达到上限 $%.2f，请求已被拒绝", b.Name, period, spent, b.HardLimit)
+}
@@ -0,0 +1,167 @@
+package services
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/daodao97/xgo/xdb"
+)
+
+func TestBudgetSpendFromClientRollup(t *testing.T) {
+	ls := newTestLogService(t)
+	client := clientFingerprint("budget-rollup-token")
+	for range 2 {
+		ls.writeRequestLog(&RequestLog{Platform: "budget-test", Provider: "budget-p", Model: "claude-sonnet-4", Client: client, HttpCode: 200, InputTokens: 1000, OutputTokens: 1000}, nil)
+	}
+	waitLogs(t, "budget-test", "budget-p", 2)
+	// 原始日志被清理后费用仍从汇总中读取
+	if _, err := xdb.New("request_log").Delete(xdb.WhereEq("platform", "budget-test")); err != nil {
+		t.Fatalf("delete raw logs: %v", err)
+	}
+
+	bt := newBudgetTracker()
+	bt.path = filepath.Join(t.TempDir(), budgetFile)
+	if err := bt.save([]Budget{{
+		Name:      "rollup-month",
+		Enabled:   true,
+		Scope:     BudgetScopeClient,
+		Target:    "budget-rollup-token",
+		Platform:  "budget-test",
+		Period:    BudgetPeriodMonth,
+		HardLimit: 0.000001,
+	}}); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	budget, spent, over := bt.exceeded("budget-test", "", client)
+	if !over || budget.Name != "rollup-month" || spent <= 0 {
+		t.Fatalf("exceeded = %v, %v, %v", budget, spent, over)
+	}
+	if _, _, over := bt.exceeded("budget-test", "", clientFingerprint("other-token")); over {
+		t.Fatal("other client should not be over budget")
+	}
+
+	if runtime.GOOS != "windows" {
+		info, err := os.Stat(bt.path)
+		if err != nil {
+			t.Fatalf("stat: %v", err)
+		}
+		if perm := info.Mode().Perm(); perm != 0o600 {
+			t.Fatalf("budgets.json mode = %o, want 600", perm)
+		}
+	}
+}
+
+func TestRelayClientBudget(t *testing.T) {
+	setProviders(t, "claude", mockProvider("budget-target", "in=1000,out=1000"))
+	alerts := make(chan BudgetAlert, 4)
+	testRelay.SetOnBudgetAlert(func(alert BudgetAlert) { alerts <- alert })
+	if err := testRelay.SaveBudgets([]Budget{{
+		Name:      "agent-daily",
+		Enabled:   true,
+		Scope:     BudgetScopeClient,
+		Target:    "agent-token",
+		Period:    BudgetPeriodDay,
+		HardLimit: 0.000001,
+	}}); err != nil {
+		t.Fatalf("SaveBudgets: %v", err)
+	}
+	t.Cleanup(func() {
+		testRelay.SetOnBudgetAlert(nil)
+		_ = testRelay.SaveBudgets([]Budget{})
+	})
+
+	agent := map[string]string{"x-api-key": "agent-token"}
+	body := `{"model":"claude-sonnet-4"}`
+	if w := doRelay(t, nil, "/v1/messages", body, agent); w.Code != http.StatusOK {
+		t.Fatalf("first request: status = %d, body = %s", w.Code, w.Body.String())
+	}
+	select {
+	case alert := <-alerts:
+		if alert.Budget != "agent-daily" || alert.Level != BudgetLevelHard {
+			t.Fatalf("unexpected alert: %+v", alert)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("budget alert not emitted")
+	}
+
+	w := doRelay(t, nil, "/v1/messages", body, agent)
+	if w.Code != http.StatusTooManyRequests || !strings.Contains(w.Body.String(), "rate_limit_error") {
+		t.Fatalf("over budget: status = %d, body = %s", w.Code, w.Body.String())
+	}
+	// 其他客户端不受影响
+	if w := doRelay(t, nil, "/v1/messages", body, map[string]string{"x-api-key": "other-token"}); w.Code != http.StatusOK {
+		t.Fatalf("other client: status = %d, body = %s", w.Code, w.Body.String())
+	}
+}
+
+func TestListBudgetsMasksClientTokens(t *testing.T) {
+	budgets := []Budget{
+		{Name: "agent", Enabled: true, Scope: BudgetScopeClient, Target: "agent-secret-token", Period: BudgetPeriodDay, HardLimit: 1},
+		{Name: "vendor", Enabled: true, Scope: BudgetScopeProvider, Target: "vendor-a", Period: BudgetPeriodMonth, HardLimit: 10},
+	}
+	if err := testRelay.SaveBudgets(budgets); err != nil {
+		t.Fatalf("SaveBudgets: %v", err)
+	}
+	t.Cleanup(func() { _ = testRelay.SaveBudgets([]Budget{}) })
+
+	listed, err := testRelay.ListBudgets()
+	if err != nil || len(listed) != 2 {
+		t.Fatalf("ListBudgets = %+v, %v", listed, err)
+	}
+	if listed[0].Target != "****oken" || listed[1].Target != "vendor-a" {
+		t.Fatalf("targets = %q, %q", listed[0].Target, listed[1].Target)
+	}
+
+	// 原样保存脱敏值时还原为已保存的 token
+	listed[0].HardLimit = 2
+	if err := testRelay.SaveBudgets(listed); err != nil {
+		t.Fatalf("SaveBudgets masked: %v", err)
+	}
+	if got := testRelay.budgets.budgets[0]; got.Target != "agent-secret-token" || got.HardLimit != 2 {
+		t.Fatalf("stored budget = %+v", got)
+	}
+	// 脱敏值挪到了其他预算名下：无法还原
+	moved := []Budget{{Name: "renamed", Enabled: true, Scope: BudgetScopeClient, Target: "****oken", Period: BudgetPeriodDay, HardLimit: 1}}
+	if err := testRelay.SaveBudgets(moved); err == nil {
+		t.Fatal("masked token resolved under a different budget name")
+	}
+}
+
+func TestBudgetAlertsPrunedOnPeriodRollover(t *testing.T) {
+	now := time.Now()
+	today := startOfDay(now)
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	lastMonth := monthStart.AddDate(0, -1, 0)
+
+	bt := newBudgetTracker()
+	bt.dayStart, bt.monthStart = today.AddDate(0, 0, -1), lastMonth
+	bt.daySpend, bt.monthSpend = map[spendKey]float64{}, map[spendKey]float64{}
+	stale := []alertKey{
+		{budget: "daily", period: BudgetPeriodDay, start: today.AddDate(0, 0, -1), level: BudgetLevelSoft},
+		{budget: "monthly", period: BudgetPeriodMonth, start: lastMonth, level: BudgetLevelHard},
+	}
+	current := []alertKey{
+		{budget: "daily", period: BudgetPeriodDay, start: today, level: BudgetLevelSoft},
+		{budget: "monthly", period: BudgetPeriodMonth, start: monthStart, level: BudgetLevelSoft},
+	}
+	for _, key := range append(stale, current...) {
+		bt.alerted[key] = true
+	}
+
+	if !bt.refreshSpend() {
+		t.Fatal("refreshSpend did not refresh after the day rolled over")
+	}
+	if len(bt.alerted) != len(current) {
+		t.Fatalf("alerted = %v", bt.alerted)
+	}
+	for _, key := range current {
+		if !bt.alerted[key] {
+			t.Fatalf("current alert %+v pruned", key)
+		}
+	}
+}
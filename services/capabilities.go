@@ -0,0 +1,160 @@
+package services
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+)
+
+// 输入 token 估算参数：文本按每 4 字节 1 token 粗略估算，每张图片按固定 token 计
+const (
+	estimateBytesPerToken = 4
+	estimateImageTokens   = 1600
+)
+
+// ProviderCapabilities provider 的能力声明
+// 一旦配置，未声明的能力视为不支持；MaxContextTokens 为 0、Betas 为空表示不限制
+type ProviderCapabilities struct {
+	MaxContextTokens int      `json:"maxContextTokens,omitempty"` // 最大上下文（输入）token 数
+	Vision           bool     `json:"vision"`                     // 图片输入
+	Thinking         bool     `json:"thinking"`                   // extended thinking / reasoning
+	ToolUse          bool     `json:"toolUse"`                    // 工具调用
+	Betas            []string `json:"betas,omitempty"`            // 接受的 anthropic-beta 特性，支持通配符
+}
+
+// requestFeatures 从请求中识别出的、需要上游支持的特性
+type requestFeatures struct {
+	InputTokens int // 估算的输入 token 数
+	Vision      bool
+	Thinking    bool
+	ToolUse     bool
+	Betas       []string
+}
+
+// extractRequestFeatures 检查请求头和请求体，估算输入大小并识别图片、thinking、工具和 beta 特性
+// 同时兼容 Anthropic Messages、OpenAI Chat / Responses 和 Gemini 的请求格式
+func extractRequestFeatures(c *gin.Context, body []byte) requestFeatures {
+	root := gjson.ParseBytes(body)
+	features := requestFeatures{
+		Thinking: hasThinking(root),
+		ToolUse:  len(root.Get("tools").Array()) > 0,
+	}
+
+	var textBytes, images int
+	walkRequestBody(root, "", &textBytes, &images)
+	features.Vision = images > 0
+	features.InputTokens = textBytes/estimateBytesPerToken + images*estimateImageTokens
+
+	for _, value := range c.Request.Header.Values("anthropic-beta") {
+		for _, beta := range strings.Split(value, ",") {
+			if beta = strings.TrimSpace(beta); beta != "" {
+				features.Betas = append(features.Betas, beta)
+			}
+		}
+	}
+	return features
+}
+
+// hasThinking 判断请求是否开启了 thinking / reasoning
+func hasThinking(root gjson.Result) bool {
+	if thinking := root.Get("thinking"); thinking.Exists() {
+		return thinking.Get("type").String() != "disabled"
+	}
+	if effort := root.Get("reasoning_effort").String(); effort != "" && effort != "none" {
+		return true
+	}
+	if root.Get("reasoning.effort").Exists() {
+		return root.Get("reasoning.effort").String() != "none"
+	}
+	if cfg := root.Get("generationConfig.thinkingConfig"); cfg.Exists() {
+		return cfg.Get("thinkingBudget").Int() != 0 || !cfg.Get("thinkingBudget").Exists()
+	}
+	return false
+}
+
+// walkRequestBody 递归统计文本字节数与图片数量（图片的 base64 数据不计入文本）
+func walkRequestBody(node gjson.Result, key string, textBytes *int, images *int) {
+	switch {
+	case node.IsObject():
+		if isImagePart(node) {
+			*images++
+			return
+		}
+		node.ForEach(func(k, v gjson.Result) bool {
+			walkRequestBody(v, k.String(), textBytes, images)
+			return true
+		})
+	case node.IsArray():
+		node.ForEach(func(_, v gjson.Result) bool {
+			walkRequestBody(v, key, textBytes, images)
+			return true
+		})
+	case node.Type == gjson.String:
+		// thinking 签名和内嵌文件数据不会作为文本计费
+		if key == "signature" || key == "data" || strings.HasPrefix(node.Str, "data:") {
+			return
+		}
+		*textBytes += len(node.Str)
+	}
+}
+
+// isImagePart 判断内容块是否为图片
+func isImagePart(node gjson.Result) bool {
+	switch node.Get("type").String() {
+	case "image", "image_url", "input_image":
+		return true
+	}
+	for _, key := range []string{"inline_data", "inlineData", "file_data", "fileData"} {
+		part := node.Get(key)
+		if !part.Exists() {
+			continue
+		}
+		mimeType := part.Get("mimeType").String()
+		if mimeType == "" {
+			mimeType = part.Get("mime_type").String()
+		}
+		if strings.HasPrefix(mimeType, "image/") {
+			return true
+		}
+	}
+	return false
+}
+
+// unsupportedRequirement 返回 provider 无法满足的请求要求（为空表示可以处理该请求）
+func (p *Provider) unsupportedRequirement(f requestFeatures) string {
+	caps := p.Capabilities
+	if caps == nil {
+		return ""
+	}
+	if caps.MaxContextTokens > 0 && f.InputTokens > caps.MaxContextTokens {
+		return fmt.Sprintf("约 %d tokens 的上下文", f.InputTokens)
+	}
+	if f.Vision && !caps.Vision {
+		return "图片输入（vision）"
+	}
+	if f.Thinking && !caps.Thinking {
+		return "extended thinking"
+	}
+	if f.ToolUse && !caps.ToolUse {
+		return "工具调用（tool use）"
+	}
+	if len(caps.Betas) > 0 {
+		for _, beta := range f.Betas {
+			if !matchesAnyPattern(caps.Betas, beta) {
+				return "beta 特性 " + beta
+			}
+		}
+	}
+	return ""
+}
+
+func matchesAnyPattern(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if matchWildcard(strings.TrimSpace(pattern), value) {
+			return true
+		}
+	}
+	return false
+}
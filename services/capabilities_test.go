@@ -0,0 +1,38 @@
+package services
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRelayCapabilityFiltering(t *testing.T) {
+	basic := mockProvider("caps-basic", "default")
+	basic.Capabilities = &ProviderCapabilities{MaxContextTokens: 1000, ToolUse: true}
+	full := mockProvider("caps-full", "default")
+	full.Capabilities = &ProviderCapabilities{MaxContextTokens: 1000000, Vision: true, Thinking: true, ToolUse: true}
+	setProviders(t, "claude", basic, full)
+	setRoutePolicies(t, RoutePolicy{Name: "basic-first", Enabled: true, Match: RouteMatch{Route: "caps"}, PreferProviders: []string{"caps-basic"}})
+	headers := map[string]string{routeHeader: "caps"}
+
+	longText := strings.Repeat("x", 8000)
+	cases := map[string]string{
+		"long context": `{"model":"claude-sonnet-4","messages":[{"role":"user","content":"` + longText + `"}]}`,
+		"vision":       `{"model":"claude-sonnet-4","messages":[{"role":"user","content":[{"type":"image","source":{"type":"base64","media_type":"image/png","data":"AAAA"}}]}]}`,
+		"thinking":     `{"model":"claude-sonnet-4","thinking":{"type":"enabled","budget_tokens":1024},"messages":[]}`,
+	}
+	for name, body := range cases {
+		before, _ := testLogSvc.ListRequestLogs("claude", "caps-full", 1000)
+		if w := doRelay(t, nil, "/v1/messages", body, headers); w.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d, body = %s", name, w.Code, w.Body.String())
+		}
+		waitLogs(t, "claude", "caps-full", len(before)+1)
+	}
+
+	full.Capabilities.Vision = false
+	setProviders(t, "claude", basic, full)
+	w := doRelay(t, nil, "/v1/messages", cases["vision"], headers)
+	if w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), "vision") {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+}
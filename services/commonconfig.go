@@ -74,23 +74,11 @@ func (ccs *CommonConfigService) GetCommonConfigJSON(kind string) (string, error)
 
 // SaveCommonConfigJSON 保存通用配置（接收 JSON 字符串）
 func (ccs *CommonConfigService) SaveCommonConfigJSON(kind string, jsonStr string) error {
-	// 验证 JSON 格式
-	var config map[string]interface{}
-	if err := json.Unmarshal([]byte(jsonStr), &config); err != nil {
-		return fmt.Errorf("invalid JSON: %w", err)
-	}
-
-	path, err := ccs.getConfigPath(kind)
+	path, data, err := ccs.encodeCommonConfig(kind, jsonStr)
 	if err != nil {
 		return err
 	}
 
-	// 格式化 JSON
-	data, err := json.MarshalIndent(config, "", "  ")
-	if err != nil {
-		return fmt.Errorf("failed to serialize config: %w", err)
-	}
-
 	// 原子写入
 	tmp := path + ".tmp"
 	if err := os.WriteFile(tmp, data, 0o644); err != nil {
@@ -105,6 +93,27 @@ func (ccs *CommonConfigService) SaveCommonConfigJSON(kind string, jsonStr string
 	return nil
 }
 
+// encodeCommonConfig 校验并格式化通用配置，返回目标路径与文件内容
+func (ccs *CommonConfigService) encodeCommonConfig(kind string, jsonStr string) (string, []byte, error) {
+	// 验证 JSON 格式
+	var config map[string]interface{}
+	if err := json.Unmarshal([]byte(jsonStr), &config); err != nil {
+		return "", nil, fmt.Errorf("invalid JSON: %w", err)
+	}
+
+	path, err := ccs.getConfigPath(kind)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// 格式化 JSON
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to serialize config: %w", err)
+	}
+	return path, data, nil
+}
+
 // GetCommonConfig 获取通用配置（保留用于内部调用）
 func (ccs *CommonConfigService) GetCommonConfig(kind string) (map[string]interface{}, error) {
 	path, err := ccs.getConfigPath(kind)
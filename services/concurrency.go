@@ -0,0 +1,234 @@
+package services
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 并发限制相关常量
+const (
+	defaultQueueTimeout = 30 * time.Second
+	queueWaitCtxKey     = "relay.queueWait" // gin.Context 中记录本次转发排队时长（秒）的键
+)
+
+var (
+	errQueueFull    = errors.New("排队已满")
+	errQueueTimeout = errors.New("排队超时")
+)
+
+// ProviderConcurrency provider（或其某个 Key）的并发与排队状态
+type ProviderConcurrency struct {
+	Platform string `json:"platform"`
+	Provider string `json:"provider"`
+	KeyIndex int    `json:"key_index"` // -1 表示 provider 级别
+	Limit    int    `json:"limit"`
+	InFlight int    `json:"in_flight"`
+	Queued   int    `json:"queued"`
+
+	// 累计指标（进程启动以来）
+	TotalQueued   int64   `json:"total_queued"`   // 进入排队的请求数
+	TotalSpilled  int64   `json:"total_spilled"`  // 队列已满而转到下一个 provider 的请求数
+	TotalTimeouts int64   `json:"total_timeouts"` // 排队超时的请求数
+	AvgWaitSec    float64 `json:"avg_wait_sec"`   // 排队请求的平均等待时间
+	MaxWaitSec    float64 `json:"max_wait_sec"`
+}
+
+// limitSlot 单个 provider / Key 的并发计数与 FIFO 等待队列
+type limitSlot struct {
+	platform string
+	provider string
+	keyIndex int
+
+	inFlight int
+	waiters  *list.List // 元素为 chan struct{}，获得名额时关闭
+
+	totalQueued   int64
+	totalSpilled  int64
+	totalTimeouts int64
+	totalWait     time.Duration
+	maxWait       time.Duration
+	limit         int
+}
+
+// concurrencyLimiter 按 provider / Key 限制进行中的请求数
+type concurrencyLimiter struct {
+	mu    sync.Mutex
+	slots map[string]*limitSlot // key: 平台|provider 或 平台|provider|#Key下标
+}
+
+func newConcurrencyLimiter() *concurrencyLimiter {
+	return &concurrencyLimiter{slots: make(map[string]*limitSlot)}
+}
+
+func limitKey(kind string, provider string, keyIndex int) string {
+	if keyIndex < 0 {
+		return kind + "|" + provider
+	}
+	return fmt.Sprintf("%s|%s|#%d", kind, provider, keyIndex)
+}
+
+// acquire 获取一个并发名额；达到上限时按 FIFO 排队，队列已满或等待超时返回错误
+// limit <= 0 表示不限制。返回的 release 必须在请求结束后调用
+func (cl *concurrencyLimiter) acquire(ctx context.Context, kind string, provider string, keyIndex int, limit int, queueSize int, timeout time.Duration) (func(), time.Duration, error) {
+	if limit <= 0 {
+		return func() {}, 0, nil
+	}
+
+	key := limitKey(kind, provider, keyIndex)
+	cl.mu.Lock()
+	slot := cl.slots[key]
+	if slot == nil {
+		slot = &limitSlot{platform: kind, provider: provider, keyIndex: keyIndex, waiters: list.New()}
+		cl.slots[key] = slot
+	}
+	slot.limit = limit
+	if slot.inFlight < limit && slot.waiters.Len() == 0 {
+		slot.inFlight++
+		cl.mu.Unlock()
+		return cl.releaser(key), 0, nil
+	}
+	if slot.waiters.Len() >= queueSize {
+		slot.totalSpilled++
+		cl.mu.Unlock()
+		return nil, 0, errQueueFull
+	}
+	ready := make(chan struct{})
+	elem := slot.waiters.PushBack(ready)
+	slot.totalQueued++
+	depth := slot.waiters.Len()
+	cl.mu.Unlock()
+	log.Printf("[Relay] %s 达到并发上限 %d，排队等待（队列深度 %d/%d）", key, limit, depth, queueSize)
+
+	if timeout <= 0 {
+		timeout = defaultQueueTimeout
+	}
+	start := time.Now()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case <-ready:
+	case <-timer.C:
+		err = errQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	waited := time.Since(start)
+
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	slot.totalWait += waited
+	if waited > slot.maxWait {
+		slot.maxWait = waited
+	}
+	if err != nil {
+		select {
+		case <-ready:
+			// 超时 / 取消的同时已被分配名额：直接使用
+			return cl.releaser(key), waited, nil
+		default:
+		}
+		slot.waiters.Remove(elem)
+		if errors.Is(err, errQueueTimeout) {
+			slot.totalTimeouts++
+		}
+		return nil, waited, err
+	}
+	return cl.releaser(key), waited, nil
+}
+
+// releaser 返回只生效一次的释放函数：有排队请求时名额直接交给队首
+func (cl *concurrencyLimiter) releaser(key string) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			cl.mu.Lock()
+			defer cl.mu.Unlock()
+			slot := cl.slots[key]
+			if front := slot.waiters.Front(); front != nil {
+				slot.waiters.Remove(front)
+				close(front.Value.(chan struct{}))
+				return
+			}
+			slot.inFlight--
+		})
+	}
+}
+
+// snapshot 返回所有有过限制的 provider / Key 的当前状态
+func (cl *concurrencyLimiter) snapshot() []ProviderConcurrency {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	result := make([]ProviderConcurrency, 0, len(cl.slots))
+	for _, slot := range cl.slots {
+		stat := ProviderConcurrency{
+			Platform:      slot.platform,
+			Provider:      slot.provider,
+			KeyIndex:      slot.keyIndex,
+			Limit:         slot.limit,
+			InFlight:      slot.inFlight,
+			Queued:        slot.waiters.Len(),
+			TotalQueued:   slot.totalQueued,
+			TotalSpilled:  slot.totalSpilled,
+			TotalTimeouts: slot.totalTimeouts,
+			MaxWaitSec:    slot.maxWait.Seconds(),
+		}
+		if slot.totalQueued > 0 {
+			stat.AvgWaitSec = slot.totalWait.Seconds() / float64(slot.totalQueued)
+		}
+		result = append(result, stat)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Platform != result[j].Platform {
+			return result[i].Platform < result[j].Platform
+		}
+		if result[i].Provider != result[j].Provider {
+			return result[i].Provider < result[j].Provider
+		}
+		return result[i].KeyIndex < result[j].KeyIndex
+	})
+	return result
+}
+
+// ConcurrencyStatus 返回各 provider / Key 的并发、排队状态和排队指标
+func (prs *ProviderRelayService) ConcurrencyStatus() []ProviderConcurrency {
+	return prs.limiter.snapshot()
+}
+
+// acquireProvider 为一次转发获取 provider 级和 Key 级并发名额
+// providerBusy 为 true 表示 provider 级名额获取失败（换 Key 也无济于事）
+func (prs *ProviderRelayService) acquireProvider(c *gin.Context, kind string, provider Provider, keyIndex int) (release func(), waited time.Duration, providerBusy bool, err error) {
+	ctx := c.Request.Context()
+	timeout := time.Duration(provider.QueueTimeoutSec) * time.Second
+
+	releaseProvider, waitProvider, err := prs.limiter.acquire(ctx, kind, provider.Name, -1, provider.MaxConcurrent, provider.QueueSize, timeout)
+	if err != nil {
+		return nil, waitProvider, true, err
+	}
+	releaseKey, waitKey, err := prs.limiter.acquire(ctx, kind, provider.Name, keyIndex, provider.MaxConcurrentPerKey, provider.QueueSize, timeout)
+	if err != nil {
+		releaseProvider()
+		return nil, waitProvider + waitKey, false, err
+	}
+	return func() {
+		releaseKey()
+		releaseProvider()
+	}, waitProvider + waitKey, false, nil
+}
+
+// queueWaitFrom 返回本次转发的排队时长（写入 request_log）
+func queueWaitFrom(c *gin.Context) float64 {
+	if c == nil {
+		return 0
+	}
+	return c.GetFloat64(queueWaitCtxKey)
+}
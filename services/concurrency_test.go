@@ -0,0 +1,46 @@
+package services
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRelayConcurrencyQueueAndSpill(t *testing.T) {
+	limited := mockProvider("concurrency-limited", "latency=300ms")
+	limited.MaxConcurrent = 1
+	limited.QueueSize = 1
+	limited.QueueTimeoutSec = 5
+	setProviders(t, "claude", limited, mockProvider("concurrency-spill", "default"))
+	setRoutePolicies(t, RoutePolicy{Name: "limited-first", Enabled: true, Match: RouteMatch{Route: "concurrency"}, PreferProviders: []string{"concurrency-limited"}})
+	headers := map[string]string{routeHeader: "concurrency"}
+
+	codes := make(chan int, 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			codes <- doRelay(t, nil, "/v1/messages", `{"model":"claude-sonnet-4"}`, headers).Code
+		}()
+		time.Sleep(30 * time.Millisecond)
+	}
+	for i := 0; i < 3; i++ {
+		if code := <-codes; code != http.StatusOK {
+			t.Fatalf("status = %d", code)
+		}
+	}
+
+	// 1 个直接执行、1 个排队、1 个因队列已满转到下一个 provider
+	limitedLogs := waitLogs(t, "claude", "concurrency-limited", 2)
+	waitLogs(t, "claude", "concurrency-spill", 1)
+	if limitedLogs[0].QueueWaitSec <= 0 {
+		t.Fatalf("queued request has no wait time: %+v", limitedLogs[0])
+	}
+	for _, stat := range testRelay.ConcurrencyStatus() {
+		if stat.Provider == "concurrency-limited" && stat.KeyIndex == -1 {
+			if stat.TotalQueued != 1 || stat.TotalSpilled != 1 || stat.InFlight != 0 {
+				t.Fatalf("unexpected concurrency stat: %+v", stat)
+			}
+			return
+		}
+	}
+	t.Fatal("no concurrency stat for limited provider")
+}
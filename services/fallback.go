@@ -0,0 +1,169 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 模型降级相关常量
+const (
+	fallbackConfigFile = "fallback-chains.json"
+	fallbackHeader     = "X-Code-Relay-Fallback-Model" // 响应头：实际提供服务的降级模型
+	fallbackCtxKey     = "relay.fallbackFrom"          // gin.Context 中记录原始请求模型的键
+)
+
+// FallbackChain 模型降级链：请求模型的所有 provider 均失败时依次改用 Models 重试
+// 例如 {"match": "claude-opus-*", "models": ["claude-sonnet-4-5", "claude-haiku-4-5"]}
+type FallbackChain struct {
+	Match  string   `json:"match"`  // 请求模型，支持通配符与 re: 正则
+	Models []string `json:"models"` // 按顺序尝试的降级模型
+}
+
+// fallbackStore 降级链配置的加载与缓存
+type fallbackStore struct {
+	mu     sync.RWMutex
+	path   string
+	loaded bool
+	chains map[string][]FallbackChain // key: 平台
+}
+
+func newFallbackStore() *fallbackStore {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		home = "."
+	}
+	return &fallbackStore{path: filepath.Join(home, ".code-relay", fallbackConfigFile)}
+}
+
+func (fs *fallbackStore) list(kind string) ([]FallbackChain, error) {
+	fs.mu.RLock()
+	if fs.loaded {
+		chains := append([]FallbackChain(nil), fs.chains[kind]...)
+		fs.mu.RUnlock()
+		return chains, nil
+	}
+	fs.mu.RUnlock()
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if !fs.loaded {
+		chains := map[string][]FallbackChain{}
+		data, err := os.ReadFile(fs.path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		if len(data) > 0 {
+			if err := json.Unmarshal(data, &chains); err != nil {
+				return nil, err
+			}
+		}
+		fs.chains = chains
+		fs.loaded = true
+	}
+	return append([]FallbackChain(nil), fs.chains[kind]...), nil
+}
+
+func (fs *fallbackStore) save(kind string, chains []FallbackChain) error {
+	if _, err := fs.list(kind); err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	all := make(map[string][]FallbackChain, len(fs.chains)+1)
+	for k, v := range fs.chains {
+		all[k] = v
+	}
+	all[kind] = append([]FallbackChain(nil), chains...)
+
+	if err := os.MkdirAll(filepath.Dir(fs.path), 0o755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(all, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := fs.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, fs.path); err != nil {
+		return err
+	}
+	fs.chains = all
+	return nil
+}
+
+// ListFallbackChains 返回指定平台的模型降级链（按匹配顺序）
+func (prs *ProviderRelayService) ListFallbackChains(kind string) ([]FallbackChain, error) {
+	return prs.fallbacks.list(strings.ToLower(kind))
+}
+
+// SaveFallbackChains 校验并保存指定平台的模型降级链，立即生效
+func (prs *ProviderRelayService) SaveFallbackChains(kind string, chains []FallbackChain) error {
+	for i := range chains {
+		chain := &chains[i]
+		chain.Match = strings.TrimSpace(chain.Match)
+		if chain.Match == "" {
+			return fmt.Errorf("降级链 %d: 匹配模型不能为空", i+1)
+		}
+		if isModelPattern(chain.Match) {
+			if _, err := compileModelPattern(chain.Match); err != nil {
+				return fmt.Errorf("降级链 %d: 匹配模式 %q 无效: %w", i+1, chain.Match, err)
+			}
+		}
+		models := make([]string, 0, len(chain.Models))
+		for _, model := range chain.Models {
+			if model = strings.TrimSpace(model); model != "" {
+				models = append(models, model)
+			}
+		}
+		if len(models) == 0 {
+			return fmt.Errorf("降级链 %d: 至少需要一个降级模型", i+1)
+		}
+		chain.Models = models
+	}
+	return prs.fallbacks.save(strings.ToLower(kind), chains)
+}
+
+// fallbackModels 返回依次尝试的模型：请求模型在前，其后为第一个命中的降级链（去重）
+func (prs *ProviderRelayService) fallbackModels(kind string, requestedModel string) []string {
+	models := []string{requestedModel}
+	if requestedModel == "" {
+		return models
+	}
+	chains, err := prs.fallbacks.list(kind)
+	if err != nil {
+		log.Printf("[Relay] 加载模型降级链失败: %v", err)
+		return models
+	}
+	for _, chain := range chains {
+		if !matchWildcard(chain.Match, requestedModel) {
+			continue
+		}
+		for _, model := range chain.Models {
+			if !containsFold(models, model) {
+				models = append(models, model)
+			}
+		}
+		break
+	}
+	return models
+}
+
+// fallbackFrom 返回降级前的原始请求模型（未降级时为空，写入 request_log）
+func fallbackFrom(c *gin.Context) string {
+	if c == nil {
+		return ""
+	}
+	return c.GetString(fallbackCtxKey)
+}
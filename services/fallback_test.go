@@ -0,0 +1,35 @@
+package services
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRelayFallbackChain(t *testing.T) {
+	opus := mockProvider("fallback-opus", "status=529")
+	opus.SupportedModels = map[string]bool{"claude-opus-*": true}
+	sonnet := mockProvider("fallback-sonnet", "default")
+	sonnet.SupportedModels = map[string]bool{"claude-sonnet-4": true}
+	setProviders(t, "claude", opus, sonnet)
+	if err := testRelay.SaveFallbackChains("claude", []FallbackChain{{Match: "claude-opus-*", Models: []string{"claude-missing", "claude-sonnet-4"}}}); err != nil {
+		t.Fatalf("SaveFallbackChains: %v", err)
+	}
+	t.Cleanup(func() { _ = testRelay.SaveFallbackChains("claude", nil) })
+
+	w := doRelay(t, nil, "/v1/messages", `{"model":"claude-opus-4"}`, nil)
+	if w.Code != http.StatusOK || w.Header().Get(fallbackHeader) != "claude-sonnet-4" {
+		t.Fatalf("status = %d, header = %q, body = %s", w.Code, w.Header().Get(fallbackHeader), w.Body.String())
+	}
+	logs := waitLogs(t, "claude", "fallback-sonnet", 1)
+	if logs[0].Model != "claude-sonnet-4" || logs[0].FallbackFrom != "claude-opus-4" {
+		t.Fatalf("unexpected log: %+v", logs[0])
+	}
+
+	// 请求本身有误（4xx）时不降级
+	opus.APIURL = "mock://status=400"
+	setProviders(t, "claude", opus, sonnet)
+	w = doRelay(t, nil, "/v1/messages", `{"model":"claude-opus-4"}`, nil)
+	if w.Code != http.StatusBadRequest || w.Header().Get(fallbackHeader) != "" {
+		t.Fatalf("status = %d, header = %q", w.Code, w.Header().Get(fallbackHeader))
+	}
+}
@@ -0,0 +1,490 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/daodao97/xgo/xdb"
+	"github.com/tidwall/gjson"
+)
+
+// 健康探测相关常量
+const (
+	MinProbeIntervalSec   = 30               // 最小探测间隔（秒），防止配置过小导致打爆上游
+	probeTickInterval     = 5 * time.Second  // 调度器检查周期
+	probeTimeout          = 30 * time.Second // 单次探测超时
+	probeFailureThreshold = 2                // 连续探测失败 N 轮后熔断
+)
+
+// 探测方式
+const (
+	ProbeModeRequest = "request"
+	ProbeModeModels  = "models"
+)
+
+// 各平台探测默认模型（provider 未配置任何模型时使用）
+var defaultProbeModels = map[string]string{
+	"claude": "claude-3-5-haiku-latest",
+	"codex":  "gpt-4o-mini",
+	"gemini": "gemini-2.0-flash",
+}
+
+// ProviderHealth 主动探测得到的 provider 健康状态
+type ProviderHealth struct {
+	Platform            string  `json:"platform"`
+	Provider            string  `json:"provider"`
+	LastProbeAt         string  `json:"last_probe_at"`
+	LastHttpCode        int     `json:"last_http_code"`
+	LastDurationSec     float64 `json:"last_duration_sec"`
+	LastError           string  `json:"last_error"`
+	ConsecutiveFailures int     `json:"consecutive_failures"`
+	CircuitOpen         bool    `json:"circuit_open"`
+}
+
+// healthProber 后台定时探测所有启用的 provider 及其每个未禁用的 Key
+// 探测结果写入 probe_log（与用户流量分开，不参与计费统计），并维护内存中的熔断状态
+type healthProber struct {
+	relay *ProviderRelayService
+
+	mu        sync.RWMutex
+	health    map[string]*ProviderHealth // key: platform:provider
+	nextProbe map[string]time.Time       // key: platform:provider
+	running   map[string]bool            // 正在探测中的 provider，避免重叠
+
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+func newHealthProber(relay *ProviderRelayService) *healthProber {
+	return &healthProber{
+		relay:     relay,
+		health:    make(map[string]*ProviderHealth),
+		nextProbe: make(map[string]time.Time),
+		running:   make(map[string]bool),
+	}
+}
+
+func healthKey(kind, provider string) string {
+	return kind + ":" + provider
+}
+
+func (hp *healthProber) Start() {
+	hp.mu.Lock()
+	if hp.stopCh != nil {
+		hp.mu.Unlock()
+		return
+	}
+	hp.stopCh = make(chan struct{})
+	stopCh := hp.stopCh
+	hp.mu.Unlock()
+
+	hp.wg.Add(1)
+	go func() {
+		defer hp.wg.Done()
+		ticker := time.NewTicker(probeTickInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopCh:
+				return
+			case <-ticker.C:
+				hp.runDue(stopCh)
+			}
+		}
+	}()
+}
+
+func (hp *healthProber) Stop() {
+	hp.mu.Lock()
+	if hp.stopCh == nil {
+		hp.mu.Unlock()
+		return
+	}
+	close(hp.stopCh)
+	hp.stopCh = nil
+	hp.mu.Unlock()
+	hp.wg.Wait()
+}
+
+// runDue 检查所有 provider，对到期的发起探测
+func (hp *healthProber) runDue(stopCh chan struct{}) {
+	now := time.Now()
+	for _, kind := range []string{"claude", "codex", "gemini"} {
+		providers, err := hp.relay.providerService.loadSealedProviders(kind)
+		if err != nil {
+			continue
+		}
+		for _, p := range providers {
+			if !p.Enabled || p.ProbeIntervalSec <= 0 || p.APIURL == "" || len(p.enabledKeyIndexes()) == 0 {
+				continue
+			}
+			key := healthKey(kind, p.Name)
+			hp.mu.Lock()
+			if hp.running[key] || now.Before(hp.nextProbe[key]) {
+				hp.mu.Unlock()
+				continue
+			}
+			interval := p.ProbeIntervalSec
+			if interval < MinProbeIntervalSec {
+				interval = MinProbeIntervalSec
+			}
+			hp.nextProbe[key] = now.Add(time.Duration(interval) * time.Second)
+			hp.running[key] = true
+			hp.mu.Unlock()
+
+			hp.wg.Add(1)
+			go func(kind string, provider Provider) {
+				defer hp.wg.Done()
+				defer func() {
+					hp.mu.Lock()
+					delete(hp.running, healthKey(kind, provider.Name))
+					hp.mu.Unlock()
+				}()
+				ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+				defer cancel()
+				go func() {
+					select {
+					case <-stopCh:
+						cancel()
+					case <-ctx.Done():
+					}
+				}()
+				hp.probeProvider(ctx, kind, provider)
+			}(kind, p)
+		}
+	}
+}
+
+// probeProvider 依次探测 provider 每个未禁用的 Key，任意 Key 成功即视为本轮健康
+// 本轮结果计入路由使用的滑动窗口成功率；Key 被限流或认证失败时按转发时的规则进入冷却，探测成功则解除冷却
+func (hp *healthProber) probeProvider(ctx context.Context, kind string, provider Provider) {
+	mode := strings.ToLower(strings.TrimSpace(provider.ProbeMode))
+	if mode == "" {
+		mode = ProbeModeRequest
+	}
+	model := probeModelFor(kind, provider)
+
+	roundOK := false
+	var last ProbeLog
+	keys := provider.GetAPIKeys()
+	for _, i := range hp.relay.keys.probeOrder(provider) {
+		apiKey := keys[i]
+		var result ProbeLog
+		if mode == ProbeModeModels {
+			result = hp.relay.probeModelsList(ctx, kind, provider, apiKey)
+		} else {
+			result = hp.relay.probeMinimalRequest(ctx, kind, provider, i, model)
+		}
+		result.Platform = kind
+		result.Provider = provider.Name
+		result.KeyIndex = i
+		result.Mode = mode
+		insertProbeLog(result)
+		if result.HttpCode >= 200 && result.HttpCode < 300 {
+			roundOK = true
+			hp.relay.keys.recovered(kind, provider, i)
+		} else {
+			hp.relay.keys.cooldown(kind, provider, i, result.HttpCode, nil)
+		}
+		last = result
+	}
+	if ctx.Err() != nil && !roundOK {
+		// 探测被停止或超时，不作为 provider 的健康结论
+		return
+	}
+
+	hp.recordRound(kind, provider.Name, roundOK, last)
+	if hp.relay.logService != nil {
+		code := last.HttpCode
+		if roundOK {
+			code = http.StatusOK
+		}
+		hp.relay.logService.success.observe(kind, provider.Name, code)
+	}
+}
+
+// recordRound 根据一轮探测结果更新熔断状态
+func (hp *healthProber) recordRound(kind, provider string, ok bool, last ProbeLog) {
+	key := healthKey(kind, provider)
+	hp.mu.Lock()
+	defer hp.mu.Unlock()
+
+	h := hp.health[key]
+	if h == nil {
+		h = &ProviderHealth{Platform: kind, Provider: provider}
+		hp.health[key] = h
+	}
+	h.LastProbeAt = time.Now().Format(timeLayout)
+	h.LastHttpCode = last.HttpCode
+	h.LastDurationSec = last.DurationSec
+	h.LastError = last.Error
+	if ok {
+		if h.CircuitOpen {
+			log.Printf("[Probe] %s/%s 探测恢复，关闭熔断", kind, provider)
+		}
+		h.ConsecutiveFailures = 0
+		h.CircuitOpen = false
+		return
+	}
+	h.ConsecutiveFailures++
+	if !h.CircuitOpen && h.ConsecutiveFailures >= probeFailureThreshold {
+		h.CircuitOpen = true
+		log.Printf("[Probe] %s/%s 连续 %d 轮探测失败，熔断（最后状态: %d %s）",
+			kind, provider, h.ConsecutiveFailures, last.HttpCode, last.Error)
+	}
+}
+
+// isCircuitOpen 判断 provider 是否被探测熔断
+func (hp *healthProber) isCircuitOpen(kind, provider string) bool {
+	hp.mu.RLock()
+	defer hp.mu.RUnlock()
+	h := hp.health[healthKey(kind, provider)]
+	return h != nil && h.CircuitOpen
+}
+
+// applyHealth 将被熔断的 provider 权重降为 0 并移到末尾（保持其余顺序不变）
+func (hp *healthProber) applyHealth(kind string, weighted []weightedProvider) []weightedProvider {
+	healthy := make([]weightedProvider, 0, len(weighted))
+	tripped := make([]weightedProvider, 0)
+	for _, wp := range weighted {
+		if hp.isCircuitOpen(kind, wp.provider.Name) {
+			wp.weight = 0
+			tripped = append(tripped, wp)
+			continue
+		}
+		healthy = append(healthy, wp)
+	}
+	return append(healthy, tripped...)
+}
+
+// Snapshot 返回当前所有 provider 的探测健康状态
+func (hp *healthProber) Snapshot() []ProviderHealth {
+	hp.mu.RLock()
+	defer hp.mu.RUnlock()
+	result := make([]ProviderHealth, 0, len(hp.health))
+	for _, h := range hp.health {
+		result = append(result, *h)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Platform == result[j].Platform {
+			return result[i].Provider < result[j].Provider
+		}
+		return result[i].Platform < result[j].Platform
+	})
+	return result
+}
+
+// HealthStatus 返回主动探测得到的 provider 健康状态
+func (prs *ProviderRelayService) HealthStatus() []ProviderHealth {
+	return prs.prober.Snapshot()
+}
+
+// probeModelFor 选取探测使用的模型（返回映射后的实际模型名）
+// 优先级：ProbeModel > modelMapping 中的精确 key > supportedModels 中的精确模型 > 平台默认
+func probeModelFor(kind string, p Provider) string {
+	candidate := strings.TrimSpace(p.ProbeModel)
+	if candidate == "" {
+		candidate = firstLiteralModel(mapKeys(p.ModelMapping))
+	}
+	if candidate == "" {
+		candidate = firstLiteralModel(boolMapKeys(p.SupportedModels))
+	}
+	if candidate == "" {
+		candidate = defaultProbeModels[kind]
+	}
+	return p.GetEffectiveModel(candidate)
+}
+
+func firstLiteralModel(models []string) string {
+	sort.Strings(models)
+	for _, m := range models {
+		if m != "" && !isModelPattern(m) {
+			return m
+		}
+	}
+	return ""
+}
+
+func mapKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func boolMapKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k, v := range m {
+		if v {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// probeEndpointAndBody 返回各平台最小请求的端点和请求体
+func probeEndpointAndBody(kind string, model string) (string, []byte) {
+	switch kind {
+	case "codex":
+		return "/responses", []byte(fmt.Sprintf(`{"model":%q,"input":"ping","max_output_tokens":16,"stream":false}`, model))
+	case "gemini":
+		return "/v1/chat/completions", []byte(fmt.Sprintf(`{"model":%q,"max_tokens":1,"stream":false,"messages":[{"role":"user","content":"ping"}]}`, model))
+	default:
+		return "/v1/messages", []byte(fmt.Sprintf(`{"model":%q,"max_tokens":1,"stream":false,"messages":[{"role":"user","content":"ping"}]}`, model))
+	}
+}
+
+// probeMinimalRequest 通过正常转发路径发送一个最小请求，结果不写入 request_log
+func (prs *ProviderRelayService) probeMinimalRequest(ctx context.Context, kind string, provider Provider, keyIndex int, model string) ProbeLog {
+	endpoint, body := probeEndpointAndBody(kind, model)
+	result := ProbeLog{Model: model}
+
+	var attempt *RequestLog
+	c := newInternalContext(ctx, endpoint, func(rl *RequestLog) { attempt = rl })
+	status, _, respBody, err := prs.forwardRequestWithKey(c, kind, provider, keyIndex, endpoint, nil, map[string]string{}, body, false, model)
+	if attempt != nil {
+		result.DurationSec = attempt.DurationSec
+	}
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.HttpCode = status
+	if status < 200 || status >= 300 {
+		result.Error = upstreamErrorMessage(respBody)
+	}
+	return result
+}
+
+// probeModelsList 请求上游模型列表接口（GET /v1/models）
+func (prs *ProviderRelayService) probeModelsList(ctx context.Context, kind string, provider Provider, apiKey string) ProbeLog {
+	result := ProbeLog{}
+	start := time.Now()
+	status, body, err := getUpstream(ctx, kind, provider, apiKey, "/v1/models")
+	result.DurationSec = time.Since(start).Seconds()
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.HttpCode = status
+	if status < 200 || status >= 300 {
+		result.Error = upstreamErrorMessage(body)
+	}
+	return result
+}
+
+// getUpstream 以 provider 的认证方式向上游发送 GET 请求
+func getUpstream(ctx context.Context, kind string, provider Provider, apiKey string, endpoint string) (int, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, joinURL(provider.APIURL, endpoint), nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	apiKey, err = revealSecret(apiKey)
+	if err != nil {
+		return 0, nil, err
+	}
+	if kind == "gemini" && strings.HasPrefix(endpoint, "/v1beta/") {
+		// Gemini 原生接口使用 x-goog-api-key 认证，携带 Bearer 会被当作 OAuth 令牌拒绝
+		req.Header.Set("x-goog-api-key", apiKey)
+	} else {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", apiKey))
+		req.Header.Set("x-api-key", apiKey)
+	}
+	if kind == "claude" {
+		req.Header.Set("anthropic-version", "2023-06-01")
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4<<20))
+	if err != nil {
+		return resp.StatusCode, nil, err
+	}
+	return resp.StatusCode, body, nil
+}
+
+// upstreamErrorMessage 从上游错误响应中提取可读的错误信息
+func upstreamErrorMessage(body []byte) string {
+	for _, path := range []string{"error.message", "message", "error", "detail"} {
+		if v := gjson.GetBytes(body, path); v.Exists() && v.Type == gjson.String {
+			return truncateString(v.String(), 500)
+		}
+	}
+	return truncateString(strings.TrimSpace(string(body)), 500)
+}
+
+func truncateString(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	return s[:max] + "..."
+}
+
+// ProbeLog 一条主动探测记录（独立于 request_log，不参与计费统计）
+type ProbeLog struct {
+	ID          int64   `json:"id"`
+	Platform    string  `json:"platform"`
+	Provider    string  `json:"provider"`
+	KeyIndex    int     `json:"key_index"`
+	Mode        string  `json:"mode"`
+	Model       string  `json:"model"`
+	HttpCode    int     `json:"http_code"`
+	DurationSec float64 `json:"duration_sec"`
+	Error       string  `json:"error"`
+	CreatedAt   string  `json:"created_at"`
+}
+
+func insertProbeLog(pl ProbeLog) {
+	if _, err := xdb.New("probe_log").Insert(xdb.Record{
+		"platform":     pl.Platform,
+		"provider":     pl.Provider,
+		"key_index":    pl.KeyIndex,
+		"mode":         pl.Mode,
+		"model":        pl.Model,
+		"http_code":    pl.HttpCode,
+		"duration_sec": pl.DurationSec,
+		"error":        pl.Error,
+		"created_at":   time.Now().Format(timeLayout),
+	}); err != nil {
+		log.Printf("[Probe] 写入 probe_log 失败: %v", err)
+	}
+}
+
+func ensureProbeLogTable() error {
+	db, err := xdb.DB("default")
+	if err != nil {
+		return err
+	}
+	return ensureProbeLogTableWithDB(db)
+}
+
+func ensureProbeLogTableWithDB(db *sql.DB) error {
+	const createTableSQL = `CREATE TABLE IF NOT EXISTS probe_log (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		platform TEXT,
+		provider TEXT,
+		key_index INTEGER DEFAULT 0,
+		mode TEXT,
+		model TEXT,
+		http_code INTEGER,
+		duration_sec REAL DEFAULT 0,
+		error TEXT,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	)`
+	if _, err := db.Exec(createTableSQL); err != nil {
+		return err
+	}
+	_, err := db.Exec("CREATE INDEX IF NOT EXISTS idx_probe_log_provider ON probe_log(platform, provider, id)")
+	return err
+}
@@ -0,0 +1,57 @@
+package services
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/daodao97/xgo/xdb"
+)
+
+func TestProbeSkipsDisabledKeysAndFeedsRouting(t *testing.T) {
+	p := mockProvider("probe-keys", "default", "mock:status=401", "mock:ok", "mock:status=500")
+	p.DisabledKeys = []int{2}
+
+	testRelay.prober.probeProvider(context.Background(), "claude", p)
+
+	records, err := xdb.New("probe_log").Selects(xdb.WhereEq("provider", "probe-keys"), xdb.Field("key_index"))
+	if err != nil {
+		t.Fatalf("select probe_log: %v", err)
+	}
+	var probed []int
+	for _, record := range records {
+		probed = append(probed, record.GetInt("key_index"))
+	}
+	slices.Sort(probed)
+	if !slices.Equal(probed, []int{0, 1}) {
+		t.Fatalf("probed keys = %v, want [0 1]", probed)
+	}
+
+	// 认证失败的 Key 进入冷却，排在可用 Key 之后
+	if order := testRelay.keys.order("claude", p); !slices.Equal(order, []int{1, 0}) {
+		t.Fatalf("key order after probe = %v", order)
+	}
+
+	rates, counts := testLogSvc.success.rates("claude")
+	if counts["probe-keys"] != 1 || rates["probe-keys"] != 1 {
+		t.Fatalf("probe not recorded in success window: rate=%v count=%d", rates["probe-keys"], counts["probe-keys"])
+	}
+}
+
+func TestProbeFailedRoundLowersSuccessRate(t *testing.T) {
+	p := mockProvider("probe-down", "status=503", "k1", "k2")
+
+	testRelay.prober.probeProvider(context.Background(), "codex", p)
+
+	rates, counts := testLogSvc.success.rates("codex")
+	if counts["probe-down"] != 1 || rates["probe-down"] != 0 {
+		t.Fatalf("rate=%v count=%d", rates["probe-down"], counts["probe-down"])
+	}
+	if testRelay.prober.isCircuitOpen("codex", "probe-down") {
+		t.Fatal("circuit opened after a single failed round")
+	}
+	testRelay.prober.probeProvider(context.Background(), "codex", p)
+	if !testRelay.prober.isCircuitOpen("codex", "probe-down") {
+		t.Fatal("circuit not opened after consecutive failed rounds")
+	}
+}
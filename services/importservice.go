@@ -537,7 +537,7 @@ func (is *ImportService) importProviders(cfg *ccSwitchConfig, pending map[string
 }
 
 func (is *ImportService) saveProviders(kind string, candidates []providerCandidate) (int, error) {
-	existing, err := is.providerService.LoadProviders(kind)
+	existing, err := is.providerService.loadSealedProviders(kind)
 	if err != nil {
 		return 0, err
 	}
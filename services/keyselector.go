@@ -0,0 +1,250 @@
+package services
+
+import (
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Key 选择策略
+const (
+	KeyStrategySequential = "sequential"  // 默认：每次从第一个 Key 开始
+	KeyStrategyRoundRobin = "round-robin" // 跨请求轮询
+	KeyStrategyLRU        = "lru"         // 最久未使用优先
+	KeyStrategyWeighted   = "weighted"    // 按 keyWeights（配额）加权随机
+	KeyStrategyRandom     = "random"      // 随机
+)
+
+// Key 冷却时长
+const (
+	keyCooldownRateLimit = 60 * time.Second // 429 且无 Retry-After 时的默认冷却
+	keyCooldownAuth      = 5 * time.Minute  // 401/403 认证失败后的冷却
+	keyCooldownMax       = 10 * time.Minute // Retry-After 的上限
+)
+
+// keyState 单个 provider 的 Key 选择状态（仅内存，重启后重置）
+type keyState struct {
+	numKeys       int
+	cursor        int
+	lastUsed      []time.Time
+	cooldownUntil []time.Time
+}
+
+// keySelector 维护所有 provider 的 Key 游标、使用时间和冷却状态
+type keySelector struct {
+	mu     sync.Mutex
+	states map[string]*keyState // key: platform:provider
+	rnd    *rand.Rand
+}
+
+func newKeySelector() *keySelector {
+	return &keySelector{
+		states: make(map[string]*keyState),
+		rnd:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// stateLocked 获取（必要时重建）provider 的状态；Key 数量变化时重置
+func (ks *keySelector) stateLocked(kind, provider string, numKeys int) *keyState {
+	key := healthKey(kind, provider)
+	st := ks.states[key]
+	if st == nil || st.numKeys != numKeys {
+		st = &keyState{
+			numKeys:       numKeys,
+			lastUsed:      make([]time.Time, numKeys),
+			cooldownUntil: make([]time.Time, numKeys),
+		}
+		ks.states[key] = st
+	}
+	return st
+}
+
+// order 按 provider 的策略返回本次请求尝试 Key 的顺序（Key 下标）
+// 已禁用的 Key 被排除；冷却中的 Key 排在最后，仅在没有其他 Key 可用时尝试
+func (ks *keySelector) order(kind string, provider Provider) []int {
+	numKeys := len(provider.GetAPIKeys())
+	candidates := provider.enabledKeyIndexes()
+	if len(candidates) == 0 {
+		return candidates
+	}
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	st := ks.stateLocked(kind, provider.Name, numKeys)
+
+	ordered := make([]int, 0, len(candidates))
+	switch normalizeKeyStrategy(provider.KeyStrategy) {
+	case KeyStrategyRoundRobin:
+		start := st.cursor % len(candidates)
+		st.cursor = (st.cursor + 1) % len(candidates)
+		for i := range candidates {
+			ordered = append(ordered, candidates[(start+i)%len(candidates)])
+		}
+	case KeyStrategyLRU:
+		ordered = append(ordered, candidates...)
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return st.lastUsed[ordered[i]].Before(st.lastUsed[ordered[j]])
+		})
+	case KeyStrategyWeighted:
+		ordered = ks.weightedShuffleLocked(candidates, provider.KeyWeights)
+	case KeyStrategyRandom:
+		ordered = append(ordered, candidates...)
+		ks.rnd.Shuffle(len(ordered), func(i, j int) {
+			ordered[i], ordered[j] = ordered[j], ordered[i]
+		})
+	default:
+		ordered = append(ordered, candidates...)
+	}
+
+	// 冷却中的 Key 移到末尾
+	now := time.Now()
+	ready := make([]int, 0, len(ordered))
+	cooling := make([]int, 0)
+	for _, idx := range ordered {
+		if now.Before(st.cooldownUntil[idx]) {
+			cooling = append(cooling, idx)
+			continue
+		}
+		ready = append(ready, idx)
+	}
+	return append(ready, cooling...)
+}
+
+// weightedShuffleLocked 按权重做不放回抽样，权重高的 Key 更可能排在前面
+func (ks *keySelector) weightedShuffleLocked(candidates []int, weights []int) []int {
+	remaining := append([]int(nil), candidates...)
+	ordered := make([]int, 0, len(candidates))
+	weightOf := func(idx int) int {
+		if idx < len(weights) && weights[idx] > 0 {
+			return weights[idx]
+		}
+		return 1
+	}
+	for len(remaining) > 0 {
+		total := 0
+		for _, idx := range remaining {
+			total += weightOf(idx)
+		}
+		pick := ks.rnd.Intn(total)
+		chosen := 0
+		for i, idx := range remaining {
+			pick -= weightOf(idx)
+			if pick < 0 {
+				chosen = i
+				break
+			}
+		}
+		ordered = append(ordered, remaining[chosen])
+		remaining = append(remaining[:chosen], remaining[chosen+1:]...)
+	}
+	return ordered
+}
+
+// probeOrder 返回主动探测要检查的 Key：所有未禁用的 Key（包括冷却中的，探测用于发现其是否已恢复），
+// 不推进轮询游标，也不记录使用时间
+func (ks *keySelector) probeOrder(provider Provider) []int {
+	return provider.enabledKeyIndexes()
+}
+
+// markUsed 记录 Key 的使用时间（用于 LRU）
+func (ks *keySelector) markUsed(kind string, provider Provider, idx int) {
+	numKeys := len(provider.GetAPIKeys())
+	if idx < 0 || idx >= numKeys {
+		return
+	}
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.stateLocked(kind, provider.Name, numKeys).lastUsed[idx] = time.Now()
+}
+
+// cooldown 根据上游状态码让 Key 进入冷却
+func (ks *keySelector) cooldown(kind string, provider Provider, idx int, status int, headers http.Header) {
+	var d time.Duration
+	switch status {
+	case http.StatusTooManyRequests:
+		d = retryAfter(headers)
+		if d <= 0 {
+			d = keyCooldownRateLimit
+		}
+	case http.StatusUnauthorized, http.StatusForbidden:
+		d = keyCooldownAuth
+	default:
+		return
+	}
+	if d > keyCooldownMax {
+		d = keyCooldownMax
+	}
+
+	numKeys := len(provider.GetAPIKeys())
+	if idx < 0 || idx >= numKeys {
+		return
+	}
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.stateLocked(kind, provider.Name, numKeys).cooldownUntil[idx] = time.Now().Add(d)
+}
+
+// recovered 清除 Key 的冷却（主动探测确认其已恢复）
+func (ks *keySelector) recovered(kind string, provider Provider, idx int) {
+	numKeys := len(provider.GetAPIKeys())
+	if idx < 0 || idx >= numKeys {
+		return
+	}
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.stateLocked(kind, provider.Name, numKeys).cooldownUntil[idx] = time.Time{}
+}
+
+// retryAfter 解析 Retry-After 头（秒数或 HTTP 日期）
+func retryAfter(headers http.Header) time.Duration {
+	if headers == nil {
+		return 0
+	}
+	v := strings.TrimSpace(headers.Get("Retry-After"))
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+func normalizeKeyStrategy(strategy string) string {
+	switch strings.ToLower(strings.TrimSpace(strategy)) {
+	case KeyStrategyRoundRobin, "roundrobin", "rr":
+		return KeyStrategyRoundRobin
+	case KeyStrategyLRU:
+		return KeyStrategyLRU
+	case KeyStrategyWeighted:
+		return KeyStrategyWeighted
+	case KeyStrategyRandom:
+		return KeyStrategyRandom
+	default:
+		return KeyStrategySequential
+	}
+}
+
+// enabledKeyIndexes 返回未被禁用的 Key 下标
+func (p *Provider) enabledKeyIndexes() []int {
+	keys := p.GetAPIKeys()
+	disabled := make(map[int]bool, len(p.DisabledKeys))
+	for _, idx := range p.DisabledKeys {
+		disabled[idx] = true
+	}
+	indexes := make([]int, 0, len(keys))
+	for i, key := range keys {
+		if key == "" || disabled[i] {
+			continue
+		}
+		indexes = append(indexes, i)
+	}
+	return indexes
+}
@@ -0,0 +1,75 @@
+package services
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestKeySelectorOrder(t *testing.T) {
+	ks := newKeySelector()
+	p := Provider{Name: "ks", APIKeys: []string{"k0", "k1", "", "k3"}, DisabledKeys: []int{3}}
+
+	// 空 Key 与禁用的 Key 不参与选择
+	if got := ks.order("claude", p); !slices.Equal(got, []int{0, 1}) {
+		t.Fatalf("sequential order = %v", got)
+	}
+
+	p.KeyStrategy = KeyStrategyRoundRobin
+	var firsts []int
+	for i := 0; i < 4; i++ {
+		firsts = append(firsts, ks.order("claude", p)[0])
+	}
+	if !slices.Equal(firsts, []int{0, 1, 0, 1}) {
+		t.Fatalf("round-robin starts = %v", firsts)
+	}
+
+	p.KeyStrategy = KeyStrategyLRU
+	ks.markUsed("claude", p, 0)
+	if got := ks.order("claude", p); !slices.Equal(got, []int{1, 0}) {
+		t.Fatalf("lru order = %v", got)
+	}
+}
+
+func TestKeySelectorCooldown(t *testing.T) {
+	ks := newKeySelector()
+	p := Provider{Name: "ks-cooldown", APIKeys: []string{"k0", "k1", "k2"}}
+
+	ks.cooldown("codex", p, 0, http.StatusTooManyRequests, http.Header{"Retry-After": {"120"}})
+	ks.cooldown("codex", p, 1, http.StatusInternalServerError, nil)
+	if got := ks.order("codex", p); !slices.Equal(got, []int{1, 2, 0}) {
+		t.Fatalf("order with cooling key = %v", got)
+	}
+	ks.mu.Lock()
+	until := ks.states[healthKey("codex", "ks-cooldown")].cooldownUntil[0]
+	ks.mu.Unlock()
+	if d := time.Until(until); d < 110*time.Second || d > 120*time.Second {
+		t.Fatalf("Retry-After cooldown = %v", d)
+	}
+
+	ks.recovered("codex", p, 0)
+	if got := ks.order("codex", p); !slices.Equal(got, []int{0, 1, 2}) {
+		t.Fatalf("order after recovery = %v", got)
+	}
+
+	// 禁用全部 Key 时没有可用 Key
+	p.DisabledKeys = []int{0, 1, 2}
+	if got := ks.order("codex", p); len(got) != 0 {
+		t.Fatalf("all disabled order = %v", got)
+	}
+}
+
+func TestRelayLogsAttemptedKeyIndex(t *testing.T) {
+	// 相同的 Key 出现两次时，日志仍按实际尝试的下标记录
+	setProviders(t, "claude", mockProvider("key-index", "default", "mock:status=401", "mock:status=401", "mock:ok"))
+
+	w := doRelay(t, nil, "/v1/messages", `{"model":"claude-sonnet-4"}`, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	attempts := attemptCodes(waitLogs(t, "claude", "key-index", 3))
+	if attempts[0] != "401" || attempts[1] != "401" || attempts[2] != "200" {
+		t.Fatalf("unexpected attempts: %v", attempts)
+	}
+}
@@ -0,0 +1,236 @@
+package services
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/daodao97/xgo/xdb"
+)
+
+// LatencyPercentiles 一组样本的分位数
+type LatencyPercentiles struct {
+	Samples int     `json:"samples"`
+	Avg     float64 `json:"avg"`
+	P50     float64 `json:"p50"`
+	P90     float64 `json:"p90"`
+	P99     float64 `json:"p99"`
+}
+
+// LatencyStat 某个 provider + 模型成功请求的延迟与吞吐分位数
+type LatencyStat struct {
+	Platform  string             `json:"platform"`
+	Provider  string             `json:"provider"`
+	Model     string             `json:"model"`
+	Requests  int64              `json:"requests"`   // 成功请求数
+	TTFB      LatencyPercentiles `json:"ttfb"`       // 首字节时间（秒）
+	Total     LatencyPercentiles `json:"total"`      // 总耗时（秒）
+	OutputTPS LatencyPercentiles `json:"output_tps"` // 输出速度（tokens/秒）
+}
+
+// latencySamples 收集一组请求的延迟样本
+type latencySamples struct {
+	ttfb  []float64
+	total []float64
+	tps   []float64
+}
+
+func (s *latencySamples) add(rl *RequestLog) {
+	if rl.TTFBSec > 0 {
+		s.ttfb = append(s.ttfb, rl.TTFBSec)
+	}
+	if rl.TotalSec > 0 {
+		s.total = append(s.total, rl.TotalSec)
+	}
+	if tps := outputTPS(rl); tps > 0 {
+		s.tps = append(s.tps, tps)
+	}
+}
+
+// outputTPS 计算输出速度：流式请求按首字节之后的生成时间计算，非流式按总耗时计算
+func outputTPS(rl *RequestLog) float64 {
+	if rl.OutputTokens <= 0 || rl.TotalSec <= 0 {
+		return 0
+	}
+	elapsed := rl.TotalSec
+	if rl.IsStream && rl.TTFBSec > 0 && rl.TotalSec > rl.TTFBSec {
+		elapsed = rl.TotalSec - rl.TTFBSec
+	}
+	return float64(rl.OutputTokens) / elapsed
+}
+
+// percentiles 计算样本的平均值与 p50 / p90 / p99（最近秩法），会对 values 排序
+func percentiles(values []float64) LatencyPercentiles {
+	if len(values) == 0 {
+		return LatencyPercentiles{}
+	}
+	sort.Float64s(values)
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	rank := func(p float64) float64 {
+		i := int(math.Ceil(p*float64(len(values)))) - 1
+		return values[max(i, 0)]
+	}
+	return LatencyPercentiles{
+		Samples: len(values),
+		Avg:     sum / float64(len(values)),
+		P50:     rank(0.5),
+		P90:     rank(0.9),
+		P99:     rank(0.99),
+	}
+}
+
+func (s *latencySamples) stat() (ttfb, total, tps LatencyPercentiles) {
+	return percentiles(s.ttfb), percentiles(s.total), percentiles(s.tps)
+}
+
+// successfulLatencyLogs 读取时间范围内成功请求的耗时字段（只覆盖原始日志保留期内的数据）
+func successfulLatencyLogs(query StatsQuery) ([]RequestLog, error) {
+	options := []xdb.Option{
+		xdb.WhereGte("created_at", query.Start.Format(timeLayout)),
+		xdb.WhereLt("created_at", query.End.Format(timeLayout)),
+		xdb.WhereGte("http_code", 200),
+		xdb.WhereLt("http_code", 300),
+		xdb.Field("platform", "provider", "model", "is_stream", "output_tokens", "duration_sec", "ttfb_sec", "total_sec"),
+	}
+	if query.Platform != "" {
+		options = append(options, xdb.WhereEq("platform", query.Platform))
+	}
+	if query.Provider != "" {
+		options = append(options, xdb.WhereEq("provider", query.Provider))
+	}
+	if query.Model != "" && !isModelPattern(query.Model) {
+		options = append(options, xdb.WhereEq("model", query.Model))
+	}
+	if query.Client != "" {
+		options = append(options, xdb.WhereEq("client", query.Client))
+	}
+	records, err := xdb.New("request_log").Selects(options...)
+	if err != nil {
+		if errors.Is(err, xdb.ErrNotFound) || isNoSuchTableErr(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	logs := make([]RequestLog, 0, len(records))
+	for _, record := range records {
+		rl := RequestLog{
+			Platform:     record.GetString("platform"),
+			Provider:     record.GetString("provider"),
+			Model:        record.GetString("model"),
+			IsStream:     record.GetBool("is_stream"),
+			OutputTokens: record.GetInt("output_tokens"),
+			DurationSec:  record.GetFloat64("duration_sec"),
+			TTFBSec:      record.GetFloat64("ttfb_sec"),
+			TotalSec:     record.GetFloat64("total_sec"),
+		}
+		if query.Model != "" && !matchWildcard(query.Model, rl.Model) {
+			continue
+		}
+		// 旧数据没有单独的首字节时间，成功请求的 duration_sec 即为首字节时间
+		if rl.TTFBSec == 0 {
+			rl.TTFBSec = rl.DurationSec
+		}
+		logs = append(logs, rl)
+	}
+	return logs, nil
+}
+
+// LatencyStats 按 provider + 模型统计成功请求的首字节时间、总耗时和输出速度分位数，
+// 按请求数降序；筛选条件同 Stats（状态分类与分组维度不适用）
+func (ls *LogService) LatencyStats(query StatsQuery) ([]LatencyStat, error) {
+	query.StatusClass, query.GroupBy = "", ""
+	query, err := normalizeStatsQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	logs, err := successfulLatencyLogs(query)
+	if err != nil {
+		return nil, err
+	}
+
+	type latencyKey struct{ platform, provider, model string }
+	groups := map[latencyKey]*latencySamples{}
+	counts := map[latencyKey]int64{}
+	for i := range logs {
+		rl := &logs[i]
+		key := latencyKey{rl.Platform, rl.Provider, rl.Model}
+		if groups[key] == nil {
+			groups[key] = &latencySamples{}
+		}
+		groups[key].add(rl)
+		counts[key]++
+	}
+
+	stats := make([]LatencyStat, 0, len(groups))
+	for key, samples := range groups {
+		stat := LatencyStat{Platform: key.platform, Provider: key.provider, Model: key.model, Requests: counts[key]}
+		stat.TTFB, stat.Total, stat.OutputTPS = samples.stat()
+		stats = append(stats, stat)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Requests != stats[j].Requests {
+			return stats[i].Requests > stats[j].Requests
+		}
+		if stats[i].Provider != stats[j].Provider {
+			return stats[i].Provider < stats[j].Provider
+		}
+		return stats[i].Model < stats[j].Model
+	})
+	return stats, nil
+}
+
+// providerLatencyTTL 今日 provider 延迟分位数的缓存时长（分位数需要读取原始日志，面板频繁刷新时避免重复扫描）
+const providerLatencyTTL = time.Minute
+
+// latencyCache 缓存各平台 provider 的延迟分位数
+type latencyCache struct {
+	mu      sync.Mutex
+	entries map[string]*latencyCacheEntry // key: 平台
+}
+
+type latencyCacheEntry struct {
+	since     time.Time
+	updatedAt time.Time
+	stats     map[string]LatencyStat // key: provider
+}
+
+func newLatencyCache() *latencyCache {
+	return &latencyCache{entries: make(map[string]*latencyCacheEntry)}
+}
+
+// providerPercentiles 返回 since 之后各 provider 成功请求的延迟分位数，缓存 providerLatencyTTL
+func (lc *latencyCache) providerPercentiles(platform string, since time.Time) (map[string]LatencyStat, error) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if cached := lc.entries[platform]; cached != nil && cached.since.Equal(since) && time.Since(cached.updatedAt) < providerLatencyTTL {
+		return cached.stats, nil
+	}
+
+	logs, err := successfulLatencyLogs(StatsQuery{Start: since, End: time.Now().Add(time.Minute), Platform: platform})
+	if err != nil {
+		return nil, err
+	}
+	samples := map[string]*latencySamples{}
+	counts := map[string]int64{}
+	for i := range logs {
+		provider := logs[i].Provider
+		if samples[provider] == nil {
+			samples[provider] = &latencySamples{}
+		}
+		samples[provider].add(&logs[i])
+		counts[provider]++
+	}
+	stats := make(map[string]LatencyStat, len(samples))
+	for provider, s := range samples {
+		stat := LatencyStat{Platform: platform, Provider: provider, Requests: counts[provider]}
+		stat.TTFB, stat.Total, stat.OutputTPS = s.stat()
+		stats[provider] = stat
+	}
+	lc.entries[platform] = &latencyCacheEntry{since: since, updatedAt: time.Now(), stats: stats}
+	return stats, nil
+}
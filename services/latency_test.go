@@ -0,0 +1,44 @@
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLatencyPercentiles(t *testing.T) {
+	ls := newTestLogService(t)
+	for i := 1; i <= 10; i++ {
+		rl := RequestLog{Platform: "latency-test", Provider: "latency-a", Model: "claude-sonnet-4", HttpCode: 200, IsStream: true,
+			OutputTokens: 100, DurationSec: float64(i) / 10, TTFBSec: float64(i) / 10, TotalSec: float64(i)/10 + 2}
+		ls.writeRequestLog(&rl, nil)
+	}
+	// 一次超时不计入成功请求的分位数
+	timeout := RequestLog{Platform: "latency-test", Provider: "latency-a", Model: "claude-sonnet-4", HttpCode: 0, DurationSec: 60, TotalSec: 60}
+	ls.writeRequestLog(&timeout, nil)
+	waitLogs(t, "latency-test", "", 11)
+
+	stats, err := ls.LatencyStats(StatsQuery{Start: time.Now().Add(-time.Hour), End: time.Now().Add(time.Minute), Platform: "latency-test"})
+	if err != nil {
+		t.Fatalf("LatencyStats: %v", err)
+	}
+	if len(stats) != 1 || stats[0].Requests != 10 {
+		t.Fatalf("unexpected latency stats: %+v", stats)
+	}
+	s := stats[0]
+	if s.TTFB.P50 != 0.5 || s.TTFB.P90 != 0.9 || s.TTFB.P99 != 1 || s.Total.P50 != 2.5 || s.OutputTPS.P50 != 50 {
+		t.Fatalf("unexpected percentiles: %+v", s)
+	}
+
+	providers, err := ls.ProviderDailyStats("latency-test")
+	if err != nil {
+		t.Fatalf("ProviderDailyStats: %v", err)
+	}
+	if len(providers) != 1 || providers[0].TTFB.Samples != 10 || providers[0].TTFB.P90 != 0.9 || providers[0].MaxDurationSec != 60 {
+		t.Fatalf("unexpected provider stats: %+v", providers)
+	}
+
+	logs, err := ls.ListRequestLogs("latency-test", "", 1)
+	if err != nil || len(logs) != 1 || logs[0].TotalSec != 60 || logs[0].TTFBSec != 0 || logs[0].OutputTPS != 0 {
+		t.Fatalf("ListRequestLogs: %v %+v", err, logs)
+	}
+}
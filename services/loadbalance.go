@@ -0,0 +1,314 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 负载均衡模式：决定首个尝试的 provider 如何选取，之后的故障转移顺序不变
+const (
+	BalanceModePriority = "priority" // 默认：严格按权重排序，排第一的 provider 承接全部流量
+	BalanceModeWeighted = "weighted" // 按 provider 配置的 trafficWeight 比例分配
+	BalanceModeQuota    = "quota"    // 按本月剩余额度（monthlyQuota - 已用费用）比例分配
+	BalanceModeLatency  = "latency"  // 按最近一小时平均耗时的倒数比例分配
+
+	balanceConfigFile   = "balance.json"
+	balanceStatsTTL     = 30 * time.Second
+	balanceLatencyRange = time.Hour
+)
+
+// BalanceConfig 单个平台的负载均衡配置
+type BalanceConfig struct {
+	Mode string `json:"mode"`
+}
+
+// balanceStats 某平台用于计算分配比例的统计（带缓存）
+type balanceStats struct {
+	spend     map[string]float64 // 本月费用
+	latency   map[string]float64 // 最近平均耗时（秒）
+	updatedAt time.Time
+}
+
+// loadBalancer 负载均衡配置与统计缓存
+type loadBalancer struct {
+	mu      sync.RWMutex
+	path    string
+	loaded  bool
+	configs map[string]BalanceConfig // key: 平台
+
+	statsMu sync.Mutex
+	stats   map[string]*balanceStats // key: 平台:模式
+}
+
+func newLoadBalancer() *loadBalancer {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		home = "."
+	}
+	return &loadBalancer{
+		path:  filepath.Join(home, ".code-relay", balanceConfigFile),
+		stats: make(map[string]*balanceStats),
+	}
+}
+
+func (lb *loadBalancer) load() (map[string]BalanceConfig, error) {
+	lb.mu.RLock()
+	if lb.loaded {
+		configs := copyBalanceConfigs(lb.configs)
+		lb.mu.RUnlock()
+		return configs, nil
+	}
+	lb.mu.RUnlock()
+
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	if !lb.loaded {
+		configs := map[string]BalanceConfig{}
+		data, err := os.ReadFile(lb.path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		if len(data) > 0 {
+			if err := json.Unmarshal(data, &configs); err != nil {
+				return nil, err
+			}
+		}
+		lb.configs = configs
+		lb.loaded = true
+	}
+	return copyBalanceConfigs(lb.configs), nil
+}
+
+func (lb *loadBalancer) save(configs map[string]BalanceConfig) error {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(lb.path), 0o755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(configs, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := lb.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, lb.path); err != nil {
+		return err
+	}
+	lb.configs = copyBalanceConfigs(configs)
+	lb.loaded = true
+	return nil
+}
+
+func copyBalanceConfigs(configs map[string]BalanceConfig) map[string]BalanceConfig {
+	dup := make(map[string]BalanceConfig, len(configs))
+	for k, v := range configs {
+		dup[k] = v
+	}
+	return dup
+}
+
+func (lb *loadBalancer) mode(kind string) string {
+	configs, err := lb.load()
+	if err != nil {
+		log.Printf("[Relay] 加载负载均衡配置失败: %v", err)
+		return BalanceModePriority
+	}
+	if mode := strings.ToLower(configs[kind].Mode); mode != "" {
+		return mode
+	}
+	return BalanceModePriority
+}
+
+// GetBalanceConfig 返回指定平台的负载均衡配置
+func (prs *ProviderRelayService) GetBalanceConfig(kind string) (BalanceConfig, error) {
+	configs, err := prs.balancer.load()
+	if err != nil {
+		return BalanceConfig{}, err
+	}
+	cfg := configs[strings.ToLower(kind)]
+	if cfg.Mode == "" {
+		cfg.Mode = BalanceModePriority
+	}
+	return cfg, nil
+}
+
+// SaveBalanceConfig 保存指定平台的负载均衡配置，立即生效
+func (prs *ProviderRelayService) SaveBalanceConfig(kind string, cfg BalanceConfig) error {
+	cfg.Mode = strings.ToLower(strings.TrimSpace(cfg.Mode))
+	switch cfg.Mode {
+	case "", BalanceModePriority, BalanceModeWeighted, BalanceModeQuota, BalanceModeLatency:
+	default:
+		return fmt.Errorf("未知负载均衡模式 %q（应为 priority、weighted、quota 或 latency）", cfg.Mode)
+	}
+	configs, err := prs.balancer.load()
+	if err != nil {
+		return err
+	}
+	configs[strings.ToLower(kind)] = cfg
+	return prs.balancer.save(configs)
+}
+
+// balance 在优先级最高且未熔断的 provider 中按比例抽取首个尝试的 provider 并移到最前
+// 其余 provider 保持原有（按权重排序的）故障转移顺序
+func (prs *ProviderRelayService) balance(kind string, providers []weightedProvider) []weightedProvider {
+	mode := prs.balancer.mode(kind)
+	if mode == BalanceModePriority || len(providers) < 2 {
+		return providers
+	}
+
+	// 候选：未熔断的 provider 中 level 最小（优先级最高）的一组
+	bestLevel := 0
+	candidates := make([]int, 0, len(providers))
+	for i, wp := range providers {
+		if prs.prober.isCircuitOpen(kind, wp.provider.Name) {
+			continue
+		}
+		level := normalizedLevel(wp.provider.Level)
+		if len(candidates) == 0 || level < bestLevel {
+			bestLevel = level
+			candidates = candidates[:0]
+		}
+		if level == bestLevel {
+			candidates = append(candidates, i)
+		}
+	}
+	if len(candidates) < 2 {
+		return providers
+	}
+
+	weights := prs.balanceWeights(kind, mode, providers, candidates)
+	picked := pickWeighted(candidates, weights)
+	if picked < 0 {
+		return providers
+	}
+	log.Printf("[Relay] 负载均衡(%s) 首选 provider: %s", mode, providers[picked].provider.Name)
+
+	ordered := make([]weightedProvider, 0, len(providers))
+	ordered = append(ordered, providers[picked])
+	ordered = append(ordered, providers[:picked]...)
+	return append(ordered, providers[picked+1:]...)
+}
+
+// balanceWeights 按模式计算候选 provider 的分配比例（与 candidates 一一对应）
+func (prs *ProviderRelayService) balanceWeights(kind string, mode string, providers []weightedProvider, candidates []int) []float64 {
+	weights := make([]float64, len(candidates))
+	switch mode {
+	case BalanceModeWeighted:
+		for i, idx := range candidates {
+			weights[i] = float64(providers[idx].provider.TrafficWeight)
+			if weights[i] <= 0 {
+				weights[i] = 1
+			}
+		}
+	case BalanceModeQuota:
+		spend := prs.balanceStats(kind).spend
+		known := make([]bool, len(candidates))
+		for i, idx := range candidates {
+			p := providers[idx].provider
+			if p.MonthlyQuota > 0 {
+				weights[i] = max(p.MonthlyQuota-spend[p.Name], 0)
+				known[i] = true
+			}
+		}
+		fillUnknownWeights(weights, known)
+	case BalanceModeLatency:
+		latency := prs.balanceStats(kind).latency
+		known := make([]bool, len(candidates))
+		for i, idx := range candidates {
+			if avg := latency[providers[idx].provider.Name]; avg > 0 {
+				weights[i] = 1 / avg
+				known[i] = true
+			}
+		}
+		fillUnknownWeights(weights, known)
+	default:
+		for i := range weights {
+			weights[i] = 1
+		}
+	}
+	return weights
+}
+
+// balanceStats 返回平台的费用与耗时统计，缓存 balanceStatsTTL
+func (prs *ProviderRelayService) balanceStats(kind string) *balanceStats {
+	lb := prs.balancer
+	lb.statsMu.Lock()
+	defer lb.statsMu.Unlock()
+
+	if cached, ok := lb.stats[kind]; ok && time.Since(cached.updatedAt) < balanceStatsTTL {
+		return cached
+	}
+	stats := &balanceStats{updatedAt: time.Now()}
+	if prs.logService != nil {
+		now := time.Now()
+		monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+		var err error
+		if stats.spend, err = prs.logService.providerSpendSince(kind, monthStart); err != nil {
+			log.Printf("[Relay] 统计 provider 费用失败: %v", err)
+		}
+		if stats.latency, err = prs.logService.providerLatencySince(kind, now.Add(-balanceLatencyRange)); err != nil {
+			log.Printf("[Relay] 统计 provider 耗时失败: %v", err)
+		}
+	}
+	lb.stats[kind] = stats
+	return stats
+}
+
+// fillUnknownWeights 没有数据（未配置额度 / 无近期请求）的 provider 取已知权重的平均值
+func fillUnknownWeights(weights []float64, known []bool) {
+	var sum float64
+	var n int
+	for i, w := range weights {
+		if known[i] {
+			sum += w
+			n++
+		}
+	}
+	fallback := 1.0
+	if n > 0 {
+		fallback = sum / float64(n)
+	}
+	for i := range weights {
+		if !known[i] {
+			weights[i] = fallback
+		}
+	}
+}
+
+// pickWeighted 按权重随机抽取，全部权重为 0 时返回 -1
+func pickWeighted(candidates []int, weights []float64) int {
+	var total float64
+	for _, w := range weights {
+		total += w
+	}
+	if total <= 0 {
+		return -1
+	}
+	r := rand.Float64() * total
+	for i, w := range weights {
+		if r < w {
+			return candidates[i]
+		}
+		r -= w
+	}
+	return candidates[len(candidates)-1]
+}
+
+// normalizedLevel 未配置的优先级按 1 处理
+func normalizedLevel(level int) int {
+	if level <= 0 {
+		return 1
+	}
+	return level
+}
@@ -0,0 +1,82 @@
+package services
+
+import (
+	"math"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/daodao97/xgo/xdb"
+)
+
+func TestProviderSpendAndLatencyFromRollups(t *testing.T) {
+	ls := newTestLogService(t)
+	for _, rl := range []RequestLog{
+		{Platform: "balance-test", Provider: "balance-a", Model: "claude-sonnet-4", HttpCode: 200, InputTokens: 1000, OutputTokens: 100, DurationSec: 1},
+		{Platform: "balance-test", Provider: "balance-a", Model: "claude-sonnet-4", HttpCode: 200, InputTokens: 1000, OutputTokens: 100, DurationSec: 3},
+		{Platform: "balance-test", Provider: "balance-a", Model: "claude-sonnet-4", HttpCode: 502, DurationSec: 10},
+	} {
+		rl := rl
+		ls.writeRequestLog(&rl, nil)
+	}
+	waitLogs(t, "balance-test", "balance-a", 3)
+
+	since := time.Now().Add(-time.Hour)
+	before, err := ls.providerSpendSince("balance-test", since)
+	if err != nil || before["balance-a"] <= 0 {
+		t.Fatalf("spend = %v, err = %v", before, err)
+	}
+
+	// 原始日志被清理后，费用与耗时仍可从汇总中读取
+	if _, err := xdb.New("request_log").Delete(xdb.WhereEq("platform", "balance-test")); err != nil {
+		t.Fatalf("delete raw logs: %v", err)
+	}
+	spend, err := ls.providerSpendSince("balance-test", since)
+	if err != nil || math.Abs(spend["balance-a"]-before["balance-a"]) > 1e-9 {
+		t.Fatalf("spend after prune = %v (before %v), err = %v", spend, before, err)
+	}
+	// 失败请求的耗时不计入平均值
+	latency, err := ls.providerLatencySince("balance-test", since)
+	if err != nil || latency["balance-a"] != 2 {
+		t.Fatalf("latency = %v, err = %v", latency, err)
+	}
+}
+
+func TestRelayWeightedBalance(t *testing.T) {
+	a := mockProvider("balance-a", "default")
+	b := mockProvider("balance-b", "default")
+	b.TrafficWeight = 3
+	c := mockProvider("balance-low-priority", "default")
+	c.Level = 2
+	setProviders(t, "claude", a, b, c)
+	if err := testRelay.SaveBalanceConfig("claude", BalanceConfig{Mode: BalanceModeWeighted}); err != nil {
+		t.Fatalf("SaveBalanceConfig: %v", err)
+	}
+	t.Cleanup(func() { _ = testRelay.SaveBalanceConfig("claude", BalanceConfig{}) })
+
+	countLogs := func(provider string) int {
+		logs, _ := testLogSvc.ListRequestLogs("claude", provider, 1000)
+		return len(logs)
+	}
+	baseA, baseB, baseLow := countLogs("balance-a"), countLogs("balance-b"), countLogs("balance-low-priority")
+
+	const requests = 40
+	for i := 0; i < requests; i++ {
+		if w := doRelay(t, nil, "/v1/messages", `{"model":"claude-sonnet-4"}`, nil); w.Code != http.StatusOK {
+			t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+		}
+	}
+	// 两个同优先级 provider 都应分到首选流量，低优先级的不参与
+	var countA, countB int
+	deadline := time.Now().Add(3 * time.Second)
+	for countA+countB < requests && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+		countA, countB = countLogs("balance-a")-baseA, countLogs("balance-b")-baseB
+	}
+	if countA+countB != requests || countA == 0 || countB <= countA {
+		t.Fatalf("unexpected split: a=%d b=%d", countA, countB)
+	}
+	if n := countLogs("balance-low-priority") - baseLow; n != 0 {
+		t.Fatalf("low priority provider received %d requests", n)
+	}
+}
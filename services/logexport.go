@@ -0,0 +1,377 @@
+package services
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	modelpricing "coderelay/resources/model-pricing"
+
+	"github.com/daodao97/xgo/xdb"
+)
+
+// 导出格式
+const (
+	LogExportCSV    = "csv"
+	LogExportJSON   = "json"   // 对象数组
+	LogExportNDJSON = "ndjson" // 每行一个对象
+
+	logExportChunk = 1000 // 每次从数据库读取的行数
+)
+
+// LogExportColumns 导出的列，CSV 表头与 JSON 对象的键均按此顺序。
+// 列的含义和类型在各版本之间保持不变：新增列只追加在末尾，不会改名或删除。
+//
+//	id                   integer  request_log 自增 ID
+//	created_at           string   请求时间，RFC 3339（带本地时区偏移）
+//	platform             string   claude / codex / gemini
+//	provider             string   provider 名称，未转发的请求为空
+//	model                string   转发的模型
+//	http_code            integer  上游状态码，0 表示网络错误，499 表示被取消
+//	is_stream            boolean  是否流式请求
+//	input_tokens         integer
+//	output_tokens        integer
+//	reasoning_tokens     integer
+//	cache_create_tokens  integer
+//	cache_read_tokens    integer
+//	duration_sec         number   成功时为首字节时间，失败时为总耗时
+//	ttfb_sec             number   首字节时间，未收到响应或旧数据为 0
+//	total_sec            number   总耗时，旧数据为 0
+//	output_tps           number   输出速度（tokens/秒）
+//	queue_wait_sec       number   因并发限制排队的时间
+//	key_index            integer  使用的 Key 下标
+//	profile              string   请求时激活的配置方案
+//	route_policy         string   命中的路由策略
+//	fallback_from        string   降级前的原始模型
+//	client               string   客户端 relay token 的指纹
+//	input_cost           number   USD，按导出时的价格计算
+//	output_cost          number   USD
+//	cache_create_cost    number   USD
+//	cache_read_cost      number   USD
+//	total_cost           number   USD
+//	has_pricing          boolean  模型是否有价格数据
+//	error                string   网络错误或上游错误响应中的错误信息
+var LogExportColumns = []string{
+	"id", "created_at", "platform", "provider", "model", "http_code", "is_stream",
+	"input_tokens", "output_tokens", "reasoning_tokens", "cache_create_tokens", "cache_read_tokens",
+	"duration_sec", "ttfb_sec", "total_sec", "output_tps", "queue_wait_sec",
+	"key_index", "profile", "route_policy", "fallback_from", "client",
+	"input_cost", "output_cost", "cache_create_cost", "cache_read_cost", "total_cost", "has_pricing",
+	"error",
+}
+
+// LogExportQuery 导出条件，时间为空表示不限
+type LogExportQuery struct {
+	Path        string    `json:"path"`   // 导出文件路径，"-" 表示标准输出
+	Format      string    `json:"format"` // csv / json / ndjson，为空时按文件扩展名判断，默认 csv
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end"`
+	Platform    string    `json:"platform"`
+	Provider    string    `json:"provider"`
+	Model       string    `json:"model"` // 支持通配符与 re: 正则
+	Client      string    `json:"client"`
+	StatusClass string    `json:"status_class"` // 2xx / 4xx / 5xx / error / failed
+}
+
+// LogExportResult 导出结果
+type LogExportResult struct {
+	Path   string `json:"path"`
+	Format string `json:"format"`
+	Rows   int64  `json:"rows"`
+}
+
+// ExportRequestLogs 将符合条件的请求日志导出到文件
+func (ls *LogService) ExportRequestLogs(query LogExportQuery) (LogExportResult, error) {
+	if strings.TrimSpace(query.Path) == "" {
+		return LogExportResult{}, errors.New("请指定导出文件路径")
+	}
+	format, err := logExportFormat(query.Format, query.Path)
+	if err != nil {
+		return LogExportResult{}, err
+	}
+	query.Format = format
+	if query.Path == "-" {
+		rows, err := ls.writeRequestLogs(os.Stdout, query)
+		return LogExportResult{Path: query.Path, Format: format, Rows: rows}, err
+	}
+
+	// 先写入临时文件，完成后再改名，避免留下不完整的文件
+	tmp := query.Path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return LogExportResult{}, err
+	}
+	rows, err := ls.writeRequestLogs(f, query)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return LogExportResult{}, err
+	}
+	if err := os.Rename(tmp, query.Path); err != nil {
+		os.Remove(tmp)
+		return LogExportResult{}, err
+	}
+	return LogExportResult{Path: query.Path, Format: format, Rows: rows}, nil
+}
+
+// writeRequestLogs 按 ID 顺序分批读取请求日志并以 query.Format 写入 w，返回写入的行数
+func (ls *LogService) writeRequestLogs(w io.Writer, query LogExportQuery) (int64, error) {
+	format, err := logExportFormat(query.Format, "")
+	if err != nil {
+		return 0, err
+	}
+	query.StatusClass = strings.ToLower(strings.TrimSpace(query.StatusClass))
+	switch query.StatusClass {
+	case "", "2xx", "3xx", "4xx", "5xx", "error", "failed":
+	default:
+		return 0, fmt.Errorf("不支持的状态分类: %s", query.StatusClass)
+	}
+
+	bw := bufio.NewWriter(w)
+	enc := newLogExportEncoder(bw, format)
+	if err := enc.begin(); err != nil {
+		return 0, err
+	}
+	var rows int64
+	var lastID int64
+	for {
+		records, err := exportChunk(query, lastID)
+		if err != nil {
+			return rows, err
+		}
+		for _, record := range records {
+			lastID = record.GetInt64("id")
+			rl := requestLogFromRecord(record)
+			if !matchStatusClass(query.StatusClass, rl.HttpCode) {
+				continue
+			}
+			if query.Model != "" && !matchWildcard(query.Model, rl.Model) {
+				continue
+			}
+			if err := enc.row(ls.exportRow(record, rl)); err != nil {
+				return rows, err
+			}
+			rows++
+		}
+		if len(records) < logExportChunk {
+			break
+		}
+	}
+	if err := enc.end(); err != nil {
+		return rows, err
+	}
+	return rows, bw.Flush()
+}
+
+func logExportFormat(format, path string) (string, error) {
+	format = strings.ToLower(strings.TrimSpace(format))
+	if format == "" {
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".json":
+			format = LogExportJSON
+		case ".ndjson", ".jsonl":
+			format = LogExportNDJSON
+		default:
+			format = LogExportCSV
+		}
+	}
+	switch format {
+	case LogExportCSV, LogExportJSON, LogExportNDJSON:
+		return format, nil
+	case "jsonl":
+		return LogExportNDJSON, nil
+	}
+	return "", fmt.Errorf("不支持的导出格式: %s", format)
+}
+
+// exportChunk 读取 id > afterID 的下一批日志
+func exportChunk(query LogExportQuery, afterID int64) ([]xdb.Record, error) {
+	options := []xdb.Option{
+		xdb.WhereGt("id", afterID),
+		xdb.OrderByAsc("id"),
+		xdb.Limit(logExportChunk),
+	}
+	if !query.Start.IsZero() {
+		options = append(options, xdb.WhereGte("created_at", query.Start.In(time.Local).Format(timeLayout)))
+	}
+	if !query.End.IsZero() {
+		options = append(options, xdb.WhereLt("created_at", query.End.In(time.Local).Format(timeLayout)))
+	}
+	if query.Platform != "" {
+		options = append(options, xdb.WhereEq("platform", strings.ToLower(query.Platform)))
+	}
+	if query.Provider != "" {
+		options = append(options, xdb.WhereEq("provider", query.Provider))
+	}
+	if query.Model != "" && !isModelPattern(query.Model) {
+		options = append(options, xdb.WhereEq("model", query.Model))
+	}
+	if query.Client != "" {
+		options = append(options, xdb.WhereEq("client", query.Client))
+	}
+	records, err := xdb.New("request_log").Selects(options...)
+	if err != nil {
+		if errors.Is(err, xdb.ErrNotFound) || isNoSuchTableErr(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return records, nil
+}
+
+// requestLogFromRecord 将 request_log 的一行转换为 RequestLog（不含费用）
+func requestLogFromRecord(record xdb.Record) RequestLog {
+	rl := RequestLog{
+		ID:                record.GetInt64("id"),
+		Platform:          record.GetString("platform"),
+		Model:             record.GetString("model"),
+		Provider:          record.GetString("provider"),
+		HttpCode:          record.GetInt("http_code"),
+		InputTokens:       record.GetInt("input_tokens"),
+		OutputTokens:      record.GetInt("output_tokens"),
+		CacheCreateTokens: record.GetInt("cache_create_tokens"),
+		CacheReadTokens:   record.GetInt("cache_read_tokens"),
+		ReasoningTokens:   record.GetInt("reasoning_tokens"),
+		CreatedAt:         record.GetString("created_at"),
+		IsStream:          record.GetBool("is_stream"),
+		DurationSec:       record.GetFloat64("duration_sec"),
+		TTFBSec:           record.GetFloat64("ttfb_sec"),
+		TotalSec:          record.GetFloat64("total_sec"),
+		KeyIndex:          record.GetInt("key_index"),
+		Profile:           record.GetString("profile"),
+		RoutePolicy:       record.GetString("route_policy"),
+		FallbackFrom:      record.GetString("fallback_from"),
+		Client:            record.GetString("client"),
+		QueueWaitSec:      record.GetFloat64("queue_wait_sec"),
+		Error:             record.GetString("error"),
+	}
+	rl.OutputTPS = outputTPS(&rl)
+	return rl
+}
+
+// exportRow 按 LogExportColumns 的顺序返回一行的值
+func (ls *LogService) exportRow(record xdb.Record, rl RequestLog) []any {
+	createdAt := rl.CreatedAt
+	if t, ok := parseCreatedAt(record); ok {
+		createdAt = t.Format(time.RFC3339)
+	}
+	cost := ls.calculateCost(rl.Model, modelpricing.UsageSnapshot{
+		InputTokens:       rl.InputTokens,
+		OutputTokens:      rl.OutputTokens,
+		CacheCreateTokens: rl.CacheCreateTokens,
+		CacheReadTokens:   rl.CacheReadTokens,
+	})
+	return []any{
+		rl.ID, createdAt, rl.Platform, rl.Provider, rl.Model, rl.HttpCode, rl.IsStream,
+		rl.InputTokens, rl.OutputTokens, rl.ReasoningTokens, rl.CacheCreateTokens, rl.CacheReadTokens,
+		rl.DurationSec, rl.TTFBSec, rl.TotalSec, rl.OutputTPS, rl.QueueWaitSec,
+		rl.KeyIndex, rl.Profile, rl.RoutePolicy, rl.FallbackFrom, rl.Client,
+		cost.InputCost, cost.OutputCost, cost.CacheCreateCost, cost.CacheReadCost, cost.TotalCost, cost.HasPricing,
+		rl.Error,
+	}
+}
+
+// logExportEncoder 按格式输出表头、行和结尾
+type logExportEncoder struct {
+	w      *bufio.Writer
+	csv    *csv.Writer
+	format string
+	rows   int64
+}
+
+func newLogExportEncoder(w *bufio.Writer, format string) *logExportEncoder {
+	enc := &logExportEncoder{w: w, format: format}
+	if format == LogExportCSV {
+		enc.csv = csv.NewWriter(w)
+	}
+	return enc
+}
+
+func (enc *logExportEncoder) begin() error {
+	switch enc.format {
+	case LogExportCSV:
+		return enc.csv.Write(LogExportColumns)
+	case LogExportJSON:
+		_, err := enc.w.WriteString("[")
+		return err
+	}
+	return nil
+}
+
+func (enc *logExportEncoder) row(values []any) error {
+	defer func() { enc.rows++ }()
+	if enc.format == LogExportCSV {
+		fields := make([]string, len(values))
+		for i, v := range values {
+			fields[i] = exportCSVValue(v)
+		}
+		if err := enc.csv.Write(fields); err != nil {
+			return err
+		}
+		enc.csv.Flush()
+		return enc.csv.Error()
+	}
+
+	// 手动拼接对象，保证键按列顺序输出
+	var b strings.Builder
+	if enc.format == LogExportJSON {
+		if enc.rows > 0 {
+			b.WriteString(",")
+		}
+		b.WriteString("\n")
+	}
+	b.WriteString("{")
+	for i, v := range values {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		key, _ := json.Marshal(LogExportColumns[i])
+		value, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		b.Write(key)
+		b.WriteString(":")
+		b.Write(value)
+	}
+	b.WriteString("}")
+	if enc.format == LogExportNDJSON {
+		b.WriteString("\n")
+	}
+	_, err := enc.w.WriteString(b.String())
+	return err
+}
+
+func (enc *logExportEncoder) end() error {
+	if enc.format == LogExportJSON {
+		_, err := enc.w.WriteString("\n]\n")
+		return err
+	}
+	return nil
+}
+
+func exportCSVValue(v any) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case bool:
+		return strconv.FormatBool(v)
+	case int:
+		return strconv.Itoa(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,75 @@
+package services
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExportRequestLogs(t *testing.T) {
+	ls := newTestLogService(t)
+	for _, rl := range []RequestLog{
+		{Platform: "export-test", Provider: "export-a", Model: "claude-sonnet-4", HttpCode: 200, InputTokens: 1000, OutputTokens: 100, TTFBSec: 0.5, TotalSec: 1.5, IsStream: true},
+		{Platform: "export-test", Provider: "export-a", Model: "claude-sonnet-4", HttpCode: 500, Client: "a,\"b\""},
+		{Platform: "export-test", Provider: "export-b", Model: "gpt-5", HttpCode: 200},
+	} {
+		rl := rl
+		ls.writeRequestLog(&rl, nil)
+	}
+	waitLogs(t, "export-test", "", 3)
+	dir := t.TempDir()
+
+	csvResult, err := ls.ExportRequestLogs(LogExportQuery{Path: filepath.Join(dir, "logs.csv"), Platform: "export-test", Model: "claude-*"})
+	if err != nil || csvResult.Format != LogExportCSV || csvResult.Rows != 2 {
+		t.Fatalf("csv export: %+v %v", csvResult, err)
+	}
+	f, err := os.Open(csvResult.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(f).ReadAll()
+	f.Close()
+	if err != nil || len(rows) != 3 || strings.Join(rows[0], ",") != strings.Join(LogExportColumns, ",") {
+		t.Fatalf("unexpected csv: %v %v", rows, err)
+	}
+	column := make(map[string]int, len(rows[0]))
+	for i, name := range rows[0] {
+		column[name] = i
+	}
+	if rows[2][column["client"]] != "a,\"b\"" {
+		t.Fatalf("client not escaped: %v", rows[2])
+	}
+	if rows[1][column["output_tps"]] != "100" || rows[1][column["has_pricing"]] != "true" {
+		t.Fatalf("unexpected csv row: %v", rows[1])
+	}
+
+	jsonResult, err := ls.ExportRequestLogs(LogExportQuery{Path: filepath.Join(dir, "logs.json"), Platform: "export-test"})
+	if err != nil || jsonResult.Format != LogExportJSON || jsonResult.Rows != 3 {
+		t.Fatalf("json export: %+v %v", jsonResult, err)
+	}
+	data, _ := os.ReadFile(jsonResult.Path)
+	var objects []map[string]any
+	if err := json.Unmarshal(data, &objects); err != nil || len(objects) != 3 || objects[0]["total_cost"].(float64) <= 0 || len(objects[0]) != len(LogExportColumns) {
+		t.Fatalf("unexpected json: %s %v", data, err)
+	}
+
+	ndResult, err := ls.ExportRequestLogs(LogExportQuery{Path: filepath.Join(dir, "logs.ndjson"), Platform: "export-test", StatusClass: "failed"})
+	if err != nil || ndResult.Format != LogExportNDJSON || ndResult.Rows != 1 {
+		t.Fatalf("ndjson export: %+v %v", ndResult, err)
+	}
+	data, _ = os.ReadFile(ndResult.Path)
+	if lines := strings.Split(strings.TrimSpace(string(data)), "\n"); len(lines) != 1 || !strings.HasPrefix(lines[0], `{"id":`) {
+		t.Fatalf("unexpected ndjson: %s", data)
+	}
+
+	empty, err := ls.ExportRequestLogs(LogExportQuery{Path: filepath.Join(dir, "empty.json"), Platform: "export-none"})
+	if data, _ := os.ReadFile(empty.Path); err != nil || json.Unmarshal(data, &objects) != nil || len(objects) != 0 {
+		t.Fatalf("unexpected empty export: %s %v", data, err)
+	}
+	if _, err := ls.ExportRequestLogs(LogExportQuery{Path: filepath.Join(dir, "logs.xml"), Format: "xml"}); err == nil {
+		t.Fatalf("expected error for unsupported format")
+	}
+}
@@ -0,0 +1,272 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/daodao97/xgo/xdb"
+)
+
+// 日志浏览参数
+const (
+	defaultLogPageSize = 100
+	maxLogPageSize     = 1000
+	maxLogScanRows     = 20000 // 单次查询最多扫描的行数（模型通配符、最低费用在读取后筛选）
+	requestLogFTSTable = "request_log_fts"
+)
+
+// logSearchFTS 错误信息全文索引是否可用，不可用时退回 LIKE
+var logSearchFTS atomic.Bool
+
+// LogQuery 请求日志查询条件，按 id 倒序分页
+type LogQuery struct {
+	Cursor int64 `json:"cursor"` // 上一页返回的 next_cursor，0 表示从最新的日志开始
+	Limit  int   `json:"limit"`  // 默认 100，最多 1000
+
+	Start         time.Time `json:"start"` // 时间为空表示不限
+	End           time.Time `json:"end"`
+	Platform      string    `json:"platform"`
+	Provider      string    `json:"provider"`
+	Model         string    `json:"model"` // 支持通配符与 re: 正则
+	Client        string    `json:"client"`
+	StatusClass   string    `json:"status_class"`    // 2xx / 4xx / 5xx / error / failed
+	Stream        string    `json:"stream"`          // stream / non_stream，为空不限
+	MinCost       float64   `json:"min_cost"`        // 最低费用（USD）
+	MinLatencySec float64   `json:"min_latency_sec"` // 最低总耗时（旧数据按 duration_sec）
+	Search        string    `json:"search"`          // 在错误信息中全文搜索
+}
+
+// LogPage 一页请求日志
+type LogPage struct {
+	Logs       []RequestLog `json:"logs"`
+	NextCursor int64        `json:"next_cursor"` // 传给下一次查询的 cursor，0 表示没有更多
+}
+
+// ensureRequestLogSearch 为 request_log.error 建立 FTS5 全文索引（trigram 分词，支持中文与子串匹配），
+// 由触发器随插入和删除同步更新
+func ensureRequestLogSearch(db *sql.DB) error {
+	logSearchFTS.Store(false)
+	var exists int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", requestLogFTSTable).Scan(&exists); err != nil {
+		return err
+	}
+	statements := []string{
+		`CREATE VIRTUAL TABLE IF NOT EXISTS request_log_fts USING fts5(error, content='request_log', content_rowid='id', tokenize='trigram')`,
+		`CREATE TRIGGER IF NOT EXISTS request_log_fts_insert AFTER INSERT ON request_log WHEN new.error != '' BEGIN
+			INSERT INTO request_log_fts(rowid, error) VALUES (new.id, new.error);
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS request_log_fts_delete AFTER DELETE ON request_log WHEN old.error != '' BEGIN
+			INSERT INTO request_log_fts(request_log_fts, rowid, error) VALUES ('delete', old.id, old.error);
+		END`,
+		`CREATE TRIGGER IF NOT EXISTS request_log_fts_update AFTER UPDATE OF error ON request_log BEGIN
+			INSERT INTO request_log_fts(request_log_fts, rowid, error) VALUES ('delete', old.id, old.error);
+			INSERT INTO request_log_fts(rowid, error) VALUES (new.id, new.error);
+		END`,
+	}
+	if exists == 0 {
+		// 首次创建时为已有日志建立索引
+		statements = append(statements, `INSERT INTO request_log_fts(request_log_fts) VALUES ('rebuild')`)
+	}
+	for _, stmt := range statements {
+		if _, err := db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	logSearchFTS.Store(true)
+	return nil
+}
+
+// QueryRequestLogs 按条件分页查询请求日志（按 id 倒序），翻页时把 NextCursor 作为下一次的 Cursor
+func (ls *LogService) QueryRequestLogs(query LogQuery) (LogPage, error) {
+	if query.Limit <= 0 {
+		query.Limit = defaultLogPageSize
+	}
+	query.Limit = min(query.Limit, maxLogPageSize)
+	where, args, err := logQueryWhere(query)
+	if err != nil {
+		return LogPage{}, err
+	}
+	db, err := xdb.DB("default")
+	if err != nil {
+		return LogPage{}, err
+	}
+
+	page := LogPage{Logs: make([]RequestLog, 0, query.Limit)}
+	cursor := query.Cursor
+	chunk := max(query.Limit+1, 200)
+	scanned := 0
+	for {
+		chunkWhere, chunkArgs := where, args
+		if cursor > 0 {
+			chunkWhere = append([]string{"id < ?"}, where...)
+			chunkArgs = append([]any{cursor}, args...)
+		}
+		sqlQuery := "SELECT * FROM request_log"
+		if len(chunkWhere) > 0 {
+			sqlQuery += " WHERE " + strings.Join(chunkWhere, " AND ")
+		}
+		sqlQuery += " ORDER BY id DESC LIMIT ?"
+		records, err := queryRecords(db, sqlQuery, append(chunkArgs, chunk)...)
+		if err != nil {
+			if isNoSuchTableErr(err) {
+				return page, nil
+			}
+			return LogPage{}, err
+		}
+
+		for _, record := range records {
+			logEntry := requestLogFromRecord(record)
+			scanned++
+			if query.Model != "" && !matchWildcard(query.Model, logEntry.Model) {
+				cursor = logEntry.ID
+				continue
+			}
+			ls.decorateCost(&logEntry)
+			if query.MinCost > 0 && logEntry.TotalCost < query.MinCost {
+				cursor = logEntry.ID
+				continue
+			}
+			if len(page.Logs) == query.Limit {
+				// 还有更多符合条件的日志
+				page.NextCursor = page.Logs[len(page.Logs)-1].ID
+				return page, nil
+			}
+			page.Logs = append(page.Logs, logEntry)
+			cursor = logEntry.ID
+		}
+		if len(records) < chunk {
+			return page, nil
+		}
+		if scanned >= maxLogScanRows {
+			// 筛选条件过于稀疏：返回已找到的部分，从扫描到的位置继续
+			page.NextCursor = cursor
+			return page, nil
+		}
+	}
+}
+
+// logQueryWhere 将可以在 SQL 中处理的条件转换为 WHERE 子句
+func logQueryWhere(query LogQuery) ([]string, []any, error) {
+	if query.MinCost < 0 || query.MinLatencySec < 0 {
+		return nil, nil, errors.New("最低费用与最低耗时不能为负数")
+	}
+	var where []string
+	var args []any
+	add := func(clause string, values ...any) {
+		where = append(where, clause)
+		args = append(args, values...)
+	}
+
+	if !query.Start.IsZero() {
+		add("created_at >= ?", query.Start.In(time.Local).Format(timeLayout))
+	}
+	if !query.End.IsZero() {
+		add("created_at < ?", query.End.In(time.Local).Format(timeLayout))
+	}
+	if platform := strings.ToLower(strings.TrimSpace(query.Platform)); platform != "" {
+		add("platform = ?", platform)
+	}
+	if provider := strings.TrimSpace(query.Provider); provider != "" {
+		add("provider = ?", provider)
+	}
+	if model := strings.TrimSpace(query.Model); model != "" && !isModelPattern(model) {
+		add("model = ?", model)
+	}
+	if client := strings.TrimSpace(query.Client); client != "" {
+		add("client = ?", client)
+	}
+
+	switch class := strings.ToLower(strings.TrimSpace(query.StatusClass)); class {
+	case "":
+	case "2xx", "3xx", "4xx", "5xx":
+		base := int(class[0]-'0') * 100
+		add("http_code >= ? AND http_code < ?", base, base+100)
+	case "error":
+		add("http_code <= 0")
+	case "failed":
+		add("(http_code < 200 OR http_code >= 300)")
+	default:
+		return nil, nil, fmt.Errorf("不支持的状态分类: %s", query.StatusClass)
+	}
+
+	switch strings.ToLower(strings.TrimSpace(query.Stream)) {
+	case "":
+	case "stream":
+		add("is_stream = 1")
+	case "non_stream":
+		add("is_stream = 0")
+	default:
+		return nil, nil, fmt.Errorf("不支持的流式筛选: %s", query.Stream)
+	}
+
+	if query.MinLatencySec > 0 {
+		add("(CASE WHEN total_sec > 0 THEN total_sec ELSE duration_sec END) >= ?", query.MinLatencySec)
+	}
+
+	if search := strings.TrimSpace(query.Search); search != "" {
+		// trigram 索引只能匹配 3 个字符及以上的词，较短的搜索词退回 LIKE
+		if logSearchFTS.Load() && utf8.RuneCountInString(search) >= 3 {
+			add("id IN (SELECT rowid FROM "+requestLogFTSTable+" WHERE "+requestLogFTSTable+" MATCH ?)", ftsPhrase(search))
+		} else {
+			add("error LIKE ? ESCAPE '\\'", "%"+escapeLike(search)+"%")
+		}
+	}
+	return where, args, nil
+}
+
+// ftsPhrase 将搜索词转换为 FTS5 短语，避免其中的运算符被当作查询语法
+func ftsPhrase(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// sqlQueryer *sql.DB 或 *sql.Tx
+type sqlQueryer interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+}
+
+// queryRecords 执行查询并将每行转换为 xdb.Record
+func queryRecords(db sqlQueryer, query string, args ...any) ([]xdb.Record, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	var records []xdb.Record
+	for rows.Next() {
+		values := make([]any, len(columns))
+		pointers := make([]any, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, err
+		}
+		record := make(xdb.Record, len(columns))
+		for i, column := range columns {
+			switch v := values[i].(type) {
+			case []byte:
+				record[column] = string(v)
+			case time.Time:
+				// DATETIME 列按写入时的本地时间字符串返回
+				record[column] = v.Format(timeLayout)
+			default:
+				record[column] = v
+			}
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
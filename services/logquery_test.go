@@ -0,0 +1,100 @@
+package services
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestQueryRequestLogs(t *testing.T) {
+	ls := newTestLogService(t)
+	// 上游错误信息写入日志，可全文搜索
+	setProviders(t, "claude", mockProvider("query-bad", "status=503"))
+	if w := doRelay(t, nil, "/v1/messages", `{"model":"claude-sonnet-4","messages":[]}`, nil); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if logs := waitLogs(t, "claude", "query-bad", 1); logs[0].Error != "mock upstream error 503" {
+		t.Fatalf("unexpected error: %+v", logs[0])
+	}
+	if page, err := ls.QueryRequestLogs(LogQuery{Platform: "claude", Search: "error 503"}); err != nil || len(page.Logs) == 0 {
+		t.Fatalf("search across providers: %+v %v", page, err)
+	}
+	for _, search := range []string{"upstream ERROR", "503", "mo"} {
+		page, err := ls.QueryRequestLogs(LogQuery{Platform: "claude", Provider: "query-bad", Search: search})
+		if err != nil || len(page.Logs) != 1 || page.Logs[0].Provider != "query-bad" {
+			t.Fatalf("search %q: %+v %v", search, page, err)
+		}
+	}
+	if page, err := ls.QueryRequestLogs(LogQuery{Platform: "claude", Search: `" OR *`}); err != nil || len(page.Logs) != 0 {
+		t.Fatalf("search with operators: %+v %v", page, err)
+	}
+
+	for _, rl := range []RequestLog{
+		{Platform: "query-test", Provider: "query-a", Model: "claude-opus-4", HttpCode: 200, IsStream: true, InputTokens: 100000, TotalSec: 9},
+		{Platform: "query-test", Provider: "query-a", Model: "claude-sonnet-4", HttpCode: 502, Error: "bad gateway"},
+		{Platform: "query-test", Provider: "query-a", Model: "claude-sonnet-4", HttpCode: 500, DurationSec: 12, Error: "internal"},
+		{Platform: "query-test", Provider: "query-b", Model: "gpt-5", HttpCode: 429, IsStream: true},
+		{Platform: "query-test", Provider: "query-a", Model: "claude-haiku-4-5", HttpCode: 200, TotalSec: 1},
+	} {
+		rl := rl
+		ls.writeRequestLog(&rl, nil)
+	}
+	waitLogs(t, "query-test", "", 5)
+
+	// 按 id 倒序翻页
+	var ids []int64
+	query := LogQuery{Platform: "query-test", Limit: 2}
+	for pages := 0; ; pages++ {
+		page, err := ls.QueryRequestLogs(query)
+		if err != nil || pages > 3 {
+			t.Fatalf("QueryRequestLogs: %v (pages=%d)", err, pages)
+		}
+		for _, rl := range page.Logs {
+			ids = append(ids, rl.ID)
+		}
+		if page.NextCursor == 0 {
+			break
+		}
+		query.Cursor = page.NextCursor
+	}
+	if len(ids) != 5 {
+		t.Fatalf("expected 5 logs across pages, got %v", ids)
+	}
+	for i := 1; i < len(ids); i++ {
+		if ids[i] >= ids[i-1] {
+			t.Fatalf("logs not in descending id order: %v", ids)
+		}
+	}
+
+	for _, tc := range []struct {
+		query LogQuery
+		want  int
+	}{
+		{LogQuery{Provider: "query-a", StatusClass: "5xx"}, 2},
+		{LogQuery{StatusClass: "4xx", Stream: "stream"}, 1},
+		{LogQuery{Stream: "non_stream"}, 3},
+		{LogQuery{Model: "claude-*", StatusClass: "2xx"}, 2},
+		{LogQuery{MinLatencySec: 5}, 2},
+		{LogQuery{MinCost: 0.01}, 1},
+		{LogQuery{Search: "gateway"}, 1},
+		{LogQuery{Start: time.Now().Add(-time.Hour), End: time.Now().Add(time.Minute), StatusClass: "failed"}, 3},
+		{LogQuery{End: time.Now().Add(-time.Hour)}, 0},
+	} {
+		tc.query.Platform = "query-test"
+		page, err := ls.QueryRequestLogs(tc.query)
+		if err != nil || len(page.Logs) != tc.want || page.NextCursor != 0 {
+			t.Fatalf("query %+v: got %d logs (%v), want %d", tc.query, len(page.Logs), err, tc.want)
+		}
+	}
+	if _, err := ls.QueryRequestLogs(LogQuery{Stream: "maybe"}); err == nil {
+		t.Fatalf("expected error for invalid stream filter")
+	}
+
+	// 清理原始日志时同步删除全文索引
+	if _, err := ls.pruneRequestLogs(time.Now().Add(time.Minute)); err != nil {
+		t.Fatalf("pruneRequestLogs: %v", err)
+	}
+	if page, err := ls.QueryRequestLogs(LogQuery{Search: "gateway"}); err != nil || len(page.Logs) != 0 {
+		t.Fatalf("search after prune: %+v %v", page, err)
+	}
+}
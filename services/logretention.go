@@ -0,0 +1,217 @@
+package services
+
+import (
+	"database/sql"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/daodao97/xgo/xdb"
+)
+
+// 日志保留与数据库维护参数
+const (
+	logPruneChunk          = 2000 // 每条 DELETE 删除的行数
+	logMaintenanceDelay    = time.Minute
+	logMaintenanceInterval = time.Hour
+	logVacuumInterval      = 7 * 24 * time.Hour
+)
+
+// DatabaseInfo 数据库大小与日志保留状态
+type DatabaseInfo struct {
+	Path          string `json:"path"`
+	SizeBytes     int64  `json:"size_bytes"` // 数据库文件（含 -wal / -shm）总大小
+	WalBytes      int64  `json:"wal_bytes"`
+	RawRows       int64  `json:"raw_rows"`       // request_log 行数
+	OldestRaw     string `json:"oldest_raw"`     // 最早一条原始日志的时间
+	AggregateDays int64  `json:"aggregate_days"` // request_log_daily 中有数据的天数
+	RetentionDays int    `json:"retention_days"` // 0 表示永久保留原始日志
+
+	LastRunAt      string `json:"last_run_at"`
+	LastPrunedRows int64  `json:"last_pruned_rows"`
+	LastVacuumAt   string `json:"last_vacuum_at"`
+}
+
+// logMaintenance 定期清理过期日志并压缩数据库
+type logMaintenance struct {
+	mu            sync.Mutex
+	retentionDays func() int // 由 main 从应用设置读取
+	startOnce     sync.Once
+	stopOnce      sync.Once
+	stop          chan struct{}
+
+	lastRun    time.Time
+	lastPruned int64
+	lastVacuum time.Time
+}
+
+func newLogMaintenance() *logMaintenance {
+	return &logMaintenance{stop: make(chan struct{})}
+}
+
+// SetRetentionSource 设置日志保留天数的来源并启动定期维护（首次在启动一分钟后执行）
+func (ls *LogService) SetRetentionSource(days func() int) {
+	m := ls.maintenance
+	m.mu.Lock()
+	m.retentionDays = days
+	m.mu.Unlock()
+	m.startOnce.Do(func() {
+		go ls.maintenanceLoop()
+	})
+}
+
+func (ls *LogService) maintenanceLoop() {
+	timer := time.NewTimer(logMaintenanceDelay)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ls.maintenance.stop:
+			return
+		case <-timer.C:
+			if _, err := ls.RunLogMaintenance(); err != nil {
+				log.Printf("[Log] 日志维护失败: %v", err)
+			}
+			timer.Reset(logMaintenanceInterval)
+		}
+	}
+}
+
+func (ls *LogService) stopMaintenance() {
+	ls.maintenance.stopOnce.Do(func() {
+		close(ls.maintenance.stop)
+	})
+}
+
+func (ls *LogService) retentionDays() int {
+	m := ls.maintenance
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.retentionDays == nil {
+		return 0
+	}
+	return m.retentionDays()
+}
+
+// RunLogMaintenance 立即执行一次日志维护：删除过期日志、checkpoint WAL，必要时 VACUUM
+func (ls *LogService) RunLogMaintenance() (DatabaseInfo, error) {
+	db, err := xdb.DB("default")
+	if err != nil {
+		return DatabaseInfo{}, err
+	}
+
+	var pruned int64
+	if days := ls.retentionDays(); days > 0 {
+		cutoff := startOfDay(time.Now()).AddDate(0, 0, -days)
+		if pruned, err = ls.pruneRequestLogs(cutoff); err != nil {
+			return DatabaseInfo{}, err
+		}
+		// 探测与影子流量日志没有长期价值，按同样的期限直接删除
+		for _, table := range []string{"probe_log", "shadow_log"} {
+			if _, err := db.Exec("DELETE FROM "+table+" WHERE created_at < ?", cutoff.Format(timeLayout)); err != nil && !isNoSuchTableErr(err) {
+				log.Printf("[Log] 清理 %s 失败: %v", table, err)
+			}
+		}
+	}
+
+	if _, err := db.Exec("PRAGMA wal_checkpoint(TRUNCATE)"); err != nil {
+		log.Printf("[Log] WAL checkpoint 失败: %v", err)
+	}
+
+	m := ls.maintenance
+	m.mu.Lock()
+	vacuum := pruned > 0 && time.Since(m.lastVacuum) >= logVacuumInterval
+	m.mu.Unlock()
+	if vacuum {
+		if _, err := db.Exec("VACUUM"); err != nil {
+			log.Printf("[Log] VACUUM 失败: %v", err)
+			vacuum = false
+		}
+	}
+
+	m.mu.Lock()
+	m.lastRun = time.Now()
+	m.lastPruned = pruned
+	if vacuum {
+		m.lastVacuum = m.lastRun
+	}
+	m.mu.Unlock()
+	if pruned > 0 {
+		log.Printf("[Log] 已删除 %d 条过期请求日志", pruned)
+	}
+	return ls.DatabaseInfo()
+}
+
+// pruneRequestLogs 分批删除 cutoff 之前的原始日志（汇总表在写入时已累计，永久保留）
+func (ls *LogService) pruneRequestLogs(cutoff time.Time) (int64, error) {
+	db, err := xdb.DB("default")
+	if err != nil {
+		return 0, err
+	}
+	const deleteSQL = "DELETE FROM request_log WHERE id IN (SELECT id FROM request_log WHERE created_at < ? ORDER BY id LIMIT ?)"
+
+	var total int64
+	for {
+		res, err := db.Exec(deleteSQL, cutoff.Format(timeLayout), logPruneChunk)
+		if err != nil {
+			if isNoSuchTableErr(err) {
+				return total, nil
+			}
+			return total, err
+		}
+		deleted, err := res.RowsAffected()
+		if err != nil {
+			return total, err
+		}
+		total += deleted
+		if deleted < logPruneChunk {
+			return total, nil
+		}
+		// 让出数据库给日志写入
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// DatabaseInfo 返回数据库文件大小、原始日志与汇总数据的规模及最近一次维护情况
+func (ls *LogService) DatabaseInfo() (DatabaseInfo, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		home = "."
+	}
+	path := filepath.Join(home, ".code-relay", "app.db")
+	info := DatabaseInfo{Path: path, RetentionDays: ls.retentionDays()}
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		if stat, err := os.Stat(path + suffix); err == nil {
+			info.SizeBytes += stat.Size()
+			if suffix == "-wal" {
+				info.WalBytes = stat.Size()
+			}
+		}
+	}
+
+	db, err := xdb.DB("default")
+	if err != nil {
+		return info, err
+	}
+	var oldest sql.NullString
+	if err := db.QueryRow("SELECT COUNT(*), MIN(created_at) FROM request_log").Scan(&info.RawRows, &oldest); err != nil && !isNoSuchTableErr(err) {
+		return info, err
+	}
+	info.OldestRaw = oldest.String
+	if err := db.QueryRow("SELECT COUNT(DISTINCT day) FROM request_log_daily").Scan(&info.AggregateDays); err != nil && !isNoSuchTableErr(err) {
+		return info, err
+	}
+
+	m := ls.maintenance
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.lastRun.IsZero() {
+		info.LastRunAt = m.lastRun.Format(time.RFC3339)
+	}
+	info.LastPrunedRows = m.lastPruned
+	if !m.lastVacuum.IsZero() {
+		info.LastVacuumAt = m.lastVacuum.Format(time.RFC3339)
+	}
+	return info, nil
+}
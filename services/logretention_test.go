@@ -0,0 +1,49 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/daodao97/xgo/xdb"
+)
+
+func TestLogRetentionPrunesRawRowsOnly(t *testing.T) {
+	ls := newTestLogService(t)
+	for _, code := range []int{200, 200, 500} {
+		ls.writeRequestLog(&RequestLog{Platform: "retention-test", Provider: "retention-p", Model: "claude-sonnet-4", HttpCode: code, InputTokens: 10, OutputTokens: 5}, nil)
+	}
+	waitLogs(t, "retention-test", "retention-p", 3)
+	old := time.Now().AddDate(0, 0, -40).Format(timeLayout)
+	if _, err := xdb.New("request_log").Update(xdb.Record{"created_at": old}, xdb.WhereEq("platform", "retention-test")); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	ls.writeRequestLog(&RequestLog{Platform: "retention-test", Provider: "retention-p", HttpCode: 200}, nil)
+	waitLogs(t, "retention-test", "retention-p", 4)
+
+	ls.SetRetentionSource(func() int { return 30 })
+	info, err := ls.RunLogMaintenance()
+	if err != nil {
+		t.Fatalf("RunLogMaintenance: %v", err)
+	}
+	if info.LastPrunedRows < 3 || info.RetentionDays != 30 || info.AggregateDays < 1 || info.SizeBytes == 0 {
+		t.Fatalf("unexpected maintenance result: %+v", info)
+	}
+	if logs := waitLogs(t, "retention-test", "retention-p", 1); len(logs) != 1 {
+		t.Fatalf("expected only the recent log to remain, got %d", len(logs))
+	}
+
+	// 汇总在写入时累计，清理原始日志后仍然保留
+	records, err := xdb.New("request_log_daily").Selects(xdb.WhereEq("platform", "retention-test"))
+	if err != nil {
+		t.Fatalf("daily rollup: %v", err)
+	}
+	var requests, success, input int
+	for _, record := range records {
+		requests += record.GetInt("requests")
+		success += record.GetInt("success_requests")
+		input += record.GetInt("input_tokens")
+	}
+	if requests != 4 || success != 3 || input != 30 {
+		t.Fatalf("unexpected daily rollup: requests=%d success=%d input=%d", requests, success, input)
+	}
+}
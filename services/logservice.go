@@ -5,7 +5,6 @@ import (
 	"log"
 	"sort"
 	"strings"
-	"sync"
 	"time"
 
 	modelpricing "coderelay/resources/model-pricing"
@@ -15,23 +14,19 @@ import (
 
 const timeLayout = "2006-01-02 15:04:05"
 
-// 成功率缓存配置
-const (
-	SuccessRateCacheTTL = 30 * time.Second // 缓存有效期 30 秒
-)
-
-// successRateCache 成功率缓存结构
-type successRateCache struct {
-	data      map[string]float64 // platform:provider -> successRate
-	updatedAt time.Time
-}
-
 type LogService struct {
 	pricing *modelpricing.Service
 
-	// 成功率缓存
-	srCache   map[string]*successRateCache // key: platform
-	srCacheMu sync.RWMutex
+	// 路由使用的滑动窗口成功率
+	success *successTracker
+
+	// 今日 provider 延迟分位数缓存
+	latency *latencyCache
+
+	// 请求日志批量写入
+	writer *logWriter
+	// 日志保留与数据库维护
+	maintenance *logMaintenance
 }
 
 func NewLogService() *LogService {
@@ -39,10 +34,14 @@ func NewLogService() *LogService {
 	if err != nil {
 		log.Printf("pricing service init failed: %v", err)
 	}
-	return &LogService{
-		pricing: svc,
-		srCache: make(map[string]*successRateCache),
+	ls := &LogService{
+		pricing:     svc,
+		success:     newSuccessTracker(),
+		latency:     newLatencyCache(),
+		maintenance: newLogMaintenance(),
 	}
+	ls.writer = newLogWriter(ls)
+	return ls
 }
 
 func (ls *LogService) ListRequestLogs(platform string, provider string, limit int) ([]RequestLog, error) {
@@ -74,21 +73,7 @@ func (ls *LogService) ListRequestLogs(platform string, provider string, limit in
 	}
 	logs := make([]RequestLog, 0, len(records))
 	for _, record := range records {
-		logEntry := RequestLog{
-			ID:                record.GetInt64("id"),
-			Platform:          record.GetString("platform"),
-			Model:             record.GetString("model"),
-			Provider:          record.GetString("provider"),
-			HttpCode:          record.GetInt("http_code"),
-			InputTokens:       record.GetInt("input_tokens"),
-			OutputTokens:      record.GetInt("output_tokens"),
-			CacheCreateTokens: record.GetInt("cache_create_tokens"),
-			CacheReadTokens:   record.GetInt("cache_read_tokens"),
-			ReasoningTokens:   record.GetInt("reasoning_tokens"),
-			CreatedAt:         record.GetString("created_at"),
-			IsStream:          record.GetBool("is_stream"),
-			DurationSec:       record.GetFloat64("duration_sec"),
-		}
+		logEntry := requestLogFromRecord(record)
 		ls.decorateCost(&logEntry)
 		logs = append(logs, logEntry)
 	}
@@ -122,83 +107,192 @@ func (ls *LogService) ListProviders(platform string) ([]string, error) {
 	return providers, nil
 }
 
-func (ls *LogService) HeatmapStats(days int) ([]HeatmapStat, error) {
-	if days <= 0 {
-		days = 30
-	}
-	totalHours := days * 24
-	if totalHours <= 0 {
-		totalHours = 24
+// ListProbeLogs 返回主动健康探测记录（与用户请求日志分开存储）
+func (ls *LogService) ListProbeLogs(platform string, provider string, limit int) ([]ProbeLog, error) {
+	if limit <= 0 {
+		limit = 100
 	}
-	rangeStart := startOfHour(time.Now())
-	if totalHours > 1 {
-		rangeStart = rangeStart.Add(-time.Duration(totalHours-1) * time.Hour)
+	if limit > 1000 {
+		limit = 1000
 	}
-	model := xdb.New("request_log")
+
 	options := []xdb.Option{
-		xdb.WhereGe("created_at", rangeStart.Format(timeLayout)),
-		xdb.Field(
-			"model",
-			"input_tokens",
-			"output_tokens",
-			"reasoning_tokens",
-			"cache_create_tokens",
-			"cache_read_tokens",
-			"created_at",
-		),
-		xdb.OrderByDesc("created_at"),
+		xdb.OrderByDesc("id"),
+		xdb.Limit(limit),
 	}
-	records, err := model.Selects(options...)
+	if platform != "" {
+		options = append(options, xdb.WhereEq("platform", platform))
+	}
+	if provider != "" {
+		options = append(options, xdb.WhereEq("provider", provider))
+	}
+	records, err := xdb.New("probe_log").Selects(options...)
 	if err != nil {
 		if errors.Is(err, xdb.ErrNotFound) || isNoSuchTableErr(err) {
-			return []HeatmapStat{}, nil
+			return []ProbeLog{}, nil
 		}
 		return nil, err
 	}
-	hourBuckets := map[int64]*HeatmapStat{}
+	logs := make([]ProbeLog, 0, len(records))
 	for _, record := range records {
-		createdAt, _ := parseCreatedAt(record)
-		if createdAt.IsZero() {
-			continue
+		logs = append(logs, ProbeLog{
+			ID:          record.GetInt64("id"),
+			Platform:    record.GetString("platform"),
+			Provider:    record.GetString("provider"),
+			KeyIndex:    record.GetInt("key_index"),
+			Mode:        record.GetString("mode"),
+			Model:       record.GetString("model"),
+			HttpCode:    record.GetInt("http_code"),
+			DurationSec: record.GetFloat64("duration_sec"),
+			Error:       record.GetString("error"),
+			CreatedAt:   record.GetString("created_at"),
+		})
+	}
+	return logs, nil
+}
+
+// ListShadowLogs 返回影子流量记录（每条包含影子请求与对应主请求的结果）
+func (ls *LogService) ListShadowLogs(platform string, limit int) ([]ShadowLog, error) {
+	if limit <= 0 {
+		limit = 100
+	}
+	if limit > 1000 {
+		limit = 1000
+	}
+
+	options := []xdb.Option{
+		xdb.OrderByDesc("id"),
+		xdb.Limit(limit),
+	}
+	if platform != "" {
+		options = append(options, xdb.WhereEq("platform", platform))
+	}
+	records, err := xdb.New("shadow_log").Selects(options...)
+	if err != nil {
+		if errors.Is(err, xdb.ErrNotFound) || isNoSuchTableErr(err) {
+			return []ShadowLog{}, nil
 		}
-		hourStart := startOfHour(createdAt)
-		hourKey := hourStart.Unix()
-		bucket := hourBuckets[hourKey]
-		if bucket == nil {
-			bucket = &HeatmapStat{Day: hourStart.Format("2006-01-02 15")}
-			hourBuckets[hourKey] = bucket
+		return nil, err
+	}
+	logs := make([]ShadowLog, 0, len(records))
+	for _, record := range records {
+		logs = append(logs, ShadowLog{
+			ID:                  record.GetInt64("id"),
+			Platform:            record.GetString("platform"),
+			Model:               record.GetString("model"),
+			IsStream:            record.GetInt("is_stream") == 1,
+			ShadowProvider:      record.GetString("shadow_provider"),
+			ShadowHttpCode:      record.GetInt("shadow_http_code"),
+			ShadowDurationSec:   record.GetFloat64("shadow_duration_sec"),
+			ShadowInputTokens:   record.GetInt("shadow_input_tokens"),
+			ShadowOutputTokens:  record.GetInt("shadow_output_tokens"),
+			ShadowCost:          record.GetFloat64("shadow_cost"),
+			ShadowError:         record.GetString("shadow_error"),
+			PrimaryProvider:     record.GetString("primary_provider"),
+			PrimaryHttpCode:     record.GetInt("primary_http_code"),
+			PrimaryDurationSec:  record.GetFloat64("primary_duration_sec"),
+			PrimaryInputTokens:  record.GetInt("primary_input_tokens"),
+			PrimaryOutputTokens: record.GetInt("primary_output_tokens"),
+			PrimaryCost:         record.GetFloat64("primary_cost"),
+			CreatedAt:           record.GetString("created_at"),
+		})
+	}
+	return logs, nil
+}
+
+// ShadowComparison 按影子 provider 汇总最近 days 天的影子流量，与同一批请求的主 provider 结果对比
+func (ls *LogService) ShadowComparison(platform string, days int) ([]ShadowComparisonStat, error) {
+	if days <= 0 {
+		days = 7
+	}
+	db, err := xdb.DB("default")
+	if err != nil {
+		return nil, err
+	}
+	// 成功判定与 isSuccessCode 一致：2xx
+	query := `SELECT platform, shadow_provider, COUNT(*),
+		SUM(CASE WHEN COALESCE(shadow_http_code, 0) BETWEEN 200 AND 299 THEN 1 ELSE 0 END),
+		AVG(shadow_duration_sec), SUM(shadow_input_tokens), SUM(shadow_output_tokens), SUM(shadow_cost),
+		SUM(CASE WHEN COALESCE(primary_http_code, 0) BETWEEN 200 AND 299 THEN 1 ELSE 0 END),
+		AVG(primary_duration_sec), SUM(primary_input_tokens), SUM(primary_output_tokens), SUM(primary_cost),
+		SUM(CASE WHEN (COALESCE(shadow_http_code, 0) BETWEEN 200 AND 299) <> (COALESCE(primary_http_code, 0) BETWEEN 200 AND 299) THEN 1 ELSE 0 END)
+		FROM shadow_log WHERE created_at >= ?`
+	args := []any{time.Now().AddDate(0, 0, -days).Format(timeLayout)}
+	if platform != "" {
+		query += " AND platform = ?"
+		args = append(args, platform)
+	}
+	query += " GROUP BY platform, shadow_provider"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		if isNoSuchTableErr(err) {
+			return []ShadowComparisonStat{}, nil
 		}
-		bucket.TotalRequests++
-		input := record.GetInt("input_tokens")
-		output := record.GetInt("output_tokens")
-		reasoning := record.GetInt("reasoning_tokens")
-		cacheCreate := record.GetInt("cache_create_tokens")
-		cacheRead := record.GetInt("cache_read_tokens")
-		bucket.InputTokens += int64(input)
-		bucket.OutputTokens += int64(output)
-		bucket.ReasoningTokens += int64(reasoning)
-		usage := modelpricing.UsageSnapshot{
-			InputTokens:       input,
-			OutputTokens:      output,
-			CacheCreateTokens: cacheCreate,
-			CacheReadTokens:   cacheRead,
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := []ShadowComparisonStat{}
+	for rows.Next() {
+		var stat ShadowComparisonStat
+		var shadowOK, primaryOK int64
+		if err := rows.Scan(&stat.Platform, &stat.ShadowProvider, &stat.Samples,
+			&shadowOK, &stat.Shadow.AvgDurationSec, &stat.Shadow.InputTokens, &stat.Shadow.OutputTokens, &stat.Shadow.CostTotal,
+			&primaryOK, &stat.Primary.AvgDurationSec, &stat.Primary.InputTokens, &stat.Primary.OutputTokens, &stat.Primary.CostTotal,
+			&stat.StatusMismatches,
+		); err != nil {
+			return nil, err
+		}
+		stat.Shadow.setCounts(shadowOK, stat.Samples)
+		stat.Primary.setCounts(primaryOK, stat.Samples)
+		stat.LatencyDeltaSec = stat.Shadow.AvgDurationSec - stat.Primary.AvgDurationSec
+		stat.CostDelta = stat.Shadow.CostTotal - stat.Primary.CostTotal
+		result = append(result, stat)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Platform != result[j].Platform {
+			return result[i].Platform < result[j].Platform
 		}
-		cost := ls.calculateCost(record.GetString("model"), usage)
-		bucket.TotalCost += cost.TotalCost
+		return result[i].ShadowProvider < result[j].ShadowProvider
+	})
+	return result, nil
+}
+
+func isSuccessCode(code int) bool {
+	return code >= 200 && code < 300
+}
+
+func (ls *LogService) HeatmapStats(days int) ([]HeatmapStat, error) {
+	if days <= 0 {
+		days = 30
 	}
-	if len(hourBuckets) == 0 {
-		return []HeatmapStat{}, nil
+	totalHours := days * 24
+	if totalHours <= 0 {
+		totalHours = 24
 	}
-	hourKeys := make([]int64, 0, len(hourBuckets))
-	for key := range hourBuckets {
-		hourKeys = append(hourKeys, key)
+	rangeStart := startOfHour(time.Now())
+	if totalHours > 1 {
+		rangeStart = rangeStart.Add(-time.Duration(totalHours-1) * time.Hour)
 	}
-	sort.Slice(hourKeys, func(i, j int) bool {
-		return hourKeys[i] < hourKeys[j]
-	})
-	stats := make([]HeatmapStat, 0, min(len(hourKeys), totalHours))
-	for i := len(hourKeys) - 1; i >= 0 && len(stats) < totalHours; i-- {
-		stats = append(stats, *hourBuckets[hourKeys[i]])
+	rows, err := queryHourlyRollups("hour", "", rangeStart, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	stats := make([]HeatmapStat, 0, min(len(rows), totalHours))
+	for i := len(rows) - 1; i >= 0 && len(stats) < totalHours; i-- {
+		m := rows[i].metrics
+		stats = append(stats, HeatmapStat{
+			Day:             rows[i].group[:13],
+			TotalRequests:   m.requests,
+			InputTokens:     m.inputTokens,
+			OutputTokens:    m.outputTokens,
+			ReasoningTokens: m.reasoningTokens,
+			TotalCost:       m.totalCost,
+		})
 	}
 	return stats, nil
 }
@@ -209,119 +303,50 @@ func (ls *LogService) StatsSince(platform string) (LogStats, error) {
 	stats := LogStats{
 		Series: make([]LogStatsSeries, 0, seriesHours),
 	}
-	now := time.Now()
-	model := xdb.New("request_log")
-	seriesStart := startOfDay(now)
-	seriesEnd := seriesStart.Add(seriesHours * time.Hour)
 	// 只查询今天的数据，不再查询昨天的
-	queryStart := seriesStart
-	summaryStart := seriesStart
-	options := []xdb.Option{
-		xdb.WhereGte("created_at", queryStart.Format(timeLayout)),
-		xdb.Field(
-			"model",
-			"input_tokens",
-			"output_tokens",
-			"reasoning_tokens",
-			"cache_create_tokens",
-			"cache_read_tokens",
-			"created_at",
-		),
-		xdb.OrderByAsc("created_at"),
-	}
-	if platform != "" {
-		options = append(options, xdb.WhereEq("platform", platform))
-	}
-	records, err := model.Selects(options...)
+	seriesStart := startOfDay(time.Now())
+	seriesEnd := seriesStart.Add(seriesHours * time.Hour)
+	rows, err := queryHourlyRollups("hour", platform, seriesStart, seriesEnd)
 	if err != nil {
-		if errors.Is(err, xdb.ErrNotFound) || isNoSuchTableErr(err) {
-			return stats, nil
-		}
 		return stats, err
 	}
 
-	seriesBuckets := make([]*LogStatsSeries, seriesHours)
-	for i := 0; i < seriesHours; i++ {
-		bucketTime := seriesStart.Add(time.Duration(i) * time.Hour)
-		seriesBuckets[i] = &LogStatsSeries{
-			Day: bucketTime.Format(timeLayout),
-		}
+	seriesBuckets := make([]LogStatsSeries, seriesHours)
+	for i := range seriesBuckets {
+		seriesBuckets[i].Day = seriesStart.Add(time.Duration(i) * time.Hour).Format(timeLayout)
 	}
-
-	for _, record := range records {
-		createdAt, hasTime := parseCreatedAt(record)
-		dayKey := dayFromTimestamp(record.GetString("created_at"))
-		isToday := dayKey == seriesStart.Format("2006-01-02")
-
-		if hasTime {
-			if createdAt.Before(seriesStart) || !createdAt.Before(seriesEnd) {
-				continue
-			}
-		} else {
-			if !isToday {
-				continue
-			}
-			createdAt = seriesStart
-		}
-
-		bucketIndex := 0
-		if hasTime {
-			bucketIndex = int(createdAt.Sub(seriesStart) / time.Hour)
-			if bucketIndex < 0 {
-				bucketIndex = 0
-			}
-			if bucketIndex >= seriesHours {
-				bucketIndex = seriesHours - 1
-			}
-		}
-		bucket := seriesBuckets[bucketIndex]
-		input := record.GetInt("input_tokens")
-		output := record.GetInt("output_tokens")
-		reasoning := record.GetInt("reasoning_tokens")
-		cacheCreate := record.GetInt("cache_create_tokens")
-		cacheRead := record.GetInt("cache_read_tokens")
-		usage := modelpricing.UsageSnapshot{
-			InputTokens:       input,
-			OutputTokens:      output,
-			CacheCreateTokens: cacheCreate,
-			CacheReadTokens:   cacheRead,
-		}
-		cost := ls.calculateCost(record.GetString("model"), usage)
-
-		bucket.TotalRequests++
-		bucket.InputTokens += int64(input)
-		bucket.OutputTokens += int64(output)
-		bucket.ReasoningTokens += int64(reasoning)
-		bucket.CacheCreateTokens += int64(cacheCreate)
-		bucket.CacheReadTokens += int64(cacheRead)
-		bucket.TotalCost += cost.TotalCost
-
-		if createdAt.IsZero() || createdAt.Before(summaryStart) {
+	for _, row := range rows {
+		hour, err := time.ParseInLocation(timeLayout, row.group, time.Local)
+		if err != nil {
 			continue
 		}
-		stats.TotalRequests++
-		stats.InputTokens += int64(input)
-		stats.OutputTokens += int64(output)
-		stats.ReasoningTokens += int64(reasoning)
-		stats.CacheCreateTokens += int64(cacheCreate)
-		stats.CacheReadTokens += int64(cacheRead)
-		stats.CostInput += cost.InputCost
-		stats.CostOutput += cost.OutputCost
-		stats.CostCacheCreate += cost.CacheCreateCost
-		stats.CostCacheRead += cost.CacheReadCost
-		stats.CostTotal += cost.TotalCost
-	}
-
-	for i := 0; i < seriesHours; i++ {
-		if bucket := seriesBuckets[i]; bucket != nil {
-			stats.Series = append(stats.Series, *bucket)
-		} else {
-			bucketTime := seriesStart.Add(time.Duration(i) * time.Hour)
-			stats.Series = append(stats.Series, LogStatsSeries{
-				Day: bucketTime.Format(timeLayout),
-			})
+		bucketIndex := int(hour.Sub(seriesStart) / time.Hour)
+		if bucketIndex < 0 || bucketIndex >= seriesHours {
+			continue
 		}
-	}
+		m := row.metrics
+		bucket := &seriesBuckets[bucketIndex]
+		bucket.TotalRequests += m.requests
+		bucket.InputTokens += m.inputTokens
+		bucket.OutputTokens += m.outputTokens
+		bucket.ReasoningTokens += m.reasoningTokens
+		bucket.CacheCreateTokens += m.cacheCreateTokens
+		bucket.CacheReadTokens += m.cacheReadTokens
+		bucket.TotalCost += m.totalCost
+
+		stats.TotalRequests += m.requests
+		stats.InputTokens += m.inputTokens
+		stats.OutputTokens += m.outputTokens
+		stats.ReasoningTokens += m.reasoningTokens
+		stats.CacheCreateTokens += m.cacheCreateTokens
+		stats.CacheReadTokens += m.cacheReadTokens
+		stats.CostInput += m.inputCost
+		stats.CostOutput += m.outputCost
+		stats.CostCacheCreate += m.cacheCreateCost
+		stats.CostCacheRead += m.cacheReadCost
+		stats.CostTotal += m.totalCost
+	}
+	stats.Series = append(stats.Series, seriesBuckets...)
 
 	return stats, nil
 }
@@ -329,117 +354,69 @@ func (ls *LogService) StatsSince(platform string) (LogStats, error) {
 func (ls *LogService) ProviderDailyStats(platform string) ([]ProviderDailyStat, error) {
 	start := startOfDay(time.Now())
 	end := start.Add(24 * time.Hour)
-	queryStart := start.Add(-24 * time.Hour)
-
-	model := xdb.New("request_log")
-	options := []xdb.Option{
-		xdb.WhereGte("created_at", queryStart.Format(timeLayout)),
-		xdb.Field(
-			"provider",
-			"model",
-			"http_code",
-			"input_tokens",
-			"output_tokens",
-			"reasoning_tokens",
-			"cache_create_tokens",
-			"cache_read_tokens",
-			"duration_sec",
-			"created_at",
-		),
-	}
-	if platform != "" {
-		options = append(options, xdb.WhereEq("platform", platform))
-	}
-	records, err := model.Selects(options...)
+	rows, err := queryHourlyRollups("provider", platform, start, end)
 	if err != nil {
-		if errors.Is(err, xdb.ErrNotFound) || isNoSuchTableErr(err) {
-			return []ProviderDailyStat{}, nil
-		}
 		return nil, err
 	}
 
 	statMap := map[string]*ProviderDailyStat{}
-	// 临时存储每个 provider 的响应时间列表，用于计算 min/max/avg
-	durationMap := map[string][]float64{}
-	for _, record := range records {
-		provider := strings.TrimSpace(record.GetString("provider"))
+	durations := map[string]*rollupMetrics{}
+	for _, row := range rows {
+		provider := strings.TrimSpace(row.group)
 		if provider == "" {
 			provider = "(unknown)"
 		}
-		createdAt, hasTime := parseCreatedAt(record)
-
-		if hasTime {
-			if createdAt.Before(start) || !createdAt.Before(end) {
-				continue
-			}
-		} else {
-			dayKey := dayFromTimestamp(record.GetString("created_at"))
-			if dayKey != start.Format("2006-01-02") {
-				continue
-			}
-		}
 		stat := statMap[provider]
 		if stat == nil {
 			stat = &ProviderDailyStat{Provider: provider}
 			statMap[provider] = stat
-			durationMap[provider] = []float64{}
+			durations[provider] = &rollupMetrics{}
 		}
-		httpCode := record.GetInt("http_code")
-		input := record.GetInt("input_tokens")
-		output := record.GetInt("output_tokens")
-		reasoning := record.GetInt("reasoning_tokens")
-		cacheCreate := record.GetInt("cache_create_tokens")
-		cacheRead := record.GetInt("cache_read_tokens")
-		durationSec := record.GetFloat64("duration_sec")
-		usage := modelpricing.UsageSnapshot{
-			InputTokens:       input,
-			OutputTokens:      output,
-			CacheCreateTokens: cacheCreate,
-			CacheReadTokens:   cacheRead,
-		}
-		cost := ls.calculateCost(record.GetString("model"), usage)
-		stat.TotalRequests++
+		m := row.metrics
+		stat.TotalRequests += m.requests
 		// 只有 HTTP 200-299 才算成功，其他（包括 0）都算失败
-		if httpCode >= 200 && httpCode < 300 {
-			stat.SuccessfulRequests++
-		} else {
-			stat.FailedRequests++
-		}
-		stat.InputTokens += int64(input)
-		stat.OutputTokens += int64(output)
-		stat.ReasoningTokens += int64(reasoning)
-		stat.CacheCreateTokens += int64(cacheCreate)
-		stat.CacheReadTokens += int64(cacheRead)
-		stat.CostTotal += cost.TotalCost
-		// 记录响应时间（只记录有效的响应时间）
-		if durationSec > 0 {
-			durationMap[provider] = append(durationMap[provider], durationSec)
+		stat.SuccessfulRequests += m.successRequests
+		stat.FailedRequests += m.requests - m.successRequests
+		stat.InputTokens += m.inputTokens
+		stat.OutputTokens += m.outputTokens
+		stat.ReasoningTokens += m.reasoningTokens
+		stat.CacheCreateTokens += m.cacheCreateTokens
+		stat.CacheReadTokens += m.cacheReadTokens
+		stat.CostTotal += m.totalCost
+
+		d := durations[provider]
+		if m.durationCount > 0 {
+			if d.durationCount == 0 || m.durationMin < d.durationMin {
+				d.durationMin = m.durationMin
+			}
+			d.durationMax = max(d.durationMax, m.durationMax)
+			d.durationSum += m.durationSum
+			d.durationCount += m.durationCount
 		}
 	}
 
+	latency, err := ls.latency.providerPercentiles(platform, start)
+	if err != nil {
+		return nil, err
+	}
+
 	stats := make([]ProviderDailyStat, 0, len(statMap))
-	for _, stat := range statMap {
+	for provider, stat := range statMap {
 		if stat.TotalRequests > 0 {
 			stat.SuccessRate = float64(stat.SuccessfulRequests) / float64(stat.TotalRequests)
 		}
-		// 计算响应时间统计
-		durations := durationMap[stat.Provider]
-		if len(durations) > 0 {
-			var sum float64
-			minDur := durations[0]
-			maxDur := durations[0]
-			for _, d := range durations {
-				sum += d
-				if d < minDur {
-					minDur = d
-				}
-				if d > maxDur {
-					maxDur = d
-				}
-			}
-			stat.AvgDurationSec = sum / float64(len(durations))
-			stat.MinDurationSec = minDur
-			stat.MaxDurationSec = maxDur
+		// 响应时间统计（只包含有效的响应时间）
+		if d := durations[provider]; d.durationCount > 0 {
+			stat.AvgDurationSec = d.durationSum / float64(d.durationCount)
+			stat.MinDurationSec = d.durationMin
+			stat.MaxDurationSec = d.durationMax
+		}
+		key := provider
+		if key == "(unknown)" {
+			key = ""
+		}
+		if l, ok := latency[key]; ok {
+			stat.TTFB, stat.Total, stat.OutputTPS = l.TTFB, l.Total, l.OutputTPS
 		}
 		stats = append(stats, *stat)
 	}
@@ -453,6 +430,34 @@ func (ls *LogService) ProviderDailyStats(platform string) ([]ProviderDailyStat,
 	return stats, nil
 }
 
+// providerSpendSince 统计 since 之后各 provider 的费用（USD），读取小时汇总（按写入时的价格计算，不受原始日志清理影响）
+func (ls *LogService) providerSpendSince(platform string, since time.Time) (map[string]float64, error) {
+	rows, err := queryHourlyRollups("provider", platform, startOfHour(since), time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	spend := make(map[string]float64, len(rows))
+	for _, row := range rows {
+		spend[row.group] = row.metrics.totalCost
+	}
+	return spend, nil
+}
+
+// providerLatencySince 统计 since 所在小时之后各 provider 成功请求的平均耗时（秒），读取小时汇总
+func (ls *LogService) providerLatencySince(platform string, since time.Time) (map[string]float64, error) {
+	rows, err := queryHourlyRollups("provider", platform, startOfHour(since), time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	latency := make(map[string]float64, len(rows))
+	for _, row := range rows {
+		if m := row.metrics; m.successDurationCount > 0 {
+			latency[row.group] = m.successDurationSum / float64(m.successDurationCount)
+		}
+	}
+	return latency, nil
+}
+
 func (ls *LogService) decorateCost(logEntry *RequestLog) {
 	if ls == nil || ls.pricing == nil || logEntry == nil {
 		return
@@ -548,176 +553,22 @@ func isNoSuchTableErr(err error) bool {
 	return strings.Contains(err.Error(), "no such table")
 }
 
-// GetProviderSuccessRate 获取指定供应商的成功率
-// 返回成功率（0-1）和总请求数
+// GetProviderSuccessRate 获取指定供应商在成功率窗口内的衰减加权成功率
+// 返回成功率（0-1）和窗口内的请求数
 func (ls *LogService) GetProviderSuccessRate(platform string, providerName string) (float64, int64, error) {
 	if providerName == "" {
 		return 0, 0, nil
 	}
-
-	// 查询今天的数据
-	start := startOfDay(time.Now())
-
-	model := xdb.New("request_log")
-	options := []xdb.Option{
-		xdb.WhereGte("created_at", start.Format(timeLayout)),
-		xdb.WhereEq("provider", providerName),
-		xdb.Field("http_code"),
-	}
-	if platform != "" {
-		options = append(options, xdb.WhereEq("platform", platform))
-	}
-
-	records, err := model.Selects(options...)
-	if err != nil {
-		if errors.Is(err, xdb.ErrNotFound) || isNoSuchTableErr(err) {
-			return 0, 0, nil
-		}
-		return 0, 0, err
-	}
-
-	if len(records) == 0 {
-		return 0, 0, nil
-	}
-
-	var totalRequests int64
-	var successfulRequests int64
-
-	for _, record := range records {
-		totalRequests++
-		httpCode := record.GetInt("http_code")
-		if httpCode >= 200 && httpCode < 300 {
-			successfulRequests++
-		}
-	}
-
-	if totalRequests == 0 {
-		return 0, 0, nil
-	}
-
-	successRate := float64(successfulRequests) / float64(totalRequests)
-	return successRate, totalRequests, nil
+	rates, counts := ls.success.rates(platform)
+	return rates[providerName], int64(counts[providerName]), nil
 }
 
 // GetAllProviderSuccessRates 获取指定平台所有供应商的成功率
-// 返回 map[providerName]successRate，成功率范围 0-1
-// 使用缓存减少数据库压力，缓存 TTL 为 30 秒
+// 返回 map[providerName]successRate，成功率范围 0-1；窗口内没有请求的供应商不在结果中
+// 数据保存在内存中，每次转发结束时更新
 func (ls *LogService) GetAllProviderSuccessRates(platform string) (map[string]float64, error) {
-	cacheKey := platform
-	if cacheKey == "" {
-		cacheKey = "__all__"
-	}
-
-	// 第一次检查：尝试从缓存读取（读锁）
-	ls.srCacheMu.RLock()
-	if cache, exists := ls.srCache[cacheKey]; exists {
-		if time.Since(cache.updatedAt) < SuccessRateCacheTTL {
-			// 缓存有效，返回副本
-			result := make(map[string]float64, len(cache.data))
-			for k, v := range cache.data {
-				result[k] = v
-			}
-			ls.srCacheMu.RUnlock()
-			return result, nil
-		}
-	}
-	ls.srCacheMu.RUnlock()
-
-	// 缓存过期或不存在，获取写锁
-	ls.srCacheMu.Lock()
-	defer ls.srCacheMu.Unlock()
-
-	// 第二次检查：防止并发时多个 goroutine 同时查询数据库
-	if cache, exists := ls.srCache[cacheKey]; exists {
-		if time.Since(cache.updatedAt) < SuccessRateCacheTTL {
-			// 其他 goroutine 已经更新了缓存，返回副本
-			result := make(map[string]float64, len(cache.data))
-			for k, v := range cache.data {
-				result[k] = v
-			}
-			return result, nil
-		}
-	}
-
-	// 查询数据库
-	result, err := ls.loadProviderSuccessRates(platform)
-	if err != nil {
-		return nil, err
-	}
-
-	// 更新缓存
-	ls.srCache[cacheKey] = &successRateCache{
-		data:      result,
-		updatedAt: time.Now(),
-	}
-
-	// 返回副本
-	resultCopy := make(map[string]float64, len(result))
-	for k, v := range result {
-		resultCopy[k] = v
-	}
-	return resultCopy, nil
-}
-
-// loadProviderSuccessRates 从数据库加载供应商成功率（内部方法）
-func (ls *LogService) loadProviderSuccessRates(platform string) (map[string]float64, error) {
-	result := make(map[string]float64)
-
-	// 查询今天的数据
-	start := startOfDay(time.Now())
-
-	model := xdb.New("request_log")
-	options := []xdb.Option{
-		xdb.WhereGte("created_at", start.Format(timeLayout)),
-		xdb.WhereNotEq("provider", ""),
-		xdb.Field("provider", "http_code"),
-	}
-	if platform != "" {
-		options = append(options, xdb.WhereEq("platform", platform))
-	}
-
-	records, err := model.Selects(options...)
-	if err != nil {
-		if errors.Is(err, xdb.ErrNotFound) || isNoSuchTableErr(err) {
-			return result, nil
-		}
-		return nil, err
-	}
-
-	// 统计每个渠道的成功和总请求数
-	type stats struct {
-		total   int64
-		success int64
-	}
-	providerStats := make(map[string]*stats)
-
-	for _, record := range records {
-		provider := strings.TrimSpace(record.GetString("provider"))
-		if provider == "" {
-			continue
-		}
-
-		s := providerStats[provider]
-		if s == nil {
-			s = &stats{}
-			providerStats[provider] = s
-		}
-
-		s.total++
-		httpCode := record.GetInt("http_code")
-		if httpCode >= 200 && httpCode < 300 {
-			s.success++
-		}
-	}
-
-	// 计算成功率
-	for provider, s := range providerStats {
-		if s.total > 0 {
-			result[provider] = float64(s.success) / float64(s.total)
-		}
-	}
-
-	return result, nil
+	rates, _ := ls.success.rates(platform)
+	return rates, nil
 }
 
 type HeatmapStat struct {
@@ -760,6 +611,10 @@ type ProviderDailyStat struct {
 	AvgDurationSec float64 `json:"avg_duration_sec"` // 平均响应时间（秒）
 	MinDurationSec float64 `json:"min_duration_sec"` // 最小响应时间（秒）
 	MaxDurationSec float64 `json:"max_duration_sec"` // 最大响应时间（秒）
+	// 成功请求的分位数（来自原始日志）
+	TTFB      LatencyPercentiles `json:"ttfb"`
+	Total     LatencyPercentiles `json:"total"`
+	OutputTPS LatencyPercentiles `json:"output_tps"`
 }
 
 type LogStatsSeries struct {
@@ -772,3 +627,34 @@ type LogStatsSeries struct {
 	CacheReadTokens   int64   `json:"cache_read_tokens"`
 	TotalCost         float64 `json:"total_cost"`
 }
+
+// ShadowComparisonStat 影子 provider 与主 provider 在同一批请求上的对比
+type ShadowComparisonStat struct {
+	Platform         string          `json:"platform"`
+	ShadowProvider   string          `json:"shadow_provider"`
+	Samples          int64           `json:"samples"`
+	Shadow           ShadowSideStats `json:"shadow"`
+	Primary          ShadowSideStats `json:"primary"`
+	StatusMismatches int64           `json:"status_mismatches"` // 一方成功、另一方失败的请求数
+	LatencyDeltaSec  float64         `json:"latency_delta_sec"` // 影子平均耗时 - 主请求平均耗时
+	CostDelta        float64         `json:"cost_delta"`        // 影子总费用 - 主请求总费用
+}
+
+// ShadowSideStats 对比中单侧（影子或主请求）的汇总
+type ShadowSideStats struct {
+	Successful     int64   `json:"successful"`
+	Failed         int64   `json:"failed"`
+	SuccessRate    float64 `json:"success_rate"`
+	AvgDurationSec float64 `json:"avg_duration_sec"`
+	InputTokens    int64   `json:"input_tokens"`
+	OutputTokens   int64   `json:"output_tokens"`
+	CostTotal      float64 `json:"cost_total"`
+}
+
+func (s *ShadowSideStats) setCounts(successful int64, total int64) {
+	s.Successful = successful
+	s.Failed = total - successful
+	if total > 0 {
+		s.SuccessRate = float64(successful) / float64(total)
+	}
+}
@@ -0,0 +1,225 @@
+package services
+
+import (
+	"database/sql"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/daodao97/xgo/xdb"
+)
+
+// 日志写入参数
+const (
+	logQueueSize        = 4096                  // 待写入日志的队列长度
+	logBatchSize        = 200                   // 单个事务最多写入的行数
+	logEnqueueTimeout   = 50 * time.Millisecond // 队列已满时最多等待的时间，超时丢弃
+	logStopFlushTimeout = 5 * time.Second       // Stop 时等待剩余日志写完的时间
+)
+
+// LogWriterStats 日志写入统计（进程启动以来）
+type LogWriterStats struct {
+	Queued  int   `json:"queued"`  // 队列中待写入的日志数
+	Written int64 `json:"written"` // 已写入的日志数
+	Batches int64 `json:"batches"` // 已提交的事务数
+	Dropped int64 `json:"dropped"` // 队列已满被丢弃的日志数
+	Failed  int64 `json:"failed"`  // 写入数据库失败的日志数
+}
+
+// logEntry 一条待写入的 request_log，onWritten 在写入成功后调用
+type logEntry struct {
+	rl        *RequestLog
+	onWritten func(*RequestLog)
+}
+
+// logWriter 单个 goroutine 从有界队列取出日志，按批在事务中写入 request_log 并累加汇总表
+type logWriter struct {
+	ls    *LogService
+	queue chan logEntry
+	stop  chan struct{}
+	done  chan struct{}
+
+	// 提交与停止互斥：停止后不会再有日志进入队列，run 退出前即可写完队列
+	mu      sync.RWMutex
+	stopped bool
+
+	written atomic.Int64
+	batches atomic.Int64
+	dropped atomic.Int64
+	failed  atomic.Int64
+}
+
+func newLogWriter(ls *LogService) *logWriter {
+	w := &logWriter{
+		ls:    ls,
+		queue: make(chan logEntry, logQueueSize),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// enqueue 提交一条日志；队列已满时短暂等待（背压），仍无空间则丢弃并计数
+func (w *logWriter) enqueue(entry logEntry) {
+	w.mu.RLock()
+	if w.stopped {
+		w.mu.RUnlock()
+		// 已停止：直接同步写入，不再经过队列
+		w.flush([]logEntry{entry})
+		return
+	}
+	defer w.mu.RUnlock()
+	select {
+	case w.queue <- entry:
+		return
+	default:
+	}
+	timer := time.NewTimer(logEnqueueTimeout)
+	defer timer.Stop()
+	select {
+	case w.queue <- entry:
+	case <-timer.C:
+		if n := w.dropped.Add(1); n == 1 || n%100 == 0 {
+			log.Printf("[Log] 日志队列已满，已丢弃 %d 条请求日志", n)
+		}
+	}
+}
+
+func (w *logWriter) run() {
+	defer close(w.done)
+	batch := make([]logEntry, 0, logBatchSize)
+	for {
+		select {
+		case entry := <-w.queue:
+			batch = append(batch[:0], entry)
+			// 取出队列中已有的日志合并为一批，空闲时单条立即写入，不额外等待
+		collect:
+			for len(batch) < logBatchSize {
+				select {
+				case entry := <-w.queue:
+					batch = append(batch, entry)
+				default:
+					break collect
+				}
+			}
+			w.flush(batch)
+		case <-w.stop:
+			for {
+				batch = batch[:0]
+			drain:
+				for len(batch) < logBatchSize {
+					select {
+					case entry := <-w.queue:
+						batch = append(batch, entry)
+					default:
+						break drain
+					}
+				}
+				if len(batch) == 0 {
+					return
+				}
+				w.flush(batch)
+			}
+		}
+	}
+}
+
+// flush 在一个事务中写入一批日志；事务失败时逐条重试，仍失败的计入 Failed 且不调用 onWritten
+func (w *logWriter) flush(batch []logEntry) {
+	entries := make([]logEntry, 0, len(batch))
+	for _, entry := range batch {
+		if entry.rl != nil && entry.rl.Platform != "" {
+			entries = append(entries, entry)
+		}
+	}
+	if len(entries) == 0 {
+		return
+	}
+
+	if err := w.insert(entries); err == nil {
+		w.batches.Add(1)
+		w.written.Add(int64(len(entries)))
+	} else {
+		log.Printf("[Log] 批量写入 %d 条请求日志失败，改为逐条写入: %v", len(entries), err)
+		inserted := entries[:0]
+		for _, entry := range entries {
+			if err := w.insert([]logEntry{entry}); err != nil {
+				w.failed.Add(1)
+				continue
+			}
+			w.written.Add(1)
+			inserted = append(inserted, entry)
+		}
+		entries = inserted
+	}
+
+	for _, entry := range entries {
+		if entry.onWritten != nil {
+			entry.onWritten(entry.rl)
+		}
+	}
+}
+
+// insert 在一个事务中写入日志，并按 created_at 累加小时 / 日汇总
+func (w *logWriter) insert(entries []logEntry) error {
+	rollups := newRollupBatch()
+	return xdb.New("request_log").Transaction(func(tx *sql.Tx, m xdb.Model) error {
+		txModel := m.Tx(tx)
+		for _, entry := range entries {
+			record := requestLogRecord(entry.rl)
+			if _, err := txModel.Insert(record); err != nil {
+				return err
+			}
+			rollups.add(w.ls, record.GetString("created_at"), entry.rl)
+		}
+		return rollups.write(tx)
+	})
+}
+
+// close 停止接收队列并写完剩余日志，超时返回 false
+func (w *logWriter) close(timeout time.Duration) bool {
+	w.mu.Lock()
+	if !w.stopped {
+		w.stopped = true
+		close(w.stop)
+	}
+	w.mu.Unlock()
+	select {
+	case <-w.done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func (w *logWriter) stats() LogWriterStats {
+	return LogWriterStats{
+		Queued:  len(w.queue),
+		Written: w.written.Load(),
+		Batches: w.batches.Load(),
+		Dropped: w.dropped.Load(),
+		Failed:  w.failed.Load(),
+	}
+}
+
+// writeRequestLog 更新滑动窗口成功率并将请求日志交给后台批量写入，onWritten（可为空）在写入数据库后调用
+func (ls *LogService) writeRequestLog(rl *RequestLog, onWritten func(*RequestLog)) {
+	ls.success.record(rl)
+	ls.writer.enqueue(logEntry{rl: rl, onWritten: onWritten})
+}
+
+// LogWriterStatus 返回日志写入统计，包括丢失（丢弃或写入失败）的日志数
+func (ls *LogService) LogWriterStatus() LogWriterStats {
+	return ls.writer.stats()
+}
+
+// Stop 停止定期维护并写完队列中剩余的请求日志
+func (ls *LogService) Stop() error {
+	ls.stopMaintenance()
+	if !ls.writer.close(logStopFlushTimeout) {
+		log.Printf("[Log] 停止时仍有 %d 条请求日志未写入", len(ls.writer.queue))
+	}
+	return nil
+}
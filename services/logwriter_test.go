@@ -0,0 +1,103 @@
+package services
+
+import (
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/daodao97/xgo/xdb"
+)
+
+func TestLogWriterBatchesAndFlushesOnStop(t *testing.T) {
+	ls := newTestLogService(t)
+	w := newLogWriter(ls)
+	var written atomic.Int64
+	const n = 500
+	for i := 0; i < n; i++ {
+		w.enqueue(logEntry{
+			rl:        &RequestLog{Platform: "writer-test", Provider: "writer-batch", HttpCode: 200},
+			onWritten: func(*RequestLog) { written.Add(1) },
+		})
+	}
+	if !w.close(5 * time.Second) {
+		t.Fatalf("writer did not flush in time")
+	}
+
+	logs, err := ls.ListRequestLogs("writer-test", "writer-batch", 1000)
+	if err != nil {
+		t.Fatalf("ListRequestLogs: %v", err)
+	}
+	stats := w.stats()
+	if len(logs) != n || written.Load() != n || stats.Written != n || stats.Dropped != 0 || stats.Failed != 0 {
+		t.Fatalf("logs = %d, onWritten = %d, stats = %+v", len(logs), written.Load(), stats)
+	}
+	if stats.Batches >= n/2 {
+		t.Fatalf("expected batched inserts, got %d transactions", stats.Batches)
+	}
+
+	// 停止后提交的日志同步写入
+	w.enqueue(logEntry{rl: &RequestLog{Platform: "writer-test", Provider: "writer-batch", HttpCode: 200}})
+	if stats := w.stats(); stats.Written != n+1 {
+		t.Fatalf("log after stop not written: %+v", stats)
+	}
+}
+
+func TestLogWriterSkipsOnWrittenForFailedInserts(t *testing.T) {
+	ls := newTestLogService(t)
+	db, err := xdb.DB("default")
+	if err != nil {
+		t.Fatalf("db: %v", err)
+	}
+	if _, err := db.Exec(`CREATE TRIGGER writer_fail_test BEFORE INSERT ON request_log WHEN new.provider = 'writer-fail'
+		BEGIN SELECT RAISE(ABORT, 'writer-fail'); END`); err != nil {
+		t.Fatalf("create trigger: %v", err)
+	}
+
+	w := newLogWriter(ls)
+	var written []string
+	var mu sync.Mutex
+	for _, provider := range []string{"writer-ok", "writer-fail", "writer-ok"} {
+		w.enqueue(logEntry{
+			rl: &RequestLog{Platform: "writer-fail-test", Provider: provider, HttpCode: 200},
+			onWritten: func(rl *RequestLog) {
+				mu.Lock()
+				defer mu.Unlock()
+				written = append(written, rl.Provider)
+			},
+		})
+	}
+	if !w.close(5 * time.Second) {
+		t.Fatalf("writer did not flush in time")
+	}
+	stats := w.stats()
+	if stats.Written != 2 || stats.Failed != 1 || len(written) != 2 || slices.Contains(written, "writer-fail") {
+		t.Fatalf("stats = %+v, onWritten = %v", stats, written)
+	}
+}
+
+func TestLogWriterCloseRacingEnqueue(t *testing.T) {
+	ls := newTestLogService(t)
+	w := newLogWriter(ls)
+	var wg sync.WaitGroup
+	const workers, perWorker = 8, 50
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range perWorker {
+				w.enqueue(logEntry{rl: &RequestLog{Platform: "writer-race-test", Provider: "writer-race", HttpCode: 200}})
+			}
+		}()
+	}
+	time.Sleep(5 * time.Millisecond)
+	if !w.close(5 * time.Second) {
+		t.Fatalf("writer did not flush in time")
+	}
+	wg.Wait()
+	// 停止前进入队列的日志由后台写完，停止后提交的同步写入，都不会丢失
+	if stats := w.stats(); stats.Written+stats.Dropped != workers*perWorker || stats.Queued != 0 {
+		t.Fatalf("lost logs: %+v", stats)
+	}
+}
@@ -117,7 +117,7 @@ func (ms *MCPService) ListServers() ([]MCPServer, error) {
 
 	servers := make([]MCPServer, 0, len(names))
 	for _, name := range names {
-		entry := config[name]
+		entry := maskServerSecrets(config[name], secretSlotsOf(name, config[name]))
 		typ := normalizeServerType(entry.Type)
 		platforms := normalizePlatforms(entry.EnablePlatform)
 		server := MCPServer{
@@ -145,6 +145,12 @@ func (ms *MCPService) SaveServers(servers []MCPServer) error {
 	ms.mu.Lock()
 	defer ms.mu.Unlock()
 
+	// 前端拿到的是脱敏值，保存前需要对照现有配置还原
+	existing, err := ms.loadConfig()
+	if err != nil {
+		return err
+	}
+
 	normalized := make([]MCPServer, len(servers))
 	raw := make(map[string]rawMCPServer, len(servers))
 	for i := range servers {
@@ -155,23 +161,35 @@ func (ms *MCPService) SaveServers(servers []MCPServer) error {
 		}
 		typ := normalizeServerType(server.Type)
 		platforms := normalizePlatforms(server.EnablePlatform)
-		args := cleanArgs(server.Args)
-		env := cleanEnv(server.Env)
+		slots := secretSlotsOf(name, existing[name])
+		resolved, err := resolveServerSecrets(rawMCPServer{
+			Args: cleanArgs(server.Args),
+			Env:  cleanEnv(server.Env),
+			URL:  strings.TrimSpace(server.URL),
+		}, existing[name], slots)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		args, env, url := resolved.Args, resolved.Env, resolved.URL
 		command := strings.TrimSpace(server.Command)
-		url := strings.TrimSpace(server.URL)
 		if typ == "stdio" && command == "" {
 			return fmt.Errorf("%s 需要提供 command", name)
 		}
 		if typ == "http" && url == "" {
 			return fmt.Errorf("%s 需要提供 url", name)
 		}
+		// 写入各 CLI 配置时需要明文
+		plain, err := revealServerSecrets(resolved, slots)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
 		normalized[i] = MCPServer{
 			Name:            name,
 			Type:            typ,
 			Command:         command,
-			Args:            args,
-			Env:             env,
-			URL:             url,
+			Args:            plain.Args,
+			Env:             plain.Env,
+			URL:             plain.URL,
 			Website:         strings.TrimSpace(server.Website),
 			Tips:            strings.TrimSpace(server.Tips),
 			EnablePlatform:  platforms,
@@ -189,7 +207,7 @@ func (ms *MCPService) SaveServers(servers []MCPServer) error {
 			Tips:           normalized[i].Tips,
 			EnablePlatform: platforms,
 		}
-		placeholders := detectPlaceholders(url, args)
+		placeholders := detectPlaceholders(normalized[i].URL, args)
 		normalized[i].MissingPlaceholders = placeholders
 		if len(placeholders) > 0 {
 			normalized[i].EnablePlatform = []string{}
@@ -199,7 +217,7 @@ func (ms *MCPService) SaveServers(servers []MCPServer) error {
 		}
 	}
 
-	if err := ms.saveConfig(raw); err != nil {
+	if err := ms.saveConfig(raw, existing); err != nil {
 		return err
 	}
 	if err := ms.syncClaudeServers(normalized); err != nil {
@@ -242,11 +260,15 @@ func (ms *MCPService) loadConfig() (map[string]rawMCPServer, error) {
 		return nil, err
 	}
 
+	changed := false
 	for name, entry := range payload {
 		payload[name] = normalizeRawEntry(entry)
+		// 透明迁移：旧版明文密钥在下次保存时加密
+		if hasPlainServerSecrets(payload[name], secretSlotsOf(name, payload[name])) {
+			changed = true
+		}
 	}
 
-	changed := false
 	if imported, err := ms.importFromClaude(payload); err == nil {
 		if ms.mergeImportedServers(payload, imported) {
 			changed = true
@@ -260,7 +282,7 @@ func (ms *MCPService) loadConfig() (map[string]rawMCPServer, error) {
 	}
 
 	if changed {
-		if err := ms.saveConfig(payload); err != nil {
+		if err := ms.saveConfig(payload, payload); err != nil {
 			return payload, err
 		}
 	}
@@ -326,17 +348,24 @@ func (ms *MCPService) importFromClaude(existing map[string]rawMCPServer) (map[st
 	return result, nil
 }
 
-func (ms *MCPService) saveConfig(payload map[string]rawMCPServer) error {
+// saveConfig 加密密钥后写入 mcp.json；prev 为写入前的配置，用于识别已填写的占位符位置
+func (ms *MCPService) saveConfig(payload map[string]rawMCPServer, prev map[string]rawMCPServer) error {
 	path, err := ms.configPath()
 	if err != nil {
 		return err
 	}
-	data, err := json.MarshalIndent(payload, "", "  ")
+	sealed := make(map[string]rawMCPServer, len(payload))
+	for name, entry := range payload {
+		if sealed[name], err = sealServerSecrets(entry, secretSlotsOf(name, prev[name])); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	data, err := json.MarshalIndent(sealed, "", "  ")
 	if err != nil {
 		return err
 	}
 	tmp := path + ".tmp"
-	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
 		return err
 	}
 	return os.Rename(tmp, path)
@@ -447,6 +476,201 @@ func cleanEnv(values map[string]string) map[string]string {
 	return result
 }
 
+// mcpSecretSlots 记录 server 中需要按密钥处理的 env 名与 args 下标：
+// 内置模板或已存储配置中该位置为占位符（填写后即为用户的密钥）或已加密
+type mcpSecretSlots struct {
+	env  map[string]bool
+	args map[int]bool
+}
+
+// secretSlotsOf 汇总 name 对应的内置模板与已存储配置 prev 中的密钥位置
+func secretSlotsOf(name string, prev rawMCPServer) mcpSecretSlots {
+	slots := mcpSecretSlots{env: map[string]bool{}, args: map[int]bool{}}
+	for _, tmpl := range []rawMCPServer{builtInServers[name], prev} {
+		for key, value := range tmpl.Env {
+			if isSealedSecret(value) || placeholderPattern.MatchString(value) {
+				slots.env[key] = true
+			}
+		}
+		for i, arg := range tmpl.Args {
+			if isSealedSecret(arg) || placeholderPattern.MatchString(arg) {
+				slots.args[i] = true
+			}
+		}
+	}
+	return slots
+}
+
+// isSecretFlag 判断命令行参数是否为名称像密钥的选项（如 --api-key、-token）
+func isSecretFlag(arg string) bool {
+	return strings.HasPrefix(arg, "-") && !strings.Contains(arg, "=") && isSecretName(strings.TrimLeft(arg, "-"))
+}
+
+// transformEnvSecrets 对密钥类 env 值执行 fn（加密 / 解密 / 脱敏 / 还原）
+// 密钥类 env：名称像密钥、已加密或脱敏，或 slots 中标记的位置；空值与未填写的占位符不处理
+func transformEnvSecrets(values map[string]string, slots mcpSecretSlots, fn func(key, value string) (string, error)) (map[string]string, error) {
+	result := cloneEnv(values)
+	for key, value := range values {
+		if !isSecretName(key) && !slots.env[key] && !isSealedSecret(value) && !isMaskedSecret(value) {
+			continue
+		}
+		if value == "" || placeholderPattern.MatchString(value) {
+			continue
+		}
+		next, err := fn(key, value)
+		if err != nil {
+			return nil, fmt.Errorf("env %s: %w", key, err)
+		}
+		result[key] = next
+	}
+	return result, nil
+}
+
+// transformArgSecrets 对 args 中的密钥执行 fn（加密 / 解密 / 脱敏 / 还原）
+// 密钥包括：--api-key=xxx 中的值、--api-key 之后的参数、已加密或脱敏的参数以及 slots 中标记的位置
+func transformArgSecrets(args []string, slots mcpSecretSlots, fn func(i int, value string) (string, error)) ([]string, error) {
+	result := cloneArgs(args)
+	for i, arg := range args {
+		prefix, value := "", arg
+		if name, v, ok := strings.Cut(arg, "="); ok && isSecretFlag(name) {
+			prefix, value = name+"=", v
+		} else if !slots.args[i] && !isSealedSecret(arg) && !isMaskedSecret(arg) && (i == 0 || !isSecretFlag(args[i-1])) {
+			continue
+		}
+		if value == "" || placeholderPattern.MatchString(value) {
+			continue
+		}
+		next, err := fn(i, value)
+		if err != nil {
+			return nil, fmt.Errorf("args[%d]: %w", i, err)
+		}
+		result[i] = prefix + next
+	}
+	return result, nil
+}
+
+// sealServerSecrets 返回密钥类 env / args 与 URL 密钥参数加密后的副本（用于写入 mcp.json）
+func sealServerSecrets(entry rawMCPServer, slots mcpSecretSlots) (rawMCPServer, error) {
+	seal := func(_ string, v string) (string, error) {
+		return sealSecret(v)
+	}
+	env, err := transformEnvSecrets(entry.Env, slots, seal)
+	if err != nil {
+		return entry, err
+	}
+	args, err := transformArgSecrets(entry.Args, slots, func(_ int, v string) (string, error) {
+		return sealSecret(v)
+	})
+	if err != nil {
+		return entry, err
+	}
+	url, err := transformURLSecrets(entry.URL, seal)
+	if err != nil {
+		return entry, err
+	}
+	entry.Env = env
+	entry.Args = args
+	entry.URL = url
+	return entry, nil
+}
+
+// hasPlainServerSecrets 判断配置中是否仍有未加密的密钥类 env / args 或 URL 密钥参数
+func hasPlainServerSecrets(entry rawMCPServer, slots mcpSecretSlots) bool {
+	plain := false
+	check := func(_ string, v string) (string, error) {
+		if !isSealedSecret(v) {
+			plain = true
+		}
+		return v, nil
+	}
+	_, _ = transformEnvSecrets(entry.Env, slots, check)
+	_, _ = transformArgSecrets(entry.Args, slots, func(_ int, v string) (string, error) {
+		return check("", v)
+	})
+	_, _ = transformURLSecrets(entry.URL, check)
+	return plain
+}
+
+// resolveServerSecrets 将前端回传的脱敏 env / args / URL 参数还原为已存储的值
+// 只按位置还原：env 按变量名，args 按下标，URL 参数按参数名及其出现次序
+func resolveServerSecrets(entry rawMCPServer, prev rawMCPServer, slots mcpSecretSlots) (rawMCPServer, error) {
+	env, err := transformEnvSecrets(entry.Env, slots, func(key, v string) (string, error) {
+		return resolveMaskedSecret(v, prev.Env[key])
+	})
+	if err != nil {
+		return entry, err
+	}
+
+	prevArgs := make(map[int]string)
+	_, _ = transformArgSecrets(prev.Args, slots, func(i int, v string) (string, error) {
+		prevArgs[i] = v
+		return v, nil
+	})
+	args, err := transformArgSecrets(entry.Args, slots, func(i int, v string) (string, error) {
+		return resolveMaskedSecret(v, prevArgs[i])
+	})
+	if err != nil {
+		return entry, err
+	}
+
+	prevParams := make(map[string][]string)
+	_, _ = transformURLSecrets(prev.URL, func(name, v string) (string, error) {
+		prevParams[name] = append(prevParams[name], v)
+		return v, nil
+	})
+	seen := make(map[string]int)
+	url, err := transformURLSecrets(entry.URL, func(name, v string) (string, error) {
+		i := seen[name]
+		seen[name]++
+		return resolveMaskedSecret(v, slotOf(prevParams[name], i))
+	})
+	if err != nil {
+		return entry, fmt.Errorf("url: %w", err)
+	}
+	entry.Env = env
+	entry.Args = args
+	entry.URL = url
+	return entry, nil
+}
+
+// maskServerSecrets 返回密钥类 env / args 与 URL 密钥参数脱敏后的副本（用于返回给前端）
+func maskServerSecrets(entry rawMCPServer, slots mcpSecretSlots) rawMCPServer {
+	mask := func(_ string, v string) (string, error) {
+		return maskSecret(v), nil
+	}
+	entry.Env, _ = transformEnvSecrets(entry.Env, slots, mask)
+	entry.Args, _ = transformArgSecrets(entry.Args, slots, func(_ int, v string) (string, error) {
+		return maskSecret(v), nil
+	})
+	entry.URL, _ = transformURLSecrets(entry.URL, mask)
+	return entry
+}
+
+// revealServerSecrets 返回解密后的副本（写入各 CLI 配置时需要明文）
+func revealServerSecrets(entry rawMCPServer, slots mcpSecretSlots) (rawMCPServer, error) {
+	reveal := func(_ string, v string) (string, error) {
+		return revealSecret(v)
+	}
+	env, err := transformEnvSecrets(entry.Env, slots, reveal)
+	if err != nil {
+		return entry, err
+	}
+	args, err := transformArgSecrets(entry.Args, slots, func(_ int, v string) (string, error) {
+		return revealSecret(v)
+	})
+	if err != nil {
+		return entry, err
+	}
+	url, err := transformURLSecrets(entry.URL, reveal)
+	if err != nil {
+		return entry, fmt.Errorf("url: %w", err)
+	}
+	entry.Env = env
+	entry.Args = args
+	entry.URL = url
+	return entry, nil
+}
+
 func containsNormalized(pool map[string]struct{}, value string) bool {
 	if len(pool) == 0 {
 		return false
@@ -0,0 +1,456 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// 内置 mock 上游：Provider.APIURL 使用 mock:// 时，请求在进程内处理，不访问网络
+// 行为写在 URL 的 host 部分，逗号或分号分隔，例如：
+//
+//	mock://default                      正常返回
+//	mock://status=429,retry=5           返回 429，Retry-After: 5
+//	mock://latency=2s,in=100,out=50     延迟 2 秒后返回，固定 token 数
+//	mock://error200                     返回 200，但响应体是错误
+//	mock://disconnect=3,interval=50ms   流式返回 3 个事件后断开
+//
+// API Key 以 "mock:" 开头时，其后的内容作为该 Key 的行为覆盖 URL 中的配置，
+// 用于测试 Key 轮换（如 apiKeys: ["mock:status=429", "mock:ok"]）
+const (
+	mockScheme    = "mock"
+	mockKeyPrefix = "mock:"
+
+	mockDefaultInputTokens  = 10
+	mockDefaultOutputTokens = 20
+	mockDefaultText         = "Hello from the code-relay mock provider."
+)
+
+// mockDefaultModels 模型列表接口返回的默认模型
+var mockDefaultModels = []string{"mock-small", "mock-large"}
+
+// mockSpec 一次 mock 请求的行为
+type mockSpec struct {
+	status       int           // 非 2xx 时返回错误响应
+	retryAfter   int           // 429 时的 Retry-After（秒）
+	latency      time.Duration // 返回响应头前的延迟
+	interval     time.Duration // 流式事件之间的间隔
+	inputTokens  int
+	outputTokens int
+	error200     bool // 返回 200 但响应体为错误
+	disconnect   int  // >0 时在发送该数量的流式事件（或非流式响应的一部分）后断开
+	text         string
+	models       []string
+}
+
+func defaultMockSpec() mockSpec {
+	return mockSpec{
+		status:       http.StatusOK,
+		inputTokens:  mockDefaultInputTokens,
+		outputTokens: mockDefaultOutputTokens,
+		text:         mockDefaultText,
+		models:       mockDefaultModels,
+	}
+}
+
+// parseMockSpec 解析行为描述，在 base 的基础上覆盖
+func parseMockSpec(raw string, base mockSpec) (mockSpec, error) {
+	spec := base
+	for _, part := range strings.FieldsFunc(raw, func(r rune) bool { return r == ',' || r == ';' }) {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		var err error
+		switch key {
+		case "", "ok", "default":
+		case "status":
+			spec.status, err = strconv.Atoi(value)
+		case "retry":
+			spec.retryAfter, err = strconv.Atoi(value)
+		case "latency":
+			spec.latency, err = time.ParseDuration(value)
+		case "interval":
+			spec.interval, err = time.ParseDuration(value)
+		case "in":
+			spec.inputTokens, err = strconv.Atoi(value)
+		case "out":
+			spec.outputTokens, err = strconv.Atoi(value)
+		case "error200":
+			spec.error200 = true
+		case "disconnect":
+			spec.disconnect = 1
+			if value != "" {
+				spec.disconnect, err = strconv.Atoi(value)
+			}
+		case "text":
+			spec.text = value
+		case "models":
+			spec.models = strings.Split(value, "|")
+		default:
+			return spec, fmt.Errorf("未知的 mock 行为: %s", key)
+		}
+		if err != nil {
+			return spec, fmt.Errorf("mock 行为 %s 的值无效: %w", key, err)
+		}
+	}
+	return spec, nil
+}
+
+// mockTransport 实现 http.RoundTripper，注册在 relay 的 httpClient 上处理 mock:// 请求
+type mockTransport struct{}
+
+func init() {
+	if t, ok := httpClient.Transport.(*http.Transport); ok {
+		t.RegisterProtocol(mockScheme, mockTransport{})
+	}
+}
+
+func (mockTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	spec, err := parseMockSpec(req.URL.Host, defaultMockSpec())
+	if err != nil {
+		return nil, err
+	}
+	if key := mockRequestKey(req); strings.HasPrefix(key, mockKeyPrefix) {
+		if spec, err = parseMockSpec(strings.TrimPrefix(key, mockKeyPrefix), spec); err != nil {
+			return nil, err
+		}
+	}
+
+	var body []byte
+	if req.Body != nil {
+		body, _ = io.ReadAll(req.Body)
+		req.Body.Close()
+	}
+
+	if spec.latency > 0 {
+		if err := sleepContext(req.Context(), spec.latency); err != nil {
+			return nil, err
+		}
+	}
+
+	proto := mockProtocolFor(req.URL.Path)
+	if spec.status < 200 || spec.status >= 300 {
+		return mockErrorResponse(req, proto, spec), nil
+	}
+	if req.Method == http.MethodGet {
+		return mockResponse(req, http.StatusOK, "application/json", mockModelList(req.URL.Path, spec.models), spec, false), nil
+	}
+
+	model := gjson.GetBytes(body, "model").String()
+	if model == "" {
+		model = "mock-model"
+	}
+	stream := gjson.GetBytes(body, "stream").Bool() || strings.Contains(req.URL.Path, "streamGenerateContent")
+	if stream {
+		events := mockStreamEvents(proto, model, spec)
+		resp := mockResponse(req, http.StatusOK, "text/event-stream", nil, spec, true)
+		resp.Body = &mockStreamBody{ctx: req.Context(), events: events, interval: spec.interval, disconnect: spec.disconnect}
+		return resp, nil
+	}
+	return mockResponse(req, http.StatusOK, "application/json", mockJSONBody(proto, model, spec), spec, false), nil
+}
+
+// mockRequestKey 从请求头取出 relay 设置的 API Key
+func mockRequestKey(req *http.Request) string {
+	if key := req.Header.Get("x-api-key"); key != "" {
+		return key
+	}
+	if key := req.Header.Get("x-goog-api-key"); key != "" {
+		return key
+	}
+	return strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+}
+
+// mock 支持的协议
+const (
+	mockProtoAnthropic = "anthropic"
+	mockProtoChat      = "chat"
+	mockProtoResponses = "responses"
+	mockProtoGemini    = "gemini"
+	mockProtoEmbedding = "embedding"
+)
+
+func mockProtocolFor(path string) string {
+	switch {
+	case strings.HasSuffix(path, "/messages"):
+		return mockProtoAnthropic
+	case strings.HasSuffix(path, "/responses"):
+		return mockProtoResponses
+	case strings.HasSuffix(path, "/embeddings"):
+		return mockProtoEmbedding
+	case strings.Contains(path, "generateContent"):
+		return mockProtoGemini
+	default:
+		return mockProtoChat
+	}
+}
+
+func mockResponse(req *http.Request, status int, contentType string, body []byte, spec mockSpec, stream bool) *http.Response {
+	header := make(http.Header)
+	header.Set("Content-Type", contentType)
+	var rc io.ReadCloser = io.NopCloser(bytes.NewReader(body))
+	if !stream && spec.disconnect > 0 && len(body) > 0 {
+		// 非流式响应中途断开：只返回一半内容后报错
+		rc = &mockStreamBody{ctx: req.Context(), events: [][]byte{body[:len(body)/2], body[len(body)/2:]}, disconnect: 1}
+	}
+	return &http.Response{
+		Status:     fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode: status,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header,
+		Body:       rc,
+		Request:    req,
+	}
+}
+
+func mockErrorResponse(req *http.Request, proto string, spec mockSpec) *http.Response {
+	message := fmt.Sprintf("mock upstream error %d", spec.status)
+	resp := mockResponse(req, spec.status, "application/json", mockErrorBody(proto, spec.status, message), spec, false)
+	if spec.status == http.StatusTooManyRequests && spec.retryAfter > 0 {
+		resp.Header.Set("Retry-After", strconv.Itoa(spec.retryAfter))
+	}
+	return resp
+}
+
+func mockErrorBody(proto string, status int, message string) []byte {
+	if proto == mockProtoAnthropic {
+		errType := "api_error"
+		switch status {
+		case http.StatusUnauthorized:
+			errType = "authentication_error"
+		case http.StatusForbidden:
+			errType = "permission_error"
+		case http.StatusTooManyRequests:
+			errType = "rate_limit_error"
+		case http.StatusOK, 529:
+			errType = "overloaded_error"
+		}
+		return mockJSON(map[string]any{"type": "error", "error": map[string]any{"type": errType, "message": message}})
+	}
+	return mockJSON(map[string]any{"error": map[string]any{"message": message, "type": "mock_error", "code": status}})
+}
+
+func mockModelList(path string, models []string) []byte {
+	if strings.Contains(path, "v1beta") {
+		items := make([]map[string]any, 0, len(models))
+		for _, m := range models {
+			items = append(items, map[string]any{"name": "models/" + m})
+		}
+		return mockJSON(map[string]any{"models": items})
+	}
+	items := make([]map[string]any, 0, len(models))
+	for _, m := range models {
+		items = append(items, map[string]any{"id": m, "object": "model"})
+	}
+	return mockJSON(map[string]any{"object": "list", "data": items})
+}
+
+// mockJSONBody 构造非流式响应
+func mockJSONBody(proto string, model string, spec mockSpec) []byte {
+	if spec.error200 {
+		return mockErrorBody(proto, http.StatusOK, "mock error returned with status 200")
+	}
+	in, out := spec.inputTokens, spec.outputTokens
+	switch proto {
+	case mockProtoAnthropic:
+		return mockJSON(map[string]any{
+			"id": "msg_mock", "type": "message", "role": "assistant", "model": model,
+			"content":     []map[string]any{{"type": "text", "text": spec.text}},
+			"stop_reason": "end_turn",
+			"usage":       map[string]any{"input_tokens": in, "output_tokens": out},
+		})
+	case mockProtoResponses:
+		return mockJSON(mockResponsesObject(model, spec, "completed"))
+	case mockProtoGemini:
+		return mockJSON(mockGeminiChunk(spec.text, "STOP", &spec))
+	case mockProtoEmbedding:
+		return mockJSON(map[string]any{
+			"object": "list", "model": model,
+			"data":  []map[string]any{{"object": "embedding", "index": 0, "embedding": []float64{0.1, 0.2, 0.3}}},
+			"usage": map[string]any{"prompt_tokens": in, "total_tokens": in},
+		})
+	default:
+		return mockJSON(map[string]any{
+			"id": "chatcmpl-mock", "object": "chat.completion", "created": time.Now().Unix(), "model": model,
+			"choices": []map[string]any{{
+				"index": 0, "finish_reason": "stop",
+				"message": map[string]any{"role": "assistant", "content": spec.text},
+			}},
+			"usage": map[string]any{"prompt_tokens": in, "completion_tokens": out, "total_tokens": in + out},
+		})
+	}
+}
+
+// mockStreamEvents 构造流式响应的 SSE 事件（每个元素为一个完整事件）
+func mockStreamEvents(proto string, model string, spec mockSpec) [][]byte {
+	if spec.error200 {
+		if proto == mockProtoAnthropic {
+			return [][]byte{sseEvent("error", mockErrorBody(proto, http.StatusOK, "mock error returned in stream"))}
+		}
+		return [][]byte{sseEvent("", mockErrorBody(proto, http.StatusOK, "mock error returned in stream"))}
+	}
+
+	words := strings.SplitAfter(spec.text, " ")
+	in, out := spec.inputTokens, spec.outputTokens
+	events := make([][]byte, 0, len(words)+4)
+	switch proto {
+	case mockProtoAnthropic:
+		events = append(events,
+			sseEvent("message_start", mockJSON(map[string]any{"type": "message_start", "message": map[string]any{
+				"id": "msg_mock", "type": "message", "role": "assistant", "model": model, "content": []any{},
+				"usage": map[string]any{"input_tokens": in, "output_tokens": 0},
+			}})),
+			sseEvent("content_block_start", mockJSON(map[string]any{"type": "content_block_start", "index": 0,
+				"content_block": map[string]any{"type": "text", "text": ""}})),
+		)
+		for _, w := range words {
+			events = append(events, sseEvent("content_block_delta", mockJSON(map[string]any{"type": "content_block_delta", "index": 0,
+				"delta": map[string]any{"type": "text_delta", "text": w}})))
+		}
+		events = append(events,
+			sseEvent("content_block_stop", mockJSON(map[string]any{"type": "content_block_stop", "index": 0})),
+			sseEvent("message_delta", mockJSON(map[string]any{"type": "message_delta",
+				"delta": map[string]any{"stop_reason": "end_turn"},
+				"usage": map[string]any{"output_tokens": out}})),
+			sseEvent("message_stop", mockJSON(map[string]any{"type": "message_stop"})),
+		)
+	case mockProtoResponses:
+		events = append(events, sseEvent("response.created", mockJSON(map[string]any{
+			"type": "response.created", "response": mockResponsesObject(model, mockSpec{}, "in_progress"),
+		})))
+		for _, w := range words {
+			events = append(events, sseEvent("response.output_text.delta", mockJSON(map[string]any{
+				"type": "response.output_text.delta", "output_index": 0, "content_index": 0, "delta": w,
+			})))
+		}
+		events = append(events, sseEvent("response.completed", mockJSON(map[string]any{
+			"type": "response.completed", "response": mockResponsesObject(model, spec, "completed"),
+		})))
+	case mockProtoGemini:
+		for i, w := range words {
+			if i == len(words)-1 {
+				events = append(events, sseEvent("", mockJSON(mockGeminiChunk(w, "STOP", &spec))))
+				continue
+			}
+			events = append(events, sseEvent("", mockJSON(mockGeminiChunk(w, "", nil))))
+		}
+	default:
+		chunk := func(delta map[string]any, finish any) map[string]any {
+			return map[string]any{
+				"id": "chatcmpl-mock", "object": "chat.completion.chunk", "created": time.Now().Unix(), "model": model,
+				"choices": []map[string]any{{"index": 0, "delta": delta, "finish_reason": finish}},
+			}
+		}
+		events = append(events, sseEvent("", mockJSON(chunk(map[string]any{"role": "assistant", "content": ""}, nil))))
+		for _, w := range words {
+			events = append(events, sseEvent("", mockJSON(chunk(map[string]any{"content": w}, nil))))
+		}
+		final := chunk(map[string]any{}, "stop")
+		final["usage"] = map[string]any{"prompt_tokens": in, "completion_tokens": out, "total_tokens": in + out}
+		events = append(events, sseEvent("", mockJSON(final)), []byte("data: [DONE]\n\n"))
+	}
+	return events
+}
+
+func mockResponsesObject(model string, spec mockSpec, status string) map[string]any {
+	obj := map[string]any{"id": "resp_mock", "object": "response", "status": status, "model": model, "output": []any{}}
+	if status == "completed" {
+		obj["output"] = []map[string]any{{
+			"type": "message", "role": "assistant",
+			"content": []map[string]any{{"type": "output_text", "text": spec.text}},
+		}}
+		obj["usage"] = map[string]any{
+			"input_tokens": spec.inputTokens, "output_tokens": spec.outputTokens,
+			"total_tokens": spec.inputTokens + spec.outputTokens,
+		}
+	}
+	return obj
+}
+
+// mockGeminiChunk 构造 Gemini generateContent 响应；usage 非空时附带 usageMetadata
+func mockGeminiChunk(text string, finish string, usage *mockSpec) map[string]any {
+	candidate := map[string]any{"index": 0, "content": map[string]any{"role": "model", "parts": []map[string]any{{"text": text}}}}
+	if finish != "" {
+		candidate["finishReason"] = finish
+	}
+	chunk := map[string]any{"candidates": []map[string]any{candidate}}
+	if usage != nil {
+		chunk["usageMetadata"] = map[string]any{
+			"promptTokenCount":     usage.inputTokens,
+			"candidatesTokenCount": usage.outputTokens,
+			"totalTokenCount":      usage.inputTokens + usage.outputTokens,
+		}
+	}
+	return chunk
+}
+
+func sseEvent(event string, data []byte) []byte {
+	var buf bytes.Buffer
+	if event != "" {
+		buf.WriteString("event: " + event + "\n")
+	}
+	buf.WriteString("data: ")
+	buf.Write(data)
+	buf.WriteString("\n\n")
+	return buf.Bytes()
+}
+
+func mockJSON(v any) []byte {
+	data, _ := json.Marshal(v)
+	return data
+}
+
+// mockStreamBody 按事件逐个输出响应体，支持事件间隔和中途断开
+type mockStreamBody struct {
+	ctx        context.Context
+	events     [][]byte
+	interval   time.Duration
+	disconnect int // >0 时在输出该数量的事件后返回 io.ErrUnexpectedEOF
+	next       int
+	buf        []byte
+}
+
+func (b *mockStreamBody) Read(p []byte) (int, error) {
+	if len(b.buf) == 0 {
+		if b.disconnect > 0 && b.next >= b.disconnect {
+			return 0, io.ErrUnexpectedEOF
+		}
+		if b.next >= len(b.events) {
+			return 0, io.EOF
+		}
+		if b.next > 0 && b.interval > 0 {
+			if err := sleepContext(b.ctx, b.interval); err != nil {
+				return 0, err
+			}
+		}
+		b.buf = b.events[b.next]
+		b.next++
+	}
+	n := copy(p, b.buf)
+	b.buf = b.buf[n:]
+	return n, nil
+}
+
+func (b *mockStreamBody) Close() error { return nil }
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,267 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// 模型发现相关常量
+const (
+	modelDiscoveryTimeout   = 30 * time.Second
+	modelRefreshTick        = 10 * time.Minute // 定时刷新检查周期
+	MinModelRefreshInterval = 1                // 最小自动刷新间隔（小时）
+	modelRefreshRetry       = 30 * time.Minute // 刷新失败后的重试间隔
+)
+
+// ModelDiscoveryResult 上游模型列表与当前白名单的对比结果
+type ModelDiscoveryResult struct {
+	Provider   string   `json:"provider"`
+	Discovered []string `json:"discovered"` // 上游返回的全部模型
+	Current    []string `json:"current"`    // 当前 supportedModels
+	Added      []string `json:"added"`      // 上游有、白名单中没有的模型
+	Missing    []string `json:"missing"`    // 白名单中有（非通配符）、上游已不存在的模型
+}
+
+// DiscoverModels 调用上游模型列表接口，并与当前 supportedModels 对比
+// 兼容 OpenAI / Anthropic（data[].id）以及 Gemini（models[].name）返回格式
+func (ps *ProviderService) DiscoverModels(kind string, providerName string) (ModelDiscoveryResult, error) {
+	result := ModelDiscoveryResult{Provider: providerName}
+
+	provider, err := ps.findProvider(kind, providerName)
+	if err != nil {
+		return result, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), modelDiscoveryTimeout)
+	defer cancel()
+	discovered, err := fetchUpstreamModels(ctx, strings.ToLower(kind), provider)
+	if err != nil {
+		return result, err
+	}
+
+	result.Discovered = discovered
+	result.Current = boolMapKeys(provider.SupportedModels)
+	sort.Strings(result.Current)
+	result.Added, result.Missing = diffModels(discovered, provider.SupportedModels)
+	return result, nil
+}
+
+// AcceptDiscoveredModels 将选中的模型加入 supportedModels，并移除指定的模型
+func (ps *ProviderService) AcceptDiscoveredModels(kind string, providerName string, add []string, remove []string) error {
+	return ps.updateProvider(kind, providerName, func(p *Provider) error {
+		if p.SupportedModels == nil {
+			p.SupportedModels = make(map[string]bool)
+		}
+		for _, m := range add {
+			if m = strings.TrimSpace(m); m != "" {
+				p.SupportedModels[m] = true
+			}
+		}
+		for _, m := range remove {
+			delete(p.SupportedModels, strings.TrimSpace(m))
+		}
+		if errs := p.ValidateConfiguration(); len(errs) > 0 {
+			log.Printf("[ModelDiscovery] %s/%s 更新白名单后存在配置提示: %v", kind, providerName, errs)
+		}
+		return nil
+	})
+}
+
+// fetchUpstreamModels 依次使用 provider 的 Key 请求模型列表，返回排序去重后的模型 ID
+func fetchUpstreamModels(ctx context.Context, kind string, provider Provider) ([]string, error) {
+	keys := provider.GetAPIKeys()
+	if provider.APIURL == "" || len(keys) == 0 {
+		return nil, fmt.Errorf("provider %s 未配置 API URL 或 API Key", provider.Name)
+	}
+
+	endpoints := []string{"/v1/models"}
+	if kind == "gemini" {
+		endpoints = append(endpoints, "/v1beta/models")
+	}
+
+	var lastErr error
+	for _, apiKey := range keys {
+		for _, endpoint := range endpoints {
+			status, body, err := getUpstream(ctx, kind, provider, apiKey, endpoint)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			if status < 200 || status >= 300 {
+				lastErr = fmt.Errorf("上游返回 %d: %s", status, upstreamErrorMessage(body))
+				continue
+			}
+			models := parseModelList(body)
+			if len(models) == 0 {
+				lastErr = fmt.Errorf("上游模型列表为空或格式无法识别")
+				continue
+			}
+			return models, nil
+		}
+	}
+	return nil, lastErr
+}
+
+// parseModelList 解析上游模型列表响应
+func parseModelList(body []byte) []string {
+	seen := make(map[string]bool)
+	add := func(id string) {
+		id = strings.TrimSpace(strings.TrimPrefix(id, "models/"))
+		if id != "" {
+			seen[id] = true
+		}
+	}
+
+	// OpenAI / Anthropic: {"data":[{"id":"..."}]}
+	gjson.GetBytes(body, "data").ForEach(func(_, item gjson.Result) bool {
+		add(item.Get("id").String())
+		return true
+	})
+	// Gemini: {"models":[{"name":"models/gemini-..."}]}
+	gjson.GetBytes(body, "models").ForEach(func(_, item gjson.Result) bool {
+		if item.Type == gjson.String {
+			add(item.String())
+		} else if name := item.Get("name").String(); name != "" {
+			add(name)
+		} else {
+			add(item.Get("id").String())
+		}
+		return true
+	})
+
+	models := make([]string, 0, len(seen))
+	for id := range seen {
+		models = append(models, id)
+	}
+	sort.Strings(models)
+	return models
+}
+
+// diffModels 对比上游模型与白名单
+// added: 上游有、且未被白名单（含通配符）覆盖的模型
+// missing: 白名单中的精确模型、上游已不存在
+func diffModels(discovered []string, supported map[string]bool) (added []string, missing []string) {
+	added = make([]string, 0)
+	missing = make([]string, 0)
+	upstream := make(map[string]bool, len(discovered))
+	for _, m := range discovered {
+		upstream[m] = true
+		covered := supported[m]
+		if !covered {
+			for pattern, enabled := range supported {
+				if enabled && matchWildcard(pattern, m) {
+					covered = true
+					break
+				}
+			}
+		}
+		if !covered {
+			added = append(added, m)
+		}
+	}
+	for m, enabled := range supported {
+		if enabled && !isModelPattern(m) && !upstream[m] {
+			missing = append(missing, m)
+		}
+	}
+	sort.Strings(missing)
+	return added, missing
+}
+
+// startModelRefresh 启动定时刷新：对配置了 modelRefreshHours 的 provider，
+// 定期拉取上游模型列表，自动将新模型加入白名单（不会自动删除）
+func (ps *ProviderService) startModelRefresh() {
+	ps.mu.Lock()
+	if ps.stopCh != nil {
+		ps.mu.Unlock()
+		return
+	}
+	ps.stopCh = make(chan struct{})
+	stopCh := ps.stopCh
+	ps.mu.Unlock()
+
+	ps.wg.Add(1)
+	go func() {
+		defer ps.wg.Done()
+		ticker := time.NewTicker(modelRefreshTick)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopCh:
+				return
+			case <-ticker.C:
+				ps.refreshDueModels()
+			}
+		}
+	}()
+}
+
+func (ps *ProviderService) stopModelRefresh() {
+	ps.mu.Lock()
+	if ps.stopCh == nil {
+		ps.mu.Unlock()
+		return
+	}
+	close(ps.stopCh)
+	ps.stopCh = nil
+	ps.mu.Unlock()
+	ps.wg.Wait()
+}
+
+func (ps *ProviderService) refreshDueModels() {
+	now := time.Now()
+	for _, kind := range []string{"claude", "codex", "gemini"} {
+		providers, err := ps.loadSealedProviders(kind)
+		if err != nil {
+			continue
+		}
+		for _, p := range providers {
+			if !p.Enabled || p.ModelRefreshHours <= 0 {
+				continue
+			}
+			hours := p.ModelRefreshHours
+			if hours < MinModelRefreshInterval {
+				hours = MinModelRefreshInterval
+			}
+			key := kind + ":" + p.Name
+			ps.mu.Lock()
+			if next := ps.nextModelRefresh[key]; now.Before(next) {
+				ps.mu.Unlock()
+				continue
+			}
+			// 失败时只推迟较短的时间，成功后才按配置的间隔推迟
+			ps.nextModelRefresh[key] = now.Add(modelRefreshRetry)
+			ps.mu.Unlock()
+
+			if err := ps.refreshProviderModels(kind, p.Name); err != nil {
+				log.Printf("[ModelDiscovery] %s/%s %v，%v 后重试", kind, p.Name, err, modelRefreshRetry)
+				continue
+			}
+			ps.mu.Lock()
+			ps.nextModelRefresh[key] = now.Add(time.Duration(hours) * time.Hour)
+			ps.mu.Unlock()
+		}
+	}
+}
+
+// refreshProviderModels 拉取一次上游模型列表，将新模型加入白名单
+func (ps *ProviderService) refreshProviderModels(kind string, providerName string) error {
+	result, err := ps.DiscoverModels(kind, providerName)
+	if err != nil {
+		return fmt.Errorf("刷新模型列表失败: %w", err)
+	}
+	if len(result.Added) == 0 {
+		return nil
+	}
+	if err := ps.AcceptDiscoveredModels(kind, providerName, result.Added, nil); err != nil {
+		return fmt.Errorf("保存新模型失败: %w", err)
+	}
+	log.Printf("[ModelDiscovery] %s/%s 自动加入 %d 个新模型: %v", kind, providerName, len(result.Added), result.Added)
+	return nil
+}
@@ -0,0 +1,63 @@
+package services
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestFetchGeminiModelsUsesGoogleKeyAuth(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1beta/models" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("x-goog-api-key") != "gemini-key" || r.Header.Get("Authorization") != "" {
+			http.Error(w, `{"error":{"message":"bad auth"}}`, http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"models":[{"name":"models/gemini-2.5-pro"},{"name":"models/gemini-2.5-flash"}]}`))
+	}))
+	defer upstream.Close()
+
+	provider := Provider{Name: "gemini-native", APIURL: upstream.URL, APIKeys: []string{"gemini-key"}, Enabled: true}
+	models, err := fetchUpstreamModels(context.Background(), "gemini", provider)
+	if err != nil {
+		t.Fatalf("fetchUpstreamModels: %v", err)
+	}
+	if !slices.Equal(models, []string{"gemini-2.5-flash", "gemini-2.5-pro"}) {
+		t.Fatalf("models = %v", models)
+	}
+}
+
+func TestModelRefreshRetriesAfterFailure(t *testing.T) {
+	p := mockProvider("refresh-fail", "status=500")
+	p.ModelRefreshHours = 24
+	setProviders(t, "codex", p)
+	key := "codex:refresh-fail"
+
+	before := time.Now()
+	testProviderSvc.refreshDueModels()
+	testProviderSvc.mu.RLock()
+	next := testProviderSvc.nextModelRefresh[key]
+	testProviderSvc.mu.RUnlock()
+	if next.Before(before.Add(modelRefreshRetry)) || next.After(time.Now().Add(modelRefreshRetry)) {
+		t.Fatalf("failed refresh scheduled at %v, want retry after %v", next, modelRefreshRetry)
+	}
+
+	p.APIURL = "mock://default"
+	setProviders(t, "codex", p)
+	testProviderSvc.mu.Lock()
+	testProviderSvc.nextModelRefresh[key] = time.Time{}
+	testProviderSvc.mu.Unlock()
+	testProviderSvc.refreshDueModels()
+	testProviderSvc.mu.RLock()
+	next = testProviderSvc.nextModelRefresh[key]
+	testProviderSvc.mu.RUnlock()
+	if next.Before(before.Add(24 * time.Hour)) {
+		t.Fatalf("successful refresh scheduled at %v, want after 24h", next)
+	}
+}
@@ -0,0 +1,267 @@
+package services
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/tidwall/gjson"
+)
+
+// 模型匹配模式语法：
+//   - 精确模型名：       "claude-sonnet-4"
+//   - 通配符：           "*" 匹配任意长度，"?" 匹配单个字符，可出现多次，如 "claude-*-4-?"
+//   - 正则（re: 前缀）： "re:^claude-(opus|sonnet)-(.*)$"，整串匹配
+//
+// 映射目标（replacement）中：
+//   - "*" 依次替换为源模式中各个 "*" 捕获到的内容（正则模式下依次替换为各捕获组）
+//   - "?" 依次替换为源模式中各个 "?" 捕获到的字符
+//   - "$1"、"${name}" 引用正则或通配符的捕获组
+const regexPatternPrefix = "re:"
+
+// patternCache 缓存编译后的模式，避免每次请求重复编译
+var patternCache sync.Map // pattern -> *compiledPattern
+
+type compiledPattern struct {
+	re     *regexp.Regexp
+	err    error
+	prefix string // 字面前缀，用于排序
+	kinds  []rune // 通配符模式中每个捕获组对应的通配符（'*' 或 '?'），正则模式为 nil
+}
+
+// isModelPattern 判断是否为通配符或正则模式（而非精确模型名）
+func isModelPattern(s string) bool {
+	return strings.HasPrefix(s, regexPatternPrefix) || strings.ContainsAny(s, "*?")
+}
+
+// compileModelPattern 将模式编译为整串匹配的正则
+// 通配符中的每个 * / ? 都会成为一个捕获组
+func compileModelPattern(pattern string) (*regexp.Regexp, error) {
+	cp := loadPattern(pattern)
+	return cp.re, cp.err
+}
+
+func loadPattern(pattern string) *compiledPattern {
+	if cached, ok := patternCache.Load(pattern); ok {
+		return cached.(*compiledPattern)
+	}
+
+	cp := &compiledPattern{}
+	if body, ok := strings.CutPrefix(pattern, regexPatternPrefix); ok {
+		cp.re, cp.err = regexp.Compile("^(?:" + body + ")$")
+		// 字面前缀取自原始正则：包一层 ^(?:...)$ 后，正则自带的 ^ 会使 LiteralPrefix 为空
+		if raw, err := regexp.Compile(body); err == nil {
+			cp.prefix, _ = raw.LiteralPrefix()
+		}
+	} else {
+		var b strings.Builder
+		b.WriteString("^")
+		for _, r := range pattern {
+			switch r {
+			case '*':
+				b.WriteString("(.*)")
+				cp.kinds = append(cp.kinds, r)
+			case '?':
+				b.WriteString("(.)")
+				cp.kinds = append(cp.kinds, r)
+			default:
+				b.WriteString(regexp.QuoteMeta(string(r)))
+			}
+		}
+		b.WriteString("$")
+		cp.re, cp.err = regexp.Compile(b.String())
+		cp.prefix = pattern
+		if idx := strings.IndexAny(pattern, "*?"); idx >= 0 {
+			cp.prefix = pattern[:idx]
+		}
+	}
+
+	patternCache.Store(pattern, cp)
+	return cp
+}
+
+// matchWildcard 模式匹配函数
+// 支持多个 *、? 以及 re: 正则，如 "claude-*" 匹配 "claude-sonnet-4"
+func matchWildcard(pattern, text string) bool {
+	if !isModelPattern(pattern) {
+		return pattern == text
+	}
+	re, err := compileModelPattern(pattern)
+	if err != nil {
+		return false
+	}
+	return re.MatchString(text)
+}
+
+// applyWildcardMapping 应用模式映射
+// 示例: pattern="claude-*", replacement="anthropic/claude-*", input="claude-sonnet-4"
+//
+//	输出: "anthropic/claude-sonnet-4"
+//
+// 示例: pattern="re:^claude-(\w+)-(.*)$", replacement="vendor/$1/$2"
+func applyWildcardMapping(pattern, replacement, input string) string {
+	if !isModelPattern(pattern) {
+		return replacement
+	}
+	cp := loadPattern(pattern)
+	if cp.err != nil {
+		return replacement
+	}
+	re := cp.re
+	submatch := re.FindStringSubmatchIndex(input)
+	if submatch == nil {
+		return replacement
+	}
+
+	// 显式引用捕获组
+	if strings.Contains(replacement, "$") {
+		return string(re.ExpandString(nil, replacement, input, submatch))
+	}
+
+	// 依次将 replacement 中的 * / ? 替换为源模式中同类通配符的捕获内容
+	if !strings.ContainsAny(replacement, "*?") || re.NumSubexp() == 0 {
+		return replacement
+	}
+	captures := map[rune][]string{}
+	for i := 1; i <= re.NumSubexp(); i++ {
+		kind := '*'
+		if cp.kinds != nil {
+			kind = cp.kinds[i-1]
+		}
+		start, end := submatch[2*i], submatch[2*i+1]
+		if start < 0 {
+			captures[kind] = append(captures[kind], "")
+			continue
+		}
+		captures[kind] = append(captures[kind], input[start:end])
+	}
+	var b strings.Builder
+	next := map[rune]int{}
+	for _, r := range replacement {
+		if (r == '*' || r == '?') && next[r] < len(captures[r]) {
+			b.WriteString(captures[r][next[r]])
+			next[r]++
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// patternLiteralPrefix 返回模式在第一个通配符/正则元字符之前的字面前缀
+func patternLiteralPrefix(pattern string) string {
+	return loadPattern(pattern).prefix
+}
+
+// resolveModelMapping 按确定的优先级查找模型映射：精确匹配 > 字面前缀最长的模式 > 声明顺序
+// 没有命中时返回 false
+func resolveModelMapping(mapping map[string]string, order []string, model string) (string, bool) {
+	if target, ok := mapping[model]; ok {
+		return target, true
+	}
+	for _, pattern := range orderedMappingPatterns(mapping, order) {
+		if matchWildcard(pattern, model) {
+			return applyWildcardMapping(pattern, mapping[pattern], model), true
+		}
+	}
+	return "", false
+}
+
+// orderedMappingPatterns 返回映射中的模式 key，按确定的优先级排序：
+// 字面前缀越长越优先，相同时按声明顺序（order），未声明的按字典序
+func orderedMappingPatterns(mapping map[string]string, order []string) []string {
+	declared := make(map[string]int, len(order))
+	for i, key := range order {
+		if _, exists := declared[key]; !exists {
+			declared[key] = i
+		}
+	}
+
+	patterns := make([]string, 0, len(mapping))
+	for key := range mapping {
+		if isModelPattern(key) {
+			patterns = append(patterns, key)
+		}
+	}
+	sort.SliceStable(patterns, func(i, j int) bool {
+		pi, pj := len(patternLiteralPrefix(patterns[i])), len(patternLiteralPrefix(patterns[j]))
+		if pi != pj {
+			return pi > pj
+		}
+		oi, iok := declared[patterns[i]]
+		oj, jok := declared[patterns[j]]
+		if iok != jok {
+			return iok
+		}
+		if iok && oi != oj {
+			return oi < oj
+		}
+		return patterns[i] < patterns[j]
+	})
+	return patterns
+}
+
+// mappingKeyOrder 返回 JSON 对象 data 中 field 的 key 顺序（Go map 不保留声明顺序）
+func mappingKeyOrder(data []byte, field string) []string {
+	var order []string
+	gjson.GetBytes(data, field).ForEach(func(key, _ gjson.Result) bool {
+		order = append(order, key.String())
+		return true
+	})
+	return order
+}
+
+// expandTargetPattern 将映射目标中的捕获引用（$1、${name}）统一视为通配符，
+// 以便与 SupportedModels 做匹配校验
+var captureRefPattern = regexp.MustCompile(`\$(\d+|\{[^}]*\})`)
+
+func expandTargetPattern(target string) string {
+	if strings.HasPrefix(target, regexPatternPrefix) {
+		return target
+	}
+	return captureRefPattern.ReplaceAllString(target, "*")
+}
+
+// isTargetSupported 校验映射目标（可能含通配符）是否被 SupportedModels 覆盖：
+// 目标为精确名时直接匹配白名单；目标含通配符时，只要展开后能命中白名单中的任一模型即视为有效
+func (p *Provider) isTargetSupported(target string) bool {
+	target = expandTargetPattern(target)
+	if !isModelPattern(target) {
+		if p.SupportedModels[target] {
+			return true
+		}
+		for supported := range p.SupportedModels {
+			if matchWildcard(supported, target) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for supported := range p.SupportedModels {
+		if !isModelPattern(supported) {
+			if matchWildcard(target, supported) {
+				return true
+			}
+			continue
+		}
+		// 白名单本身也是模式：用示例展开的目标去匹配
+		if matchWildcard(supported, sampleExpansion(target)) {
+			return true
+		}
+	}
+	return false
+}
+
+// sampleExpansion 将通配符模式展开为一个示例模型名（* 与 ? 替换为 "x"）
+func sampleExpansion(pattern string) string {
+	if strings.HasPrefix(pattern, regexPatternPrefix) {
+		cp := loadPattern(pattern)
+		if cp.err != nil {
+			return pattern
+		}
+		return cp.prefix + "x"
+	}
+	return strings.NewReplacer("*", "x", "?", "x").Replace(pattern)
+}
@@ -0,0 +1,112 @@
+package services
+
+import "testing"
+
+func TestGetEffectiveModelPrecedence(t *testing.T) {
+	tests := []struct {
+		name    string
+		mapping map[string]string
+		order   []string
+		model   string
+		want    string
+	}{
+		{
+			name:    "exact beats patterns",
+			mapping: map[string]string{"claude-*": "wild", "re:^claude-(.*)$": "regex", "claude-sonnet-4": "exact"},
+			model:   "claude-sonnet-4",
+			want:    "exact",
+		},
+		{
+			name:    "longer wildcard prefix wins",
+			mapping: map[string]string{"claude-*": "short", "claude-sonnet-*": "long"},
+			model:   "claude-sonnet-4",
+			want:    "long",
+		},
+		{
+			name:    "anchored regex uses its literal prefix",
+			mapping: map[string]string{"claude-*": "wild", "re:^claude-(opus|sonnet)-(.*)$": "regex"},
+			order:   []string{"re:^claude-(opus|sonnet)-(.*)$", "claude-*"},
+			model:   "claude-opus-4",
+			want:    "regex",
+		},
+		{
+			name:    "regex without literal prefix loses to wildcard",
+			mapping: map[string]string{"re:(?i)claude-.*": "regex", "claude-*": "wild"},
+			order:   []string{"re:(?i)claude-.*", "claude-*"},
+			model:   "claude-opus-4",
+			want:    "wild",
+		},
+		{
+			name:    "equal prefix follows declaration order",
+			mapping: map[string]string{"gpt-*-mini": "second", "gpt-*": "first"},
+			order:   []string{"gpt-*", "gpt-*-mini"},
+			model:   "gpt-4o-mini",
+			want:    "first",
+		},
+		{
+			name:    "declared patterns before undeclared",
+			mapping: map[string]string{"gpt-?o": "undeclared", "gpt-*": "declared"},
+			order:   []string{"gpt-*"},
+			model:   "gpt-4o",
+			want:    "declared",
+		},
+		{
+			name:    "no match keeps model",
+			mapping: map[string]string{"claude-*": "wild"},
+			model:   "gpt-5",
+			want:    "gpt-5",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := Provider{ModelMapping: tt.mapping, ModelMappingOrder: tt.order}
+			for i := 0; i < 5; i++ {
+				if got := p.GetEffectiveModel(tt.model); got != tt.want {
+					t.Fatalf("GetEffectiveModel(%q) = %q, want %q", tt.model, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestApplyWildcardMappingCaptures(t *testing.T) {
+	tests := []struct {
+		pattern     string
+		replacement string
+		input       string
+		want        string
+	}{
+		{"claude-*", "anthropic/claude-*", "claude-sonnet-4", "anthropic/claude-sonnet-4"},
+		{"claude-*-*", "vendor/*/*", "claude-opus-4", "vendor/opus/4"},
+		{"gpt-?-*", "openai/gpt-*", "gpt-5-mini", "openai/gpt-mini"},
+		{"gpt-?-*", "openai/gpt-?-*", "gpt-5-mini", "openai/gpt-5-mini"},
+		{"gpt-*-?", "openai/?/*", "gpt-4o-2", "openai/2/4o"},
+		{"claude-*-?", "vendor/$1/$2", "claude-opus-4", "vendor/opus/4"},
+		{"re:^claude-(opus|sonnet)-(.*)$", "vendor/$1/$2", "claude-opus-4", "vendor/opus/4"},
+		{"re:^claude-(?P<tier>\\w+)-(.*)$", "vendor/${tier}", "claude-haiku-3", "vendor/haiku"},
+		{"re:^claude-(\\w+)-(.*)$", "vendor/*-*", "claude-haiku-3", "vendor/haiku-3"},
+		{"claude-*", "fixed-model", "claude-sonnet-4", "fixed-model"},
+	}
+	for _, tt := range tests {
+		if got := applyWildcardMapping(tt.pattern, tt.replacement, tt.input); got != tt.want {
+			t.Errorf("applyWildcardMapping(%q, %q, %q) = %q, want %q", tt.pattern, tt.replacement, tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestPatternLiteralPrefix(t *testing.T) {
+	tests := map[string]string{
+		"claude-sonnet-4":                "claude-sonnet-4",
+		"claude-*":                       "claude-",
+		"gpt-?o":                         "gpt-",
+		"re:^claude-(opus|sonnet)-(.*)$": "claude-",
+		"re:claude-(opus|sonnet)":        "claude-",
+		"re:(opus|sonnet)":               "",
+		"re:([":                          "",
+	}
+	for pattern, want := range tests {
+		if got := patternLiteralPrefix(pattern); got != want {
+			t.Errorf("patternLiteralPrefix(%q) = %q, want %q", pattern, got, want)
+		}
+	}
+}
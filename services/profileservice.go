@@ -0,0 +1,572 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 配置方案相关常量
+const (
+	profileStoreFile     = "profiles.json"
+	profileWatchInterval = 2 * time.Second // 检测 CLI 等外部修改的间隔
+)
+
+// profileKinds 配置方案覆盖的平台
+var profileKinds = []string{"claude", "codex", "gemini"}
+
+// profileCommonConfigKinds 拥有通用配置的平台（与 CommonConfigService 支持的类型一致）
+var profileCommonConfigKinds = []string{"claude", "codex"}
+
+// ProfileProviderState 配置方案中单个 provider 的快照
+type ProfileProviderState struct {
+	ID           int    `json:"id"`
+	Name         string `json:"name"`
+	Enabled      bool   `json:"enabled"`
+	Level        int    `json:"level,omitempty"`
+	KeyStrategy  string `json:"keyStrategy,omitempty"`
+	KeyWeights   []int  `json:"keyWeights,omitempty"`
+	DisabledKeys []int  `json:"disabledKeys,omitempty"`
+
+	TrafficWeight int     `json:"trafficWeight,omitempty"`
+	MonthlyQuota  float64 `json:"monthlyQuota,omitempty"`
+}
+
+// Profile 命名的配置方案：三个平台的启用集合、优先级、Key 选择以及通用配置
+type Profile struct {
+	Name         string                            `json:"name"`
+	Description  string                            `json:"description,omitempty"`
+	Providers    map[string][]ProfileProviderState `json:"providers"`              // key: 平台
+	CommonConfig map[string]string                 `json:"commonConfig,omitempty"` // key: 平台，value: JSON 字符串
+	UpdatedAt    string                            `json:"updatedAt"`
+}
+
+type profileStore struct {
+	Active   string    `json:"active"`
+	Profiles []Profile `json:"profiles"`
+}
+
+// ProfileService 管理配置方案的保存与切换
+// GUI、托盘菜单和 CLI 共用同一套切换逻辑
+type ProfileService struct {
+	mu           sync.Mutex
+	path         string
+	modTime      time.Time
+	providers    *ProviderService
+	commonConfig *CommonConfigService
+	onChange     func()
+	stopCh       chan struct{}
+	wg           sync.WaitGroup
+}
+
+// NewProfileService 创建配置方案服务，并恢复上次激活的方案名
+func NewProfileService(providers *ProviderService, commonConfig *CommonConfigService) *ProfileService {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		home = "."
+	}
+	ps := &ProfileService{
+		path:         filepath.Join(home, ".code-relay", profileStoreFile),
+		providers:    providers,
+		commonConfig: commonConfig,
+	}
+	if store, err := ps.load(); err == nil {
+		providers.setActiveProfile(store.Active)
+	}
+	return ps
+}
+
+// Start 启动外部修改检测（CLI 切换方案后运行中的实例立即生效）
+func (ps *ProfileService) Start() error {
+	ps.mu.Lock()
+	if ps.stopCh != nil {
+		ps.mu.Unlock()
+		return nil
+	}
+	ps.stopCh = make(chan struct{})
+	stopCh := ps.stopCh
+	ps.mu.Unlock()
+
+	ps.wg.Add(1)
+	go func() {
+		defer ps.wg.Done()
+		ticker := time.NewTicker(profileWatchInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopCh:
+				return
+			case <-ticker.C:
+				ps.checkExternalChange()
+			}
+		}
+	}()
+	return nil
+}
+
+func (ps *ProfileService) Stop() error {
+	ps.mu.Lock()
+	if ps.stopCh == nil {
+		ps.mu.Unlock()
+		return nil
+	}
+	close(ps.stopCh)
+	ps.stopCh = nil
+	ps.mu.Unlock()
+	ps.wg.Wait()
+	return nil
+}
+
+// SetOnChange 设置方案列表或激活方案变化时的回调（用于刷新托盘菜单）
+func (ps *ProfileService) SetOnChange(fn func()) {
+	ps.mu.Lock()
+	ps.onChange = fn
+	ps.mu.Unlock()
+}
+
+// ListProfiles 返回所有配置方案（按名称排序）
+func (ps *ProfileService) ListProfiles() ([]Profile, error) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	store, err := ps.load()
+	if err != nil {
+		return nil, err
+	}
+	return store.Profiles, nil
+}
+
+// GetActiveProfile 返回当前激活的方案名，未使用方案时返回空串
+func (ps *ProfileService) GetActiveProfile() string {
+	return ps.providers.activeProfileName()
+}
+
+// SaveProfile 将当前配置快照为指定名称的方案（同名覆盖）
+func (ps *ProfileService) SaveProfile(name string, description string) (Profile, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return Profile{}, fmt.Errorf("方案名称不能为空")
+	}
+
+	profile := Profile{
+		Name:         name,
+		Description:  strings.TrimSpace(description),
+		Providers:    make(map[string][]ProfileProviderState, len(profileKinds)),
+		CommonConfig: make(map[string]string, len(profileCommonConfigKinds)),
+		UpdatedAt:    time.Now().Format("2006-01-02 15:04:05"),
+	}
+	for _, kind := range profileKinds {
+		providers, err := ps.providers.loadSealedProviders(kind)
+		if err != nil {
+			return Profile{}, err
+		}
+		states := make([]ProfileProviderState, 0, len(providers))
+		for _, p := range providers {
+			states = append(states, ProfileProviderState{
+				ID:           p.ID,
+				Name:         p.Name,
+				Enabled:      p.Enabled,
+				Level:        p.Level,
+				KeyStrategy:  p.KeyStrategy,
+				KeyWeights:   append([]int(nil), p.KeyWeights...),
+				DisabledKeys: append([]int(nil), p.DisabledKeys...),
+
+				TrafficWeight: p.TrafficWeight,
+				MonthlyQuota:  p.MonthlyQuota,
+			})
+		}
+		profile.Providers[kind] = states
+	}
+	if ps.commonConfig != nil {
+		for _, kind := range profileCommonConfigKinds {
+			config, err := ps.commonConfig.GetCommonConfigJSON(kind)
+			if err != nil {
+				return Profile{}, err
+			}
+			profile.CommonConfig[kind] = config
+		}
+	}
+
+	ps.mu.Lock()
+	store, err := ps.load()
+	if err != nil {
+		ps.mu.Unlock()
+		return Profile{}, err
+	}
+	replaced := false
+	for i := range store.Profiles {
+		if store.Profiles[i].Name == name {
+			store.Profiles[i] = profile
+			replaced = true
+			break
+		}
+	}
+	if !replaced {
+		store.Profiles = append(store.Profiles, profile)
+	}
+	err = ps.save(store)
+	ps.mu.Unlock()
+	if err != nil {
+		return Profile{}, err
+	}
+
+	ps.notifyChange()
+	return profile, nil
+}
+
+// DeleteProfile 删除方案；删除当前激活的方案时仅清除激活标记，不改动 provider 配置
+func (ps *ProfileService) DeleteProfile(name string) error {
+	ps.mu.Lock()
+	store, err := ps.load()
+	if err != nil {
+		ps.mu.Unlock()
+		return err
+	}
+	found := false
+	for i := range store.Profiles {
+		if store.Profiles[i].Name == name {
+			store.Profiles = append(store.Profiles[:i], store.Profiles[i+1:]...)
+			found = true
+			break
+		}
+	}
+	if !found {
+		ps.mu.Unlock()
+		return fmt.Errorf("方案不存在: %s", name)
+	}
+	if store.Active == name {
+		store.Active = ""
+		ps.providers.setActiveProfile("")
+	}
+	err = ps.save(store)
+	ps.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	ps.notifyChange()
+	return nil
+}
+
+// SwitchProfile 切换到指定方案：provider 文件、通用配置和激活标记作为一组文件替换，
+// 任一文件写入失败时恢复全部原文件并返回错误，激活方案保持不变；成功后 relay 下一个请求即使用新方案
+func (ps *ProfileService) SwitchProfile(name string) error {
+	ps.mu.Lock()
+	store, err := ps.load()
+	if err != nil {
+		ps.mu.Unlock()
+		return err
+	}
+	var profile *Profile
+	for i := range store.Profiles {
+		if store.Profiles[i].Name == name {
+			profile = &store.Profiles[i]
+			break
+		}
+	}
+	if profile == nil {
+		ps.mu.Unlock()
+		return fmt.Errorf("方案不存在: %s", name)
+	}
+
+	var files []pendingFile
+	if ps.commonConfig != nil {
+		kinds := make([]string, 0, len(profile.CommonConfig))
+		for kind := range profile.CommonConfig {
+			kinds = append(kinds, kind)
+		}
+		sort.Strings(kinds)
+		for _, kind := range kinds {
+			path, data, err := ps.commonConfig.encodeCommonConfig(kind, profile.CommonConfig[kind])
+			if err != nil {
+				ps.mu.Unlock()
+				return fmt.Errorf("%s 通用配置: %w", kind, err)
+			}
+			files = append(files, pendingFile{path: path, data: data, perm: 0o644})
+		}
+	}
+	store.Active = profile.Name
+	data, err := json.MarshalIndent(store, "", "  ")
+	if err != nil {
+		ps.mu.Unlock()
+		return err
+	}
+	// 激活标记最后写入：CLI 切换时运行中的实例检测到它的变化后，其余文件已经就绪
+	files = append(files, pendingFile{path: ps.path, data: data, perm: 0o644})
+
+	err = ps.providers.applyProfileStates(profile.Name, profile.Providers, files)
+	if info, statErr := os.Stat(ps.path); statErr == nil {
+		ps.modTime = info.ModTime()
+	}
+	ps.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[Profile] 已切换到方案: %s", name)
+	ps.notifyChange()
+	return nil
+}
+
+// checkExternalChange 检测 profiles.json 的外部修改（如 CLI 切换），
+// 发现修改时丢弃 provider 缓存，使 relay 立即读取新的配置
+func (ps *ProfileService) checkExternalChange() {
+	info, err := os.Stat(ps.path)
+	if err != nil {
+		return
+	}
+
+	ps.mu.Lock()
+	if info.ModTime().Equal(ps.modTime) {
+		ps.mu.Unlock()
+		return
+	}
+	store, err := ps.load()
+	ps.mu.Unlock()
+	if err != nil {
+		return
+	}
+
+	// CLI 切换时会同时改写 provider 文件，统一丢弃缓存重新读取
+	ps.providers.reloadProviders(store.Active)
+	log.Printf("[Profile] 检测到外部修改，当前方案: %s", store.Active)
+	ps.notifyChange()
+}
+
+func (ps *ProfileService) notifyChange() {
+	ps.mu.Lock()
+	fn := ps.onChange
+	ps.mu.Unlock()
+	if fn != nil {
+		fn()
+	}
+}
+
+// load 读取方案文件（调用方持有 ps.mu）
+func (ps *ProfileService) load() (profileStore, error) {
+	store := profileStore{Profiles: []Profile{}}
+	info, err := os.Stat(ps.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return store, nil
+		}
+		return store, err
+	}
+	data, err := os.ReadFile(ps.path)
+	if err != nil {
+		return store, err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &store); err != nil {
+			return store, err
+		}
+	}
+	if store.Profiles == nil {
+		store.Profiles = []Profile{}
+	}
+	sort.Slice(store.Profiles, func(i, j int) bool {
+		return store.Profiles[i].Name < store.Profiles[j].Name
+	})
+	ps.modTime = info.ModTime()
+	return store, nil
+}
+
+// save 原子写入方案文件（调用方持有 ps.mu）
+func (ps *ProfileService) save(store profileStore) error {
+	if err := os.MkdirAll(filepath.Dir(ps.path), 0o755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(store, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := ps.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, ps.path); err != nil {
+		return err
+	}
+	if info, err := os.Stat(ps.path); err == nil {
+		ps.modTime = info.ModTime()
+	}
+	return nil
+}
+
+// applyProfileStates 在写锁内按快照更新所有平台的 provider，与 extra 中的文件一起通过 replaceFiles 持久化
+// 快照中不存在的 provider（方案保存后新增的）会被禁用，保证启用集合与方案一致；
+// 写入失败时磁盘上的文件已恢复原样，缓存和激活方案也保持不变
+func (ps *ProviderService) applyProfileStates(profile string, states map[string][]ProfileProviderState, extra []pendingFile) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	kinds := make([]string, 0, len(states))
+	for kind := range states {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+
+	updated := make(map[string][]Provider, len(states))
+	files := make([]pendingFile, 0, len(states)+len(extra))
+	for _, kind := range kinds {
+		snapshot := states[kind]
+		kind = strings.ToLower(kind)
+		providers, err := ps.loadProvidersInternal(kind)
+		if err != nil {
+			return err
+		}
+		for i := range providers {
+			state, ok := findProfileState(snapshot, providers[i])
+			if !ok {
+				providers[i].Enabled = false
+				continue
+			}
+			providers[i].Enabled = state.Enabled
+			providers[i].Level = state.Level
+			providers[i].KeyStrategy = state.KeyStrategy
+			providers[i].KeyWeights = append([]int(nil), state.KeyWeights...)
+			providers[i].DisabledKeys = append([]int(nil), state.DisabledKeys...)
+			providers[i].TrafficWeight = state.TrafficWeight
+			providers[i].MonthlyQuota = state.MonthlyQuota
+		}
+		updated[kind] = providers
+
+		path, err := providerFilePath(kind)
+		if err != nil {
+			return err
+		}
+		data, err := encodeProvidersFile(providers)
+		if err != nil {
+			return err
+		}
+		files = append(files, pendingFile{path: path, data: data, perm: 0o600})
+	}
+
+	if err := replaceFiles(append(files, extra...)); err != nil {
+		return err
+	}
+	if ps.cache == nil {
+		ps.cache = make(map[string][]Provider)
+	}
+	for kind, providers := range updated {
+		ps.cache[kind] = deepCopyProviders(providers)
+	}
+	ps.activeProfile = profile
+	return nil
+}
+
+// pendingFile 待写入的文件
+type pendingFile struct {
+	path string
+	data []byte
+	perm os.FileMode
+}
+
+// replaceFiles 替换一组文件：先全部写入临时文件，再依次重命名到目标路径；
+// 任一步失败时删除临时文件、将已替换的文件恢复为原内容并返回错误
+func replaceFiles(files []pendingFile) error {
+	tmps := make([]string, 0, len(files))
+	removeTmps := func() {
+		for _, tmp := range tmps {
+			os.Remove(tmp)
+		}
+	}
+	for _, f := range files {
+		tmp := f.path + ".tmp"
+		if err := os.WriteFile(tmp, f.data, f.perm); err != nil {
+			removeTmps()
+			return err
+		}
+		tmps = append(tmps, tmp)
+	}
+
+	// 记录原内容，用于回滚（nil 表示原本不存在）
+	originals := make([][]byte, len(files))
+	for i, f := range files {
+		data, err := os.ReadFile(f.path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			removeTmps()
+			return err
+		}
+		if err == nil && data == nil {
+			data = []byte{}
+		}
+		originals[i] = data
+	}
+
+	for i, f := range files {
+		if err := os.Rename(tmps[i], f.path); err != nil {
+			removeTmps()
+			var restoreErrs []error
+			for j := i - 1; j >= 0; j-- {
+				if err := restoreFile(files[j], originals[j]); err != nil {
+					restoreErrs = append(restoreErrs, err)
+				}
+			}
+			if len(restoreErrs) > 0 {
+				return fmt.Errorf("写入 %s 失败: %w；恢复原文件失败: %w", f.path, err, errors.Join(restoreErrs...))
+			}
+			return fmt.Errorf("写入 %s 失败，已恢复原文件: %w", f.path, err)
+		}
+	}
+	return nil
+}
+
+// restoreFile 将文件恢复为原内容，原本不存在的文件直接删除
+func restoreFile(f pendingFile, original []byte) error {
+	if original == nil {
+		if err := os.Remove(f.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	tmp := f.path + ".tmp"
+	if err := os.WriteFile(tmp, original, f.perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.path)
+}
+
+// findProfileState 按 ID（其次按名称）查找 provider 的快照
+func findProfileState(snapshot []ProfileProviderState, p Provider) (ProfileProviderState, bool) {
+	if p.ID != 0 {
+		for _, s := range snapshot {
+			if s.ID == p.ID {
+				return s, true
+			}
+		}
+	}
+	for _, s := range snapshot {
+		if s.Name == p.Name {
+			return s, true
+		}
+	}
+	return ProfileProviderState{}, false
+}
+
+// reloadProviders 丢弃缓存，下次读取时从磁盘重新加载
+func (ps *ProviderService) reloadProviders(profile string) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.cache = make(map[string][]Provider)
+	ps.activeProfile = profile
+}
+
+func (ps *ProviderService) setActiveProfile(profile string) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.activeProfile = profile
+}
+
+// activeProfileName 返回当前激活的方案名（写入 request_log）
+func (ps *ProviderService) activeProfileName() string {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	return ps.activeProfile
+}
@@ -0,0 +1,155 @@
+package services
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// profileProviders 返回 provider 名称到启用状态的映射
+func profileProviders(t *testing.T, ps *ProviderService, kind string) map[string]bool {
+	t.Helper()
+	providers, err := ps.loadSealedProviders(kind)
+	if err != nil {
+		t.Fatalf("loadSealedProviders: %v", err)
+	}
+	enabled := make(map[string]bool, len(providers))
+	for _, p := range providers {
+		enabled[p.Name] = p.Enabled
+	}
+	return enabled
+}
+
+func newTestProfileService(t *testing.T) *ProfileService {
+	t.Helper()
+	profiles := NewProfileService(testProviderSvc, NewCommonConfigService())
+	t.Cleanup(func() {
+		os.Remove(profiles.path)
+		testProviderSvc.setActiveProfile("")
+	})
+	return profiles
+}
+
+func TestProfileSaveAndSwitch(t *testing.T) {
+	profiles := newTestProfileService(t)
+	common := NewCommonConfigService()
+	work, home := mockProvider("profile-work", "default"), mockProvider("profile-home", "default")
+	home.Enabled = false
+	setProviders(t, "claude", work, home)
+	if err := common.SaveCommonConfigJSON("claude", `{"env":"work"}`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := profiles.SaveProfile("work", "office"); err != nil {
+		t.Fatalf("SaveProfile: %v", err)
+	}
+
+	work.Enabled, home.Enabled = false, true
+	setProviders(t, "claude", work, home)
+	if err := common.SaveCommonConfigJSON("claude", `{"env":"home"}`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := profiles.SaveProfile("home", ""); err != nil {
+		t.Fatalf("SaveProfile: %v", err)
+	}
+	list, err := profiles.ListProfiles()
+	if err != nil || len(list) != 2 || list[0].Name != "home" || list[1].Name != "work" {
+		t.Fatalf("ListProfiles = %+v, %v", list, err)
+	}
+
+	if err := profiles.SwitchProfile("work"); err != nil {
+		t.Fatalf("SwitchProfile: %v", err)
+	}
+	if enabled := profileProviders(t, testProviderSvc, "claude"); !enabled["profile-work"] || enabled["profile-home"] {
+		t.Fatalf("providers after switch = %v", enabled)
+	}
+	if config, _ := common.GetCommonConfigJSON("claude"); !bytes.Contains([]byte(config), []byte(`"work"`)) {
+		t.Fatalf("common config after switch = %s", config)
+	}
+	if active := profiles.GetActiveProfile(); active != "work" {
+		t.Fatalf("active profile = %q", active)
+	}
+
+	// CLI（profile use）在另一个进程中切换，运行中的实例检测到修改后重新读取
+	cli := NewProfileService(NewProviderService(), NewCommonConfigService())
+	if err := cli.SwitchProfile("home"); err != nil {
+		t.Fatalf("cli SwitchProfile: %v", err)
+	}
+	profiles.checkExternalChange()
+	if active := profiles.GetActiveProfile(); active != "home" {
+		t.Fatalf("active profile after external switch = %q", active)
+	}
+	if enabled := profileProviders(t, testProviderSvc, "claude"); enabled["profile-work"] || !enabled["profile-home"] {
+		t.Fatalf("providers after external switch = %v", enabled)
+	}
+
+	if err := profiles.SwitchProfile("missing"); err == nil {
+		t.Fatal("switched to a missing profile")
+	}
+}
+
+func TestProfileSwitchRollsBackOnFailure(t *testing.T) {
+	profiles := newTestProfileService(t)
+	common := NewCommonConfigService()
+	p := mockProvider("profile-rollback", "default")
+	setProviders(t, "claude", p)
+	if err := common.SaveCommonConfigJSON("claude", `{"env":"saved"}`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := profiles.SaveProfile("rollback", ""); err != nil {
+		t.Fatalf("SaveProfile: %v", err)
+	}
+	if err := profiles.SwitchProfile("rollback"); err != nil {
+		t.Fatalf("SwitchProfile: %v", err)
+	}
+
+	p.Enabled = false
+	setProviders(t, "claude", p)
+	if err := common.SaveCommonConfigJSON("claude", `{"env":"current"}`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := profiles.SaveProfile("other", ""); err != nil {
+		t.Fatalf("SaveProfile: %v", err)
+	}
+
+	// 让 codex 通用配置无法写入：目标路径被目录占用
+	codexPath, err := common.getConfigPath("codex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(codexPath)
+	if err := os.MkdirAll(filepath.Join(codexPath, "blocked"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(codexPath) })
+
+	claudePath, _ := providerFilePath("claude")
+	claudeConfigPath, _ := common.getConfigPath("claude")
+	before := map[string][]byte{}
+	for _, path := range []string{claudePath, claudeConfigPath, profiles.path} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		before[path] = data
+	}
+
+	if err := profiles.SwitchProfile("rollback"); err == nil {
+		t.Fatal("SwitchProfile succeeded with an unwritable common config")
+	}
+	for path, data := range before {
+		after, err := os.ReadFile(path)
+		if err != nil || !bytes.Equal(after, data) {
+			t.Fatalf("%s changed after failed switch: %v", filepath.Base(path), err)
+		}
+		if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+			t.Fatalf("temporary file left for %s", filepath.Base(path))
+		}
+	}
+	if active := profiles.GetActiveProfile(); active != "rollback" {
+		t.Fatalf("active profile changed to %q", active)
+	}
+	if enabled := profileProviders(t, testProviderSvc, "claude"); enabled["profile-rollback"] {
+		t.Fatal("provider cache updated by failed switch")
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"log"
 	"math/rand"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"sort"
@@ -27,6 +28,16 @@ type ProviderRelayService struct {
 	logService      *LogService
 	server          *http.Server
 	addr            string
+	prober          *healthProber
+	keys            *keySelector
+	policies        *routePolicyStore
+	fallbacks       *fallbackStore
+	budgets         *budgetTracker
+	limiter         *concurrencyLimiter
+	events          *relayEventBus
+	active          *activeRequests
+	shadow          *shadowMirror
+	balancer        *loadBalancer
 }
 
 // 权重相关常量
@@ -40,6 +51,32 @@ func NewProviderRelayService(providerService *ProviderService, logService *LogSe
 		addr = ":18100"
 	}
 
+	if err := logService.OpenDatabase(); err != nil {
+		log.Printf("[DB] %v", err)
+	} else {
+		log.Printf("[DB] 数据库初始化成功")
+	}
+
+	prs := &ProviderRelayService{
+		providerService: providerService,
+		logService:      logService,
+		addr:            addr,
+		keys:            newKeySelector(),
+		policies:        newRoutePolicyStore(),
+		fallbacks:       newFallbackStore(),
+		budgets:         newBudgetTracker(),
+		limiter:         newConcurrencyLimiter(),
+		events:          newRelayEventBus(),
+		active:          newActiveRequests(),
+		shadow:          newShadowMirror(),
+		balancer:        newLoadBalancer(),
+	}
+	prs.prober = newHealthProber(prs)
+	return prs
+}
+
+// OpenDatabase 打开 ~/.code-relay/app.db 并确保日志相关的表存在
+func (ls *LogService) OpenDatabase() error {
 	home, _ := os.UserHomeDir()
 	dataDir := filepath.Join(home, ".code-relay")
 
@@ -47,10 +84,15 @@ func NewProviderRelayService(providerService *ProviderService, logService *LogSe
 	if err := os.MkdirAll(dataDir, 0o755); err != nil {
 		log.Printf("创建数据目录失败: %v", err)
 	}
+	return ls.openDatabaseAt(filepath.Join(dataDir, "app.db"))
+}
 
-	const sqliteOptions = "?cache=shared&mode=rwc&_busy_timeout=5000&_journal_mode=WAL"
+// openDatabaseAt 将 default 连接指向 path 处的数据库并确保日志相关的表存在
+func (ls *LogService) openDatabaseAt(path string) error {
+	// modernc sqlite 通过 _pragma 为每个连接设置 busy_timeout，避免并发写入日志时 SQLITE_BUSY 丢日志
+	const sqliteOptions = "?cache=shared&mode=rwc&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"
 
-	dbPath := filepath.Join(dataDir, "app.db"+sqliteOptions)
+	dbPath := path + sqliteOptions
 	log.Printf("[DB] 初始化数据库: %s", dbPath)
 
 	if err := xdb.Inits([]xdb.Config{
@@ -62,18 +104,27 @@ func NewProviderRelayService(providerService *ProviderService, logService *LogSe
 			MaxIdleConn: 2,
 		},
 	}); err != nil {
-		log.Printf("[DB] 初始化数据库失败: %v", err)
-	} else if err := ensureRequestLogTable(); err != nil {
-		log.Printf("[DB] 初始化 request_log 表失败: %v", err)
-	} else {
-		log.Printf("[DB] 数据库初始化成功")
+		return fmt.Errorf("初始化数据库失败: %w", err)
 	}
-
-	return &ProviderRelayService{
-		providerService: providerService,
-		logService:      logService,
-		addr:            addr,
+	if err := ensureRequestLogTable(); err != nil {
+		return fmt.Errorf("初始化 request_log 表失败: %w", err)
+	}
+	if db, err := xdb.DB("default"); err == nil {
+		if err := ensureRequestLogSearch(db); err != nil {
+			// 全文索引不可用时搜索退回 LIKE，不影响其他功能
+			log.Printf("[DB] 初始化错误信息全文索引失败: %v", err)
+		}
 	}
+	if err := ensureProbeLogTable(); err != nil {
+		return fmt.Errorf("初始化 probe_log 表失败: %w", err)
+	}
+	if err := ensureShadowLogTable(); err != nil {
+		return fmt.Errorf("初始化 shadow_log 表失败: %w", err)
+	}
+	if err := ls.ensureRollupTables(); err != nil {
+		return fmt.Errorf("初始化汇总表失败: %w", err)
+	}
+	return nil
 }
 
 func (prs *ProviderRelayService) Start() error {
@@ -112,6 +163,9 @@ func (prs *ProviderRelayService) Start() error {
 			log.Printf("[Relay] 服务器错误: %v", err)
 		}
 	}()
+
+	// 启动后台健康探测
+	prs.prober.Start()
 	return nil
 }
 
@@ -121,7 +175,7 @@ func (prs *ProviderRelayService) validateConfig() []string {
 	warnings := make([]string, 0)
 
 	for _, kind := range []string{"claude", "codex", "gemini"} {
-		providers, err := prs.providerService.LoadProviders(kind)
+		providers, err := prs.providerService.loadSealedProviders(kind)
 		if err != nil {
 			warnings = append(warnings, fmt.Sprintf("[%s] 加载配置失败: %v", kind, err))
 			continue
@@ -159,12 +213,21 @@ func (prs *ProviderRelayService) validateConfig() []string {
 }
 
 func (prs *ProviderRelayService) Stop() error {
+	prs.prober.Stop()
 	if prs.server == nil {
 		return nil
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	// 停止接受新请求，等待进行中的请求完成；超时后取消剩余请求，由其向客户端写入终止消息
+	ctx, cancel := context.WithTimeout(context.Background(), stopDrainTimeout+stopCancelGrace)
 	defer cancel()
-	return prs.server.Shutdown(ctx)
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- prs.server.Shutdown(ctx)
+	}()
+	if !prs.active.wait(stopDrainTimeout) {
+		log.Printf("[Relay] 停止服务：取消 %d 个仍在进行中的请求", prs.active.cancelAll())
+	}
+	return <-shutdown
 }
 
 func (prs *ProviderRelayService) Addr() string {
@@ -202,7 +265,52 @@ func (prs *ProviderRelayService) proxyHandler(kind string, endpoint string) gin.
 
 		log.Printf("[Relay] 请求模型: %s, 流式: %v, 请求体大小: %d bytes", requestedModel, isStream, len(bodyBytes))
 
-		providers, err := prs.providerService.LoadProviders(kind)
+		// 路由策略：按客户端身份拒绝请求、强制模型映射，或限制 / 调整可用 provider
+		client := extractRouteClient(c, bodyBytes)
+		c.Set(clientCtxKey, clientFingerprint(client.Token))
+
+		// 实时请求事件：received → provider_selected → first_byte → progress → completed
+		prs.beginLiveRequest(c, kind, endpoint, requestedModel, isStream)
+		defer prs.finishLiveRequest(c)
+
+		policy := prs.matchRoutePolicy(kind, client)
+		if policy != nil {
+			c.Set(routePolicyCtxKey, policy.Name)
+			log.Printf("[Relay] 命中路由策略: %s", policy.Name)
+
+			if policy.denies() {
+				message := policy.DenyMessage
+				if message == "" {
+					message = "请求被路由策略 '" + policy.Name + "' 拒绝"
+				}
+				log.Printf("[Relay] 路由策略 %s 拒绝请求", policy.Name)
+				prs.insertRequestLog(c, &RequestLog{Platform: kind, Model: requestedModel, HttpCode: http.StatusForbidden})
+				writeRelayError(c, kind, http.StatusForbidden, message)
+				return
+			}
+
+			if mapped := policy.mapModel(requestedModel); mapped != requestedModel {
+				modifiedBody, err := ReplaceModelInRequestBody(bodyBytes, mapped)
+				if err != nil {
+					log.Printf("[Relay] 路由策略 %s 替换模型失败: %v", policy.Name, err)
+				} else {
+					log.Printf("[Relay] 路由策略 %s 强制模型映射: %s -> %s", policy.Name, requestedModel, mapped)
+					bodyBytes = modifiedBody
+					requestedModel = mapped
+				}
+			}
+		}
+
+		// 全局 / 客户端预算达到硬限制：直接拒绝
+		if budget, spent, over := prs.budgets.exceeded(kind, "", clientFrom(c)); over {
+			message := budgetExceededMessage(budget, spent)
+			log.Printf("[Relay] %s", message)
+			prs.insertRequestLog(c, &RequestLog{Platform: kind, Model: requestedModel, HttpCode: http.StatusTooManyRequests})
+			writeRelayError(c, kind, http.StatusTooManyRequests, message)
+			return
+		}
+
+		providers, err := prs.providerService.loadSealedProviders(kind)
 		if err != nil {
 			log.Printf("[Relay] 加载 providers 失败: %v", err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to load providers"})
@@ -211,60 +319,79 @@ func (prs *ProviderRelayService) proxyHandler(kind string, endpoint string) gin.
 
 		log.Printf("[Relay] 加载到 %d 个 providers", len(providers))
 
-		active := make([]Provider, 0, len(providers))
-		for _, provider := range providers {
-			// 基础过滤：enabled、URL
-			if !provider.Enabled {
-				log.Printf("[Relay] 跳过 provider %s: 未启用", provider.Name)
-				continue
-			}
-			if provider.APIURL == "" {
-				log.Printf("[Relay] 跳过 provider %s: 无 API URL", provider.Name)
-				continue
-			}
-			// 使用新的 GetAPIKeys 方法检查是否有可用的 Key
-			if len(provider.GetAPIKeys()) == 0 {
-				log.Printf("[Relay] 跳过 provider %s: 无 API Key", provider.Name)
-				continue
-			}
+		// 按请求内容（上下文长度、图片、thinking、工具、beta 特性）过滤不具备能力的 provider
+		features := extractRequestFeatures(c, bodyBytes)
 
-			// 配置验证：失败则自动跳过
-			if errs := provider.ValidateConfiguration(); len(errs) > 0 {
-				log.Printf("[Relay] 跳过 provider %s: 配置验证失败 %v", provider.Name, errs)
-				continue
-			}
+		query := flattenQuery(c.Request.URL.Query())
+		// 性能优化：只克隆白名单内的请求头，避免无效遍历
+		clientHeaders := filterHeaders(c.Request.Header)
 
-			// 核心过滤：只保留支持请求模型的 provider
-			if requestedModel != "" && !provider.IsModelSupported(requestedModel) {
-				log.Printf("[Relay] 跳过 provider %s: 不支持模型 %s", provider.Name, requestedModel)
-				continue
+		// 影子流量：主请求完整成功后按采样比例异步复制到候选 provider；
+		// 主请求失败、流中断或客户端已取消时不复制
+		if shadowProvider, ok := prs.shadowTarget(kind, requestedModel, features); ok {
+			defer func() {
+				primary := lastAttemptFrom(c)
+				if primary == nil || !isSuccessCode(primary.HttpCode) || primary.Error != "" || c.Request.Context().Err() != nil {
+					return
+				}
+				prs.mirrorRequest(kind, *shadowProvider, endpoint, query, clientHeaders, bodyBytes, isStream, requestedModel, primary)
+			}()
+		}
+
+		// 降级链：请求模型的所有 provider 均不可用或失败时，依次改用链上的模型重试
+		var result relayResult
+		resultFromFallback := false
+		for i, model := range prs.fallbackModels(kind, requestedModel) {
+			currentBody := bodyBytes
+			if i > 0 {
+				modifiedBody, err := ReplaceModelInRequestBody(bodyBytes, model)
+				if err != nil {
+					log.Printf("[Relay] 降级模型 %s 替换失败: %v", model, err)
+					continue
+				}
+				currentBody = modifiedBody
+				c.Set(fallbackCtxKey, requestedModel)
+				c.Header(fallbackHeader, model)
+				log.Printf("[Relay] 模型 %s 无法完成请求，降级为 %s", requestedModel, model)
+				prs.emitRelayEvent(c, RelayEvent{Type: RelayEventFailover, Model: model, FallbackFrom: requestedModel})
 			}
 
-			log.Printf("[Relay] 添加 provider: %s (可用 Keys: %d)", provider.Name, len(provider.GetAPIKeys()))
-			active = append(active, provider)
+			attempt := prs.relayModel(c, kind, endpoint, policy, providers, features, query, clientHeaders, currentBody, isStream, model)
+			if attempt.served {
+				return
+			}
+			// 降级模型没有可用 provider 时，保留之前更有价值的失败响应
+			if i == 0 || !attempt.noProvider {
+				result = attempt
+				resultFromFallback = i > 0
+			}
+			if !attempt.canFallback() || c.Request.Context().Err() != nil {
+				break
+			}
+		}
+		if !resultFromFallback {
+			c.Set(fallbackCtxKey, "")
+			c.Writer.Header().Del(fallbackHeader)
 		}
 
-		log.Printf("[Relay] 可用 providers: %d 个", len(active))
+		if requestCancelled(c) {
+			log.Printf("[Relay] 请求已被取消")
+			writeRelayError(c, kind, statusRequestCancelled, requestCancelledMessage)
+			return
+		}
 
-		if len(active) == 0 {
+		if result.noProvider {
 			// 记录 404 错误日志
-			go func() {
-				if _, err := xdb.New("request_log").Insert(xdb.Record{
-					"platform":   kind,
-					"model":      requestedModel,
-					"provider":   "",
-					"http_code":  http.StatusNotFound,
-					"created_at": time.Now().Format("2006-01-02 15:04:05"),
-				}); err != nil {
-					// 静默处理
-				}
-			}()
+			prs.insertRequestLog(c, &RequestLog{Platform: kind, Model: requestedModel, HttpCode: http.StatusNotFound})
 
 			// 返回符合 Anthropic API 格式的错误响应
 			message := "no providers available"
 			if requestedModel != "" {
 				message = "没有可用的 provider 支持模型 '" + requestedModel + "'"
 			}
+			if len(result.unmet) > 0 {
+				message = "没有可用的 provider 满足请求要求：" + strings.Join(result.unmet, "、")
+			}
 			log.Printf("[Relay] 没有可用 provider: %s", message)
 			c.Header("Content-Type", "application/json")
 			c.JSON(http.StatusNotFound, gin.H{
@@ -278,144 +405,314 @@ func (prs *ProviderRelayService) proxyHandler(kind string, endpoint string) gin.
 			return
 		}
 
-		query := flattenQuery(c.Request.URL.Query())
-		// 性能优化：只克隆白名单内的请求头，避免无效遍历
-		clientHeaders := filterHeaders(c.Request.Header)
+		// 如果所有 provider 都失败了（可能是网络错误等），返回最后一个 provider 的响应
+		if result.lastBody != nil {
+			log.Printf("[Relay] 所有 provider 失败, status=%d, 返回错误给客户端", result.lastStatus)
+			prs.writeResponse(c, result.lastStatus, result.lastHeaders, result.lastBody)
+			return
+		}
 
-		// 获取所有渠道的成功率，用于权重计算
-		var successRates map[string]float64
-		if prs.logService != nil {
-			successRates, _ = prs.logService.GetAllProviderSuccessRates(kind)
+		// 如果连响应都没有（所有请求都失败了）
+		message := "所有 provider 均失败"
+		if result.lastErr != nil {
+			message = message + ": " + result.lastErr.Error()
 		}
+		log.Printf("[Relay] 所有 provider 失败: %s", message)
 
-		// 按权重排序 providers（权重高的优先、相同权重随机）
-		weightedProviders := prs.sortProvidersByWeight(active, successRates)
+		// 返回符合 Anthropic API 格式的错误响应
+		c.Header("Content-Type", "application/json")
+		c.JSON(http.StatusBadGateway, gin.H{
+			"type": "error",
+			"error": gin.H{
+				"type":    "api_error",
+				"message": message,
+			},
+		})
+		c.Writer.Flush()
+	}
+}
 
-		log.Printf("[Relay] 按权重排序后的 providers:")
-		for i, wp := range weightedProviders {
-			log.Printf("[Relay]   %d. %s (权重: %d, 成功率: %.1f%%)",
-				i+1, wp.provider.Name, wp.weight, wp.successRate*100)
-		}
+// relayResult 以单个模型遍历所有可用 provider 的结果
+type relayResult struct {
+	served      bool     // 响应已写入客户端（成功或流式）
+	noProvider  bool     // 没有可用 provider
+	unmet       []string // 因能力不足被跳过的 provider 所缺的能力
+	lastStatus  int
+	lastHeaders http.Header
+	lastBody    []byte
+	lastErr     error
+}
 
-		totalProviders := len(weightedProviders)
-		var lastErr error
-		var lastStatus int
-		var lastBody []byte
-		var lastHeaders http.Header
-		bodyCache := make(map[string][]byte)
+// canFallback 失败是否值得降级到其他模型重试（请求本身有误时不降级）
+func (r relayResult) canFallback() bool {
+	if r.noProvider || r.lastBody == nil {
+		return true
+	}
+	switch r.lastStatus {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound,
+		http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return true
+	}
+	return r.lastStatus >= 500
+}
 
-		for i := range weightedProviders {
-			provider := &weightedProviders[i].provider
-			isLastProvider := (i == totalProviders-1)
+// relayModel 按指定模型筛选、排序可用 provider 并依次尝试（含多 Key 轮换）
+// 成功或流式转发时直接写入客户端；全部失败时由调用方决定降级或返回错误
+func (prs *ProviderRelayService) relayModel(
+	c *gin.Context,
+	kind string,
+	endpoint string,
+	policy *RoutePolicy,
+	providers []Provider,
+	features requestFeatures,
+	query map[string]string,
+	clientHeaders map[string]string,
+	bodyBytes []byte,
+	isStream bool,
+	model string,
+) relayResult {
+	var result relayResult
+
+	active := make([]Provider, 0, len(providers))
+	for _, provider := range providers {
+		// 基础过滤：enabled、URL
+		if !provider.Enabled {
+			log.Printf("[Relay] 跳过 provider %s: 未启用", provider.Name)
+			continue
+		}
+		if policy != nil && !policy.allowsProvider(provider.Name) {
+			log.Printf("[Relay] 跳过 provider %s: 路由策略 %s 不允许", provider.Name, policy.Name)
+			continue
+		}
+		if provider.APIURL == "" {
+			log.Printf("[Relay] 跳过 provider %s: 无 API URL", provider.Name)
+			continue
+		}
+		// 检查是否有可用（未禁用）的 Key
+		if len(provider.enabledKeyIndexes()) == 0 {
+			log.Printf("[Relay] 跳过 provider %s: 无 API Key", provider.Name)
+			continue
+		}
 
-			effectiveModel := provider.GetEffectiveModel(requestedModel)
+		// 配置验证：失败则自动跳过
+		if errs := provider.ValidateConfiguration(); len(errs) > 0 {
+			log.Printf("[Relay] 跳过 provider %s: 配置验证失败 %v", provider.Name, errs)
+			continue
+		}
 
-			currentBodyBytes := bodyBytes
-			if effectiveModel != requestedModel && requestedModel != "" {
-				// 性能优化：缓存已替换的模型体，避免在 provider 轮询中重复执行 sjson 操作
-				if cachedBody, exists := bodyCache[effectiveModel]; exists {
-					currentBodyBytes = cachedBody
-				} else {
-					modifiedBody, err := ReplaceModelInRequestBody(bodyBytes, effectiveModel)
-					if err != nil {
-						lastErr = err
-						log.Printf("[Relay] 替换模型失败: %v", err)
-						continue
-					}
-					currentBodyBytes = modifiedBody
-					bodyCache[effectiveModel] = modifiedBody
-				}
+		// 核心过滤：只保留支持请求模型的 provider
+		if model != "" && !provider.IsModelSupported(model) {
+			log.Printf("[Relay] 跳过 provider %s: 不支持模型 %s", provider.Name, model)
+			continue
+		}
+		if requirement := provider.unsupportedRequirement(features); requirement != "" {
+			log.Printf("[Relay] 跳过 provider %s: 不支持%s", provider.Name, requirement)
+			if !containsFold(result.unmet, requirement) {
+				result.unmet = append(result.unmet, requirement)
 			}
+			continue
+		}
+		if budget, _, over := prs.budgets.exceeded(kind, provider.Name, clientFrom(c)); over {
+			log.Printf("[Relay] 跳过 provider %s: 预算 %s 已达上限", provider.Name, budget.Name)
+			continue
+		}
 
-			// 多 Key 轮换循环：同一 provider 的多个 Key 依次尝试
-			// 缓存 keys 数组，避免在循环中多次调用 GetAPIKeys()
-			keys := provider.GetAPIKeys()
-			numKeys := len(keys)
-			for keyAttempt := 0; keyAttempt < numKeys; keyAttempt++ {
-				// 安全边界检查
-				keyIndex := keyAttempt % numKeys
-				currentKey := keys[keyIndex]
-				isLastKey := (keyAttempt == numKeys-1)
-
-				if numKeys > 1 {
-					log.Printf("[Relay] Provider %s 尝试 Key %d/%d", provider.Name, keyAttempt+1, numKeys)
-				}
+		log.Printf("[Relay] 添加 provider: %s (可用 Keys: %d)", provider.Name, len(provider.enabledKeyIndexes()))
+		active = append(active, provider)
+	}
+
+	log.Printf("[Relay] 可用 providers: %d 个", len(active))
+
+	if len(active) == 0 {
+		result.noProvider = true
+		return result
+	}
+
+	// 获取所有渠道的成功率，用于权重计算
+	var successRates map[string]float64
+	if prs.logService != nil {
+		successRates, _ = prs.logService.GetAllProviderSuccessRates(kind)
+	}
+
+	// 按权重排序 providers（权重高的优先、相同权重随机）
+	weightedProviders := prs.sortProvidersByWeight(active, successRates)
+	// 主动探测熔断的 provider 降为最低权重，仅作为兜底
+	weightedProviders = prs.prober.applyHealth(kind, weightedProviders)
+	// 负载均衡模式：同优先级的 provider 按比例分配首次尝试，之后仍按权重故障转移
+	weightedProviders = prs.balance(kind, weightedProviders)
+	// 路由策略指定的优先 provider 排在最前
+	if policy != nil {
+		weightedProviders = policy.reorder(weightedProviders)
+	}
+
+	log.Printf("[Relay] 按权重排序后的 providers:")
+	for i, wp := range weightedProviders {
+		log.Printf("[Relay]   %d. %s (权重: %d, 成功率: %.1f%%)",
+			i+1, wp.provider.Name, wp.weight, wp.successRate*100)
+	}
+
+	bodyCache := make(map[string][]byte)
 
-				status, headers, body, err := prs.forwardRequestWithKey(c, kind, *provider, currentKey, endpoint, query, clientHeaders, currentBodyBytes, isStream, effectiveModel)
+	for i := range weightedProviders {
+		provider := &weightedProviders[i].provider
 
+		effectiveModel := provider.GetEffectiveModel(model)
+
+		currentBodyBytes := bodyBytes
+		if effectiveModel != model && model != "" {
+			// 性能优化：缓存已替换的模型体，避免在 provider 轮询中重复执行 sjson 操作
+			if cachedBody, exists := bodyCache[effectiveModel]; exists {
+				currentBodyBytes = cachedBody
+			} else {
+				modifiedBody, err := ReplaceModelInRequestBody(bodyBytes, effectiveModel)
 				if err != nil {
-					log.Printf("[Relay] Provider %s Key %d 请求失败: %v", provider.Name, keyAttempt+1, err)
-					lastErr = err
-					// 尝试下一个 Key（通过循环自动递增 keyAttempt）
-					if !isLastKey {
-						continue
-					}
-					// 所有 Key 都失败，尝试下一个 provider
-					break
+					result.lastErr = err
+					log.Printf("[Relay] 替换模型失败: %v", err)
+					continue
 				}
+				currentBodyBytes = modifiedBody
+				bodyCache[effectiveModel] = modifiedBody
+			}
+		}
 
-				// status = -1 表示流式响应已经直接写入客户端，直接返回
-				if status == -1 {
-					log.Printf("[Relay] Provider %s 流式转发完成", provider.Name)
-					return
-				}
+		// 多 Key 轮换循环：按 provider 的 Key 策略决定尝试顺序（跳过禁用的 Key，冷却中的排在最后）
+		keyOrder := prs.keys.order(kind, *provider)
+		numKeys := len(keyOrder)
+		for keyAttempt, keyIndex := range keyOrder {
+			isLastKey := (keyAttempt == numKeys-1)
 
-				// 保存最后一次响应
-				lastStatus = status
-				lastHeaders = headers
-				lastBody = body
+			if numKeys > 1 {
+				log.Printf("[Relay] Provider %s 尝试 Key %d (%d/%d)", provider.Name, keyIndex+1, keyAttempt+1, numKeys)
+			}
 
-				// 如果成功 (2xx)，立即返回
-				if status >= 200 && status < 300 {
-					log.Printf("[Relay] Provider %s 成功, status=%d", provider.Name, status)
-					prs.writeResponse(c, status, headers, body)
-					return
+			// 并发限制：达到上限时排队，队列已满或超时则尝试下一个 Key / provider
+			release, waited, providerBusy, err := prs.acquireProvider(c, kind, *provider, keyIndex)
+			if err != nil {
+				log.Printf("[Relay] Provider %s Key %d 无法获得并发名额: %v (等待 %.2fs)", provider.Name, keyIndex+1, err, waited.Seconds())
+				result.lastErr = fmt.Errorf("provider %s: %w", provider.Name, err)
+				if c.Request.Context().Err() != nil {
+					return result
 				}
+				prs.emitFailover(c, provider.Name, keyIndex, effectiveModel, 0, result.lastErr)
+				if providerBusy || isLastKey {
+					break
+				}
+				continue
+			}
+			c.Set(queueWaitCtxKey, waited.Seconds())
+			prs.emitRelayEvent(c, RelayEvent{
+				Type:         RelayEventProviderSelected,
+				Provider:     provider.Name,
+				KeyIndex:     keyIndex,
+				Model:        effectiveModel,
+				QueueWaitSec: waited.Seconds(),
+			})
 
-				// 如果是 401/403 认证错误，尝试下一个 Key（通过循环自动递增 keyAttempt）
-				if (status == 401 || status == 403) && !isLastKey {
-					log.Printf("[Relay] Provider %s Key %d 认证失败 (status=%d), 尝试下一个 Key", provider.Name, keyAttempt+1, status)
+			prs.keys.markUsed(kind, *provider, keyIndex)
+			status, headers, body, err := prs.forwardRequestWithKey(c, kind, *provider, keyIndex, endpoint, query, clientHeaders, currentBodyBytes, isStream, effectiveModel)
+			release()
+
+			if err != nil {
+				log.Printf("[Relay] Provider %s Key %d 请求失败: %v", provider.Name, keyIndex+1, err)
+				result.lastErr = err
+				prs.emitFailover(c, provider.Name, keyIndex, effectiveModel, 0, err)
+				// 客户端断开或请求被取消：不再尝试其他 Key / provider
+				if c.Request.Context().Err() != nil {
+					return result
+				}
+				// 尝试下一个 Key（通过循环自动递增 keyAttempt）
+				if !isLastKey {
 					continue
 				}
+				// 所有 Key 都失败，尝试下一个 provider
+				break
+			}
 
-				// 如果失败但是最后一个 provider 的最后一个 Key，返回错误响应
-				if isLastProvider && isLastKey {
-					log.Printf("[Relay] 最后一个 provider %s 最后一个 Key 失败, status=%d, 返回错误给客户端", provider.Name, status)
-					prs.writeResponse(c, status, headers, body)
-					return
-				}
+			// status = -1 表示流式响应已经直接写入客户端，直接返回
+			if status == -1 {
+				log.Printf("[Relay] Provider %s 流式转发完成", provider.Name)
+				result.served = true
+				return result
+			}
 
-				// 其他错误（非认证错误），直接尝试下一个 provider
-				log.Printf("[Relay] Provider %s 失败, status=%d, 尝试下一个 provider", provider.Name, status)
-				break
+			// 保存最后一次响应
+			result.lastStatus = status
+			result.lastHeaders = headers
+			result.lastBody = body
+
+			// 如果成功 (2xx)，立即返回
+			if status >= 200 && status < 300 {
+				log.Printf("[Relay] Provider %s 成功, status=%d", provider.Name, status)
+				prs.writeResponse(c, status, headers, body)
+				result.served = true
+				return result
 			}
-		}
 
-		// 如果所有 provider 都失败了（可能是网络错误等）
-		if lastBody != nil {
-			// 返回最后一个 provider 的响应
-			prs.writeResponse(c, lastStatus, lastHeaders, lastBody)
-			return
-		}
+			prs.emitFailover(c, provider.Name, keyIndex, effectiveModel, status, nil)
 
-		// 如果连响应都没有（所有请求都失败了）
-		message := "所有 provider 均失败"
-		if lastErr != nil {
-			message = message + ": " + lastErr.Error()
+			// 401/403 认证错误或 429 限流：该 Key 进入冷却，尝试下一个 Key
+			prs.keys.cooldown(kind, *provider, keyIndex, status, headers)
+			if (status == 401 || status == 403 || status == 429) && !isLastKey {
+				log.Printf("[Relay] Provider %s Key %d 失败 (status=%d), 尝试下一个 Key", provider.Name, keyIndex+1, status)
+				continue
+			}
+
+			// 其他错误（非认证/限流错误），直接尝试下一个 provider
+			log.Printf("[Relay] Provider %s 失败, status=%d, 尝试下一个 provider", provider.Name, status)
+			break
 		}
-		log.Printf("[Relay] 所有 provider 失败: %s", message)
+	}
 
-		// 返回符合 Anthropic API 格式的错误响应
-		c.Header("Content-Type", "application/json")
-		c.JSON(http.StatusBadGateway, gin.H{
+	return result
+}
+
+// writeRelayError 按平台协议返回 relay 自身产生的错误
+// claude 使用 Anthropic 格式，codex / gemini 使用 OpenAI 兼容格式
+func writeRelayError(c *gin.Context, kind string, status int, message string) {
+	if kind == "claude" {
+		c.JSON(status, gin.H{
 			"type": "error",
 			"error": gin.H{
-				"type":    "api_error",
+				"type":    anthropicErrorType(status),
 				"message": message,
 			},
 		})
-		c.Writer.Flush()
+		return
+	}
+	errType := "api_error"
+	switch {
+	case status == http.StatusTooManyRequests:
+		errType = "insufficient_quota"
+	case status < 500:
+		errType = "invalid_request_error"
+	}
+	c.JSON(status, gin.H{
+		"error": gin.H{
+			"message": message,
+			"type":    errType,
+			"code":    errType,
+		},
+	})
+}
+
+func anthropicErrorType(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return "invalid_request_error"
+	case http.StatusUnauthorized:
+		return "authentication_error"
+	case http.StatusForbidden:
+		return "permission_error"
+	case http.StatusNotFound:
+		return "not_found_error"
+	case http.StatusRequestEntityTooLarge:
+		return "request_too_large"
+	case http.StatusTooManyRequests:
+		return "rate_limit_error"
+	case 529:
+		return "overloaded_error"
 	}
+	return "api_error"
 }
 
 // writeResponse 将响应写入客户端
@@ -460,15 +757,10 @@ func (prs *ProviderRelayService) forwardRequest(
 	isStream bool,
 	model string,
 ) (int, http.Header, []byte, error) {
-	keys := provider.GetAPIKeys()
-	apiKey := ""
-	if len(keys) > 0 {
-		apiKey = keys[0]
-	}
-	return prs.forwardRequestWithKey(c, kind, provider, apiKey, endpoint, query, clientHeaders, bodyBytes, isStream, model)
+	return prs.forwardRequestWithKey(c, kind, provider, 0, endpoint, query, clientHeaders, bodyBytes, isStream, model)
 }
 
-// forwardRequestWithKey 转发请求到上游 provider（使用指定的 API Key）
+// forwardRequestWithKey 转发请求到上游 provider（使用下标为 keyIndex 的 API Key）
 // 返回值: (状态码, 响应头, 响应体, 错误)
 // - 返回响应数据，由调用者决定是否写入客户端
 // - 如果发生网络错误，返回 error，调用者可以尝试下一个 provider/key
@@ -476,7 +768,7 @@ func (prs *ProviderRelayService) forwardRequestWithKey(
 	c *gin.Context,
 	kind string,
 	provider Provider,
-	apiKey string,
+	keyIndex int,
 	endpoint string,
 	query map[string]string,
 	clientHeaders map[string]string,
@@ -485,6 +777,10 @@ func (prs *ProviderRelayService) forwardRequestWithKey(
 	model string,
 ) (int, http.Header, []byte, error) {
 	targetURL := joinURL(provider.APIURL, endpoint)
+	apiKey := ""
+	if keys := provider.GetAPIKeys(); keyIndex >= 0 && keyIndex < len(keys) {
+		apiKey = keys[keyIndex]
+	}
 
 	// 构建查询参数
 	if len(query) > 0 {
@@ -500,6 +796,13 @@ func (prs *ProviderRelayService) forwardRequestWithKey(
 		Provider: provider.Name,
 		Model:    model,
 		IsStream: isStream,
+		KeyIndex: keyIndex,
+		Profile:  prs.providerService.activeProfileName(),
+
+		RoutePolicy:  routePolicyFrom(c),
+		FallbackFrom: fallbackFrom(c),
+		Client:       clientFrom(c),
+		QueueWaitSec: queueWaitFrom(c),
 	}
 	start := time.Now()
 
@@ -507,30 +810,30 @@ func (prs *ProviderRelayService) forwardRequestWithKey(
 	writeLog := func() {
 		// 注意：DurationSec 应该在收到响应后立即设置（TTFB），而不是在这里
 		// 如果 DurationSec 还是 0，说明请求失败了，使用总时间
+		requestLog.TotalSec = time.Since(start).Seconds()
 		if requestLog.DurationSec == 0 {
-			requestLog.DurationSec = time.Since(start).Seconds()
+			requestLog.DurationSec = requestLog.TotalSec
 		}
-		go func(rl *RequestLog) {
-			if rl.Platform == "" {
-				return
-			}
-			if _, err := xdb.New("request_log").Insert(xdb.Record{
-				"platform":            rl.Platform,
-				"model":               rl.Model,
-				"provider":            rl.Provider,
-				"http_code":           rl.HttpCode,
-				"input_tokens":        rl.InputTokens,
-				"output_tokens":       rl.OutputTokens,
-				"cache_create_tokens": rl.CacheCreateTokens,
-				"cache_read_tokens":   rl.CacheReadTokens,
-				"reasoning_tokens":    rl.ReasoningTokens,
-				"is_stream":           boolToInt(rl.IsStream),
-				"duration_sec":        rl.DurationSec,
-				"created_at":          time.Now().Format("2006-01-02 15:04:05"),
-			}); err != nil {
-				// 生产环境不频繁记录日志失败
-			}
-		}(requestLog)
+		// 记录最后一次转发结果，供影子流量对比
+		c.Set(lastAttemptCtxKey, requestLog)
+		// 探测等内部请求：结果交给调用方处理，不计入用户流量
+		if sink := attemptSinkFrom(c); sink != nil {
+			sink(requestLog)
+			return
+		}
+		prs.logService.writeRequestLog(requestLog, func(rl *RequestLog) {
+			prs.budgets.record(prs.logService, rl)
+		})
+	}
+
+	// Key 在内存和磁盘中均为密文，仅在转发时解密当前使用的 Key
+	// 无法解密（加密口令变更）时按失败处理，由调用方切换下一个 Key / provider
+	apiKey, err := revealSecret(apiKey)
+	if err != nil {
+		log.Printf("[Relay] Provider %s Key %d %v", provider.Name, keyIndex+1, err)
+		requestLog.Error = err.Error()
+		writeLog()
+		return 0, nil, nil, err
 	}
 
 	// 创建请求并绑定 Context，确保客户端断开时同步停止上游请求
@@ -538,6 +841,7 @@ func (prs *ProviderRelayService) forwardRequestWithKey(
 	if err != nil {
 		log.Printf("[Relay] 创建请求失败: %v", err)
 		requestLog.HttpCode = 0
+		requestLog.Error = err.Error()
 		writeLog()
 		return 0, nil, nil, err
 	}
@@ -578,6 +882,11 @@ func (prs *ProviderRelayService) forwardRequestWithKey(
 	if err != nil {
 		log.Printf("[Relay] 请求失败: %v", err)
 		requestLog.HttpCode = 0
+		requestLog.Error = err.Error()
+		if requestCancelled(c) {
+			requestLog.HttpCode = statusRequestCancelled
+			requestLog.Error = requestCancelledMessage
+		}
 		writeLog()
 		return 0, nil, nil, err
 	}
@@ -585,10 +894,12 @@ func (prs *ProviderRelayService) forwardRequestWithKey(
 	// 记录 TTFB（首字节时间）：从发送请求到收到响应头的时间
 	// 这是衡量 API 响应速度的关键指标，不包括响应体传输时间
 	requestLog.DurationSec = time.Since(start).Seconds()
+	requestLog.TTFBSec = requestLog.DurationSec
 
 	status := resp.StatusCode
 	requestLog.HttpCode = status
 	log.Printf("[Relay] 收到响应, status=%d, content-type=%s, ttfb=%.3fs", status, resp.Header.Get("Content-Type"), requestLog.DurationSec)
+	prs.emitRelayEvent(c, RelayEvent{Type: RelayEventFirstByte, Provider: provider.Name, KeyIndex: requestLog.KeyIndex, Model: model, HttpCode: status})
 
 	// 检测是否为 SSE 流式响应
 	contentType := resp.Header.Get("Content-Type")
@@ -609,7 +920,7 @@ func (prs *ProviderRelayService) forwardRequestWithKey(
 		c.Writer.WriteHeader(status)
 
 		// 创建一个带有 Token 统计功能的 Writer
-		hook := RequestLogHook(c, kind, requestLog)
+		hook := prs.progressHook(c, requestLog, RequestLogHook(c, kind, requestLog))
 		parser := &streamParser{
 			writer: c.Writer,
 			hook:   hook,
@@ -618,6 +929,12 @@ func (prs *ProviderRelayService) forwardRequestWithKey(
 		// 使用 io.Copy 实现高性能透传，避免 bufio.Scanner 的行缓冲区造成的延迟
 		if _, err := io.Copy(parser, resp.Body); err != nil {
 			log.Printf("[Relay] 流式转发中断: %v", err)
+			requestLog.Error = "流式转发中断: " + err.Error()
+			if requestCancelled(c) {
+				requestLog.HttpCode = statusRequestCancelled
+				requestLog.Error = requestCancelledMessage
+				writeStreamCancelled(c, endpoint)
+			}
 		}
 		// 必须调用 Flush 处理最后一行的解析
 		parser.Flush()
@@ -637,6 +954,7 @@ func (prs *ProviderRelayService) forwardRequestWithKey(
 	if err != nil {
 		log.Printf("[Relay] 读取响应体失败: %v", err)
 		requestLog.HttpCode = 0
+		requestLog.Error = err.Error()
 		writeLog()
 		return 0, nil, nil, err
 	}
@@ -654,6 +972,9 @@ func (prs *ProviderRelayService) forwardRequestWithKey(
 
 	log.Printf("[Relay] 转发完成, status=%d, body_size=%d, tokens: in=%d, out=%d",
 		status, len(body), requestLog.InputTokens, requestLog.OutputTokens)
+	if !isSuccessCode(status) {
+		requestLog.Error = upstreamErrorMessage(body)
+	}
 
 	writeLog()
 
@@ -661,6 +982,27 @@ func (prs *ProviderRelayService) forwardRequestWithKey(
 	return status, resp.Header, body, nil
 }
 
+// attemptSinkKey gin.Context 中的键，存在时转发结果交给该回调，不写入 request_log
+const attemptSinkKey = "relay.attemptSink"
+
+func attemptSinkFrom(c *gin.Context) func(*RequestLog) {
+	if v, ok := c.Get(attemptSinkKey); ok {
+		if sink, ok := v.(func(*RequestLog)); ok {
+			return sink
+		}
+	}
+	return nil
+}
+
+// newInternalContext 为内部请求（探测、测试）构造一个脱离客户端的 gin.Context
+// 响应写入内存 recorder，转发结果通过 sink 回传
+func newInternalContext(ctx context.Context, endpoint string, sink func(*RequestLog)) *gin.Context {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, endpoint, nil).WithContext(ctx)
+	c.Set(attemptSinkKey, sink)
+	return c
+}
+
 func getTokenParser(kind string) func(string, *RequestLog) {
 	if kind == "codex" || kind == "gemini" {
 		return CodexParseTokenUsageFromResponse
@@ -761,6 +1103,42 @@ func boolToInt(b bool) int {
 	return 0
 }
 
+// insertRequestLog 异步写入未经过转发的请求日志（如无可用 provider、被策略拒绝）
+func (prs *ProviderRelayService) insertRequestLog(c *gin.Context, rl *RequestLog) {
+	rl.Profile = prs.providerService.activeProfileName()
+	rl.RoutePolicy = routePolicyFrom(c)
+	rl.FallbackFrom = fallbackFrom(c)
+	rl.Client = clientFrom(c)
+	prs.logService.writeRequestLog(rl, nil)
+}
+
+// requestLogRecord 将 RequestLog 转换为 request_log 表的一行
+func requestLogRecord(rl *RequestLog) xdb.Record {
+	return xdb.Record{
+		"platform":            rl.Platform,
+		"model":               rl.Model,
+		"provider":            rl.Provider,
+		"http_code":           rl.HttpCode,
+		"input_tokens":        rl.InputTokens,
+		"output_tokens":       rl.OutputTokens,
+		"cache_create_tokens": rl.CacheCreateTokens,
+		"cache_read_tokens":   rl.CacheReadTokens,
+		"reasoning_tokens":    rl.ReasoningTokens,
+		"is_stream":           boolToInt(rl.IsStream),
+		"duration_sec":        rl.DurationSec,
+		"ttfb_sec":            rl.TTFBSec,
+		"total_sec":           rl.TotalSec,
+		"key_index":           rl.KeyIndex,
+		"profile":             rl.Profile,
+		"route_policy":        rl.RoutePolicy,
+		"fallback_from":       rl.FallbackFrom,
+		"client":              rl.Client,
+		"queue_wait_sec":      rl.QueueWaitSec,
+		"error":               truncateString(rl.Error, 500),
+		"created_at":          time.Now().Format("2006-01-02 15:04:05"),
+	}
+}
+
 func ensureRequestLogColumn(db *sql.DB, column string, definition string) error {
 	query := fmt.Sprintf("SELECT COUNT(*) FROM pragma_table_info('request_log') WHERE name = '%s'", column)
 	var count int
@@ -821,6 +1199,33 @@ func ensureRequestLogTableWithDB(db *sql.DB) error {
 	if err := ensureRequestLogColumn(db, "duration_sec", "REAL DEFAULT 0"); err != nil {
 		return err
 	}
+	if err := ensureRequestLogColumn(db, "ttfb_sec", "REAL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := ensureRequestLogColumn(db, "total_sec", "REAL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := ensureRequestLogColumn(db, "key_index", "INTEGER DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := ensureRequestLogColumn(db, "profile", "TEXT DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := ensureRequestLogColumn(db, "route_policy", "TEXT DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := ensureRequestLogColumn(db, "fallback_from", "TEXT DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := ensureRequestLogColumn(db, "client", "TEXT DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := ensureRequestLogColumn(db, "queue_wait_sec", "REAL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := ensureRequestLogColumn(db, "error", "TEXT DEFAULT ''"); err != nil {
+		return err
+	}
 
 	return nil
 }
@@ -856,10 +1261,7 @@ func RequestLogHook(c *gin.Context, kind string, usage *RequestLog) func(data []
 	// 使用 stateful buffer 记录未关闭的行，防止 chunk 截断导致解析失败
 	var rowBuf bytes.Buffer
 
-	parserFn := ClaudeCodeParseTokenUsageFromResponse
-	if kind == "codex" {
-		parserFn = CodexParseTokenUsageFromResponse
-	}
+	parserFn := getTokenParser(kind)
 
 	return func(data []byte) (bool, []byte) {
 		if data == nil {
@@ -921,7 +1323,17 @@ type RequestLog struct {
 	CacheReadTokens   int     `json:"cache_read_tokens"`
 	ReasoningTokens   int     `json:"reasoning_tokens"`
 	IsStream          bool    `json:"is_stream"`
-	DurationSec       float64 `json:"duration_sec"`
+	DurationSec       float64 `json:"duration_sec"`   // 成功时为首字节时间，失败时为总耗时（兼容旧数据）
+	TTFBSec           float64 `json:"ttfb_sec"`       // 首字节时间，未收到响应时为 0
+	TotalSec          float64 `json:"total_sec"`      // 从发出请求到响应结束的总耗时
+	OutputTPS         float64 `json:"output_tps"`     // 输出速度（tokens/秒）
+	KeyIndex          int     `json:"key_index"`      // 本次请求使用的 Key 下标
+	Profile           string  `json:"profile"`        // 请求时激活的配置方案
+	RoutePolicy       string  `json:"route_policy"`   // 命中的路由策略
+	FallbackFrom      string  `json:"fallback_from"`  // 降级前的原始请求模型（未降级为空）
+	Client            string  `json:"client"`         // 客户端 relay token 的指纹
+	QueueWaitSec      float64 `json:"queue_wait_sec"` // 因并发限制排队等待的时间
+	Error             string  `json:"error"`          // 网络错误或上游错误响应中的错误信息
 	CreatedAt         string  `json:"created_at"`
 	InputCost         float64 `json:"input_cost"`
 	OutputCost        float64 `json:"output_cost"`
@@ -0,0 +1,343 @@
+package services
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/daodao97/xgo/xdb"
+	"github.com/gin-gonic/gin"
+)
+
+// 测试使用 mock:// provider，不访问网络；数据与配置写入临时 HOME
+
+var (
+	testProviderSvc *ProviderService
+	testLogSvc      *LogService
+	testRelay       *ProviderRelayService
+	testProviderID  atomic.Int64
+)
+
+func TestMain(m *testing.M) {
+	home, err := os.MkdirTemp("", "code-relay-test-*")
+	if err != nil {
+		panic(err)
+	}
+	os.Setenv("HOME", home)
+	os.Setenv("USERPROFILE", home)
+	os.Unsetenv(secretPassphraseEnv)
+	gin.SetMode(gin.TestMode)
+
+	testProviderSvc = NewProviderService()
+	testLogSvc = NewLogService()
+	testRelay = NewProviderRelayService(testProviderSvc, testLogSvc, "127.0.0.1:0")
+
+	code := m.Run()
+	os.RemoveAll(home)
+	os.Exit(code)
+}
+
+// mockProvider 构造一个使用 mock 上游的 provider（ID 全局唯一，避免触发改名校验）
+func mockProvider(name string, spec string, keys ...string) Provider {
+	if len(keys) == 0 {
+		keys = []string{"test-key"}
+	}
+	return Provider{
+		ID:      int(testProviderID.Add(1)),
+		Name:    name,
+		APIURL:  "mock://" + spec,
+		APIKeys: keys,
+		Enabled: true,
+	}
+}
+
+func setProviders(t *testing.T, kind string, providers ...Provider) {
+	t.Helper()
+	if err := testProviderSvc.SaveProviders(kind, providers); err != nil {
+		t.Fatalf("SaveProviders: %v", err)
+	}
+}
+
+func setRoutePolicies(t *testing.T, policies ...RoutePolicy) {
+	t.Helper()
+	if policies == nil {
+		policies = []RoutePolicy{}
+	}
+	if err := testRelay.SaveRoutePolicies(policies); err != nil {
+		t.Fatalf("SaveRoutePolicies: %v", err)
+	}
+	t.Cleanup(func() { _ = testRelay.SaveRoutePolicies([]RoutePolicy{}) })
+}
+
+func doRelay(t *testing.T, ctx context.Context, path string, body string, headers map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+	router := gin.New()
+	testRelay.registerRoutes(router)
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	if ctx != nil {
+		req = req.WithContext(ctx)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// waitLogs 等待异步写入的 request_log 达到指定条数（按 id 倒序返回）
+func waitLogs(t *testing.T, platform string, provider string, n int) []RequestLog {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		logs, err := testLogSvc.ListRequestLogs(platform, provider, 100)
+		if err != nil {
+			t.Fatalf("ListRequestLogs: %v", err)
+		}
+		if len(logs) >= n || time.Now().After(deadline) {
+			if len(logs) < n {
+				t.Fatalf("expected %d logs for %s/%s, got %d", n, platform, provider, len(logs))
+			}
+			return logs
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// newTestLogService 返回使用独立临时数据库的 LogService（default 连接指向该数据库，
+// 通过 testRelay 写入的日志也写到这里）；测试结束时写完日志、关闭数据库并切回共享数据库
+func newTestLogService(t *testing.T) *LogService {
+	t.Helper()
+	ls := NewLogService()
+	if err := ls.openDatabaseAt(filepath.Join(t.TempDir(), "app.db")); err != nil {
+		t.Fatalf("openDatabaseAt: %v", err)
+	}
+	db, err := xdb.DB("default")
+	if err != nil {
+		t.Fatalf("db: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = ls.Stop()
+		if err := testLogSvc.OpenDatabase(); err != nil {
+			t.Errorf("reopen shared database: %v", err)
+		}
+		_ = db.Close()
+	})
+	return ls
+}
+
+func TestRelayClaudeNonStream(t *testing.T) {
+	setProviders(t, "claude", mockProvider("claude-basic", "in=11,out=22"))
+
+	w := doRelay(t, nil, "/v1/messages", `{"model":"claude-sonnet-4","messages":[]}`, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if !strings.Contains(w.Body.String(), "mock provider") {
+		t.Fatalf("unexpected body: %s", w.Body.String())
+	}
+
+	logs := waitLogs(t, "claude", "claude-basic", 1)
+	if logs[0].HttpCode != 200 || logs[0].InputTokens != 11 || logs[0].OutputTokens != 22 {
+		t.Fatalf("unexpected log: %+v", logs[0])
+	}
+}
+
+func TestRelayClaudeStreamUsage(t *testing.T) {
+	setProviders(t, "claude", mockProvider("claude-stream", "in=7,out=9"))
+
+	w := doRelay(t, nil, "/v1/messages", `{"model":"claude-sonnet-4","stream":true}`, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "event: message_stop") {
+		t.Fatalf("stream not completed: %s", w.Body.String())
+	}
+
+	logs := waitLogs(t, "claude", "claude-stream", 1)
+	if !logs[0].IsStream || logs[0].InputTokens != 7 || logs[0].OutputTokens != 9 {
+		t.Fatalf("unexpected log: %+v", logs[0])
+	}
+}
+
+func TestRelayCodexResponsesStream(t *testing.T) {
+	setProviders(t, "codex", mockProvider("codex-stream", "in=5,out=6"))
+
+	w := doRelay(t, nil, "/responses", `{"model":"gpt-5","stream":true}`, nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "response.completed") {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+
+	logs := waitLogs(t, "codex", "codex-stream", 1)
+	if logs[0].InputTokens != 5 || logs[0].OutputTokens != 6 {
+		t.Fatalf("unexpected log: %+v", logs[0])
+	}
+}
+
+func TestRelayGeminiChatCompletions(t *testing.T) {
+	setProviders(t, "gemini", mockProvider("gemini-chat", "in=3,out=4"))
+
+	w := doRelay(t, nil, "/v1/chat/completions", `{"model":"gemini-2.5-pro","stream":true}`, nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "[DONE]") {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+
+	logs := waitLogs(t, "gemini", "gemini-chat", 1)
+	if logs[0].InputTokens != 3 || logs[0].OutputTokens != 4 {
+		t.Fatalf("unexpected log: %+v", logs[0])
+	}
+}
+
+func TestRelayFailoverToNextProvider(t *testing.T) {
+	setProviders(t, "claude",
+		mockProvider("failover-bad", "status=500"),
+		mockProvider("failover-good", "default"),
+	)
+	// 通过路由策略固定尝试顺序：先失败的 provider
+	setRoutePolicies(t, RoutePolicy{
+		Name:            "failover-order",
+		Enabled:         true,
+		Match:           RouteMatch{Route: "failover"},
+		PreferProviders: []string{"failover-bad", "failover-good"},
+	})
+
+	w := doRelay(t, nil, "/v1/messages", `{"model":"claude-sonnet-4"}`, map[string]string{routeHeader: "failover"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if bad := waitLogs(t, "claude", "failover-bad", 1); bad[0].HttpCode != 500 || bad[0].RoutePolicy != "failover-order" {
+		t.Fatalf("unexpected log for bad provider: %+v", bad[0])
+	}
+	if good := waitLogs(t, "claude", "failover-good", 1); good[0].HttpCode != 200 {
+		t.Fatalf("unexpected log for good provider: %+v", good[0])
+	}
+}
+
+func TestRelayKeyRotationOnRateLimit(t *testing.T) {
+	setProviders(t, "claude", mockProvider("key-rotation", "default", "mock:status=429,retry=30", "mock:ok"))
+
+	w := doRelay(t, nil, "/v1/messages", `{"model":"claude-sonnet-4"}`, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	attempts := attemptCodes(waitLogs(t, "claude", "key-rotation", 2))
+	if attempts[0] != "429" || attempts[1] != "200" {
+		t.Fatalf("unexpected attempts: %v", attempts)
+	}
+
+	// 第一个 Key 冷却中，第二次请求直接使用第二个 Key
+	w = doRelay(t, nil, "/v1/messages", `{"model":"claude-sonnet-4"}`, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d", w.Code)
+	}
+	attempts = attemptCodes(waitLogs(t, "claude", "key-rotation", 3))
+	if attempts[0] != "429" || attempts[1] != "200,200" {
+		t.Fatalf("cooling key was retried: %v", attempts)
+	}
+}
+
+// attemptCodes 按 Key 下标汇总状态码（日志异步写入，顺序不确定）
+func attemptCodes(logs []RequestLog) map[int]string {
+	codes := make(map[int]string)
+	for i := len(logs) - 1; i >= 0; i-- {
+		if codes[logs[i].KeyIndex] != "" {
+			codes[logs[i].KeyIndex] += ","
+		}
+		codes[logs[i].KeyIndex] += strconv.Itoa(logs[i].HttpCode)
+	}
+	return codes
+}
+
+func TestRelayAuthErrorRotatesKey(t *testing.T) {
+	setProviders(t, "codex", mockProvider("key-auth", "default", "mock:status=401", "mock:ok"))
+
+	w := doRelay(t, nil, "/responses", `{"model":"gpt-5"}`, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	attempts := attemptCodes(waitLogs(t, "codex", "key-auth", 2))
+	if attempts[0] != "401" || attempts[1] != "200" {
+		t.Fatalf("unexpected attempts: %v", attempts)
+	}
+}
+
+func TestRelayAllProvidersFailReturnsLastError(t *testing.T) {
+	setProviders(t, "claude", mockProvider("all-fail", "status=500"))
+
+	w := doRelay(t, nil, "/v1/messages", `{"model":"claude-sonnet-4"}`, nil)
+	if w.Code != http.StatusInternalServerError || !strings.Contains(w.Body.String(), "mock upstream error 500") {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+}
+
+func TestRelayMidStreamDisconnect(t *testing.T) {
+	setProviders(t, "claude", mockProvider("disconnect", "disconnect=2,in=8"))
+
+	w := doRelay(t, nil, "/v1/messages", `{"model":"claude-sonnet-4","stream":true}`, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d", w.Code)
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, "message_start") || strings.Contains(body, "message_stop") {
+		t.Fatalf("expected truncated stream, got: %s", body)
+	}
+	logs := waitLogs(t, "claude", "disconnect", 1)
+	if logs[0].InputTokens != 8 || logs[0].OutputTokens != 0 {
+		t.Fatalf("unexpected log: %+v", logs[0])
+	}
+}
+
+func TestRelayError200PassesThrough(t *testing.T) {
+	setProviders(t, "claude", mockProvider("error200", "error200"))
+
+	w := doRelay(t, nil, "/v1/messages", `{"model":"claude-sonnet-4"}`, nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "overloaded_error") {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+}
+
+func TestRelayClientCancelStopsUpstream(t *testing.T) {
+	setProviders(t, "claude", mockProvider("slow", "latency=5s"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	w := doRelay(t, ctx, "/v1/messages", `{"model":"claude-sonnet-4"}`, nil)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("relay waited %s after client cancel", elapsed)
+	}
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+}
+
+func TestRelayModelMapping(t *testing.T) {
+	p := mockProvider("mapping", "default")
+	p.SupportedModels = map[string]bool{"mock-*": true}
+	p.ModelMapping = map[string]string{"claude-*": "mock-*"}
+	setProviders(t, "claude", p)
+
+	w := doRelay(t, nil, "/v1/messages", `{"model":"claude-sonnet-4"}`, nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"model":"mock-sonnet-4"`) {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+}
+
+func TestRelayNoProviderForModel(t *testing.T) {
+	p := mockProvider("whitelist", "default")
+	p.SupportedModels = map[string]bool{"claude-sonnet-4": true}
+	setProviders(t, "claude", p)
+
+	w := doRelay(t, nil, "/v1/messages", `{"model":"claude-opus-4"}`, nil)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+}
@@ -3,10 +3,12 @@ package services
 import (
 	"encoding/json"
 	"fmt"
+	"log"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 )
 
 type Provider struct {
@@ -24,22 +26,77 @@ type Provider struct {
 	// 向后兼容：如果 APIKeys 为空，则使用 APIKey 字段
 	APIKeys []string `json:"apiKeys,omitempty"`
 
+	// Key 选择策略：sequential（默认）、round-robin、lru、weighted、random
+	KeyStrategy string `json:"keyStrategy,omitempty"`
+	// 每个 Key 的权重（按下标对应，用于 weighted 策略，通常按配额设置），缺省为 1
+	KeyWeights []int `json:"keyWeights,omitempty"`
+	// 被禁用的 Key 下标，转发时跳过
+	DisabledKeys []int `json:"disabledKeys,omitempty"`
+
 	// 模型白名单 - Provider 原生支持的模型名
 	// 使用 map 实现 O(1) 查找，向后兼容（omitempty）
 	SupportedModels map[string]bool `json:"supportedModels,omitempty"`
 
 	// 模型映射 - 外部模型名 -> Provider 内部模型名
-	// 支持精确匹配和通配符（如 "claude-*" -> "anthropic/claude-*"）
+	// 支持精确匹配、通配符（*、?，可多个）和 re: 正则（如 "claude-*" -> "anthropic/claude-*"）
 	ModelMapping map[string]string `json:"modelMapping,omitempty"`
 
+	// 模型映射的声明顺序，用于多个模式同时命中时的确定性优先级
+	// 未配置时从配置文件中 modelMapping 的 key 顺序推导
+	ModelMappingOrder []string `json:"modelMappingOrder,omitempty"`
+
 	// 优先级分组 - 数字越小优先级越高（1-10，默认 1）
 	// 使用 omitempty 确保零值不序列化，向后兼容
 	Level int `json:"level,omitempty"`
 
+	// 负载均衡 - weighted 模式下首选流量的相对权重，缺省为 1
+	TrafficWeight int `json:"trafficWeight,omitempty"`
+	// 负载均衡 - quota 模式下每自然月的费用额度（USD），按剩余额度分配首选流量
+	MonthlyQuota float64 `json:"monthlyQuota,omitempty"`
+
+	// 能力声明 - 用于按请求内容（上下文长度、图片、thinking、工具、beta 特性）过滤 provider
+	// 未配置（nil）表示不限制
+	Capabilities *ProviderCapabilities `json:"capabilities,omitempty"`
+
+	// 并发限制 - 同时进行中的请求上限，0 表示不限制
+	MaxConcurrent int `json:"maxConcurrent,omitempty"`
+	// 并发限制 - 每个 Key 同时进行中的请求上限，0 表示不限制
+	MaxConcurrentPerKey int `json:"maxConcurrentPerKey,omitempty"`
+	// 达到并发上限时的排队长度，0 表示不排队，直接尝试下一个 provider
+	QueueSize int `json:"queueSize,omitempty"`
+	// 排队超时（秒），超时后尝试下一个 provider，默认 30
+	QueueTimeoutSec int `json:"queueTimeoutSec,omitempty"`
+
+	// 主动健康探测 - 探测间隔（秒），0 表示不探测
+	ProbeIntervalSec int `json:"probeIntervalSec,omitempty"`
+	// 探测方式："request"（默认，发送 max_tokens=1 的最小请求）或 "models"（请求模型列表）
+	ProbeMode string `json:"probeMode,omitempty"`
+	// 探测使用的模型（外部模型名，会经过 modelMapping），留空时自动选取
+	ProbeModel string `json:"probeModel,omitempty"`
+
+	// 模型自动发现 - 定时拉取上游模型列表的间隔（小时），0 表示不自动刷新
+	ModelRefreshHours int `json:"modelRefreshHours,omitempty"`
+
 	// 内部字段：配置验证错误（不持久化）
 	configErrors []string `json:"-"`
 }
 
+// UnmarshalJSON 在标准解码的基础上记录 modelMapping 的声明顺序
+// （Go map 不保留顺序，多个通配符映射重叠时需要依赖声明顺序做决定）
+func (p *Provider) UnmarshalJSON(data []byte) error {
+	type providerAlias Provider
+	var alias providerAlias
+	if err := json.Unmarshal(data, &alias); err != nil {
+		return err
+	}
+	*p = Provider(alias)
+
+	if len(p.ModelMappingOrder) == 0 && len(p.ModelMapping) > 1 {
+		p.ModelMappingOrder = mappingKeyOrder(data, "modelMapping")
+	}
+	return nil
+}
+
 // GetAPIKeys 获取所有可用的 API Keys
 // 向后兼容：如果 APIKeys 为空，返回包含 APIKey 的切片
 func (p *Provider) GetAPIKeys() []string {
@@ -59,16 +116,32 @@ type providerEnvelope struct {
 type ProviderService struct {
 	mu    sync.RWMutex
 	cache map[string][]Provider
+
+	// 当前激活的配置方案名（见 ProfileService）
+	activeProfile string
+
+	// 模型列表定时刷新
+	nextModelRefresh map[string]time.Time // key: kind:provider，下次允许刷新的时间
+	stopCh           chan struct{}
+	wg               sync.WaitGroup
 }
 
 func NewProviderService() *ProviderService {
 	return &ProviderService{
-		cache: make(map[string][]Provider),
+		cache:            make(map[string][]Provider),
+		nextModelRefresh: make(map[string]time.Time),
 	}
 }
 
-func (ps *ProviderService) Start() error { return nil }
-func (ps *ProviderService) Stop() error  { return nil }
+func (ps *ProviderService) Start() error {
+	ps.startModelRefresh()
+	return nil
+}
+
+func (ps *ProviderService) Stop() error {
+	ps.stopModelRefresh()
+	return nil
+}
 
 func providerFilePath(kind string) (string, error) {
 	home, err := os.UserHomeDir()
@@ -111,6 +184,14 @@ func (ps *ProviderService) SaveProviders(kind string, providers []Provider) erro
 		nameByID[p.ID] = p.Name
 	}
 
+	// 前端拿到的是脱敏 Key，保存前还原为已存储的密文（避免修改调用方的切片）
+	providers = deepCopyProviders(providers)
+	for i := range providers {
+		if err := resolveMaskedKeys(&providers[i], existingProviders); err != nil {
+			return fmt.Errorf("[%s] %w", providers[i].Name, err)
+		}
+	}
+
 	// 验证每个 provider 的配置
 	validationErrors := make([]string, 0)
 	for _, p := range providers {
@@ -132,16 +213,7 @@ func (ps *ProviderService) SaveProviders(kind string, providers []Provider) erro
 		return fmt.Errorf("配置验证失败：\n  - %s", strings.Join(validationErrors, "\n  - "))
 	}
 
-	data, err := json.MarshalIndent(providerEnvelope{Providers: providers}, "", "  ")
-	if err != nil {
-		return err
-	}
-
-	tmp := path + ".tmp"
-	if err := os.WriteFile(tmp, data, 0o644); err != nil {
-		return err
-	}
-	if err := os.Rename(tmp, path); err != nil {
+	if err := writeProvidersFile(path, providers); err != nil {
 		return err
 	}
 
@@ -153,7 +225,20 @@ func (ps *ProviderService) SaveProviders(kind string, providers []Provider) erro
 	return nil
 }
 
+// LoadProviders 返回 provider 列表（面向前端，API Key 已脱敏）
 func (ps *ProviderService) LoadProviders(kind string) ([]Provider, error) {
+	providers, err := ps.loadSealedProviders(kind)
+	if err != nil {
+		return nil, err
+	}
+	for i := range providers {
+		maskProviderKeys(&providers[i])
+	}
+	return providers, nil
+}
+
+// loadSealedProviders 返回 provider 列表（内部使用，API Key 为密文，仅在转发时解密）
+func (ps *ProviderService) loadSealedProviders(kind string) ([]Provider, error) {
 	kind = strings.ToLower(kind)
 	
 	// 1. 尝试从缓存读取
@@ -199,6 +284,14 @@ func deepCopyProviders(src []Provider) []Provider {
 			dst[i].APIKeys = make([]string, len(p.APIKeys))
 			copy(dst[i].APIKeys, p.APIKeys)
 		}
+		if p.KeyWeights != nil {
+			dst[i].KeyWeights = make([]int, len(p.KeyWeights))
+			copy(dst[i].KeyWeights, p.KeyWeights)
+		}
+		if p.DisabledKeys != nil {
+			dst[i].DisabledKeys = make([]int, len(p.DisabledKeys))
+			copy(dst[i].DisabledKeys, p.DisabledKeys)
+		}
 		// 深拷贝 Map 字段
 		if p.SupportedModels != nil {
 			dst[i].SupportedModels = make(map[string]bool)
@@ -212,6 +305,15 @@ func deepCopyProviders(src []Provider) []Provider {
 				dst[i].ModelMapping[k] = v
 			}
 		}
+		if p.ModelMappingOrder != nil {
+			dst[i].ModelMappingOrder = make([]string, len(p.ModelMappingOrder))
+			copy(dst[i].ModelMappingOrder, p.ModelMappingOrder)
+		}
+		if p.Capabilities != nil {
+			caps := *p.Capabilities
+			caps.Betas = append([]string(nil), p.Capabilities.Betas...)
+			dst[i].Capabilities = &caps
+		}
 	}
 	return dst
 }
@@ -259,24 +361,17 @@ func (p *Provider) IsModelSupported(modelName string) bool {
 }
 
 // GetEffectiveModel 获取实际应该使用的模型名
-// 如果存在映射（精确或通配符），返回映射后的模型名；否则返回原模型名
+// 如果存在映射（精确或模式），返回映射后的模型名；否则返回原模型名
+// 优先级：精确匹配 > 字面前缀最长的模式 > 声明顺序
 func (p *Provider) GetEffectiveModel(requestedModel string) string {
 	if p.ModelMapping == nil || len(p.ModelMapping) == 0 {
 		return requestedModel
 	}
 
-	// 优先查找精确映射
-	if mappedModel, exists := p.ModelMapping[requestedModel]; exists {
+	if mappedModel, ok := resolveModelMapping(p.ModelMapping, p.ModelMappingOrder, requestedModel); ok {
 		return mappedModel
 	}
 
-	// 查找通配符映射
-	for pattern, replacement := range p.ModelMapping {
-		if matchWildcard(pattern, requestedModel) {
-			return applyWildcardMapping(pattern, replacement, requestedModel)
-		}
-	}
-
 	// 无映射，返回原模型名
 	return requestedModel
 }
@@ -286,30 +381,40 @@ func (p *Provider) GetEffectiveModel(requestedModel string) string {
 func (p *Provider) ValidateConfiguration() []string {
 	errors := make([]string, 0)
 
-	// 规则 1：ModelMapping 的 value 必须在 SupportedModels 中
-	if p.ModelMapping != nil && p.SupportedModels != nil {
-		for externalModel, internalModel := range p.ModelMapping {
-			// 检查是否为通配符映射
-			if strings.Contains(internalModel, "*") {
-				// 通配符映射暂不验证（需要具体请求才能展开）
-				continue
+	// 规则 0：模式必须可编译（正则语法错误等）
+	for pattern := range p.ModelMapping {
+		if isModelPattern(pattern) {
+			if _, err := compileModelPattern(pattern); err != nil {
+				errors = append(errors, fmt.Sprintf("模型映射模式无效：'%s'：%v", pattern, err))
 			}
+		}
+	}
+	for pattern := range p.SupportedModels {
+		if isModelPattern(pattern) {
+			if _, err := compileModelPattern(pattern); err != nil {
+				errors = append(errors, fmt.Sprintf("模型白名单模式无效：'%s'：%v", pattern, err))
+			}
+		}
+	}
 
-			// 精确映射需要验证
-			supported := false
-			if p.SupportedModels[internalModel] {
-				supported = true
-			} else {
-				// 检查通配符白名单
-				for supportedPattern := range p.SupportedModels {
-					if matchWildcard(supportedPattern, internalModel) {
-						supported = true
-						break
-					}
+	if caps := p.Capabilities; caps != nil {
+		if caps.MaxContextTokens < 0 {
+			errors = append(errors, "能力声明无效：maxContextTokens 不能为负数")
+		}
+		for _, beta := range caps.Betas {
+			if isModelPattern(beta) {
+				if _, err := compileModelPattern(beta); err != nil {
+					errors = append(errors, fmt.Sprintf("beta 特性模式无效：'%s'：%v", beta, err))
 				}
 			}
+		}
+	}
 
-			if !supported {
+	// 规则 1：ModelMapping 的 value 必须在 SupportedModels 中
+	// 含通配符 / 捕获组引用的目标会被展开后与白名单匹配
+	if p.ModelMapping != nil && p.SupportedModels != nil {
+		for externalModel, internalModel := range p.ModelMapping {
+			if !p.isTargetSupported(internalModel) {
 				errors = append(errors, fmt.Sprintf(
 					"模型映射无效：'%s' -> '%s'，目标模型 '%s' 不在 supportedModels 中",
 					externalModel, internalModel, internalModel,
@@ -342,28 +447,6 @@ func (p *Provider) ValidateConfiguration() []string {
 	return errors
 }
 
-// matchWildcard 通配符匹配函数
-// 支持 * 通配符，如 "claude-*" 匹配 "claude-sonnet-4"
-func matchWildcard(pattern, text string) bool {
-	// 如果没有通配符，使用精确匹配
-	if !strings.Contains(pattern, "*") {
-		return pattern == text
-	}
-
-	// 简化实现：只支持单个 * 通配符
-	parts := strings.Split(pattern, "*")
-	if len(parts) == 2 {
-		// 前缀 + * 或 * + 后缀
-		prefix, suffix := parts[0], parts[1]
-		return strings.HasPrefix(text, prefix) && strings.HasSuffix(text, suffix)
-	}
-
-	// 多个 * 的情况（更复杂，暂不支持）
-	return false
-}
-
-
-
 // DisableProvider 禁用指定的供应商
 // 返回是否成功禁用
 func (ps *ProviderService) DisableProvider(kind string, providerName string) error {
@@ -400,6 +483,54 @@ func (ps *ProviderService) DisableProvider(kind string, providerName string) err
 	return nil
 }
 
+// findProvider 按名称查找 provider（返回副本）
+func (ps *ProviderService) findProvider(kind string, providerName string) (Provider, error) {
+	providers, err := ps.loadSealedProviders(kind)
+	if err != nil {
+		return Provider{}, err
+	}
+	for _, p := range providers {
+		if p.Name == providerName {
+			return p, nil
+		}
+	}
+	return Provider{}, fmt.Errorf("provider not found: %s", providerName)
+}
+
+// updateProvider 在写锁内修改指定 provider 并持久化
+func (ps *ProviderService) updateProvider(kind string, providerName string, fn func(*Provider) error) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	providers, err := ps.loadProvidersInternal(kind)
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for i := range providers {
+		if providers[i].Name == providerName {
+			if err := fn(&providers[i]); err != nil {
+				return err
+			}
+			found = true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("provider not found: %s", providerName)
+	}
+
+	if err := ps.saveProvidersInternal(kind, providers); err != nil {
+		return err
+	}
+	if ps.cache == nil {
+		ps.cache = make(map[string][]Provider)
+	}
+	ps.cache[strings.ToLower(kind)] = deepCopyProviders(providers)
+	return nil
+}
+
 // loadProvidersInternal 内部加载方法（不加锁）
 func (ps *ProviderService) loadProvidersInternal(kind string) ([]Provider, error) {
 	path, err := providerFilePath(kind)
@@ -423,7 +554,26 @@ func (ps *ProviderService) loadProvidersInternal(kind string) ([]Provider, error
 	if err := json.Unmarshal(data, &envelope); err != nil {
 		return nil, err
 	}
-	return envelope.Providers, nil
+
+	// 透明迁移：旧版明文 Key 加密后回写，并收紧文件权限
+	providers := envelope.Providers
+	plain := false
+	for _, p := range providers {
+		if providerHasPlainKeys(p) {
+			plain = true
+			break
+		}
+	}
+	if plain {
+		if err := writeProvidersFile(path, providers); err != nil {
+			log.Printf("[Secrets] 加密 %s 中的明文 Key 失败: %v", filepath.Base(path), err)
+		} else {
+			log.Printf("[Secrets] 已将 %s 中的明文 Key 迁移为加密存储", filepath.Base(path))
+		}
+	} else if info, err := os.Stat(path); err == nil && info.Mode().Perm() != 0o600 {
+		_ = os.Chmod(path, 0o600)
+	}
+	return providers, nil
 }
 
 // saveProvidersInternal 内部保存方法（不加锁）
@@ -432,45 +582,119 @@ func (ps *ProviderService) saveProvidersInternal(kind string, providers []Provid
 	if err != nil {
 		return err
 	}
+	return writeProvidersFile(path, providers)
+}
 
-	data, err := json.MarshalIndent(providerEnvelope{Providers: providers}, "", "  ")
+// writeProvidersFile 加密所有 Key（原地修改）后以 0600 权限原子写入
+func writeProvidersFile(path string, providers []Provider) error {
+	data, err := encodeProvidersFile(providers)
 	if err != nil {
 		return err
 	}
 
 	tmp := path + ".tmp"
-	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
 		return err
 	}
 	return os.Rename(tmp, path)
 }
 
-// applyWildcardMapping 应用通配符映射
-// 将 pattern 中的 * 匹配部分替换到 replacement 的 * 位置
-// 示例: pattern="claude-*", replacement="anthropic/claude-*", input="claude-sonnet-4"
-//      输出: "anthropic/claude-sonnet-4"
-func applyWildcardMapping(pattern, replacement, input string) string {
-	// 如果 pattern 或 replacement 没有通配符，直接返回 replacement
-	if !strings.Contains(pattern, "*") || !strings.Contains(replacement, "*") {
-		return replacement
+// encodeProvidersFile 加密所有 Key（原地修改）并序列化为 provider 文件内容
+func encodeProvidersFile(providers []Provider) ([]byte, error) {
+	for i := range providers {
+		if err := sealProviderKeys(&providers[i]); err != nil {
+			return nil, err
+		}
+	}
+	return json.MarshalIndent(providerEnvelope{Providers: providers}, "", "  ")
+}
+
+// sealProviderKeys 加密 provider 的所有 Key（已加密的保持不变）
+func sealProviderKeys(p *Provider) error {
+	sealed, err := sealSecret(p.APIKey)
+	if err != nil {
+		return err
+	}
+	p.APIKey = sealed
+	for i, key := range p.APIKeys {
+		if p.APIKeys[i], err = sealSecret(key); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	// 提取通配符匹配的部分
-	parts := strings.Split(pattern, "*")
-	if len(parts) != 2 {
-		return replacement // 不支持多个通配符
+// providerHasPlainKeys 判断 provider 是否仍有未加密的 Key
+func providerHasPlainKeys(p Provider) bool {
+	if p.APIKey != "" && !isSealedSecret(p.APIKey) {
+		return true
 	}
+	for _, key := range p.APIKeys {
+		if key != "" && !isSealedSecret(key) {
+			return true
+		}
+	}
+	return false
+}
 
-	prefix, suffix := parts[0], parts[1]
+// maskProviderKeys 将 provider 的 Key 替换为脱敏值（用于返回前端）
+func maskProviderKeys(p *Provider) {
+	p.APIKey = maskSecret(p.APIKey)
+	for i, key := range p.APIKeys {
+		p.APIKeys[i] = maskSecret(key)
+	}
+}
 
-	// 验证 input 确实匹配 pattern，且长度足以提取中间部分，防止切片越界
-	if len(input) < len(prefix)+len(suffix) || !strings.HasPrefix(input, prefix) || !strings.HasSuffix(input, suffix) {
-		return replacement
+// resolveMaskedKeys 将前端回传的脱敏 Key 还原为已存储的密文
+// 按 ID（其次按名称）找到原 provider，按位置还原：调整了顺序的脱敏 Key 需要重新填写
+func resolveMaskedKeys(p *Provider, existing []Provider) error {
+	var prev *Provider
+	for i := range existing {
+		if existing[i].ID == p.ID && p.ID != 0 {
+			prev = &existing[i]
+			break
+		}
+	}
+	if prev == nil {
+		for i := range existing {
+			if existing[i].Name == p.Name {
+				prev = &existing[i]
+				break
+			}
+		}
+	}
+
+	var prevKey string
+	var prevKeys []string
+	if prev != nil {
+		prevKey = prev.APIKey
+		prevKeys = prev.APIKeys
+	}
+
+	var err error
+	if p.APIKey, err = resolveMaskedSecret(p.APIKey, prevKey); err != nil {
+		return err
 	}
+	for i, key := range p.APIKeys {
+		if p.APIKeys[i], err = resolveMaskedSecret(key, slotOf(prevKeys, i)); err != nil {
+			return fmt.Errorf("Key %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
 
-	// 提取中间部分
-	wildcardPart := input[len(prefix) : len(input)-len(suffix)]
+func slotOf(values []string, i int) string {
+	if i >= 0 && i < len(values) {
+		return values[i]
+	}
+	return ""
+}
 
-	// 替换 replacement 中的 *
-	return strings.Replace(replacement, "*", wildcardPart, 1)
+// resolveProviderSecrets 将前端传入 provider 中的脱敏 Key 还原为已存储的密文
+func (ps *ProviderService) resolveProviderSecrets(kind string, p *Provider) error {
+	existing, err := ps.loadSealedProviders(kind)
+	if err != nil {
+		return err
+	}
+	return resolveMaskedKeys(p, existing)
 }
@@ -0,0 +1,122 @@
+package services
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+)
+
+const providerTestTimeout = 60 * time.Second
+
+// ProviderTestResult 一键测试 provider 的结果
+type ProviderTestResult struct {
+	Provider     string          `json:"provider"`
+	Success      bool            `json:"success"` // 至少一个 Key + 模型组合成功
+	ConfigErrors []string        `json:"config_errors"`
+	Results      []KeyTestResult `json:"results"`
+}
+
+// KeyTestResult 单个 Key + 模型组合的测试结果
+type KeyTestResult struct {
+	KeyIndex       int     `json:"key_index"`
+	KeyHint        string  `json:"key_hint"` // 仅显示 Key 末尾 4 位
+	RequestedModel string  `json:"requested_model"`
+	EffectiveModel string  `json:"effective_model"`
+	HttpCode       int     `json:"http_code"`
+	LatencySec     float64 `json:"latency_sec"`
+	Error          string  `json:"error"`
+	UsageParsed    bool    `json:"usage_parsed"`
+	InputTokens    int     `json:"input_tokens"`
+	OutputTokens   int     `json:"output_tokens"`
+}
+
+// TestProvider 对 provider 的每个 Key、每个映射模型发送一个真实的最小请求
+// 走与用户请求相同的 forwardRequestWithKey 路径，但结果不写入 request_log
+// provider 无需已保存或已启用，可在启用前验证配置
+func (prs *ProviderRelayService) TestProvider(kind string, provider Provider) ProviderTestResult {
+	kind = strings.ToLower(kind)
+	result := ProviderTestResult{
+		Provider:     provider.Name,
+		ConfigErrors: provider.ValidateConfiguration(),
+		Results:      make([]KeyTestResult, 0),
+	}
+
+	// 前端传入的 Key 可能是脱敏值，还原为已存储的密文
+	if err := prs.providerService.resolveProviderSecrets(kind, &provider); err != nil {
+		result.ConfigErrors = append(result.ConfigErrors, err.Error())
+		return result
+	}
+
+	keys := provider.GetAPIKeys()
+	if provider.APIURL == "" || len(keys) == 0 {
+		result.ConfigErrors = append(result.ConfigErrors, "未配置 API URL 或 API Key")
+		return result
+	}
+
+	models := providerTestModels(kind, provider)
+	for i, apiKey := range keys {
+		for _, requested := range models {
+			r := prs.testProviderKey(kind, provider, i, requested)
+			r.KeyIndex = i
+			r.KeyHint = maskSecret(apiKey)
+			if r.HttpCode >= 200 && r.HttpCode < 300 {
+				result.Success = true
+			}
+			result.Results = append(result.Results, r)
+		}
+	}
+	return result
+}
+
+func (prs *ProviderRelayService) testProviderKey(kind string, provider Provider, keyIndex int, requested string) KeyTestResult {
+	effective := provider.GetEffectiveModel(requested)
+	r := KeyTestResult{RequestedModel: requested, EffectiveModel: effective}
+
+	ctx, cancel := context.WithTimeout(context.Background(), providerTestTimeout)
+	defer cancel()
+
+	endpoint, body := probeEndpointAndBody(kind, effective)
+	var attempt *RequestLog
+	c := newInternalContext(ctx, endpoint, func(rl *RequestLog) { attempt = rl })
+	status, _, respBody, err := prs.forwardRequestWithKey(c, kind, provider, keyIndex, endpoint, nil, map[string]string{}, body, false, effective)
+	if attempt != nil {
+		r.LatencySec = attempt.DurationSec
+		r.InputTokens = attempt.InputTokens
+		r.OutputTokens = attempt.OutputTokens
+		r.UsageParsed = attempt.InputTokens > 0 || attempt.OutputTokens > 0
+	}
+	if err != nil {
+		r.Error = err.Error()
+		return r
+	}
+	r.HttpCode = status
+	if status < 200 || status >= 300 {
+		r.Error = upstreamErrorMessage(respBody)
+	}
+	return r
+}
+
+// providerTestModels 返回需要测试的外部模型名：所有精确映射的 key；
+// 若没有精确映射，则使用探测模型
+func providerTestModels(kind string, provider Provider) []string {
+	models := make([]string, 0, len(provider.ModelMapping))
+	for external := range provider.ModelMapping {
+		if !isModelPattern(external) {
+			models = append(models, external)
+		}
+	}
+	sort.Strings(models)
+	if len(models) > 0 {
+		return models
+	}
+
+	candidate := strings.TrimSpace(provider.ProbeModel)
+	if candidate == "" {
+		candidate = firstLiteralModel(boolMapKeys(provider.SupportedModels))
+	}
+	if candidate == "" {
+		candidate = defaultProbeModels[kind]
+	}
+	return []string{candidate}
+}
@@ -0,0 +1,22 @@
+package services
+
+import (
+	"testing"
+)
+
+func TestProviderTestWithMock(t *testing.T) {
+	p := mockProvider("one-click", "in=3,out=4", "mock:ok", "mock:status=401")
+	p.ModelMapping = map[string]string{"claude-sonnet-4": "mock-small"}
+
+	result := testRelay.TestProvider("claude", p)
+	if !result.Success || len(result.Results) != 2 {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	ok, denied := result.Results[0], result.Results[1]
+	if ok.HttpCode != 200 || ok.EffectiveModel != "mock-small" || ok.InputTokens != 3 || ok.OutputTokens != 4 {
+		t.Fatalf("unexpected first key result: %+v", ok)
+	}
+	if denied.HttpCode != 401 || denied.Error == "" {
+		t.Fatalf("unexpected second key result: %+v", denied)
+	}
+}
@@ -0,0 +1,261 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 实时请求事件相关常量
+const (
+	liveRequestCtxKey      = "relay.liveRequest"    // gin.Context 中记录当前请求实时状态的键
+	relayEventBuffer       = 512                    // 待推送事件的缓冲数量，已满时丢弃新事件
+	streamProgressInterval = 500 * time.Millisecond // 流式响应推送 token 进度的最小间隔
+)
+
+// 请求生命周期事件类型
+const (
+	RelayEventReceived         = "received"          // 收到请求
+	RelayEventProviderSelected = "provider_selected" // 选定 provider / Key，开始转发
+	RelayEventFirstByte        = "first_byte"        // 收到上游响应头
+	RelayEventProgress         = "progress"          // 流式响应进度（实时 token）
+	RelayEventFailover         = "failover"          // 当前尝试失败，切换 Key / provider / 降级模型
+	RelayEventCompleted        = "completed"         // 请求结束（成功或失败）
+)
+
+// RelayEvent 推送给前端的请求生命周期事件
+type RelayEvent struct {
+	RequestID string `json:"request_id"`
+	Type      string `json:"type"`
+	Time      string `json:"time"`
+
+	Platform string `json:"platform"`
+	Model    string `json:"model"`
+	Client   string `json:"client,omitempty"`
+	Provider string `json:"provider,omitempty"`
+	KeyIndex int    `json:"key_index,omitempty"`
+	IsStream bool   `json:"is_stream"`
+
+	HttpCode     int     `json:"http_code,omitempty"`
+	ElapsedSec   float64 `json:"elapsed_sec"`              // 自收到请求起的时长
+	QueueWaitSec float64 `json:"queue_wait_sec,omitempty"` // provider_selected：排队时长
+	Bytes        int64   `json:"bytes,omitempty"`          // 已向客户端转发的响应字节数
+	InputTokens  int     `json:"input_tokens,omitempty"`
+	OutputTokens int     `json:"output_tokens,omitempty"`
+	FallbackFrom string  `json:"fallback_from,omitempty"` // 降级前的原始模型
+	Error        string  `json:"error,omitempty"`
+}
+
+// liveRequest 单个客户端请求的实时状态，随 gin.Context 传递，同时登记在进行中请求列表
+type liveRequest struct {
+	id       string
+	platform string
+	endpoint string
+	model    string
+	client   string
+	isStream bool
+	start    time.Time
+
+	cancel    context.CancelFunc
+	cancelled atomic.Bool // 由 CancelRequest / Stop 主动取消
+
+	mu           sync.Mutex
+	provider     string
+	keyIndex     int
+	bytes        int64
+	inputTokens  int
+	outputTokens int
+}
+
+// observe 按事件更新当前 provider、已转发字节数与 token
+func (lr *liveRequest) observe(ev RelayEvent) {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	switch ev.Type {
+	case RelayEventProviderSelected:
+		lr.provider = ev.Provider
+		lr.keyIndex = ev.KeyIndex
+		lr.bytes, lr.inputTokens, lr.outputTokens = 0, 0, 0
+	case RelayEventProgress:
+		lr.bytes = ev.Bytes
+		lr.inputTokens = ev.InputTokens
+		lr.outputTokens = ev.OutputTokens
+	}
+}
+
+var liveRequestSeq atomic.Uint64
+
+// relayEventBus 事件分发：发送方不阻塞，由单独的 goroutine 按顺序回调
+type relayEventBus struct {
+	mu      sync.RWMutex
+	handler func(RelayEvent)
+	once    sync.Once
+	events  chan RelayEvent
+}
+
+func newRelayEventBus() *relayEventBus {
+	return &relayEventBus{events: make(chan RelayEvent, relayEventBuffer)}
+}
+
+func (b *relayEventBus) setHandler(fn func(RelayEvent)) {
+	b.mu.Lock()
+	b.handler = fn
+	b.mu.Unlock()
+	b.once.Do(func() {
+		go b.dispatch()
+	})
+}
+
+func (b *relayEventBus) enabled() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.handler != nil
+}
+
+func (b *relayEventBus) publish(ev RelayEvent) {
+	select {
+	case b.events <- ev:
+	default:
+		// 前端处理不过来时丢弃事件，不能拖慢转发
+	}
+}
+
+func (b *relayEventBus) dispatch() {
+	for ev := range b.events {
+		b.mu.RLock()
+		handler := b.handler
+		b.mu.RUnlock()
+		if handler != nil {
+			handler(ev)
+		}
+	}
+}
+
+// SetOnRelayEvent 设置请求生命周期事件回调（由 main 转发为前端事件）
+func (prs *ProviderRelayService) SetOnRelayEvent(fn func(RelayEvent)) {
+	prs.events.setHandler(fn)
+}
+
+// beginLiveRequest 为客户端请求分配 ID、登记为进行中并推送 received 事件
+// 请求的 Context 替换为可取消的 Context，供 CancelRequest 中止上游请求
+func (prs *ProviderRelayService) beginLiveRequest(c *gin.Context, kind string, endpoint string, model string, isStream bool) *liveRequest {
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	c.Request = c.Request.WithContext(ctx)
+	live := &liveRequest{
+		id:       fmt.Sprintf("%x-%d", time.Now().Unix(), liveRequestSeq.Add(1)),
+		platform: kind,
+		endpoint: endpoint,
+		model:    model,
+		client:   clientFrom(c),
+		isStream: isStream,
+		start:    time.Now(),
+		keyIndex: -1,
+		cancel:   cancel,
+	}
+	c.Set(liveRequestCtxKey, live)
+	prs.active.add(live)
+	prs.emitRelayEvent(c, RelayEvent{Type: RelayEventReceived})
+	return live
+}
+
+// finishLiveRequest 推送 completed 事件（token 与 provider 取自最后一次转发）并移出进行中列表
+func (prs *ProviderRelayService) finishLiveRequest(c *gin.Context) {
+	if live := liveRequestFrom(c); live != nil {
+		defer func() {
+			prs.active.remove(live.id)
+			live.cancel()
+		}()
+	}
+	ev := RelayEvent{Type: RelayEventCompleted, HttpCode: c.Writer.Status()}
+	if rl := lastAttemptFrom(c); rl != nil {
+		ev.Provider = rl.Provider
+		ev.KeyIndex = rl.KeyIndex
+		ev.Model = rl.Model
+		ev.InputTokens = rl.InputTokens
+		ev.OutputTokens = rl.OutputTokens
+	}
+	if size := c.Writer.Size(); size > 0 {
+		ev.Bytes = int64(size)
+	}
+	prs.emitRelayEvent(c, ev)
+}
+
+// emitRelayEvent 补全请求信息后推送事件；内部请求（探测、影子流量）不推送
+func (prs *ProviderRelayService) emitRelayEvent(c *gin.Context, ev RelayEvent) {
+	live := liveRequestFrom(c)
+	if live == nil {
+		return
+	}
+	live.observe(ev)
+	if !prs.events.enabled() {
+		return
+	}
+	ev.RequestID = live.id
+	ev.Time = time.Now().Format(time.RFC3339Nano)
+	ev.Platform = live.platform
+	if ev.Model == "" {
+		ev.Model = live.model
+	}
+	ev.Client = live.client
+	ev.IsStream = live.isStream
+	ev.ElapsedSec = time.Since(live.start).Seconds()
+	if ev.FallbackFrom == "" {
+		ev.FallbackFrom = fallbackFrom(c)
+	}
+	prs.events.publish(ev)
+}
+
+// emitFailover 推送一次转发尝试失败的事件
+func (prs *ProviderRelayService) emitFailover(c *gin.Context, provider string, keyIndex int, model string, status int, err error) {
+	ev := RelayEvent{Type: RelayEventFailover, Provider: provider, KeyIndex: keyIndex, Model: model, HttpCode: status}
+	if err != nil {
+		ev.Error = err.Error()
+	}
+	prs.emitRelayEvent(c, ev)
+}
+
+// progressHook 包装流式 token 解析 hook，按固定间隔更新并推送已转发字节数和实时 token
+func (prs *ProviderRelayService) progressHook(c *gin.Context, requestLog *RequestLog, hook func([]byte) (bool, []byte)) func([]byte) (bool, []byte) {
+	if liveRequestFrom(c) == nil {
+		return hook
+	}
+	var streamed int64
+	var lastEmit time.Time
+	return func(data []byte) (bool, []byte) {
+		ok, out := hook(data)
+		streamed += int64(len(data))
+		if data != nil && time.Since(lastEmit) >= streamProgressInterval {
+			lastEmit = time.Now()
+			prs.emitRelayEvent(c, RelayEvent{
+				Type:         RelayEventProgress,
+				Provider:     requestLog.Provider,
+				KeyIndex:     requestLog.KeyIndex,
+				Model:        requestLog.Model,
+				HttpCode:     requestLog.HttpCode,
+				Bytes:        streamed,
+				InputTokens:  requestLog.InputTokens,
+				OutputTokens: requestLog.OutputTokens,
+			})
+		}
+		return ok, out
+	}
+}
+
+func liveRequestFrom(c *gin.Context) *liveRequest {
+	if c == nil {
+		return nil
+	}
+	if v, ok := c.Get(liveRequestCtxKey); ok {
+		if live, ok := v.(*liveRequest); ok {
+			return live
+		}
+	}
+	return nil
+}
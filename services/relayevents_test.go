@@ -0,0 +1,61 @@
+package services
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRelayLiveEvents(t *testing.T) {
+	setProviders(t, "claude",
+		mockProvider("events-bad", "status=503"),
+		mockProvider("events-good", "in=7,out=9"),
+	)
+	setRoutePolicies(t, RoutePolicy{
+		Name:            "events-order",
+		Enabled:         true,
+		Match:           RouteMatch{Route: "events"},
+		PreferProviders: []string{"events-bad", "events-good"},
+	})
+
+	events := make(chan RelayEvent, 64)
+	testRelay.SetOnRelayEvent(func(ev RelayEvent) { events <- ev })
+	t.Cleanup(func() { testRelay.SetOnRelayEvent(nil) })
+
+	w := doRelay(t, nil, "/v1/messages", `{"model":"claude-sonnet-4","stream":true}`, map[string]string{routeHeader: "events"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+
+	var types []string
+	var completed RelayEvent
+	timeout := time.After(3 * time.Second)
+	for completed.Type == "" {
+		select {
+		case ev := <-events:
+			types = append(types, ev.Type+":"+ev.Provider)
+			if ev.RequestID == "" || ev.Platform != "claude" {
+				t.Fatalf("incomplete event: %+v", ev)
+			}
+			if ev.Type == RelayEventCompleted {
+				completed = ev
+			}
+		case <-timeout:
+			t.Fatalf("no completed event, got %v", types)
+		}
+	}
+
+	want := []string{
+		"received:",
+		"provider_selected:events-bad", "first_byte:events-bad", "failover:events-bad",
+		"provider_selected:events-good", "first_byte:events-good", "progress:events-good",
+	}
+	for _, w := range want {
+		if !containsFold(types, w) {
+			t.Fatalf("missing %s in %v", w, types)
+		}
+	}
+	if completed.Provider != "events-good" || completed.HttpCode != 200 || completed.InputTokens != 7 || completed.OutputTokens != 9 {
+		t.Fatalf("unexpected completed event: %+v", completed)
+	}
+}
@@ -0,0 +1,75 @@
+package services
+
+// RelayService 是 relay 面向前端的绑定，只暴露配置与状态相关的方法
+// ProviderRelayService 的启动 / 停止由 main 管理，本身不注册为 Wails 服务
+type RelayService struct {
+	relay *ProviderRelayService
+}
+
+func NewRelayService(relay *ProviderRelayService) *RelayService {
+	return &RelayService{relay: relay}
+}
+
+func (rs *RelayService) ListActiveRequests() []ActiveRequest {
+	return rs.relay.ListActiveRequests()
+}
+
+func (rs *RelayService) CancelRequest(id string) error {
+	return rs.relay.CancelRequest(id)
+}
+
+func (rs *RelayService) TestProvider(kind string, provider Provider) ProviderTestResult {
+	return rs.relay.TestProvider(kind, provider)
+}
+
+func (rs *RelayService) HealthStatus() []ProviderHealth {
+	return rs.relay.HealthStatus()
+}
+
+func (rs *RelayService) ConcurrencyStatus() []ProviderConcurrency {
+	return rs.relay.ConcurrencyStatus()
+}
+
+func (rs *RelayService) ListRoutePolicies() ([]RoutePolicy, error) {
+	return rs.relay.ListRoutePolicies()
+}
+
+func (rs *RelayService) SaveRoutePolicies(policies []RoutePolicy) error {
+	return rs.relay.SaveRoutePolicies(policies)
+}
+
+func (rs *RelayService) GetShadowConfig(kind string) (ShadowConfig, error) {
+	return rs.relay.GetShadowConfig(kind)
+}
+
+func (rs *RelayService) SaveShadowConfig(kind string, cfg ShadowConfig) error {
+	return rs.relay.SaveShadowConfig(kind, cfg)
+}
+
+func (rs *RelayService) GetBalanceConfig(kind string) (BalanceConfig, error) {
+	return rs.relay.GetBalanceConfig(kind)
+}
+
+func (rs *RelayService) SaveBalanceConfig(kind string, cfg BalanceConfig) error {
+	return rs.relay.SaveBalanceConfig(kind, cfg)
+}
+
+func (rs *RelayService) ListFallbackChains(kind string) ([]FallbackChain, error) {
+	return rs.relay.ListFallbackChains(kind)
+}
+
+func (rs *RelayService) SaveFallbackChains(kind string, chains []FallbackChain) error {
+	return rs.relay.SaveFallbackChains(kind, chains)
+}
+
+func (rs *RelayService) ListBudgets() ([]Budget, error) {
+	return rs.relay.ListBudgets()
+}
+
+func (rs *RelayService) SaveBudgets(budgets []Budget) error {
+	return rs.relay.SaveBudgets(budgets)
+}
+
+func (rs *RelayService) BudgetStatus() ([]BudgetStatus, error) {
+	return rs.relay.BudgetStatus()
+}
@@ -0,0 +1,438 @@
+package services
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	modelpricing "coderelay/resources/model-pricing"
+
+	"github.com/daodao97/xgo/xdb"
+)
+
+// 汇总表：按小时 / 天、platform、provider、模型累计请求数、token、费用与耗时，
+// 另按天、platform、provider、客户端累计费用（供预算使用）
+// 写入 request_log 时在同一事务内增量更新，费用在写入时按当时的价格计算
+const (
+	hourlyRollupTable  = "request_log_hourly"
+	dailyRollupTable   = "request_log_daily"
+	clientRollupTable  = "request_log_client_daily"
+	hourLayout         = "2006-01-02 15:00:00"
+	dayLayout          = "2006-01-02"
+	rollupBackfillPage = 5000
+
+	// 汇总表的回填版本记录在 rollup_meta 中；汇总的列或计算方式变化时提升版本，下次启动会根据原始日志重建汇总
+	rollupMetaTable       = "rollup_meta"
+	rollupBackfillKey     = "backfill_version"
+	rollupBackfillVersion = 1
+)
+
+// rollupMetricColumns 小时 / 日汇总表的累计值列，与 rollupMetrics 的字段顺序一致
+const rollupMetricColumns = `requests, success_requests,
+		input_tokens, output_tokens, reasoning_tokens, cache_create_tokens, cache_read_tokens,
+		input_cost, output_cost, cache_create_cost, cache_read_cost, total_cost,
+		duration_sum, duration_count, duration_min, duration_max,
+		success_duration_sum, success_duration_count`
+
+// rollupKey 汇总表主键（bucket 为小时或日期）
+type rollupKey struct {
+	bucket   string
+	platform string
+	provider string
+	model    string
+}
+
+// rollupMetrics 一个汇总桶的累计值
+type rollupMetrics struct {
+	requests          int64
+	successRequests   int64
+	inputTokens       int64
+	outputTokens      int64
+	reasoningTokens   int64
+	cacheCreateTokens int64
+	cacheReadTokens   int64
+	inputCost         float64
+	outputCost        float64
+	cacheCreateCost   float64
+	cacheReadCost     float64
+	totalCost         float64
+	durationSum       float64
+	durationCount     int64
+	durationMin       float64
+	durationMax       float64
+	// 成功请求的耗时，供按耗时负载均衡使用
+	successDurationSum   float64
+	successDurationCount int64
+}
+
+func (m *rollupMetrics) add(rl *RequestLog, cost modelpricing.CostBreakdown) {
+	m.requests++
+	if isSuccessCode(rl.HttpCode) {
+		m.successRequests++
+	}
+	m.inputTokens += int64(rl.InputTokens)
+	m.outputTokens += int64(rl.OutputTokens)
+	m.reasoningTokens += int64(rl.ReasoningTokens)
+	m.cacheCreateTokens += int64(rl.CacheCreateTokens)
+	m.cacheReadTokens += int64(rl.CacheReadTokens)
+	m.inputCost += cost.InputCost
+	m.outputCost += cost.OutputCost
+	m.cacheCreateCost += cost.CacheCreateCost
+	m.cacheReadCost += cost.CacheReadCost
+	m.totalCost += cost.TotalCost
+	// 只统计有效的响应时间
+	if d := rl.DurationSec; d > 0 {
+		if m.durationCount == 0 || d < m.durationMin {
+			m.durationMin = d
+		}
+		if d > m.durationMax {
+			m.durationMax = d
+		}
+		m.durationSum += d
+		m.durationCount++
+		if isSuccessCode(rl.HttpCode) {
+			m.successDurationSum += d
+			m.successDurationCount++
+		}
+	}
+}
+
+// clientRollupKey 客户端日汇总主键
+type clientRollupKey struct {
+	day      string
+	platform string
+	provider string
+	client   string
+}
+
+// clientRollupMetrics 客户端日汇总的累计值
+type clientRollupMetrics struct {
+	requests  int64
+	totalCost float64
+}
+
+// rollupBatch 一批日志按小时和天的汇总
+type rollupBatch struct {
+	hourly  map[rollupKey]*rollupMetrics
+	daily   map[rollupKey]*rollupMetrics
+	clients map[clientRollupKey]*clientRollupMetrics
+}
+
+func newRollupBatch() *rollupBatch {
+	return &rollupBatch{
+		hourly:  make(map[rollupKey]*rollupMetrics),
+		daily:   make(map[rollupKey]*rollupMetrics),
+		clients: make(map[clientRollupKey]*clientRollupMetrics),
+	}
+}
+
+// add 将一条日志计入汇总，createdAt 为 request_log.created_at 的原始值
+func (b *rollupBatch) add(ls *LogService, createdAt string, rl *RequestLog) {
+	if len(createdAt) < len(hourLayout) {
+		return
+	}
+	cost := ls.calculateCost(rl.Model, modelpricing.UsageSnapshot{
+		InputTokens:       rl.InputTokens,
+		OutputTokens:      rl.OutputTokens,
+		CacheCreateTokens: rl.CacheCreateTokens,
+		CacheReadTokens:   rl.CacheReadTokens,
+	})
+	hourKey := rollupKey{bucket: createdAt[:13] + ":00:00", platform: rl.Platform, provider: rl.Provider, model: rl.Model}
+	dayKey := rollupKey{bucket: createdAt[:10], platform: rl.Platform, provider: rl.Provider, model: rl.Model}
+	for _, target := range []struct {
+		buckets map[rollupKey]*rollupMetrics
+		key     rollupKey
+	}{{b.hourly, hourKey}, {b.daily, dayKey}} {
+		m := target.buckets[target.key]
+		if m == nil {
+			m = &rollupMetrics{}
+			target.buckets[target.key] = m
+		}
+		m.add(rl, cost)
+	}
+
+	clientKey := clientRollupKey{day: createdAt[:10], platform: rl.Platform, provider: rl.Provider, client: rl.Client}
+	cm := b.clients[clientKey]
+	if cm == nil {
+		cm = &clientRollupMetrics{}
+		b.clients[clientKey] = cm
+	}
+	cm.requests++
+	cm.totalCost += cost.TotalCost
+}
+
+// write 在事务中把汇总累加到 request_log_hourly / request_log_daily / request_log_client_daily
+func (b *rollupBatch) write(tx *sql.Tx) error {
+	if err := upsertRollups(tx, hourlyRollupTable, "hour", b.hourly); err != nil {
+		return err
+	}
+	if err := upsertRollups(tx, dailyRollupTable, "day", b.daily); err != nil {
+		return err
+	}
+	return upsertClientRollups(tx, b.clients)
+}
+
+func upsertClientRollups(tx *sql.Tx, buckets map[clientRollupKey]*clientRollupMetrics) error {
+	upsertSQL := `INSERT INTO ` + clientRollupTable + ` (day, platform, provider, client, requests, total_cost)
+	VALUES (?, ?, ?, ?, ?, ?)
+	ON CONFLICT(day, platform, provider, client) DO UPDATE SET
+		requests = requests + excluded.requests,
+		total_cost = total_cost + excluded.total_cost`
+	for key, m := range buckets {
+		if _, err := tx.Exec(upsertSQL, key.day, key.platform, key.provider, key.client, m.requests, m.totalCost); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func upsertRollups(tx *sql.Tx, table string, bucketColumn string, buckets map[rollupKey]*rollupMetrics) error {
+	upsertSQL := fmt.Sprintf(`INSERT INTO %[1]s (
+		%[2]s, platform, provider, model, %[3]s
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT(%[2]s, platform, provider, model) DO UPDATE SET
+		requests = requests + excluded.requests,
+		success_requests = success_requests + excluded.success_requests,
+		input_tokens = input_tokens + excluded.input_tokens,
+		output_tokens = output_tokens + excluded.output_tokens,
+		reasoning_tokens = reasoning_tokens + excluded.reasoning_tokens,
+		cache_create_tokens = cache_create_tokens + excluded.cache_create_tokens,
+		cache_read_tokens = cache_read_tokens + excluded.cache_read_tokens,
+		input_cost = input_cost + excluded.input_cost,
+		output_cost = output_cost + excluded.output_cost,
+		cache_create_cost = cache_create_cost + excluded.cache_create_cost,
+		cache_read_cost = cache_read_cost + excluded.cache_read_cost,
+		total_cost = total_cost + excluded.total_cost,
+		duration_sum = duration_sum + excluded.duration_sum,
+		duration_count = duration_count + excluded.duration_count,
+		duration_min = CASE
+			WHEN excluded.duration_count = 0 THEN duration_min
+			WHEN duration_count = 0 THEN excluded.duration_min
+			ELSE MIN(duration_min, excluded.duration_min) END,
+		duration_max = MAX(duration_max, excluded.duration_max),
+		success_duration_sum = success_duration_sum + excluded.success_duration_sum,
+		success_duration_count = success_duration_count + excluded.success_duration_count`, table, bucketColumn, rollupMetricColumns)
+	for key, m := range buckets {
+		if _, err := tx.Exec(upsertSQL,
+			key.bucket, key.platform, key.provider, key.model, m.requests, m.successRequests,
+			m.inputTokens, m.outputTokens, m.reasoningTokens, m.cacheCreateTokens, m.cacheReadTokens,
+			m.inputCost, m.outputCost, m.cacheCreateCost, m.cacheReadCost, m.totalCost,
+			m.durationSum, m.durationCount, m.durationMin, m.durationMax,
+			m.successDurationSum, m.successDurationCount,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ensureRollupTables 创建汇总表；回填版本低于 rollupBackfillVersion 时根据原始日志重建汇总
+func (ls *LogService) ensureRollupTables() error {
+	db, err := xdb.DB("default")
+	if err != nil {
+		return err
+	}
+	if err := ensureRollupTablesWithDB(db); err != nil {
+		return err
+	}
+	var version int
+	err = db.QueryRow("SELECT value FROM "+rollupMetaTable+" WHERE key = ?", rollupBackfillKey).Scan(&version)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	if version >= rollupBackfillVersion {
+		return nil
+	}
+	return ls.backfillRollups(db)
+}
+
+func ensureRollupTablesWithDB(db *sql.DB) error {
+	const columns = `platform TEXT NOT NULL,
+		provider TEXT NOT NULL,
+		model TEXT NOT NULL,
+		requests INTEGER DEFAULT 0,
+		success_requests INTEGER DEFAULT 0,
+		input_tokens INTEGER DEFAULT 0,
+		output_tokens INTEGER DEFAULT 0,
+		reasoning_tokens INTEGER DEFAULT 0,
+		cache_create_tokens INTEGER DEFAULT 0,
+		cache_read_tokens INTEGER DEFAULT 0,
+		input_cost REAL DEFAULT 0,
+		output_cost REAL DEFAULT 0,
+		cache_create_cost REAL DEFAULT 0,
+		cache_read_cost REAL DEFAULT 0,
+		total_cost REAL DEFAULT 0,
+		duration_sum REAL DEFAULT 0,
+		duration_count INTEGER DEFAULT 0,
+		duration_min REAL DEFAULT 0,
+		duration_max REAL DEFAULT 0,
+		success_duration_sum REAL DEFAULT 0,
+		success_duration_count INTEGER DEFAULT 0`
+	for _, table := range []struct{ name, bucket string }{{hourlyRollupTable, "hour"}, {dailyRollupTable, "day"}} {
+		createSQL := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (\n\t\t%s TEXT NOT NULL,\n\t\t%s,\n\t\tPRIMARY KEY (%s, platform, provider, model)\n\t)", table.name, table.bucket, columns, table.bucket)
+		if _, err := db.Exec(createSQL); err != nil {
+			return err
+		}
+	}
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS ` + clientRollupTable + ` (
+		day TEXT NOT NULL,
+		platform TEXT NOT NULL,
+		provider TEXT NOT NULL,
+		client TEXT NOT NULL,
+		requests INTEGER DEFAULT 0,
+		total_cost REAL DEFAULT 0,
+		PRIMARY KEY (day, platform, provider, client)
+	)`); err != nil {
+		return err
+	}
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS " + rollupMetaTable + " (key TEXT PRIMARY KEY, value INTEGER DEFAULT 0)"); err != nil {
+		return err
+	}
+	_, err := db.Exec("CREATE INDEX IF NOT EXISTS idx_request_log_created_at ON request_log(created_at)")
+	return err
+}
+
+// backfillRollups 在一个事务中根据原始日志重建汇总并记录回填版本，中断后下次启动会重新执行：
+// 有原始日志的日期按原始日志重建小时 / 日 / 客户端汇总；原始日志已被清理的日期保留原有的日汇总，
+// 没有小时汇总时按日汇总补到当天 0 点，使统计查询仍覆盖清理前的数据
+func (ls *LogService) backfillRollups(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// 先写入回填版本取得写锁，重建期间新日志等待事务提交，不会被遗漏或重复计入
+	if _, err := tx.Exec("INSERT INTO "+rollupMetaTable+" (key, value) VALUES (?, ?) ON CONFLICT(key) DO UPDATE SET value = excluded.value",
+		rollupBackfillKey, rollupBackfillVersion); err != nil {
+		return err
+	}
+
+	batch := newRollupBatch()
+	var lastID int64
+	for {
+		records, err := queryRecords(tx, `SELECT id, platform, provider, model, client, http_code,
+			input_tokens, output_tokens, reasoning_tokens, cache_create_tokens, cache_read_tokens, duration_sec, created_at
+			FROM request_log WHERE id > ? ORDER BY id LIMIT ?`, lastID, rollupBackfillPage)
+		if err != nil {
+			return err
+		}
+		for _, record := range records {
+			lastID = record.GetInt64("id")
+			createdAt, ok := parseCreatedAt(record)
+			if !ok {
+				continue
+			}
+			batch.add(ls, createdAt.Format(timeLayout), &RequestLog{
+				Platform:          record.GetString("platform"),
+				Provider:          record.GetString("provider"),
+				Model:             record.GetString("model"),
+				Client:            record.GetString("client"),
+				HttpCode:          record.GetInt("http_code"),
+				InputTokens:       record.GetInt("input_tokens"),
+				OutputTokens:      record.GetInt("output_tokens"),
+				ReasoningTokens:   record.GetInt("reasoning_tokens"),
+				CacheCreateTokens: record.GetInt("cache_create_tokens"),
+				CacheReadTokens:   record.GetInt("cache_read_tokens"),
+				DurationSec:       record.GetFloat64("duration_sec"),
+			})
+		}
+		if len(records) < rollupBackfillPage {
+			break
+		}
+	}
+
+	days := map[string]bool{}
+	for key := range batch.daily {
+		days[key.bucket] = true
+	}
+	for day := range days {
+		for _, deleteSQL := range []string{
+			"DELETE FROM " + hourlyRollupTable + " WHERE substr(hour, 1, 10) = ?",
+			"DELETE FROM " + dailyRollupTable + " WHERE day = ?",
+			"DELETE FROM " + clientRollupTable + " WHERE day = ?",
+		} {
+			if _, err := tx.Exec(deleteSQL, day); err != nil {
+				return err
+			}
+		}
+	}
+	if err := batch.write(tx); err != nil {
+		return err
+	}
+	res, err := tx.Exec(fmt.Sprintf(`INSERT INTO %[1]s (hour, platform, provider, model, %[3]s)
+		SELECT day || ' 00:00:00', platform, provider, model, %[3]s FROM %[2]s
+		WHERE day NOT IN (SELECT DISTINCT substr(hour, 1, 10) FROM %[1]s)`, hourlyRollupTable, dailyRollupTable, rollupMetricColumns))
+	if err != nil {
+		return err
+	}
+	filled, _ := res.RowsAffected()
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if len(days) > 0 || filled > 0 {
+		log.Printf("[DB] 已根据现有日志重建 %d 天的汇总（%d 个小时桶），按日汇总补充 %d 个小时桶", len(days), len(batch.hourly), filled)
+	}
+	return nil
+}
+
+// rollupRow 汇总查询的一行（按查询的分组维度）
+type rollupRow struct {
+	group   string
+	metrics rollupMetrics
+}
+
+// queryHourlyRollups 按 groupColumn 分组汇总 [start, end) 内的小时汇总，end 为零值表示不限
+func queryHourlyRollups(groupColumn string, platform string, start time.Time, end time.Time) ([]rollupRow, error) {
+	db, err := xdb.DB("default")
+	if err != nil {
+		return nil, err
+	}
+	query := fmt.Sprintf(`SELECT %s,
+		SUM(requests), SUM(success_requests),
+		SUM(input_tokens), SUM(output_tokens), SUM(reasoning_tokens), SUM(cache_create_tokens), SUM(cache_read_tokens),
+		SUM(input_cost), SUM(output_cost), SUM(cache_create_cost), SUM(cache_read_cost), SUM(total_cost),
+		SUM(duration_sum), SUM(duration_count),
+		MIN(CASE WHEN duration_count > 0 THEN duration_min END), MAX(duration_max),
+		SUM(success_duration_sum), SUM(success_duration_count)
+		FROM %s WHERE hour >= ?`, groupColumn, hourlyRollupTable)
+	args := []any{start.Format(timeLayout)}
+	if !end.IsZero() {
+		query += " AND hour < ?"
+		args = append(args, end.Format(timeLayout))
+	}
+	if platform != "" {
+		query += " AND platform = ?"
+		args = append(args, platform)
+	}
+	query += fmt.Sprintf(" GROUP BY %s ORDER BY %s", groupColumn, groupColumn)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		if isNoSuchTableErr(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []rollupRow
+	for rows.Next() {
+		var row rollupRow
+		var durationMin sql.NullFloat64
+		m := &row.metrics
+		if err := rows.Scan(&row.group,
+			&m.requests, &m.successRequests,
+			&m.inputTokens, &m.outputTokens, &m.reasoningTokens, &m.cacheCreateTokens, &m.cacheReadTokens,
+			&m.inputCost, &m.outputCost, &m.cacheCreateCost, &m.cacheReadCost, &m.totalCost,
+			&m.durationSum, &m.durationCount, &durationMin, &m.durationMax,
+			&m.successDurationSum, &m.successDurationCount,
+		); err != nil {
+			return nil, err
+		}
+		m.durationMin = durationMin.Float64
+		result = append(result, row)
+	}
+	return result, rows.Err()
+}
@@ -0,0 +1,112 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/daodao97/xgo/xdb"
+)
+
+func TestRollupBackfillRebuildsAndFillsPrunedDays(t *testing.T) {
+	ls := newTestLogService(t)
+	db, err := xdb.DB("default")
+	if err != nil {
+		t.Fatalf("db: %v", err)
+	}
+	for range 2 {
+		ls.writeRequestLog(&RequestLog{Platform: "backfill-test", Provider: "backfill-p", Model: "claude-sonnet-4", HttpCode: 200, InputTokens: 10, DurationSec: 1}, nil)
+	}
+	waitLogs(t, "backfill-test", "backfill-p", 2)
+
+	// 模拟经过旧版本升级的数据库：没有回填版本，今日小时汇总缺失，已清理日期只有日汇总
+	prunedDay := startOfDay(time.Now()).AddDate(0, 0, -40).Format(dayLayout)
+	for _, stmt := range []string{
+		"DELETE FROM " + rollupMetaTable,
+		"DELETE FROM " + hourlyRollupTable + " WHERE platform = 'backfill-test'",
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+	if _, err := db.Exec("INSERT INTO "+dailyRollupTable+" (day, platform, provider, model, requests, success_requests, total_cost) VALUES (?, 'backfill-test', 'backfill-p', 'claude-sonnet-4', 7, 6, 1.5)", prunedDay); err != nil {
+		t.Fatalf("insert daily: %v", err)
+	}
+
+	hourlyTotals := func() (today, pruned int64) {
+		t.Helper()
+		if err := db.QueryRow("SELECT COALESCE(SUM(requests), 0) FROM "+hourlyRollupTable+" WHERE platform = 'backfill-test' AND substr(hour, 1, 10) = ?", time.Now().Format(dayLayout)).Scan(&today); err != nil {
+			t.Fatalf("query hourly: %v", err)
+		}
+		if err := db.QueryRow("SELECT COALESCE(SUM(requests), 0) FROM "+hourlyRollupTable+" WHERE platform = 'backfill-test' AND hour = ?", prunedDay+" 00:00:00").Scan(&pruned); err != nil {
+			t.Fatalf("query hourly: %v", err)
+		}
+		return today, pruned
+	}
+
+	// 重复执行（例如上次中断、或版本提升）结果一致
+	for run := 0; run < 2; run++ {
+		if _, err := db.Exec("DELETE FROM " + rollupMetaTable); err != nil {
+			t.Fatalf("reset marker: %v", err)
+		}
+		if err := ls.ensureRollupTables(); err != nil {
+			t.Fatalf("ensureRollupTables: %v", err)
+		}
+		if today, pruned := hourlyTotals(); today != 2 || pruned != 7 {
+			t.Fatalf("run %d: hourly today = %d, pruned day = %d", run, today, pruned)
+		}
+	}
+	var version int
+	if err := db.QueryRow("SELECT value FROM "+rollupMetaTable+" WHERE key = ?", rollupBackfillKey).Scan(&version); err != nil || version != rollupBackfillVersion {
+		t.Fatalf("backfill version = %d, err = %v", version, err)
+	}
+
+	stats, err := ls.Stats(StatsQuery{Start: startOfDay(time.Now()).AddDate(0, 0, -41), End: time.Now().Add(time.Hour), Platform: "backfill-test"})
+	if err != nil {
+		t.Fatalf("Stats: %v", err)
+	}
+	if stats.Totals.Requests != 9 {
+		t.Fatalf("stats should include the pruned day: %+v", stats.Totals)
+	}
+}
+
+func TestRollupStats(t *testing.T) {
+	ls := newTestLogService(t)
+	for _, rl := range []RequestLog{
+		{Platform: "rollup-test", Provider: "rollup-a", Model: "claude-sonnet-4", HttpCode: 200, InputTokens: 100, OutputTokens: 10, DurationSec: 1},
+		{Platform: "rollup-test", Provider: "rollup-a", Model: "claude-haiku-4-5", HttpCode: 200, InputTokens: 50, OutputTokens: 5, DurationSec: 3},
+		{Platform: "rollup-test", Provider: "rollup-a", Model: "claude-sonnet-4", HttpCode: 502},
+		{Platform: "rollup-test", Provider: "rollup-b", Model: "claude-sonnet-4", HttpCode: 200, InputTokens: 1, OutputTokens: 1, DurationSec: 2},
+	} {
+		rl := rl
+		ls.writeRequestLog(&rl, nil)
+	}
+	waitLogs(t, "rollup-test", "", 4)
+
+	providers, err := ls.ProviderDailyStats("rollup-test")
+	if err != nil {
+		t.Fatalf("ProviderDailyStats: %v", err)
+	}
+	if len(providers) != 2 || providers[0].Provider != "rollup-a" {
+		t.Fatalf("unexpected provider stats: %+v", providers)
+	}
+	a := providers[0]
+	if a.TotalRequests != 3 || a.SuccessfulRequests != 2 || a.FailedRequests != 1 || a.InputTokens != 150 ||
+		a.MinDurationSec != 1 || a.MaxDurationSec != 3 || a.AvgDurationSec != 2 || a.CostTotal <= 0 {
+		t.Fatalf("unexpected stats for rollup-a: %+v", a)
+	}
+
+	stats, err := ls.StatsSince("rollup-test")
+	if err != nil {
+		t.Fatalf("StatsSince: %v", err)
+	}
+	var seriesRequests int64
+	for _, bucket := range stats.Series {
+		seriesRequests += bucket.TotalRequests
+	}
+	if stats.TotalRequests != 4 || seriesRequests != 4 || len(stats.Series) != 24 || stats.InputTokens != 151 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	if diff := stats.CostTotal - (a.CostTotal + providers[1].CostTotal); diff > 1e-9 || diff < -1e-9 {
+		t.Fatalf("cost mismatch: %v vs %v", stats.CostTotal, a.CostTotal+providers[1].CostTotal)
+	}
+}
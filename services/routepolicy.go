@@ -0,0 +1,316 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/gjson"
+)
+
+// 路由策略相关常量
+const (
+	routePolicyFile   = "route-policies.json"
+	routeHeader       = "x-code-relay-route" // 客户端显式指定的路由标识
+	routePolicyCtxKey = "relay.routePolicy"  // gin.Context 中记录命中策略名的键
+
+	RouteActionAllow = "allow" // 默认：按策略限制 / 调整 provider 后继续转发
+	RouteActionDeny  = "deny"  // 直接拒绝请求
+)
+
+// RoutePolicy 按客户端身份决定可用 provider 的路由策略
+// 多个策略按声明顺序匹配，第一个命中的生效
+type RoutePolicy struct {
+	Name      string     `json:"name"`
+	Enabled   bool       `json:"enabled"`
+	Platforms []string   `json:"platforms,omitempty"` // 生效的平台（claude/codex/gemini），为空表示全部
+	Match     RouteMatch `json:"match"`
+
+	Action      string `json:"action,omitempty"`      // allow（默认）或 deny
+	DenyMessage string `json:"denyMessage,omitempty"` // deny 时返回给客户端的说明
+
+	// 只允许使用这些 provider（为空表示不限制）
+	AllowProviders []string `json:"allowProviders,omitempty"`
+	// 禁止使用这些 provider
+	DenyProviders []string `json:"denyProviders,omitempty"`
+	// 优先尝试这些 provider（按给定顺序排在最前，其余按权重）
+	PreferProviders []string `json:"preferProviders,omitempty"`
+	// 强制模型映射：请求模型 -> 替换后的模型，支持与 provider modelMapping 相同的模式语法与优先级
+	ModelMapping map[string]string `json:"modelMapping,omitempty"`
+	// 模型映射的声明顺序，未配置时从配置文件中 modelMapping 的 key 顺序推导
+	ModelMappingOrder []string `json:"modelMappingOrder,omitempty"`
+}
+
+// UnmarshalJSON 在标准解码的基础上记录 modelMapping 的声明顺序
+func (rp *RoutePolicy) UnmarshalJSON(data []byte) error {
+	type routePolicyAlias RoutePolicy
+	var alias routePolicyAlias
+	if err := json.Unmarshal(data, &alias); err != nil {
+		return err
+	}
+	*rp = RoutePolicy(alias)
+	if len(rp.ModelMappingOrder) == 0 && len(rp.ModelMapping) > 1 {
+		rp.ModelMappingOrder = mappingKeyOrder(data, "modelMapping")
+	}
+	return nil
+}
+
+// RouteMatch 匹配条件，所有非空条件都满足才算命中
+// UserAgent / UserID 支持通配符与 re: 正则；Token、Route 为精确匹配
+type RouteMatch struct {
+	Token     string `json:"token,omitempty"`     // 客户端使用的 relay token（x-api-key / Bearer / x-goog-api-key）
+	UserAgent string `json:"userAgent,omitempty"` // User-Agent
+	Route     string `json:"route,omitempty"`     // x-code-relay-route 请求头
+	UserID    string `json:"userId,omitempty"`    // 请求体 metadata.user_id
+}
+
+// routeClient 从请求中提取的客户端身份
+type routeClient struct {
+	Token     string
+	UserAgent string
+	Route     string
+	UserID    string
+}
+
+// routePolicyStore 路由策略的加载与缓存
+type routePolicyStore struct {
+	mu       sync.RWMutex
+	path     string
+	loaded   bool
+	policies []RoutePolicy
+}
+
+func newRoutePolicyStore() *routePolicyStore {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		home = "."
+	}
+	return &routePolicyStore{path: filepath.Join(home, ".code-relay", routePolicyFile)}
+}
+
+func (s *routePolicyStore) list() ([]RoutePolicy, error) {
+	s.mu.RLock()
+	if s.loaded {
+		policies := append([]RoutePolicy(nil), s.policies...)
+		s.mu.RUnlock()
+		return policies, nil
+	}
+	s.mu.RUnlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.loaded {
+		policies := []RoutePolicy{}
+		data, err := os.ReadFile(s.path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		if len(data) > 0 {
+			if err := json.Unmarshal(data, &policies); err != nil {
+				return nil, err
+			}
+		}
+		s.policies = policies
+		s.loaded = true
+	}
+	return append([]RoutePolicy(nil), s.policies...), nil
+}
+
+func (s *routePolicyStore) save(policies []RoutePolicy) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(policies, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	s.policies = append([]RoutePolicy(nil), policies...)
+	s.loaded = true
+	return nil
+}
+
+// ListRoutePolicies 返回所有路由策略（按匹配顺序）
+func (prs *ProviderRelayService) ListRoutePolicies() ([]RoutePolicy, error) {
+	return prs.policies.list()
+}
+
+// SaveRoutePolicies 校验并保存路由策略，立即对后续请求生效
+func (prs *ProviderRelayService) SaveRoutePolicies(policies []RoutePolicy) error {
+	for i := range policies {
+		policies[i].Name = strings.TrimSpace(policies[i].Name)
+		if err := policies[i].validate(); err != nil {
+			return fmt.Errorf("策略 %q: %w", policies[i].Name, err)
+		}
+	}
+	return prs.policies.save(policies)
+}
+
+// validate 检查策略配置是否合法
+func (rp *RoutePolicy) validate() error {
+	if rp.Name == "" {
+		return fmt.Errorf("名称不能为空")
+	}
+	switch strings.ToLower(rp.Action) {
+	case "", RouteActionAllow, RouteActionDeny:
+	default:
+		return fmt.Errorf("未知动作 %q（应为 allow 或 deny）", rp.Action)
+	}
+	m := rp.Match
+	if m.Token == "" && m.UserAgent == "" && m.Route == "" && m.UserID == "" {
+		return fmt.Errorf("至少需要一个匹配条件")
+	}
+	for _, pattern := range []string{m.UserAgent, m.UserID} {
+		if isModelPattern(pattern) {
+			if _, err := compileModelPattern(pattern); err != nil {
+				return fmt.Errorf("匹配模式 %q 无效: %w", pattern, err)
+			}
+		}
+	}
+	for pattern := range rp.ModelMapping {
+		if isModelPattern(pattern) {
+			if _, err := compileModelPattern(pattern); err != nil {
+				return fmt.Errorf("模型映射模式 %q 无效: %w", pattern, err)
+			}
+		}
+	}
+	return nil
+}
+
+// matchRoutePolicy 返回第一个命中的策略，没有命中时返回 nil
+func (prs *ProviderRelayService) matchRoutePolicy(kind string, client routeClient) *RoutePolicy {
+	policies, err := prs.policies.list()
+	if err != nil {
+		log.Printf("[Relay] 加载路由策略失败: %v", err)
+		return nil
+	}
+	for i := range policies {
+		if policies[i].matches(kind, client) {
+			return &policies[i]
+		}
+	}
+	return nil
+}
+
+func (rp *RoutePolicy) matches(kind string, client routeClient) bool {
+	if !rp.Enabled {
+		return false
+	}
+	if len(rp.Platforms) > 0 && !containsFold(rp.Platforms, kind) {
+		return false
+	}
+	m := rp.Match
+	if m.Token != "" && m.Token != client.Token {
+		return false
+	}
+	if m.Route != "" && m.Route != client.Route {
+		return false
+	}
+	if m.UserAgent != "" && !matchWildcard(m.UserAgent, client.UserAgent) {
+		return false
+	}
+	if m.UserID != "" && !matchWildcard(m.UserID, client.UserID) {
+		return false
+	}
+	return true
+}
+
+func (rp *RoutePolicy) denies() bool {
+	return strings.EqualFold(rp.Action, RouteActionDeny)
+}
+
+// mapModel 应用策略的强制模型映射，优先级与 provider 的 modelMapping 相同
+func (rp *RoutePolicy) mapModel(model string) string {
+	if model == "" || len(rp.ModelMapping) == 0 {
+		return model
+	}
+	if target, ok := resolveModelMapping(rp.ModelMapping, rp.ModelMappingOrder, model); ok {
+		return target
+	}
+	return model
+}
+
+// allowsProvider 判断策略是否允许使用该 provider
+func (rp *RoutePolicy) allowsProvider(name string) bool {
+	if len(rp.AllowProviders) > 0 && !containsFold(rp.AllowProviders, name) {
+		return false
+	}
+	return !containsFold(rp.DenyProviders, name)
+}
+
+// reorder 将 preferProviders 按给定顺序移到最前，其余保持原顺序
+func (rp *RoutePolicy) reorder(providers []weightedProvider) []weightedProvider {
+	if len(rp.PreferProviders) == 0 {
+		return providers
+	}
+	ordered := make([]weightedProvider, 0, len(providers))
+	used := make([]bool, len(providers))
+	for _, name := range rp.PreferProviders {
+		for i, wp := range providers {
+			if !used[i] && strings.EqualFold(wp.provider.Name, name) {
+				ordered = append(ordered, wp)
+				used[i] = true
+			}
+		}
+	}
+	for i, wp := range providers {
+		if !used[i] {
+			ordered = append(ordered, wp)
+		}
+	}
+	return ordered
+}
+
+// extractRouteClient 从请求头和请求体中提取客户端身份
+func extractRouteClient(c *gin.Context, body []byte) routeClient {
+	token := strings.TrimSpace(c.GetHeader("x-api-key"))
+	if token == "" {
+		if auth := strings.TrimSpace(c.GetHeader("Authorization")); len(auth) > 7 && strings.EqualFold(auth[:7], "bearer ") {
+			token = strings.TrimSpace(auth[7:])
+		}
+	}
+	if token == "" {
+		token = strings.TrimSpace(c.GetHeader("x-goog-api-key"))
+	}
+	if token == "" {
+		token = strings.TrimSpace(c.Query("key"))
+	}
+	return routeClient{
+		Token:     token,
+		UserAgent: c.GetHeader("User-Agent"),
+		Route:     strings.TrimSpace(c.GetHeader(routeHeader)),
+		UserID:    gjson.GetBytes(body, "metadata.user_id").String(),
+	}
+}
+
+// routePolicyFrom 返回当前请求命中的策略名（写入 request_log）
+func routePolicyFrom(c *gin.Context) string {
+	if c == nil {
+		return ""
+	}
+	return c.GetString(routePolicyCtxKey)
+}
+
+func containsFold(values []string, target string) bool {
+	for _, v := range values {
+		if strings.EqualFold(strings.TrimSpace(v), target) {
+			return true
+		}
+	}
+	return false
+}
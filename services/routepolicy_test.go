@@ -0,0 +1,75 @@
+package services
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRoutePolicyMapModelPrecedence(t *testing.T) {
+	var rp RoutePolicy
+	data := `{"name":"map","modelMapping":{"claude-*":"wild","re:^claude-(opus|sonnet)-(.*)$":"vendor/$1","claude-opus-*":"opus","claude-haiku-3":"exact"}}`
+	if err := json.Unmarshal([]byte(data), &rp); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if len(rp.ModelMappingOrder) != 4 || rp.ModelMappingOrder[0] != "claude-*" {
+		t.Fatalf("mapping order = %v", rp.ModelMappingOrder)
+	}
+
+	tests := map[string]string{
+		"claude-haiku-3":  "exact", // 精确匹配优先
+		"claude-opus-4":   "opus",  // 字面前缀最长
+		"claude-sonnet-4": "wild",  // 前缀相同，按声明顺序
+		"gpt-5":           "gpt-5", // 未命中保持原样
+		"claude-haiku-4":  "wild",
+	}
+	for model, want := range tests {
+		for i := 0; i < 5; i++ {
+			if got := rp.mapModel(model); got != want {
+				t.Fatalf("mapModel(%q) = %q, want %q", model, got, want)
+			}
+		}
+	}
+
+	rp.ModelMappingOrder = []string{"re:^claude-(opus|sonnet)-(.*)$", "claude-*"}
+	if got := rp.mapModel("claude-sonnet-4"); got != "vendor/sonnet" {
+		t.Fatalf("mapModel with regex declared first = %q", got)
+	}
+}
+
+func TestRoutePolicyFilePermissions(t *testing.T) {
+	setRoutePolicies(t, RoutePolicy{Name: "perm", Enabled: true, Match: RouteMatch{Route: "perm"}})
+	info, err := os.Stat(testRelay.policies.path)
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if mode := info.Mode().Perm(); mode != 0o600 {
+		t.Fatalf("route-policies.json mode = %o", mode)
+	}
+}
+
+func TestRelayRoutePolicyDeny(t *testing.T) {
+	setProviders(t, "claude", mockProvider("policy-target", "default"))
+	setRoutePolicies(t, RoutePolicy{
+		Name:    "block-guest",
+		Enabled: true,
+		Match:   RouteMatch{Token: "guest"},
+		Action:  RouteActionDeny,
+	})
+
+	w := doRelay(t, nil, "/v1/messages", `{"model":"claude-sonnet-4"}`, map[string]string{"x-api-key": "guest"})
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "permission_error") {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	// codex / gemini 按 OpenAI 兼容格式返回拒绝
+	w = doRelay(t, nil, "/responses", `{"model":"gpt-5"}`, map[string]string{"Authorization": "Bearer guest"})
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), `"code":"invalid_request_error"`) {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	w = doRelay(t, nil, "/v1/messages", `{"model":"claude-sonnet-4"}`, map[string]string{"x-api-key": "code-relay"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+}
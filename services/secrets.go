@@ -0,0 +1,263 @@
+package services
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// 密钥存储相关常量
+// 落盘的敏感值（provider Key、MCP env、URL 中的密钥参数）使用 AES-256-GCM 加密，格式为 enc:v1:<base64(nonce|密文)>
+// 加密密钥来源：环境变量 CODE_RELAY_PASSPHRASE（PBKDF2 派生），否则使用 ~/.code-relay/secret.key（0600）
+const (
+	sealedSecretPrefix  = "enc:v1:"
+	maskedSecretPrefix  = "****"
+	secretKeyFile       = "secret.key"
+	secretSaltFile      = "secret.salt"
+	secretPassphraseEnv = "CODE_RELAY_PASSPHRASE"
+	secretKDFIterations = 600000
+)
+
+var (
+	secretKeyOnce sync.Once
+	secretAEAD    cipher.AEAD
+	secretKeyErr  error
+)
+
+// secretDir 返回存放加密密钥文件的目录
+func secretDir() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(home, ".code-relay")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// loadSecretAEAD 加载（首次运行时生成）加密密钥
+func loadSecretAEAD() (cipher.AEAD, error) {
+	secretKeyOnce.Do(func() {
+		key, err := loadOrCreateSecretKey()
+		if err != nil {
+			secretKeyErr = err
+			return
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			secretKeyErr = err
+			return
+		}
+		secretAEAD, secretKeyErr = cipher.NewGCM(block)
+	})
+	return secretAEAD, secretKeyErr
+}
+
+func loadOrCreateSecretKey() ([]byte, error) {
+	dir, err := secretDir()
+	if err != nil {
+		return nil, err
+	}
+
+	if passphrase := os.Getenv(secretPassphraseEnv); passphrase != "" {
+		salt, err := readOrCreateRandomFile(filepath.Join(dir, secretSaltFile), 16)
+		if err != nil {
+			return nil, err
+		}
+		return pbkdf2.Key(sha256.New, passphrase, salt, secretKDFIterations, 32)
+	}
+
+	return readOrCreateRandomFile(filepath.Join(dir, secretKeyFile), 32)
+}
+
+// readOrCreateRandomFile 读取定长随机文件，不存在时以 0600 权限生成
+func readOrCreateRandomFile(path string, size int) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		if len(data) != size {
+			return nil, fmt.Errorf("%s 长度异常（%d 字节）", path, len(data))
+		}
+		// 修正可能过宽的权限
+		_ = os.Chmod(path, 0o600)
+		return data, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	data = make([]byte, size)
+	if _, err := io.ReadFull(rand.Reader, data); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return readOrCreateRandomFile(path, size)
+		}
+		return nil, err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// isSealedSecret 判断是否为已加密的值
+func isSealedSecret(value string) bool {
+	return strings.HasPrefix(value, sealedSecretPrefix)
+}
+
+// isMaskedSecret 判断是否为返回给前端的脱敏值
+func isMaskedSecret(value string) bool {
+	return strings.HasPrefix(value, maskedSecretPrefix)
+}
+
+// sealSecret 加密敏感值；空值、已加密的值和脱敏值原样返回
+func sealSecret(plain string) (string, error) {
+	if plain == "" || isSealedSecret(plain) || isMaskedSecret(plain) {
+		return plain, nil
+	}
+	aead, err := loadSecretAEAD()
+	if err != nil {
+		return "", fmt.Errorf("加载加密密钥失败: %w", err)
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(plain), nil)
+	return sealedSecretPrefix + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// openSecret 解密敏感值；未加密的值（旧配置）原样返回
+func openSecret(value string) (string, error) {
+	if !isSealedSecret(value) {
+		return value, nil
+	}
+	aead, err := loadSecretAEAD()
+	if err != nil {
+		return "", fmt.Errorf("加载加密密钥失败: %w", err)
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(value, sealedSecretPrefix))
+	if err != nil {
+		return "", err
+	}
+	if len(raw) < aead.NonceSize() {
+		return "", errors.New("密文长度异常")
+	}
+	plain, err := aead.Open(nil, raw[:aead.NonceSize()], raw[aead.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("解密失败（加密密钥或口令可能已变更）: %w", err)
+	}
+	return string(plain), nil
+}
+
+// revealSecret 解密敏感值；无法解密（通常是 CODE_RELAY_PASSPHRASE 或 secret.key 已变更）时返回错误
+// 仅应在真正需要明文的位置调用（如 relay 转发、写入 CLI 配置）
+func revealSecret(value string) (string, error) {
+	plain, err := openSecret(value)
+	if err != nil {
+		return "", fmt.Errorf("无法解密已保存的密钥，请重新填写: %w", err)
+	}
+	return plain, nil
+}
+
+// maskSecret 生成脱敏值：只保留明文末尾 4 位，无法解密时只返回前缀
+func maskSecret(value string) string {
+	if value == "" {
+		return ""
+	}
+	plain, err := revealSecret(value)
+	if err != nil {
+		log.Printf("[Secrets] %v", err)
+		return maskedSecretPrefix
+	}
+	if len(plain) > 4 {
+		return maskedSecretPrefix + plain[len(plain)-4:]
+	}
+	return maskedSecretPrefix
+}
+
+// resolveMaskedSecret 将前端回传的脱敏值还原为同一位置上已存储的加密值
+// 只按位置还原：该位置没有旧值或脱敏结果不一致（如调整了顺序）时返回错误，由调用方拒绝保存
+func resolveMaskedSecret(value string, stored string) (string, error) {
+	if !isMaskedSecret(value) {
+		return value, nil
+	}
+	if stored != "" && maskSecret(stored) == value {
+		return stored, nil
+	}
+	return "", fmt.Errorf("无法还原脱敏的密钥 %s，请重新填写", value)
+}
+
+// isSecretName 判断 URL 查询参数名或环境变量名是否像密钥（含 key / token / secret / password）
+func isSecretName(name string) bool {
+	lower := strings.ToLower(name)
+	for _, hint := range []string{"key", "token", "secret", "password"} {
+		if strings.Contains(lower, hint) {
+			return true
+		}
+	}
+	return false
+}
+
+// transformURLSecrets 对 URL 中疑似密钥的查询参数值执行 fn（加密 / 解密 / 脱敏）
+// 只改写密钥参数的值，其余参数的顺序与编码保持原样；不含查询参数的 URL 原样返回
+func transformURLSecrets(raw string, fn func(name, value string) (string, error)) (string, error) {
+	start := strings.Index(raw, "?")
+	if start < 0 {
+		return raw, nil
+	}
+	end := len(raw)
+	if i := strings.Index(raw[start:], "#"); i >= 0 {
+		end = start + i
+	}
+
+	params := strings.Split(raw[start+1:end], "&")
+	changed := false
+	for i, param := range params {
+		rawName, rawValue, ok := strings.Cut(param, "=")
+		if !ok {
+			continue
+		}
+		name, err := url.QueryUnescape(rawName)
+		if err != nil || !isSecretName(name) {
+			continue
+		}
+		value, err := url.QueryUnescape(rawValue)
+		// 未填写的占位符（如 {apiKey}）不处理
+		if err != nil || value == "" || placeholderPattern.MatchString(value) {
+			continue
+		}
+		next, err := fn(name, value)
+		if err != nil {
+			return raw, err
+		}
+		if next != value {
+			params[i] = rawName + "=" + url.QueryEscape(next)
+			changed = true
+		}
+	}
+	if !changed {
+		return raw, nil
+	}
+	return raw[:start+1] + strings.Join(params, "&") + raw[end:], nil
+}
@@ -0,0 +1,201 @@
+package services
+
+import (
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// usePassphrase 切换加密口令（空串表示使用 secret.key），测试结束后恢复
+func usePassphrase(t *testing.T, passphrase string) {
+	t.Helper()
+	reset := func(value string) {
+		if value == "" {
+			os.Unsetenv(secretPassphraseEnv)
+		} else {
+			os.Setenv(secretPassphraseEnv, value)
+		}
+		secretKeyOnce = sync.Once{}
+		secretAEAD, secretKeyErr = nil, nil
+	}
+	previous := os.Getenv(secretPassphraseEnv)
+	reset(passphrase)
+	t.Cleanup(func() { reset(previous) })
+}
+
+func TestSealRevealRoundTrip(t *testing.T) {
+	for _, passphrase := range []string{"", "first passphrase"} {
+		usePassphrase(t, passphrase)
+		sealed, err := sealSecret("sk-round-trip-1234")
+		if err != nil {
+			t.Fatalf("sealSecret: %v", err)
+		}
+		if !isSealedSecret(sealed) || strings.Contains(sealed, "round-trip") {
+			t.Fatalf("value not sealed: %s", sealed)
+		}
+		if again, _ := sealSecret(sealed); again != sealed {
+			t.Fatal("sealed value sealed twice")
+		}
+		plain, err := revealSecret(sealed)
+		if err != nil || plain != "sk-round-trip-1234" {
+			t.Fatalf("revealSecret = %q, %v", plain, err)
+		}
+		if got := maskSecret(sealed); got != "****1234" {
+			t.Fatalf("maskSecret = %q", got)
+		}
+	}
+
+	// 旧配置中的明文原样返回
+	if plain, err := revealSecret("sk-legacy"); err != nil || plain != "sk-legacy" {
+		t.Fatalf("revealSecret(plain) = %q, %v", plain, err)
+	}
+}
+
+func TestRevealFailsAfterPassphraseChange(t *testing.T) {
+	usePassphrase(t, "old passphrase")
+	sealed, err := sealSecret("sk-changed-5678")
+	if err != nil {
+		t.Fatalf("sealSecret: %v", err)
+	}
+	provider := mockProvider("secret-unreadable", "default")
+	provider.APIKeys = []string{sealed}
+	setProviders(t, "claude", provider)
+
+	usePassphrase(t, "new passphrase")
+	if plain, err := revealSecret(sealed); err == nil {
+		t.Fatalf("revealSecret succeeded with a changed passphrase: %q", plain)
+	}
+	if got := maskSecret(sealed); got != maskedSecretPrefix {
+		t.Fatalf("maskSecret = %q", got)
+	}
+
+	// 无法解密的 Key 按转发失败处理，不会带着空 Key 请求上游
+	w := doRelay(t, nil, "/v1/messages", `{"model":"claude-sonnet-4"}`, nil)
+	if w.Code == http.StatusOK {
+		t.Fatalf("relay used a provider with an unreadable key: %s", w.Body.String())
+	}
+}
+
+func TestResolveMaskedSecretByPosition(t *testing.T) {
+	first, _ := sealSecret("sk-first-aaaa")
+	second, _ := sealSecret("sk-second-bbbb")
+	existing := []Provider{{ID: 7, Name: "masked", APIKeys: []string{first, second}}}
+
+	p := Provider{ID: 7, Name: "masked", APIKeys: []string{"****aaaa", "****bbbb", "sk-new-cccc"}}
+	if err := resolveMaskedKeys(&p, existing); err != nil {
+		t.Fatalf("resolveMaskedKeys: %v", err)
+	}
+	if p.APIKeys[0] != first || p.APIKeys[1] != second || p.APIKeys[2] != "sk-new-cccc" {
+		t.Fatalf("resolved keys = %v", p.APIKeys)
+	}
+
+	// 调整顺序后的脱敏值不再按末尾 4 位猜测，拒绝保存
+	swapped := Provider{ID: 7, Name: "masked", APIKeys: []string{"****bbbb", "****aaaa"}}
+	if err := resolveMaskedKeys(&swapped, existing); err == nil {
+		t.Fatalf("swapped masked keys resolved to %v", swapped.APIKeys)
+	}
+	extra := Provider{ID: 7, Name: "masked", APIKeys: []string{"****aaaa", "****bbbb", "****aaaa"}}
+	if err := resolveMaskedKeys(&extra, existing); err == nil {
+		t.Fatal("masked key without a stored value resolved")
+	}
+}
+
+func TestMCPSecretMasking(t *testing.T) {
+	token, _ := sealSecret("ghp-token-9999")
+	env := map[string]string{"GITHUB_TOKEN": token, "LOG_LEVEL": "debug", "API_KEY": "plain-key-0000"}
+	masked := maskServerSecrets(rawMCPServer{Env: env}, mcpSecretSlots{}).Env
+	if masked["GITHUB_TOKEN"] != "****9999" || masked["API_KEY"] != "****0000" || masked["LOG_LEVEL"] != "debug" {
+		t.Fatalf("masked env = %v", masked)
+	}
+
+	prevURL, err := transformURLSecrets("https://mcp.example.com/sse?b=2&api_key=secret-4321&a=x%20y", func(_, v string) (string, error) {
+		return sealSecret(v)
+	})
+	if err != nil {
+		t.Fatalf("seal url: %v", err)
+	}
+	if !strings.HasPrefix(prevURL, "https://mcp.example.com/sse?b=2&api_key=") || !strings.HasSuffix(prevURL, "&a=x%20y") {
+		t.Fatalf("non-secret params rewritten: %s", prevURL)
+	}
+	maskedURL := maskServerSecrets(rawMCPServer{URL: prevURL}, mcpSecretSlots{}).URL
+	if maskedURL != "https://mcp.example.com/sse?b=2&api_key=%2A%2A%2A%2A4321&a=x%20y" {
+		t.Fatalf("masked url = %s", maskedURL)
+	}
+
+	prev := rawMCPServer{Env: map[string]string{"GITHUB_TOKEN": token, "API_KEY": "plain-key-0000"}, URL: prevURL}
+	resolved, err := resolveServerSecrets(rawMCPServer{Env: masked, URL: maskedURL}, prev, secretSlotsOf("custom", prev))
+	if err != nil {
+		t.Fatalf("resolveServerSecrets: %v", err)
+	}
+	if resolved.Env["GITHUB_TOKEN"] != token || resolved.Env["LOG_LEVEL"] != "debug" || resolved.URL != prevURL {
+		t.Fatalf("resolved env = %v, url = %s", resolved.Env, resolved.URL)
+	}
+	plain, err := revealServerSecrets(resolved, mcpSecretSlots{})
+	if err != nil || plain.URL != "https://mcp.example.com/sse?b=2&api_key=secret-4321&a=x%20y" {
+		t.Fatalf("revealed url = %s, %v", plain.URL, err)
+	}
+
+	// 脱敏值挪到了另一个变量名下：无法按位置还原
+	moved := rawMCPServer{Env: map[string]string{"OTHER_TOKEN": "****9999"}}
+	if _, err := resolveServerSecrets(moved, prev, secretSlotsOf("custom", prev)); err == nil {
+		t.Fatal("masked env resolved under a different name")
+	}
+}
+
+func TestMCPFilledPlaceholderSecrets(t *testing.T) {
+	// 模板中的占位符填写后按密钥处理，--api-key=xxx 与 --token xxx 形式的参数同样加密
+	template := rawMCPServer{
+		Args: []string{"-y", "some-mcp", "{workspace_token}", "--api-key={apiKey}", "--token", "{token}", "--verbose"},
+		Env:  map[string]string{"ENDPOINT_AUTH": "{auth}", "LOG_LEVEL": "info"},
+	}
+	slots := secretSlotsOf("custom", template)
+	filled := rawMCPServer{
+		Args: []string{"-y", "some-mcp", "ws-secret-1111", "--api-key=sk-secret-2222", "--token", "tk-secret-3333", "--verbose"},
+		Env:  map[string]string{"ENDPOINT_AUTH": "auth-secret-4444", "LOG_LEVEL": "info"},
+	}
+	if !hasPlainServerSecrets(filled, slots) {
+		t.Fatal("filled placeholders not detected as plain secrets")
+	}
+
+	sealed, err := sealServerSecrets(filled, slots)
+	if err != nil {
+		t.Fatalf("sealServerSecrets: %v", err)
+	}
+	if !isSealedSecret(sealed.Args[2]) || !strings.HasPrefix(sealed.Args[3], "--api-key="+sealedSecretPrefix) ||
+		!isSealedSecret(sealed.Args[5]) || !isSealedSecret(sealed.Env["ENDPOINT_AUTH"]) {
+		t.Fatalf("sealed = %+v", sealed)
+	}
+	if sealed.Args[0] != "-y" || sealed.Args[4] != "--token" || sealed.Args[6] != "--verbose" || sealed.Env["LOG_LEVEL"] != "info" {
+		t.Fatalf("non-secret values rewritten: %+v", sealed)
+	}
+
+	// 写入后的配置自身即可识别密钥位置
+	stored := secretSlotsOf("custom", sealed)
+	if hasPlainServerSecrets(sealed, stored) {
+		t.Fatal("sealed entry reported as plain")
+	}
+	masked := maskServerSecrets(sealed, stored)
+	want := []string{"-y", "some-mcp", "****1111", "--api-key=****2222", "--token", "****3333", "--verbose"}
+	if !reflect.DeepEqual(masked.Args, want) || masked.Env["ENDPOINT_AUTH"] != "****4444" {
+		t.Fatalf("masked = %+v", masked)
+	}
+
+	resolved, err := resolveServerSecrets(masked, sealed, stored)
+	if err != nil || !reflect.DeepEqual(resolved.Args, sealed.Args) || resolved.Env["ENDPOINT_AUTH"] != sealed.Env["ENDPOINT_AUTH"] {
+		t.Fatalf("resolved = %+v, %v", resolved, err)
+	}
+	plain, err := revealServerSecrets(resolved, stored)
+	if err != nil || !reflect.DeepEqual(plain.Args, filled.Args) || !reflect.DeepEqual(plain.Env, filled.Env) {
+		t.Fatalf("revealed = %+v, %v", plain, err)
+	}
+
+	// 脱敏的参数挪到了其他下标：无法按位置还原
+	swapped := cloneArgs(masked.Args)
+	swapped[2], swapped[5] = swapped[5], swapped[2]
+	if _, err := resolveServerSecrets(rawMCPServer{Args: swapped}, sealed, stored); err == nil {
+		t.Fatal("swapped masked args resolved")
+	}
+}
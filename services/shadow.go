@@ -0,0 +1,344 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/daodao97/xgo/xdb"
+	"github.com/gin-gonic/gin"
+)
+
+// 影子流量相关常量
+const (
+	shadowConfigFile    = "shadow.json"
+	shadowTimeout       = 5 * time.Minute
+	shadowMaxConcurrent = 4                   // 同时进行的影子请求上限，超出时丢弃本次采样
+	lastAttemptCtxKey   = "relay.lastAttempt" // gin.Context 中记录最后一次转发结果的键
+)
+
+// ShadowConfig 单个平台的影子流量配置：按比例把请求异步复制到候选 provider
+// 影子响应直接丢弃，仅记录延迟、状态码、token 用量和费用到 shadow_log
+type ShadowConfig struct {
+	Enabled       bool    `json:"enabled"`
+	Provider      string  `json:"provider"`      // 候选 provider 名称（无需启用）
+	SamplePercent float64 `json:"samplePercent"` // 采样比例 0-100
+}
+
+// ShadowLog 一次影子请求与对应主请求的对比记录
+type ShadowLog struct {
+	ID                  int64   `json:"id"`
+	Platform            string  `json:"platform"`
+	Model               string  `json:"model"`
+	IsStream            bool    `json:"is_stream"`
+	ShadowProvider      string  `json:"shadow_provider"`
+	ShadowHttpCode      int     `json:"shadow_http_code"`
+	ShadowDurationSec   float64 `json:"shadow_duration_sec"`
+	ShadowInputTokens   int     `json:"shadow_input_tokens"`
+	ShadowOutputTokens  int     `json:"shadow_output_tokens"`
+	ShadowCost          float64 `json:"shadow_cost"`
+	ShadowError         string  `json:"shadow_error"`
+	PrimaryProvider     string  `json:"primary_provider"`
+	PrimaryHttpCode     int     `json:"primary_http_code"`
+	PrimaryDurationSec  float64 `json:"primary_duration_sec"`
+	PrimaryInputTokens  int     `json:"primary_input_tokens"`
+	PrimaryOutputTokens int     `json:"primary_output_tokens"`
+	PrimaryCost         float64 `json:"primary_cost"`
+	CreatedAt           string  `json:"created_at"`
+}
+
+// shadowMirror 影子流量配置与并发控制
+type shadowMirror struct {
+	mu      sync.RWMutex
+	path    string
+	loaded  bool
+	configs map[string]ShadowConfig // key: 平台
+	slots   chan struct{}
+	rnd     *rand.Rand
+	rndMu   sync.Mutex
+}
+
+func newShadowMirror() *shadowMirror {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		home = "."
+	}
+	return &shadowMirror{
+		path:  filepath.Join(home, ".code-relay", shadowConfigFile),
+		slots: make(chan struct{}, shadowMaxConcurrent),
+		rnd:   rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (sm *shadowMirror) load() (map[string]ShadowConfig, error) {
+	sm.mu.RLock()
+	if sm.loaded {
+		configs := copyShadowConfigs(sm.configs)
+		sm.mu.RUnlock()
+		return configs, nil
+	}
+	sm.mu.RUnlock()
+
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if !sm.loaded {
+		configs := map[string]ShadowConfig{}
+		data, err := os.ReadFile(sm.path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		if len(data) > 0 {
+			if err := json.Unmarshal(data, &configs); err != nil {
+				return nil, err
+			}
+		}
+		sm.configs = configs
+		sm.loaded = true
+	}
+	return copyShadowConfigs(sm.configs), nil
+}
+
+func (sm *shadowMirror) save(configs map[string]ShadowConfig) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(sm.path), 0o755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(configs, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := sm.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, sm.path); err != nil {
+		return err
+	}
+	sm.configs = copyShadowConfigs(configs)
+	sm.loaded = true
+	return nil
+}
+
+// sampled 按配置的比例决定本次请求是否复制
+func (sm *shadowMirror) sampled(cfg ShadowConfig) bool {
+	if !cfg.Enabled || cfg.Provider == "" || cfg.SamplePercent <= 0 {
+		return false
+	}
+	if cfg.SamplePercent >= 100 {
+		return true
+	}
+	sm.rndMu.Lock()
+	defer sm.rndMu.Unlock()
+	return sm.rnd.Float64()*100 < cfg.SamplePercent
+}
+
+func copyShadowConfigs(configs map[string]ShadowConfig) map[string]ShadowConfig {
+	dup := make(map[string]ShadowConfig, len(configs))
+	for k, v := range configs {
+		dup[k] = v
+	}
+	return dup
+}
+
+// GetShadowConfig 返回指定平台的影子流量配置
+func (prs *ProviderRelayService) GetShadowConfig(kind string) (ShadowConfig, error) {
+	configs, err := prs.shadow.load()
+	if err != nil {
+		return ShadowConfig{}, err
+	}
+	return configs[strings.ToLower(kind)], nil
+}
+
+// SaveShadowConfig 保存指定平台的影子流量配置，立即生效
+func (prs *ProviderRelayService) SaveShadowConfig(kind string, cfg ShadowConfig) error {
+	kind = strings.ToLower(kind)
+	cfg.Provider = strings.TrimSpace(cfg.Provider)
+	if cfg.SamplePercent < 0 || cfg.SamplePercent > 100 {
+		return fmt.Errorf("采样比例必须在 0-100 之间")
+	}
+	if cfg.Enabled {
+		if cfg.Provider == "" {
+			return fmt.Errorf("启用影子流量时必须指定 provider")
+		}
+		if _, err := prs.providerService.findProvider(kind, cfg.Provider); err != nil {
+			return err
+		}
+	}
+	configs, err := prs.shadow.load()
+	if err != nil {
+		return err
+	}
+	configs[kind] = cfg
+	return prs.shadow.save(configs)
+}
+
+// shadowTarget 判断本次请求是否需要复制，返回候选 provider
+func (prs *ProviderRelayService) shadowTarget(kind string, requestedModel string, features requestFeatures) (*Provider, bool) {
+	configs, err := prs.shadow.load()
+	if err != nil {
+		return nil, false
+	}
+	cfg, ok := configs[kind]
+	if !ok || !prs.shadow.sampled(cfg) {
+		return nil, false
+	}
+	provider, err := prs.providerService.findProvider(kind, cfg.Provider)
+	if err != nil {
+		return nil, false
+	}
+	if provider.APIURL == "" || len(provider.enabledKeyIndexes()) == 0 {
+		return nil, false
+	}
+	if requestedModel != "" && !provider.IsModelSupported(requestedModel) {
+		return nil, false
+	}
+	if provider.unsupportedRequirement(features) != "" {
+		return nil, false
+	}
+	return &provider, true
+}
+
+// mirrorRequest 在主响应返回后异步发送影子请求，结果写入 shadow_log
+// primary 为主请求成功的那次转发；影子请求使用独立的超时 Context，不受客户端断开影响
+func (prs *ProviderRelayService) mirrorRequest(kind string, provider Provider, endpoint string, query map[string]string, clientHeaders map[string]string, bodyBytes []byte, isStream bool, requestedModel string, primary *RequestLog) {
+	select {
+	case prs.shadow.slots <- struct{}{}:
+	default:
+		log.Printf("[Shadow] 影子请求并发已满，丢弃本次采样")
+		return
+	}
+
+	go func() {
+		defer func() { <-prs.shadow.slots }()
+
+		effectiveModel := provider.GetEffectiveModel(requestedModel)
+		body := bodyBytes
+		if effectiveModel != requestedModel && requestedModel != "" {
+			replaced, err := ReplaceModelInRequestBody(bodyBytes, effectiveModel)
+			if err != nil {
+				log.Printf("[Shadow] 替换模型失败: %v", err)
+				return
+			}
+			body = replaced
+		}
+
+		keyOrder := prs.keys.order(kind, provider)
+		if len(keyOrder) == 0 {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), shadowTimeout)
+		defer cancel()
+		var attempt *RequestLog
+		c := newInternalContext(ctx, endpoint, func(rl *RequestLog) { attempt = rl })
+		_, _, _, err := prs.forwardRequestWithKey(c, kind, provider, keyOrder[0], endpoint, query, clientHeaders, body, isStream, effectiveModel)
+
+		record := ShadowLog{
+			Platform:       kind,
+			Model:          requestedModel,
+			IsStream:       isStream,
+			ShadowProvider: provider.Name,
+		}
+		if attempt != nil {
+			prs.logService.decorateCost(attempt)
+			record.ShadowHttpCode = attempt.HttpCode
+			record.ShadowDurationSec = attempt.DurationSec
+			record.ShadowInputTokens = attempt.InputTokens
+			record.ShadowOutputTokens = attempt.OutputTokens
+			record.ShadowCost = attempt.TotalCost
+		}
+		if err != nil {
+			record.ShadowError = truncateString(err.Error(), 500)
+		}
+		p := *primary
+		prs.logService.decorateCost(&p)
+		record.PrimaryProvider = p.Provider
+		record.PrimaryHttpCode = p.HttpCode
+		record.PrimaryDurationSec = p.DurationSec
+		record.PrimaryInputTokens = p.InputTokens
+		record.PrimaryOutputTokens = p.OutputTokens
+		record.PrimaryCost = p.TotalCost
+		if err := insertShadowLog(record); err != nil {
+			log.Printf("[Shadow] 写入 shadow_log 失败: %v", err)
+		}
+	}()
+}
+
+// lastAttemptFrom 返回本次请求最后一次转发的记录
+func lastAttemptFrom(c *gin.Context) *RequestLog {
+	if v, ok := c.Get(lastAttemptCtxKey); ok {
+		if rl, ok := v.(*RequestLog); ok {
+			return rl
+		}
+	}
+	return nil
+}
+
+func insertShadowLog(sl ShadowLog) error {
+	_, err := xdb.New("shadow_log").Insert(xdb.Record{
+		"platform":              sl.Platform,
+		"model":                 sl.Model,
+		"is_stream":             boolToInt(sl.IsStream),
+		"shadow_provider":       sl.ShadowProvider,
+		"shadow_http_code":      sl.ShadowHttpCode,
+		"shadow_duration_sec":   sl.ShadowDurationSec,
+		"shadow_input_tokens":   sl.ShadowInputTokens,
+		"shadow_output_tokens":  sl.ShadowOutputTokens,
+		"shadow_cost":           sl.ShadowCost,
+		"shadow_error":          sl.ShadowError,
+		"primary_provider":      sl.PrimaryProvider,
+		"primary_http_code":     sl.PrimaryHttpCode,
+		"primary_duration_sec":  sl.PrimaryDurationSec,
+		"primary_input_tokens":  sl.PrimaryInputTokens,
+		"primary_output_tokens": sl.PrimaryOutputTokens,
+		"primary_cost":          sl.PrimaryCost,
+		"created_at":            time.Now().Format(timeLayout),
+	})
+	return err
+}
+
+func ensureShadowLogTable() error {
+	db, err := xdb.DB("default")
+	if err != nil {
+		return err
+	}
+	return ensureShadowLogTableWithDB(db)
+}
+
+func ensureShadowLogTableWithDB(db *sql.DB) error {
+	const createTableSQL = `CREATE TABLE IF NOT EXISTS shadow_log (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		platform TEXT,
+		model TEXT,
+		is_stream INTEGER DEFAULT 0,
+		shadow_provider TEXT,
+		shadow_http_code INTEGER,
+		shadow_duration_sec REAL DEFAULT 0,
+		shadow_input_tokens INTEGER DEFAULT 0,
+		shadow_output_tokens INTEGER DEFAULT 0,
+		shadow_cost REAL DEFAULT 0,
+		shadow_error TEXT,
+		primary_provider TEXT,
+		primary_http_code INTEGER,
+		primary_duration_sec REAL DEFAULT 0,
+		primary_input_tokens INTEGER DEFAULT 0,
+		primary_output_tokens INTEGER DEFAULT 0,
+		primary_cost REAL DEFAULT 0,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	)`
+	if _, err := db.Exec(createTableSQL); err != nil {
+		return err
+	}
+	_, err := db.Exec("CREATE INDEX IF NOT EXISTS idx_shadow_log_platform_time ON shadow_log(platform, created_at)")
+	return err
+}
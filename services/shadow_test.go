@@ -0,0 +1,116 @@
+package services
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRelayShadowSkipsFailedOrCancelledPrimary(t *testing.T) {
+	candidate := mockProvider("shadow-skip-candidate", "default")
+	candidate.Enabled = false
+	setProviders(t, "claude", mockProvider("shadow-failed", "status=500"), candidate)
+	if err := testRelay.SaveShadowConfig("claude", ShadowConfig{Enabled: true, Provider: "shadow-skip-candidate", SamplePercent: 100}); err != nil {
+		t.Fatalf("SaveShadowConfig: %v", err)
+	}
+	t.Cleanup(func() { _ = testRelay.SaveShadowConfig("claude", ShadowConfig{}) })
+	if w := doRelay(t, nil, "/v1/messages", `{"model":"claude-sonnet-4"}`, nil); w.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+
+	setProviders(t, "claude", mockProvider("shadow-cancelled", "latency=5s"), candidate)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	doRelay(t, ctx, "/v1/messages", `{"model":"claude-sonnet-4"}`, nil)
+
+	setProviders(t, "claude", mockProvider("shadow-interrupted", "disconnect=1,interval=10ms"), candidate)
+	doRelay(t, nil, "/v1/messages", `{"model":"claude-sonnet-4","stream":true}`, nil)
+
+	time.Sleep(300 * time.Millisecond)
+	logs, err := testLogSvc.ListShadowLogs("claude", 100)
+	if err != nil {
+		t.Fatalf("ListShadowLogs: %v", err)
+	}
+	for _, sl := range logs {
+		if sl.ShadowProvider == "shadow-skip-candidate" {
+			t.Fatalf("mirrored a request whose primary did not complete: %+v", sl)
+		}
+	}
+}
+
+func TestRelayShadowMirror(t *testing.T) {
+	candidate := mockProvider("shadow-candidate", "in=5,out=6")
+	candidate.Enabled = false
+	setProviders(t, "claude", mockProvider("shadow-primary", "in=1,out=2"), candidate)
+	if err := testRelay.SaveShadowConfig("claude", ShadowConfig{Enabled: true, Provider: "shadow-candidate", SamplePercent: 100}); err != nil {
+		t.Fatalf("SaveShadowConfig: %v", err)
+	}
+	t.Cleanup(func() { _ = testRelay.SaveShadowConfig("claude", ShadowConfig{}) })
+
+	w := doRelay(t, nil, "/v1/messages", `{"model":"claude-sonnet-4"}`, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+
+	deadline := time.Now().Add(3 * time.Second)
+	var shadowLogs []ShadowLog
+	for len(shadowLogs) == 0 && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+		logs, err := testLogSvc.ListShadowLogs("claude", 10)
+		if err != nil {
+			t.Fatalf("ListShadowLogs: %v", err)
+		}
+		shadowLogs = logs
+	}
+	if len(shadowLogs) != 1 {
+		t.Fatalf("expected 1 shadow log, got %d", len(shadowLogs))
+	}
+	sl := shadowLogs[0]
+	if sl.ShadowProvider != "shadow-candidate" || sl.ShadowHttpCode != 200 || sl.ShadowInputTokens != 5 || sl.ShadowOutputTokens != 6 {
+		t.Fatalf("unexpected shadow side: %+v", sl)
+	}
+	if sl.PrimaryProvider != "shadow-primary" || sl.PrimaryHttpCode != 200 || sl.PrimaryInputTokens != 1 {
+		t.Fatalf("unexpected primary side: %+v", sl)
+	}
+	// 影子请求不计入用户流量
+	if logs, _ := testLogSvc.ListRequestLogs("claude", "shadow-candidate", 10); len(logs) != 0 {
+		t.Fatalf("shadow request leaked into request_log: %+v", logs)
+	}
+
+	report, err := testLogSvc.ShadowComparison("claude", 1)
+	if err != nil || len(report) != 1 || report[0].Samples != 1 || report[0].Shadow.SuccessRate != 1 {
+		t.Fatalf("unexpected comparison: %+v, err = %v", report, err)
+	}
+}
+
+func TestShadowComparisonAggregates(t *testing.T) {
+	ls := newTestLogService(t)
+	for _, sl := range []ShadowLog{
+		{Platform: "claude", ShadowProvider: "cand", ShadowHttpCode: 200, ShadowDurationSec: 1, ShadowInputTokens: 10, ShadowCost: 0.5,
+			PrimaryHttpCode: 200, PrimaryDurationSec: 2, PrimaryInputTokens: 10, PrimaryCost: 0.25},
+		{Platform: "claude", ShadowProvider: "cand", ShadowHttpCode: 500, ShadowDurationSec: 3, ShadowCost: 0.5,
+			PrimaryHttpCode: 200, PrimaryDurationSec: 4, PrimaryCost: 0.25},
+		{Platform: "codex", ShadowProvider: "other", ShadowHttpCode: 200, PrimaryHttpCode: 200},
+	} {
+		if err := insertShadowLog(sl); err != nil {
+			t.Fatalf("insertShadowLog: %v", err)
+		}
+	}
+
+	report, err := ls.ShadowComparison("claude", 1)
+	if err != nil || len(report) != 1 {
+		t.Fatalf("ShadowComparison = %+v, %v", report, err)
+	}
+	got := report[0]
+	if got.Samples != 2 || got.StatusMismatches != 1 || got.Shadow.Successful != 1 || got.Shadow.Failed != 1 ||
+		got.Shadow.SuccessRate != 0.5 || got.Primary.SuccessRate != 1 || got.Shadow.InputTokens != 10 {
+		t.Fatalf("unexpected comparison: %+v", got)
+	}
+	if got.Shadow.AvgDurationSec != 2 || got.Primary.AvgDurationSec != 3 || got.LatencyDeltaSec != -1 || got.CostDelta != 0.5 {
+		t.Fatalf("unexpected averages: %+v", got)
+	}
+	if all, _ := ls.ShadowComparison("", 1); len(all) != 2 || all[0].Platform != "claude" || all[1].ShadowProvider != "other" {
+		t.Fatalf("unexpected platforms: %+v", all)
+	}
+}
@@ -0,0 +1,474 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	modelpricing "coderelay/resources/model-pricing"
+
+	"github.com/daodao97/xgo/xdb"
+)
+
+// 统计查询的时间粒度
+const (
+	StatsGranularityHour  = "hour"
+	StatsGranularityDay   = "day"
+	StatsGranularityWeek  = "week"
+	StatsGranularityMonth = "month"
+
+	maxStatsBuckets = 5000 // 单次查询最多返回的时间点数
+)
+
+// StatsQuery 统计查询条件
+// 仅按 platform / provider / 模型筛选和分组时读取小时汇总表（不受原始日志保留期限影响）；
+// 涉及客户端或状态码时读取原始日志
+type StatsQuery struct {
+	Start       time.Time `json:"start"`       // 为空时为 End 前 7 天
+	End         time.Time `json:"end"`         // 为空时为当前时间
+	Granularity string    `json:"granularity"` // hour / day / week / month，为空时按时间范围自动选择
+
+	Platform    string `json:"platform"`
+	Provider    string `json:"provider"`
+	Model       string `json:"model"`        // 支持通配符与 re: 正则，如 claude-opus-*
+	Client      string `json:"client"`       // 客户端指纹
+	StatusClass string `json:"status_class"` // 2xx / 4xx / 5xx / error（网络错误）/ failed（非 2xx）
+
+	GroupBy string `json:"group_by"` // platform / provider / model / client / status，为空不分组
+}
+
+// StatsTotals 一组请求的汇总
+type StatsTotals struct {
+	Requests           int64   `json:"requests"`
+	SuccessfulRequests int64   `json:"successful_requests"`
+	FailedRequests     int64   `json:"failed_requests"`
+	SuccessRate        float64 `json:"success_rate"`
+	InputTokens        int64   `json:"input_tokens"`
+	OutputTokens       int64   `json:"output_tokens"`
+	ReasoningTokens    int64   `json:"reasoning_tokens"`
+	CacheCreateTokens  int64   `json:"cache_create_tokens"`
+	CacheReadTokens    int64   `json:"cache_read_tokens"`
+	CostInput          float64 `json:"cost_input"`
+	CostOutput         float64 `json:"cost_output"`
+	CostCacheCreate    float64 `json:"cost_cache_create"`
+	CostCacheRead      float64 `json:"cost_cache_read"`
+	CostTotal          float64 `json:"cost_total"`
+	AvgDurationSec     float64 `json:"avg_duration_sec"`
+}
+
+// StatsPoint 序列中的一个时间点
+type StatsPoint struct {
+	Bucket string `json:"bucket"` // 时间点的起始时间
+	StatsTotals
+}
+
+// StatsSeries 一个分组的时间序列
+type StatsSeries struct {
+	Group  string       `json:"group"` // 未分组时为空
+	Points []StatsPoint `json:"points"`
+	Totals StatsTotals  `json:"totals"`
+}
+
+// StatsResult 统计查询结果
+type StatsResult struct {
+	Query   StatsQuery    `json:"query"` // 补全默认值后的查询条件
+	Buckets []string      `json:"buckets"`
+	Series  []StatsSeries `json:"series"` // 按总请求数降序
+	Totals  StatsTotals   `json:"totals"`
+}
+
+// statsRow 查询到的一行明细（小时汇总或原始日志）
+type statsRow struct {
+	hour     time.Time
+	platform string
+	provider string
+	model    string
+	client   string
+	status   string
+	metrics  rollupMetrics
+}
+
+// Stats 按任意时间范围、粒度、筛选条件和分组维度统计请求
+func (ls *LogService) Stats(query StatsQuery) (StatsResult, error) {
+	query, err := normalizeStatsQuery(query)
+	if err != nil {
+		return StatsResult{}, err
+	}
+	buckets := statsBuckets(query)
+	if len(buckets) > maxStatsBuckets {
+		return StatsResult{}, fmt.Errorf("时间范围内的数据点过多（%d），请选择更大的统计粒度", len(buckets))
+	}
+
+	var rows []statsRow
+	if query.Client != "" || query.StatusClass != "" || query.GroupBy == "client" || query.GroupBy == "status" {
+		rows, err = ls.rawStatsRows(query)
+	} else {
+		rows, err = hourlyStatsRows(query)
+	}
+	if err != nil {
+		return StatsResult{}, err
+	}
+
+	index := make(map[string]int, len(buckets))
+	for i, bucket := range buckets {
+		index[bucket] = i
+	}
+	type groupAcc struct {
+		points []rollupMetrics
+		total  rollupMetrics
+	}
+	groups := map[string]*groupAcc{}
+	var total rollupMetrics
+	for _, row := range rows {
+		if query.Model != "" && !matchWildcard(query.Model, row.model) {
+			continue
+		}
+		i, ok := index[statsBucket(row.hour, query.Granularity)]
+		if !ok {
+			continue
+		}
+		group := statsGroup(row, query.GroupBy)
+		acc := groups[group]
+		if acc == nil {
+			acc = &groupAcc{points: make([]rollupMetrics, len(buckets))}
+			groups[group] = acc
+		}
+		acc.points[i].merge(row.metrics)
+		acc.total.merge(row.metrics)
+		total.merge(row.metrics)
+	}
+	// 未分组时始终返回一条（可能全为 0 的）序列
+	if query.GroupBy == "" && len(groups) == 0 {
+		groups[""] = &groupAcc{points: make([]rollupMetrics, len(buckets))}
+	}
+
+	result := StatsResult{
+		Query:   query,
+		Buckets: buckets,
+		Series:  make([]StatsSeries, 0, len(groups)),
+		Totals:  total.totals(),
+	}
+	for group, acc := range groups {
+		series := StatsSeries{Group: group, Points: make([]StatsPoint, len(buckets)), Totals: acc.total.totals()}
+		for i, bucket := range buckets {
+			series.Points[i] = StatsPoint{Bucket: bucket, StatsTotals: acc.points[i].totals()}
+		}
+		result.Series = append(result.Series, series)
+	}
+	sort.Slice(result.Series, func(i, j int) bool {
+		if result.Series[i].Totals.Requests != result.Series[j].Totals.Requests {
+			return result.Series[i].Totals.Requests > result.Series[j].Totals.Requests
+		}
+		return result.Series[i].Group < result.Series[j].Group
+	})
+	return result, nil
+}
+
+func normalizeStatsQuery(query StatsQuery) (StatsQuery, error) {
+	if query.End.IsZero() {
+		query.End = time.Now()
+	}
+	if query.Start.IsZero() {
+		query.Start = query.End.AddDate(0, 0, -7)
+	}
+	query.Start = query.Start.In(time.Local)
+	query.End = query.End.In(time.Local)
+	if !query.Start.Before(query.End) {
+		return query, errors.New("开始时间必须早于结束时间")
+	}
+
+	query.Granularity = strings.ToLower(strings.TrimSpace(query.Granularity))
+	switch query.Granularity {
+	case "":
+		query.Granularity = StatsGranularityDay
+		if query.End.Sub(query.Start) <= 48*time.Hour {
+			query.Granularity = StatsGranularityHour
+		}
+	case StatsGranularityHour, StatsGranularityDay, StatsGranularityWeek, StatsGranularityMonth:
+	default:
+		return query, fmt.Errorf("不支持的统计粒度: %s", query.Granularity)
+	}
+
+	query.StatusClass = strings.ToLower(strings.TrimSpace(query.StatusClass))
+	switch query.StatusClass {
+	case "", "2xx", "3xx", "4xx", "5xx", "error", "failed":
+	default:
+		return query, fmt.Errorf("不支持的状态分类: %s", query.StatusClass)
+	}
+
+	query.GroupBy = strings.ToLower(strings.TrimSpace(query.GroupBy))
+	switch query.GroupBy {
+	case "", "platform", "provider", "model", "client", "status":
+	default:
+		return query, fmt.Errorf("不支持的分组维度: %s", query.GroupBy)
+	}
+
+	query.Platform = strings.ToLower(strings.TrimSpace(query.Platform))
+	query.Provider = strings.TrimSpace(query.Provider)
+	query.Model = strings.TrimSpace(query.Model)
+	query.Client = strings.TrimSpace(query.Client)
+	return query, nil
+}
+
+// bucketStart 返回 t 所在时间点的起始时间（周从周一开始）
+func bucketStart(t time.Time, granularity string) time.Time {
+	switch granularity {
+	case StatsGranularityHour:
+		return startOfHour(t)
+	case StatsGranularityWeek:
+		day := startOfDay(t)
+		offset := (int(day.Weekday()) + 6) % 7
+		return day.AddDate(0, 0, -offset)
+	case StatsGranularityMonth:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+	}
+	return startOfDay(t)
+}
+
+func nextBucket(t time.Time, granularity string) time.Time {
+	switch granularity {
+	case StatsGranularityHour:
+		return t.Add(time.Hour)
+	case StatsGranularityWeek:
+		return t.AddDate(0, 0, 7)
+	case StatsGranularityMonth:
+		return t.AddDate(0, 1, 0)
+	}
+	return t.AddDate(0, 0, 1)
+}
+
+func statsBucket(t time.Time, granularity string) string {
+	return bucketStart(t, granularity).Format(timeLayout)
+}
+
+// statsBuckets 列出查询范围内的所有时间点（含空的时间点）
+func statsBuckets(query StatsQuery) []string {
+	var buckets []string
+	for t := bucketStart(query.Start, query.Granularity); t.Before(query.End); t = nextBucket(t, query.Granularity) {
+		buckets = append(buckets, t.Format(timeLayout))
+		if len(buckets) > maxStatsBuckets {
+			break
+		}
+	}
+	return buckets
+}
+
+func statsGroup(row statsRow, groupBy string) string {
+	switch groupBy {
+	case "platform":
+		return row.platform
+	case "provider":
+		return row.provider
+	case "model":
+		return row.model
+	case "client":
+		return row.client
+	case "status":
+		return row.status
+	}
+	return ""
+}
+
+// statusClass 将状态码归类为 2xx / 4xx / 5xx 等，0（网络错误）为 error
+func statusClass(code int) string {
+	if code <= 0 {
+		return "error"
+	}
+	return fmt.Sprintf("%dxx", code/100)
+}
+
+func matchStatusClass(filter string, code int) bool {
+	switch filter {
+	case "":
+		return true
+	case "failed":
+		return !isSuccessCode(code)
+	}
+	return statusClass(code) == filter
+}
+
+// hourlyStatsRows 从小时汇总表读取查询范围内的数据
+func hourlyStatsRows(query StatsQuery) ([]statsRow, error) {
+	db, err := xdb.DB("default")
+	if err != nil {
+		return nil, err
+	}
+	sqlQuery := `SELECT hour, platform, provider, model, requests, success_requests,
+		input_tokens, output_tokens, reasoning_tokens, cache_create_tokens, cache_read_tokens,
+		input_cost, output_cost, cache_create_cost, cache_read_cost, total_cost,
+		duration_sum, duration_count, duration_min, duration_max
+		FROM ` + hourlyRollupTable + ` WHERE hour >= ? AND hour < ?`
+	args := []any{startOfHour(query.Start).Format(timeLayout), query.End.Format(timeLayout)}
+	if query.Platform != "" {
+		sqlQuery += " AND platform = ?"
+		args = append(args, query.Platform)
+	}
+	if query.Provider != "" {
+		sqlQuery += " AND provider = ?"
+		args = append(args, query.Provider)
+	}
+	if query.Model != "" && !isModelPattern(query.Model) {
+		sqlQuery += " AND model = ?"
+		args = append(args, query.Model)
+	}
+
+	rows, err := db.Query(sqlQuery, args...)
+	if err != nil {
+		if isNoSuchTableErr(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []statsRow
+	for rows.Next() {
+		var row statsRow
+		var hour string
+		m := &row.metrics
+		if err := rows.Scan(&hour, &row.platform, &row.provider, &row.model, &m.requests, &m.successRequests,
+			&m.inputTokens, &m.outputTokens, &m.reasoningTokens, &m.cacheCreateTokens, &m.cacheReadTokens,
+			&m.inputCost, &m.outputCost, &m.cacheCreateCost, &m.cacheReadCost, &m.totalCost,
+			&m.durationSum, &m.durationCount, &m.durationMin, &m.durationMax,
+		); err != nil {
+			return nil, err
+		}
+		if row.hour, err = time.ParseInLocation(timeLayout, hour, time.Local); err != nil {
+			continue
+		}
+		result = append(result, row)
+	}
+	return result, rows.Err()
+}
+
+// rawStatsRows 从原始日志读取查询范围内的数据（费用按当前价格计算）
+func (ls *LogService) rawStatsRows(query StatsQuery) ([]statsRow, error) {
+	options := []xdb.Option{
+		xdb.WhereGte("created_at", query.Start.Format(timeLayout)),
+		xdb.WhereLt("created_at", query.End.Format(timeLayout)),
+		xdb.Field(
+			"platform",
+			"provider",
+			"model",
+			"client",
+			"http_code",
+			"input_tokens",
+			"output_tokens",
+			"reasoning_tokens",
+			"cache_create_tokens",
+			"cache_read_tokens",
+			"duration_sec",
+			"created_at",
+		),
+	}
+	if query.Platform != "" {
+		options = append(options, xdb.WhereEq("platform", query.Platform))
+	}
+	if query.Provider != "" {
+		options = append(options, xdb.WhereEq("provider", query.Provider))
+	}
+	if query.Model != "" && !isModelPattern(query.Model) {
+		options = append(options, xdb.WhereEq("model", query.Model))
+	}
+	if query.Client != "" {
+		options = append(options, xdb.WhereEq("client", query.Client))
+	}
+	records, err := xdb.New("request_log").Selects(options...)
+	if err != nil {
+		if errors.Is(err, xdb.ErrNotFound) || isNoSuchTableErr(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	result := make([]statsRow, 0, len(records))
+	for _, record := range records {
+		code := record.GetInt("http_code")
+		if !matchStatusClass(query.StatusClass, code) {
+			continue
+		}
+		createdAt, ok := parseCreatedAt(record)
+		if !ok {
+			continue
+		}
+		rl := &RequestLog{
+			Model:             record.GetString("model"),
+			HttpCode:          code,
+			InputTokens:       record.GetInt("input_tokens"),
+			OutputTokens:      record.GetInt("output_tokens"),
+			ReasoningTokens:   record.GetInt("reasoning_tokens"),
+			CacheCreateTokens: record.GetInt("cache_create_tokens"),
+			CacheReadTokens:   record.GetInt("cache_read_tokens"),
+			DurationSec:       record.GetFloat64("duration_sec"),
+		}
+		row := statsRow{
+			hour:     createdAt,
+			platform: record.GetString("platform"),
+			provider: record.GetString("provider"),
+			model:    rl.Model,
+			client:   record.GetString("client"),
+			status:   statusClass(code),
+		}
+		row.metrics.add(rl, ls.calculateCost(rl.Model, modelpricing.UsageSnapshot{
+			InputTokens:       rl.InputTokens,
+			OutputTokens:      rl.OutputTokens,
+			CacheCreateTokens: rl.CacheCreateTokens,
+			CacheReadTokens:   rl.CacheReadTokens,
+		}))
+		result = append(result, row)
+	}
+	return result, nil
+}
+
+// merge 累加另一个汇总桶
+func (m *rollupMetrics) merge(o rollupMetrics) {
+	m.requests += o.requests
+	m.successRequests += o.successRequests
+	m.inputTokens += o.inputTokens
+	m.outputTokens += o.outputTokens
+	m.reasoningTokens += o.reasoningTokens
+	m.cacheCreateTokens += o.cacheCreateTokens
+	m.cacheReadTokens += o.cacheReadTokens
+	m.inputCost += o.inputCost
+	m.outputCost += o.outputCost
+	m.cacheCreateCost += o.cacheCreateCost
+	m.cacheReadCost += o.cacheReadCost
+	m.totalCost += o.totalCost
+	if o.durationCount > 0 {
+		if m.durationCount == 0 || o.durationMin < m.durationMin {
+			m.durationMin = o.durationMin
+		}
+		m.durationMax = max(m.durationMax, o.durationMax)
+		m.durationSum += o.durationSum
+		m.durationCount += o.durationCount
+	}
+	m.successDurationSum += o.successDurationSum
+	m.successDurationCount += o.successDurationCount
+}
+
+func (m rollupMetrics) totals() StatsTotals {
+	t := StatsTotals{
+		Requests:           m.requests,
+		SuccessfulRequests: m.successRequests,
+		FailedRequests:     m.requests - m.successRequests,
+		InputTokens:        m.inputTokens,
+		OutputTokens:       m.outputTokens,
+		ReasoningTokens:    m.reasoningTokens,
+		CacheCreateTokens:  m.cacheCreateTokens,
+		CacheReadTokens:    m.cacheReadTokens,
+		CostInput:          m.inputCost,
+		CostOutput:         m.outputCost,
+		CostCacheCreate:    m.cacheCreateCost,
+		CostCacheRead:      m.cacheReadCost,
+		CostTotal:          m.totalCost,
+	}
+	if m.requests > 0 {
+		t.SuccessRate = float64(m.successRequests) / float64(m.requests)
+	}
+	if m.durationCount > 0 {
+		t.AvgDurationSec = m.durationSum / float64(m.durationCount)
+	}
+	return t
+}
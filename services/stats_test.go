@@ -0,0 +1,63 @@
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStatsQuery(t *testing.T) {
+	ls := newTestLogService(t)
+	for _, rl := range []RequestLog{
+		{Platform: "stats-test", Provider: "stats-a", Model: "claude-sonnet-4", Client: "cli-1", HttpCode: 200, InputTokens: 100, OutputTokens: 10, DurationSec: 1},
+		{Platform: "stats-test", Provider: "stats-a", Model: "claude-haiku-4-5", Client: "cli-2", HttpCode: 429},
+		{Platform: "stats-test", Provider: "stats-b", Model: "claude-sonnet-4", Client: "cli-1", HttpCode: 200, InputTokens: 20, OutputTokens: 2, DurationSec: 3},
+		{Platform: "stats-test", Provider: "stats-b", Model: "gpt-5", Client: "cli-1", HttpCode: 0},
+	} {
+		rl := rl
+		ls.writeRequestLog(&rl, nil)
+	}
+	waitLogs(t, "stats-test", "", 4)
+
+	now := time.Now()
+	byProvider, err := ls.Stats(StatsQuery{Start: now.Add(-3 * time.Hour), End: now.Add(time.Hour), Platform: "stats-test", GroupBy: "provider"})
+	if err != nil {
+		t.Fatalf("Stats: %v", err)
+	}
+	if byProvider.Query.Granularity != StatsGranularityHour || len(byProvider.Buckets) < 4 || len(byProvider.Buckets) > 5 {
+		t.Fatalf("unexpected buckets: %s %v", byProvider.Query.Granularity, byProvider.Buckets)
+	}
+	if byProvider.Totals.Requests != 4 || byProvider.Totals.SuccessfulRequests != 2 || byProvider.Totals.InputTokens != 120 ||
+		byProvider.Totals.AvgDurationSec != 2 || len(byProvider.Series) != 2 {
+		t.Fatalf("unexpected totals: %+v", byProvider)
+	}
+	for _, series := range byProvider.Series {
+		if len(series.Points) != len(byProvider.Buckets) || series.Totals.Requests != 2 {
+			t.Fatalf("unexpected series: %+v", series)
+		}
+	}
+
+	byStatus, err := ls.Stats(StatsQuery{Start: now.Add(-24 * time.Hour), End: now.Add(time.Hour), Granularity: "week",
+		Platform: "stats-test", Model: "claude-*", Client: "cli-1", GroupBy: "status"})
+	if err != nil {
+		t.Fatalf("Stats: %v", err)
+	}
+	if byStatus.Totals.Requests != 2 || len(byStatus.Series) != 1 || byStatus.Series[0].Group != "2xx" || byStatus.Totals.CostTotal <= 0 {
+		t.Fatalf("unexpected status stats: %+v", byStatus)
+	}
+
+	failed, err := ls.Stats(StatsQuery{Start: now.Add(-time.Hour), End: now.Add(time.Hour), Granularity: "month",
+		Platform: "stats-test", StatusClass: "failed", GroupBy: "status"})
+	if err != nil {
+		t.Fatalf("Stats: %v", err)
+	}
+	if failed.Totals.Requests != 2 || len(failed.Series) != 2 {
+		t.Fatalf("unexpected failed stats: %+v", failed)
+	}
+
+	if _, err := ls.Stats(StatsQuery{Granularity: "minute"}); err == nil {
+		t.Fatalf("expected error for unsupported granularity")
+	}
+	if _, err := ls.Stats(StatsQuery{Start: now.AddDate(-5, 0, 0), End: now, Granularity: "hour"}); err == nil {
+		t.Fatalf("expected error for too many buckets")
+	}
+}
@@ -0,0 +1,196 @@
+package services
+
+import (
+	"errors"
+	"log"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/daodao97/xgo/xdb"
+)
+
+// 滑动窗口成功率参数
+const (
+	defaultSuccessWindowMinutes = 60
+	maxSuccessWindowMinutes     = 7 * 24 * 60
+	maxSuccessSamples           = 1000             // 每个 provider 保留的最近请求数，也是按请求数窗口的上限
+	successWindowRefresh        = 30 * time.Second // 重新读取窗口设置的间隔
+	successSeedLimit            = 20000            // 启动时从 request_log 载入的最多行数
+)
+
+// SuccessWindow 路由使用的成功率窗口：Requests > 0 时按最近 N 次请求计算，否则按最近 Minutes 分钟
+type SuccessWindow struct {
+	Minutes  int `json:"minutes"`
+	Requests int `json:"requests"`
+}
+
+func (w SuccessWindow) normalize() SuccessWindow {
+	w.Requests = min(max(w.Requests, 0), maxSuccessSamples)
+	if w.Minutes <= 0 {
+		w.Minutes = defaultSuccessWindowMinutes
+	}
+	w.Minutes = min(w.Minutes, maxSuccessWindowMinutes)
+	return w
+}
+
+type successSample struct {
+	at time.Time
+	ok bool
+}
+
+type successKey struct {
+	platform string
+	provider string
+}
+
+// successTracker 在内存中保存每个 provider 最近的请求结果，每次转发结束时更新。
+// 成功率按指数衰减加权：样本权重为 exp(-age/τ)，τ 为窗口长度的 1/3，
+// 越新的请求影响越大，窗口最旧一端的权重约为 5%
+type successTracker struct {
+	mu      sync.Mutex
+	samples map[successKey][]successSample
+	seeded  bool
+	now     func() time.Time
+
+	window     SuccessWindow
+	windowFn   func() SuccessWindow // 由 main 从应用设置读取
+	windowRead time.Time
+}
+
+func newSuccessTracker() *successTracker {
+	return &successTracker{
+		samples: make(map[successKey][]successSample),
+		now:     time.Now,
+		window:  SuccessWindow{Minutes: defaultSuccessWindowMinutes},
+	}
+}
+
+// SetSuccessWindowSource 设置成功率窗口的来源，设置变更在 30 秒内生效
+func (ls *LogService) SetSuccessWindowSource(window func() SuccessWindow) {
+	st := ls.success
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.windowFn = window
+	st.windowRead = time.Time{}
+}
+
+// currentWindowLocked 返回当前窗口设置，调用方需持有 st.mu
+func (st *successTracker) currentWindowLocked() SuccessWindow {
+	if st.windowFn != nil && st.now().Sub(st.windowRead) >= successWindowRefresh {
+		st.window = st.windowFn().normalize()
+		st.windowRead = st.now()
+	}
+	return st.window
+}
+
+// seedLocked 首次使用时从 request_log 载入最近的请求结果，避免重启后成功率归零重来
+func (st *successTracker) seedLocked() {
+	if st.seeded {
+		return
+	}
+	st.seeded = true
+	since := st.now().Add(-time.Duration(max(st.currentWindowLocked().Minutes, 24*60)) * time.Minute)
+	records, err := xdb.New("request_log").Selects(
+		xdb.WhereGte("created_at", since.Format(timeLayout)),
+		xdb.WhereNotEq("provider", ""),
+		xdb.Field("platform", "provider", "http_code", "created_at"),
+		xdb.OrderByDesc("id"),
+		xdb.Limit(successSeedLimit),
+	)
+	if err != nil {
+		if !errors.Is(err, xdb.ErrNotFound) && !isNoSuchTableErr(err) {
+			log.Printf("[Log] 载入历史成功率失败: %v", err)
+		}
+		return
+	}
+	slices.Reverse(records)
+	for _, record := range records {
+		at, ok := parseCreatedAt(record)
+		if !ok {
+			continue
+		}
+		st.addLocked(record.GetString("platform"), record.GetString("provider"), record.GetInt("http_code"), at)
+	}
+}
+
+func (st *successTracker) addLocked(platform, provider string, code int, at time.Time) {
+	provider = strings.TrimSpace(provider)
+	// 被主动取消的请求与 provider 无关
+	if provider == "" || code == statusRequestCancelled {
+		return
+	}
+	key := successKey{platform: platform, provider: provider}
+	samples := append(st.samples[key], successSample{at: at, ok: isSuccessCode(code)})
+	if len(samples) > maxSuccessSamples {
+		samples = slices.Delete(samples, 0, len(samples)-maxSuccessSamples)
+	}
+	st.samples[key] = samples
+}
+
+// record 记录一次转发结果
+func (st *successTracker) record(rl *RequestLog) {
+	st.observe(rl.Platform, rl.Provider, rl.HttpCode)
+}
+
+// observe 记录一次请求或主动探测的结果
+func (st *successTracker) observe(platform, provider string, code int) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.seedLocked()
+	st.addLocked(platform, provider, code, st.now())
+}
+
+// rates 返回各 provider 在窗口内的衰减加权成功率及样本数；platform 为空时合并所有平台
+func (st *successTracker) rates(platform string) (map[string]float64, map[string]int) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.seedLocked()
+	window := st.currentWindowLocked()
+	now := st.now()
+
+	weights := map[string]float64{}
+	successes := map[string]float64{}
+	counts := map[string]int{}
+	for key, samples := range st.samples {
+		if platform != "" && key.platform != platform {
+			continue
+		}
+		if window.Requests > 0 {
+			tau := float64(window.Requests) / 3
+			for age, i := 0, len(samples)-1; i >= 0 && age < window.Requests; age, i = age+1, i-1 {
+				weight := math.Exp(-float64(age) / tau)
+				weights[key.provider] += weight
+				if samples[i].ok {
+					successes[key.provider] += weight
+				}
+				counts[key.provider]++
+			}
+			continue
+		}
+		span := time.Duration(window.Minutes) * time.Minute
+		tau := span.Seconds() / 3
+		for i := len(samples) - 1; i >= 0; i-- {
+			age := now.Sub(samples[i].at)
+			if age > span {
+				break
+			}
+			weight := math.Exp(-max(age.Seconds(), 0) / tau)
+			weights[key.provider] += weight
+			if samples[i].ok {
+				successes[key.provider] += weight
+			}
+			counts[key.provider]++
+		}
+	}
+
+	result := make(map[string]float64, len(weights))
+	for provider, weight := range weights {
+		if weight > 0 {
+			result[provider] = successes[provider] / weight
+		}
+	}
+	return result, counts
+}
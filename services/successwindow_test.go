@@ -0,0 +1,55 @@
+package services
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSuccessWindowRates(t *testing.T) {
+	ls := newTestLogService(t)
+	st := newSuccessTracker()
+	st.seeded = true
+	now := time.Date(2025, 1, 2, 0, 1, 0, 0, time.Local)
+	st.now = func() time.Time { return now }
+
+	// 昨天下午持续失败，零点后不应恢复为 100%
+	for i := 0; i < 20; i++ {
+		st.addLocked("claude", "flaky", 502, now.Add(-time.Duration(30-i)*time.Minute))
+		st.addLocked("claude", "stable", 200, now.Add(-time.Duration(30-i)*time.Minute))
+	}
+	st.addLocked("claude", "flaky", 200, now)
+	st.addLocked("claude", "flaky", statusRequestCancelled, now)
+	st.addLocked("codex", "other", 200, now)
+
+	rates, counts := st.rates("claude")
+	if rates["stable"] != 1 || counts["flaky"] != 21 || rates["flaky"] >= 0.2 || rates["flaky"] <= 1.0/21 {
+		t.Fatalf("unexpected rates: %v %v", rates, counts)
+	}
+	if _, ok := rates["other"]; ok {
+		t.Fatalf("platform filter ignored: %v", rates)
+	}
+
+	// 超出时间窗口的请求不再计入
+	now = now.Add(2 * time.Hour)
+	if rates, _ := st.rates("claude"); len(rates) != 0 {
+		t.Fatalf("expected empty window: %v", rates)
+	}
+
+	// 按请求数的窗口不受时间影响，只看最近 N 次
+	st.windowFn = func() SuccessWindow { return SuccessWindow{Requests: 5} }
+	st.windowRead = time.Time{}
+	for i := 0; i < 5; i++ {
+		st.addLocked("claude", "flaky", 200, now)
+	}
+	rates, counts = st.rates("claude")
+	if rates["flaky"] != 1 || counts["flaky"] != 5 || rates["stable"] != 1 {
+		t.Fatalf("unexpected request window rates: %v %v", rates, counts)
+	}
+
+	// 通过日志写入更新
+	rl := RequestLog{Platform: "success-test", Provider: "success-a", HttpCode: 500}
+	ls.writeRequestLog(&rl, nil)
+	if rate, count, _ := ls.GetProviderSuccessRate("success-test", "success-a"); rate != 0 || count != 1 {
+		t.Fatalf("unexpected provider rate: %v %v", rate, count)
+	}
+}